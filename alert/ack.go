@@ -0,0 +1,18 @@
+package alert
+
+// Ack acknowledges the active alert for alertKey (ruleID_conditionID_level):
+// it is not raised again, whatever its cooldown, until its condition has
+// evaluated false once. Acknowledging a key that isn't firing holds off its next alert
+// the same way.
+func (m *RuleManager) Ack(alertKey string) {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+	m.acked[alertKey] = true
+}
+
+// isAcked reports whether alerts for alertKey are acknowledged
+func (m *RuleManager) isAcked(alertKey string) bool {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+	return m.acked[alertKey]
+}
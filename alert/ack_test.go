@@ -0,0 +1,57 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+)
+
+func TestAckSuppressesUntilCleared(t *testing.T) {
+	cfg := config.Config{}
+	rm, results := newResultTestManager(t, cfg)
+	rule := &rm.Rules[0]
+	rule.CooldownPeriod = time.Nanosecond
+
+	key := cacheKey{Topic: "sensor/device1", Address: "device1"}
+	alertKey := "results_1_1"
+
+	// Both the rule and the manager cooldown are long over
+	expireCooldown := func() {
+		time.Sleep(time.Millisecond)
+		rm.alertMu.Lock()
+		rm.lastAlertTimes[alertKey] = time.Now().Add(-time.Hour)
+		rm.alertMu.Unlock()
+	}
+
+	rm.evaluateRule(rule, cfg)
+	rm.Ack(alertKey)
+
+	expireCooldown()
+	rm.evaluateRule(rule, cfg)
+
+	if len(*results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(*results))
+	}
+	if (*results)[0].Status != AlertDelivered {
+		t.Errorf("Expected first alert to be delivered, got %+v", (*results)[0])
+	}
+	if (*results)[1].Status != AlertSuppressed || (*results)[1].Reason != "acknowledged" {
+		t.Errorf("Expected acked alert to be suppressed past cooldown, got %+v", (*results)[1])
+	}
+
+	// The condition clears once, which re-arms the alert
+	rm.deviceCache.set(key, cachedValue{value: 5, timestamp: time.Now()})
+	rm.evaluateRule(rule, cfg)
+	if rm.isAcked(alertKey) {
+		t.Error("Expected ack to be reset after the condition cleared")
+	}
+
+	rm.deviceCache.set(key, cachedValue{value: 15, timestamp: time.Now()})
+	expireCooldown()
+	rm.evaluateRule(rule, cfg)
+
+	if len(*results) != 3 || (*results)[2].Status != AlertDelivered {
+		t.Errorf("Expected alert to fire again after clearing, got %+v", *results)
+	}
+}
@@ -0,0 +1,68 @@
+package alert
+
+import (
+	"math"
+	"strings"
+)
+
+// OperatorAnomaly fires when a device's latest reading deviates from its
+// rolling baseline by more than StdDevs standard deviations
+const OperatorAnomaly = "ANOMALY"
+
+// Anomaly condition defaults, used when the condition leaves them unset
+const (
+	defaultAnomalyWindow     = 20
+	defaultAnomalyStdDevs    = 3.0
+	defaultAnomalyMinSamples = 5
+)
+
+func isAnomalyOperator(operator string) bool {
+	return strings.TrimSpace(operator) == OperatorAnomaly
+}
+
+// anomalyParams returns the condition's window, K and minimum sample count,
+// applying the defaults
+func anomalyParams(condition AlertCondition) (window int, stdDevs float64, minSamples int) {
+	window, stdDevs, minSamples = condition.Window, condition.StdDevs, condition.MinSamples
+	if window <= 0 {
+		window = defaultAnomalyWindow
+	}
+	if stdDevs <= 0 {
+		stdDevs = defaultAnomalyStdDevs
+	}
+	if minSamples <= 0 {
+		minSamples = defaultAnomalyMinSamples
+	}
+	if minSamples > window {
+		minSamples = window
+	}
+	return window, stdDevs, minSamples
+}
+
+// evaluateAnomaly compares the device's latest reading with the mean and
+// standard deviation of the readings before it. Loaders reject windows the
+// history can't hold.
+func (r *AlertRule) evaluateAnomaly(condition AlertCondition, history deviceSamples) bool {
+	window, stdDevs, minSamples := anomalyParams(condition)
+
+	samples := history.samples(condition.Device, window+1)
+	if len(samples) < minSamples+1 {
+		return false
+	}
+
+	baseline, latest := samples[:len(samples)-1], samples[len(samples)-1]
+
+	var mean float64
+	for _, v := range baseline {
+		mean += v
+	}
+	mean /= float64(len(baseline))
+
+	var variance float64
+	for _, v := range baseline {
+		variance += (v - mean) * (v - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(baseline)))
+
+	return math.Abs(latest-mean) > stdDevs*stddev
+}
@@ -0,0 +1,48 @@
+package alert
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestAnomalyCondition(t *testing.T) {
+	stable := []float64{100, 101, 99, 100, 102, 98, 100, 101, 99, 100}
+
+	tests := []struct {
+		name      string
+		condition AlertCondition
+		values    []float64
+		want      conditionState
+	}{
+		{"stable series", AlertCondition{Window: 10, StdDevs: 3}, append(stable, 101), conditionClear},
+		{"injected outlier", AlertCondition{Window: 10, StdDevs: 3}, append(stable, 130), conditionTriggered},
+		{"injected drop", AlertCondition{Window: 10, StdDevs: 3}, append(stable, 80), conditionTriggered},
+		{"outlier within K", AlertCondition{Window: 10, StdDevs: 30}, append(stable, 130), conditionClear},
+		{"too few samples", AlertCondition{Window: 10, StdDevs: 3, MinSamples: 5}, []float64{100, 101, 99, 130}, conditionClear},
+		{"enough samples", AlertCondition{Window: 10, StdDevs: 3, MinSamples: 3}, []float64{100, 101, 99, 130}, conditionTriggered},
+		{"window excludes old outlier", AlertCondition{Window: 5, StdDevs: 3}, []float64{500, 100, 101, 99, 100, 101, 130}, conditionTriggered},
+		{"defaults", AlertCondition{}, append(stable, 130), conditionTriggered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := tt.condition
+			condition.ID = 1
+			condition.Device = "D1"
+			condition.Operator = OperatorAnomaly
+			rule := NewAlertRule("anomaly", []string{"sensor/D1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop())
+
+			key := cacheKey{Topic: "sensor/D1", Address: "D1"}
+			history := newSampleHistory(32)
+			for _, v := range tt.values {
+				history.record(key, v)
+			}
+
+			payload := map[string]any{"D1": tt.values[len(tt.values)-1]}
+			if state, _ := rule.checkCondition(payload, history.of(map[string]cacheKey{"D1": key}), condition); state != tt.want {
+				t.Errorf("Expected state %v, got %v", tt.want, state)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package alert
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheShardCount is the number of independently locked device cache shards
+const cacheShardCount = 32
+
+// deviceCache stores the latest value per topic/address. Entries are spread
+// over shards keyed by a hash of the cache key, so concurrent writes for
+// different devices don't contend on a single lock.
+type deviceCache struct {
+	shards [cacheShardCount]cacheShard
+}
+
+type cacheShard struct {
+	mu      sync.RWMutex
+	entries map[cacheKey]cachedValue
+}
+
+func newDeviceCache() *deviceCache {
+	c := &deviceCache{}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[cacheKey]cachedValue)
+	}
+	return c
+}
+
+// shard returns the shard holding key, using FNV-1a over the topic and address
+func (c *deviceCache) shard(key cacheKey) *cacheShard {
+	const (
+		offset = 2166136261
+		prime  = 16777619
+	)
+
+	hash := uint32(offset)
+	for i := 0; i < len(key.Topic); i++ {
+		hash ^= uint32(key.Topic[i])
+		hash *= prime
+	}
+	hash ^= 0xff // Separator between topic and address, a byte UTF-8 never uses
+	hash *= prime
+	for i := 0; i < len(key.Address); i++ {
+		hash ^= uint32(key.Address[i])
+		hash *= prime
+	}
+
+	return &c.shards[hash%cacheShardCount]
+}
+
+func (c *deviceCache) get(key cacheKey) (cachedValue, bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.entries[key]
+	return value, ok
+}
+
+func (c *deviceCache) set(key cacheKey, value cachedValue) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = value
+}
+
+// update atomically replaces the entry for key with the result of fn
+func (c *deviceCache) update(key cacheKey, fn func(prev cachedValue, exists bool) cachedValue) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, exists := s.entries[key]
+	s.entries[key] = fn(prev, exists)
+}
+
+func (c *deviceCache) delete(key cacheKey) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// sweep removes the entries last updated before cutoff and returns their keys
+func (c *deviceCache) sweep(cutoff time.Time) []cacheKey {
+	var removed []cacheKey
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for key, cached := range s.entries {
+			if cached.timestamp.Before(cutoff) {
+				delete(s.entries, key)
+				removed = append(removed, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// ages returns how long ago each cached value was received, in seconds, as
+// of now
+func (c *deviceCache) ages(now time.Time) []float64 {
+	var ages []float64
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for _, cached := range s.entries {
+			ages = append(ages, now.Sub(cached.timestamp).Seconds())
+		}
+		s.mu.RUnlock()
+	}
+	return ages
+}
+
+// keys returns the keys of every cached entry
+func (c *deviceCache) keys() []cacheKey {
+	var keys []cacheKey
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for key := range s.entries {
+			keys = append(keys, key)
+		}
+		s.mu.RUnlock()
+	}
+	return keys
+}
+
+// len returns the number of cached entries across all shards
+func (c *deviceCache) len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		n += len(s.entries)
+		s.mu.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+package alert
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeviceCache(t *testing.T) {
+	c := newDeviceCache()
+	key := cacheKey{Topic: "sensor/D800", Address: "D800"}
+
+	if _, ok := c.get(key); ok {
+		t.Fatal("Expected empty cache")
+	}
+
+	c.set(key, cachedValue{value: 1})
+	c.update(key, func(prev cachedValue, exists bool) cachedValue {
+		if !exists || prev.value != 1 {
+			t.Errorf("Expected previous value 1, got %v (exists=%v)", prev.value, exists)
+		}
+		return cachedValue{value: 2}
+	})
+	c.set(cacheKey{Topic: "sensor/D801", Address: "D801"}, cachedValue{value: 3})
+
+	if cached, ok := c.get(key); !ok || cached.value != 2 {
+		t.Errorf("Expected updated value 2, got %v", cached.value)
+	}
+	if c.len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.len())
+	}
+
+	c.delete(key)
+	if _, ok := c.get(key); ok {
+		t.Error("Expected entry to be deleted")
+	}
+	if c.len() != 1 {
+		t.Errorf("Expected 1 entry, got %d", c.len())
+	}
+}
+
+// lockedCache is the single-lock map the device cache used before sharding,
+// kept as a benchmark baseline
+type lockedCache struct {
+	mu      sync.RWMutex
+	entries map[cacheKey]cachedValue
+}
+
+func (c *lockedCache) get(key cacheKey) (cachedValue, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	value, ok := c.entries[key]
+	return value, ok
+}
+
+func (c *lockedCache) set(key cacheKey, value cachedValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = value
+}
+
+func cacheBenchKeys(n int) []cacheKey {
+	keys := make([]cacheKey, n)
+	for i := range keys {
+		address := fmt.Sprintf("D%d", i)
+		keys[i] = cacheKey{Topic: "sensor/" + address, Address: address}
+	}
+	return keys
+}
+
+// benchmarkCache writes from every goroutine and reads back one in four
+// operations, mimicking ingestion with concurrent rule snapshots
+func benchmarkCache(b *testing.B, get func(cacheKey) (cachedValue, bool), set func(cacheKey, cachedValue)) {
+	keys := cacheBenchKeys(1024)
+	var next atomic.Uint64
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1)) * 7919
+		now := time.Now()
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%4 == 0 {
+				get(key)
+			} else {
+				set(key, cachedValue{value: float64(i), timestamp: now})
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkDeviceCacheSingleLock(b *testing.B) {
+	c := &lockedCache{entries: make(map[cacheKey]cachedValue)}
+	benchmarkCache(b, c.get, c.set)
+}
+
+func BenchmarkDeviceCacheSharded(b *testing.B) {
+	c := newDeviceCache()
+	benchmarkCache(b, c.get, c.set)
+}
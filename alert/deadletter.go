@@ -0,0 +1,326 @@
+package alert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+	"goalert-engine/supabase"
+
+	"go.uber.org/zap"
+)
+
+// DeadLetter is an alert the inserter failed to store, with everything needed
+// to insert it again later
+type DeadLetter struct {
+	ID          int64      `json:"id,omitempty"` // Row ID in a dead-letter table, unset in files
+	FailedAt    time.Time  `json:"failed_at"`
+	RuleID      string     `json:"rule_id"`
+	ConditionID int        `json:"condition_id"`
+	Table       string     `json:"table"`
+	Device      string     `json:"device_id"`
+	Message     string     `json:"message"` // Alert rendered as JSON, as the inserter received it
+	Category    string     `json:"category"`
+	Machine     string     `json:"machine"`
+	Level       string     `json:"level"`
+	Reason      string     `json:"reason"`                // Error of the failed insert
+	ReplayedAt  *time.Time `json:"replayed_at,omitempty"` // When a replay inserted the alert, nil until then
+}
+
+// DeadLetterSink keeps alerts that failed to insert, so they aren't lost
+type DeadLetterSink interface {
+	StoreDeadLetter(ctx context.Context, letter DeadLetter) error
+}
+
+// DeadLetterReplayer is a DeadLetterSink whose dead letters can be inserted
+// again. ReplayDeadLetters calls insert for every dead letter not replayed
+// yet and marks each one it inserted as replayed before inserting the next.
+// Replays are at least once: an alert inserted but not marked, e.g. because
+// the process died in between, is inserted again by the next replay.
+type DeadLetterReplayer interface {
+	DeadLetterSink
+	ReplayDeadLetters(ctx context.Context, insert func(ctx context.Context, letter DeadLetter) error) (DeadLetterReplay, error)
+}
+
+// DeadLetterReplay counts the outcomes of a dead-letter replay
+type DeadLetterReplay struct {
+	Inserted int `json:"inserted"` // Inserted and marked as replayed
+	Failed   int `json:"failed"`   // Failed again, left for the next replay
+	Skipped  int `json:"skipped"`  // Replayed before
+}
+
+// ErrNoDeadLetterReplayer is returned when replaying without a sink that
+// supports replays
+var ErrNoDeadLetterReplayer = errors.New("no replayable dead-letter sink configured")
+
+// ErrReplayInProgress is returned by ReplayDeadLetters while another replay
+// runs
+var ErrReplayInProgress = errors.New("dead-letter replay already in progress")
+
+// FileDeadLetterSink appends dead letters to a file, one JSON object per line
+type FileDeadLetterSink struct {
+	path string
+	mu   sync.Mutex // Serializes appends, so lines don't interleave
+}
+
+// NewFileDeadLetterSink appends dead letters to the file at path, creating it
+// on the first dead letter
+func NewFileDeadLetterSink(path string) *FileDeadLetterSink {
+	return &FileDeadLetterSink{path: path}
+}
+
+func (s *FileDeadLetterSink) StoreDeadLetter(ctx context.Context, letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write dead letter: %w", err)
+	}
+	return f.Close()
+}
+
+// ReplayDeadLetters replays the dead letters of the file, which stays open
+// for appends meanwhile. Each inserted one is marked by rewriting the file
+// before the next is inserted.
+func (s *FileDeadLetterSink) ReplayDeadLetters(ctx context.Context, insert func(ctx context.Context, letter DeadLetter) error) (DeadLetterReplay, error) {
+	s.mu.Lock()
+	letters, err := s.read()
+	s.mu.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return DeadLetterReplay{}, nil
+	}
+	if err != nil {
+		return DeadLetterReplay{}, err
+	}
+
+	var replay DeadLetterReplay
+	for i, letter := range letters {
+		if letter.ReplayedAt != nil {
+			replay.Skipped++
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return replay, err
+		}
+		if insert(ctx, letter) != nil {
+			replay.Failed++
+			continue
+		}
+		// As for the table, an alert inserted but left unmarked is inserted
+		// again by the next replay
+		if err := s.markReplayed(i, time.Now().UTC()); err != nil {
+			return replay, err
+		}
+		replay.Inserted++
+	}
+	return replay, nil
+}
+
+// read parses the dead letters of the file, s.mu must be held
+func (s *FileDeadLetterSink) read() ([]DeadLetter, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("invalid dead letter on line %d: %w", line, err)
+		}
+		letters = append(letters, letter)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter file: %w", err)
+	}
+	return letters, nil
+}
+
+// markReplayed rewrites the file with the dead letter at index marked as
+// replayed at the given time. Dead letters appended since it was read come
+// after it, so the index still holds.
+func (s *FileDeadLetterSink) markReplayed(index int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for i, letter := range letters {
+		if i == index {
+			letter.ReplayedAt = &at
+		}
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return fmt.Errorf("failed to marshal dead letter: %w", err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// Replace the file at once, so a crash can't leave it half written
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write dead-letter file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace dead-letter file: %w", err)
+	}
+	return nil
+}
+
+// TableDeadLetterSink inserts dead letters into a Supabase table with a
+// column per DeadLetter field, the id generated by the table
+type TableDeadLetterSink struct {
+	cfg   config.Config
+	table string
+}
+
+// NewTableDeadLetterSink inserts dead letters into table
+func NewTableDeadLetterSink(cfg config.Config, table string) *TableDeadLetterSink {
+	return &TableDeadLetterSink{cfg: cfg, table: table}
+}
+
+func (s *TableDeadLetterSink) StoreDeadLetter(ctx context.Context, letter DeadLetter) error {
+	return supabase.InsertRow(ctx, s.cfg, s.table, map[string]any{
+		"failed_at":    letter.FailedAt,
+		"rule_id":      letter.RuleID,
+		"condition_id": letter.ConditionID,
+		"table":        letter.Table,
+		"device_id":    letter.Device,
+		"message":      letter.Message,
+		"category":     letter.Category,
+		"machine":      letter.Machine,
+		"level":        letter.Level,
+		"reason":       letter.Reason,
+	})
+}
+
+// ReplayDeadLetters replays the rows of the table without a replayed_at time
+// and sets it on those inserted
+func (s *TableDeadLetterSink) ReplayDeadLetters(ctx context.Context, insert func(ctx context.Context, letter DeadLetter) error) (DeadLetterReplay, error) {
+	var letters []DeadLetter
+	if err := supabase.SelectRows(ctx, s.cfg, s.table, "replayed_at=is.null&order=id", &letters); err != nil {
+		return DeadLetterReplay{}, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	var replay DeadLetterReplay
+	for _, letter := range letters {
+		if err := ctx.Err(); err != nil {
+			return replay, err
+		}
+		if insert(ctx, letter) != nil {
+			replay.Failed++
+			continue
+		}
+		// Only replay.Inserted counts the alert when it is marked, an alert
+		// inserted but left unmarked is inserted again by the next replay
+		err := supabase.UpdateRows(ctx, s.cfg, s.table, fmt.Sprintf("id=eq.%d", letter.ID), map[string]any{
+			"replayed_at": time.Now().UTC(),
+		})
+		if err != nil {
+			return replay, fmt.Errorf("failed to mark dead letter %d as replayed: %w", letter.ID, err)
+		}
+		replay.Inserted++
+	}
+	return replay, nil
+}
+
+// ReplayDeadLetters inserts the dead letters not replayed yet through the
+// manager's inserter, returning ErrNoDeadLetterReplayer when the dead-letter
+// sink doesn't support replays and ErrReplayInProgress while another replay
+// runs
+func (m *RuleManager) ReplayDeadLetters(ctx context.Context) (DeadLetterReplay, error) {
+	replayer, ok := m.deadLetters.(DeadLetterReplayer)
+	if !ok {
+		return DeadLetterReplay{}, ErrNoDeadLetterReplayer
+	}
+	if !m.replayMu.TryLock() {
+		return DeadLetterReplay{}, ErrReplayInProgress
+	}
+	defer m.replayMu.Unlock()
+	if m.Cfg.DryRun {
+		// The dry-run sink would mark every dead letter as replayed
+		return DeadLetterReplay{}, errors.New("dry run, dead letters not replayed")
+	}
+
+	replay, err := replayer.ReplayDeadLetters(ctx, func(ctx context.Context, letter DeadLetter) error {
+		if inserter, ok := m.alertInserter.(ContextAlertInserter); ok {
+			return inserter.InsertAlertContext(ctx, m.Cfg, letter.Table, letter.Device, letter.Message, letter.Category, letter.Machine, letter.Level)
+		}
+		return m.alertInserter.InsertAlert(m.Cfg, letter.Table, letter.Device, letter.Message, letter.Category, letter.Machine, letter.Level)
+	})
+	m.logger.Info("Dead letters replayed",
+		zap.Int("inserted", replay.Inserted),
+		zap.Int("failed", replay.Failed),
+		zap.Int("skipped", replay.Skipped),
+		zap.Error(err),
+	)
+	return replay, err
+}
+
+// deadLetter hands an alert that failed to insert to the dead-letter sink,
+// if one is configured. The alert is only lost when that fails as well.
+func (m *RuleManager) deadLetter(ctx context.Context, rule *AlertRule, condition AlertCondition, message string, insertErr error) {
+	if m.deadLetters == nil {
+		return
+	}
+
+	letter := DeadLetter{
+		FailedAt:    m.now().UTC(),
+		RuleID:      rule.ID,
+		ConditionID: condition.ID,
+		Table:       rule.Table,
+		Device:      condition.Device,
+		Message:     message,
+		Category:    rule.Category,
+		Machine:     rule.Machine,
+		Level:       getLevelString(condition.Level),
+		Reason:      insertErr.Error(),
+	}
+	// The insert may have failed because ctx ended, the dead letter still
+	// has to be kept
+	if err := m.deadLetters.StoreDeadLetter(context.WithoutCancel(ctx), letter); err != nil {
+		m.logger.Error("Failed to dead-letter alert, alert lost",
+			zap.String("rule_id", rule.ID),
+			zap.Int("condition_id", condition.ID),
+			zap.Error(err),
+		)
+		return
+	}
+	metrics.AlertsDeadLettered.Inc()
+	m.logger.Warn("Alert dead-lettered",
+		zap.String("rule_id", rule.ID),
+		zap.Int("condition_id", condition.ID),
+	)
+}
@@ -0,0 +1,364 @@
+package alert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+// failingInserter fails every insert with err
+type failingInserter struct {
+	err error
+}
+
+func (f failingInserter) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	return f.err
+}
+
+// newDeadLetterTestManager returns a manager whose inserts fail, with the
+// condition of its rule holding
+func newDeadLetterTestManager(t *testing.T, sink DeadLetterSink) *RuleManager {
+	t.Helper()
+
+	rules := []AlertRule{
+		*NewAlertRule("dead", []string{"sensor/device1"}, "alerts", "", "line", "m1", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelError},
+		}, zap.NewNop()),
+	}
+	rm := NewManager(context.Background(), rules, config.Config{},
+		WithInserter(failingInserter{err: errors.New("database unreachable")}),
+		WithDeadLetterSink(sink),
+		WithClock(NewManualClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))),
+	)
+	t.Cleanup(rm.Shutdown)
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+	return rm
+}
+
+func TestFailedInsertIsDeadLettered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	rm := newDeadLetterTestManager(t, NewFileDeadLetterSink(path))
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	// The alert still counts as failed, the dead letter only keeps it
+	if len(results) != 1 || results[0].Status != AlertFailed {
+		t.Fatalf("Expected a failed alert, got %+v", results)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Expected a dead-letter file: %v", err)
+	}
+	defer f.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatalf("Invalid dead letter %q: %v", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+
+	letter := letters[0]
+	if letter.RuleID != "dead" || letter.ConditionID != 1 || letter.Table != "alerts" ||
+		letter.Device != "device1" || letter.Category != "line" || letter.Machine != "m1" || letter.Level != "ERROR" {
+		t.Errorf("Unexpected dead letter: %+v", letter)
+	}
+	if letter.Reason != "database unreachable" {
+		t.Errorf("Expected the insert error as reason, got %q", letter.Reason)
+	}
+	if !letter.FailedAt.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the failure time from the clock, got %v", letter.FailedAt)
+	}
+
+	var alert AlertMessage
+	if err := json.Unmarshal([]byte(letter.Message), &alert); err != nil || alert.Current != 15 {
+		t.Errorf("Expected the full alert payload, got %q", letter.Message)
+	}
+}
+
+func TestDeadLetterFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := NewFileDeadLetterSink(path)
+
+	for _, ruleID := range []string{"a", "b"} {
+		if err := sink.StoreDeadLetter(context.Background(), DeadLetter{RuleID: ruleID}); err != nil {
+			t.Fatalf("StoreDeadLetter failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var ids []string
+	for {
+		var letter DeadLetter
+		if err := decoder.Decode(&letter); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, letter.RuleID)
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("Expected both dead letters in order, got %v", ids)
+	}
+}
+
+func TestTableDeadLetterSink(t *testing.T) {
+	var (
+		path string
+		row  map[string]any
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&row)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	rm := newDeadLetterTestManager(t, NewTableDeadLetterSink(config.Config{SupabaseURL: srv.URL}, "alert_dead_letters"))
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if path != "/rest/v1/alert_dead_letters" {
+		t.Errorf("Expected the dead letter posted to its table, got %q", path)
+	}
+	if row["rule_id"] != "dead" || row["reason"] != "database unreachable" || row["level"] != "ERROR" || row["table"] != "alerts" {
+		t.Errorf("Unexpected dead-letter row: %v", row)
+	}
+}
+
+// flakyInserter records alerts, failing those of failDevice
+type flakyInserter struct {
+	RecordingInserter
+	failDevice string
+}
+
+func (f *flakyInserter) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	if device == f.failDevice {
+		return errors.New("database unreachable")
+	}
+	return f.RecordingInserter.InsertAlert(cfg, table, device, message, category, machine, level)
+}
+
+func TestReplayDeadLetterFile(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/dead_letters.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	if err := os.WriteFile(path, fixture, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	inserter := &flakyInserter{failDevice: "D900"}
+	rm := NewManager(context.Background(), nil, config.Config{},
+		WithInserter(inserter),
+		WithDeadLetterSink(NewFileDeadLetterSink(path)),
+	)
+	defer rm.Shutdown()
+
+	replay, err := rm.ReplayDeadLetters(context.Background())
+	if err != nil {
+		t.Fatalf("ReplayDeadLetters failed: %v", err)
+	}
+	if replay != (DeadLetterReplay{Inserted: 1, Failed: 1, Skipped: 1}) {
+		t.Errorf("Unexpected replay counts: %+v", replay)
+	}
+	alerts := inserter.Alerts()
+	if len(alerts) != 1 || alerts[0].Device != "D800" || alerts[0].Table != "alerts" || alerts[0].Level != "WARNING" ||
+		alerts[0].Message != `{"device":"D800","current":950}` {
+		t.Errorf("Expected only the pending D800 alert inserted, got %+v", alerts)
+	}
+
+	// Replaying again skips what was inserted and retries what failed
+	inserter.failDevice = ""
+	replay, err = rm.ReplayDeadLetters(context.Background())
+	if err != nil {
+		t.Fatalf("ReplayDeadLetters failed: %v", err)
+	}
+	if replay != (DeadLetterReplay{Inserted: 1, Skipped: 2}) {
+		t.Errorf("Unexpected counts of the second replay: %+v", replay)
+	}
+	if alerts := inserter.Alerts(); len(alerts) != 2 || alerts[1].Device != "D900" {
+		t.Errorf("Expected the D900 alert inserted by the second replay, got %+v", alerts)
+	}
+
+	replay, err = rm.ReplayDeadLetters(context.Background())
+	if err != nil || replay != (DeadLetterReplay{Skipped: 3}) {
+		t.Errorf("Expected everything skipped once replayed, got %+v, %v", replay, err)
+	}
+}
+
+func TestReplayKeepsAppendedDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := NewFileDeadLetterSink(path)
+	if err := sink.StoreDeadLetter(context.Background(), DeadLetter{RuleID: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dead letter stored while the replay inserts is kept for the next one
+	replay, err := sink.ReplayDeadLetters(context.Background(), func(ctx context.Context, letter DeadLetter) error {
+		return sink.StoreDeadLetter(ctx, DeadLetter{RuleID: "second"})
+	})
+	if err != nil || replay.Inserted != 1 {
+		t.Fatalf("Unexpected replay: %+v, %v", replay, err)
+	}
+
+	var pending []string
+	replay, err = sink.ReplayDeadLetters(context.Background(), func(ctx context.Context, letter DeadLetter) error {
+		pending = append(pending, letter.RuleID)
+		return nil
+	})
+	if err != nil || replay.Skipped != 1 || len(pending) != 1 || pending[0] != "second" {
+		t.Errorf("Expected only the appended dead letter replayed, got %v (%+v, %v)", pending, replay, err)
+	}
+}
+
+func TestReplayMarksEachInsertedDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := NewFileDeadLetterSink(path)
+	for _, ruleID := range []string{"first", "second"} {
+		if err := sink.StoreDeadLetter(context.Background(), DeadLetter{RuleID: ruleID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The replay is cancelled after the first insert, which stays marked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replay, err := sink.ReplayDeadLetters(ctx, func(ctx context.Context, letter DeadLetter) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || replay.Inserted != 1 {
+		t.Fatalf("Expected the replay cancelled after one insert, got %+v, %v", replay, err)
+	}
+
+	var pending []string
+	replay, err = sink.ReplayDeadLetters(context.Background(), func(ctx context.Context, letter DeadLetter) error {
+		pending = append(pending, letter.RuleID)
+		return nil
+	})
+	if err != nil || replay.Skipped != 1 || len(pending) != 1 || pending[0] != "second" {
+		t.Errorf("Expected only the second dead letter replayed, got %v (%+v, %v)", pending, replay, err)
+	}
+}
+
+// replayingInserter starts another replay of rm from within an insert
+type replayingInserter struct {
+	rm  *RuleManager
+	err error // Of the nested replay
+}
+
+func (r *replayingInserter) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	_, r.err = r.rm.ReplayDeadLetters(context.Background())
+	return nil
+}
+
+func TestReplayDeadLettersOneAtATime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := NewFileDeadLetterSink(path)
+	if err := sink.StoreDeadLetter(context.Background(), DeadLetter{RuleID: "oven"}); err != nil {
+		t.Fatal(err)
+	}
+
+	inserter := &replayingInserter{}
+	rm := NewManager(context.Background(), nil, config.Config{},
+		WithInserter(inserter),
+		WithDeadLetterSink(sink),
+	)
+	defer rm.Shutdown()
+	inserter.rm = rm
+
+	replay, err := rm.ReplayDeadLetters(context.Background())
+	if err != nil || replay.Inserted != 1 {
+		t.Fatalf("Unexpected replay: %+v, %v", replay, err)
+	}
+	if !errors.Is(inserter.err, ErrReplayInProgress) {
+		t.Errorf("Expected ErrReplayInProgress while a replay runs, got %v", inserter.err)
+	}
+
+	// Once the replay is done the next one can run
+	if replay, err := rm.ReplayDeadLetters(context.Background()); err != nil || replay.Skipped != 1 {
+		t.Errorf("Expected the next replay to run, got %+v, %v", replay, err)
+	}
+}
+
+func TestReplayWithoutDeadLetterSink(t *testing.T) {
+	rm := NewManager(context.Background(), nil, config.Config{}, WithInserter(NoopInserter{}))
+	defer rm.Shutdown()
+
+	if _, err := rm.ReplayDeadLetters(context.Background()); !errors.Is(err, ErrNoDeadLetterReplayer) {
+		t.Errorf("Expected ErrNoDeadLetterReplayer, got %v", err)
+	}
+}
+
+func TestReplayDeadLetterTable(t *testing.T) {
+	var patched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("replayed_at") != "is.null" {
+				t.Errorf("Expected only rows not replayed selected, got %q", r.URL.RawQuery)
+			}
+			w.Write([]byte(`[
+				{"id": 7, "table": "alerts", "device_id": "D800", "message": "{}", "level": "WARNING"},
+				{"id": 8, "table": "alerts", "device_id": "D900", "message": "{}", "level": "ERROR"}
+			]`))
+		case http.MethodPatch:
+			var fields map[string]any
+			json.NewDecoder(r.Body).Decode(&fields)
+			if fields["replayed_at"] == nil {
+				t.Errorf("Expected replayed_at set, got %v", fields)
+			}
+			patched = append(patched, r.URL.Query().Get("id"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	inserter := &flakyInserter{failDevice: "D900"}
+	rm := NewManager(context.Background(), nil, config.Config{},
+		WithInserter(inserter),
+		WithDeadLetterSink(NewTableDeadLetterSink(config.Config{SupabaseURL: srv.URL}, "alert_dead_letters")),
+	)
+	defer rm.Shutdown()
+
+	replay, err := rm.ReplayDeadLetters(context.Background())
+	if err != nil {
+		t.Fatalf("ReplayDeadLetters failed: %v", err)
+	}
+	if replay != (DeadLetterReplay{Inserted: 1, Failed: 1}) {
+		t.Errorf("Unexpected replay counts: %+v", replay)
+	}
+	if len(patched) != 1 || patched[0] != "eq.7" {
+		t.Errorf("Expected only row 7 marked as replayed, got %v", patched)
+	}
+}
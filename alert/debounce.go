@@ -0,0 +1,62 @@
+package alert
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer coalesces bursts of triggers into a single call of fn, run once no
+// further trigger arrived within window. A trigger that arrives while fn is
+// running schedules another trailing run, so no change is missed.
+type debouncer struct {
+	window time.Duration
+	fn     func()
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	runMu   sync.Mutex // Serializes runs of fn
+}
+
+func newDebouncer(window time.Duration, fn func()) *debouncer {
+	return &debouncer{
+		window: window,
+		fn:     fn,
+	}
+}
+
+// Trigger schedules fn, postponing any pending run. With a zero window fn runs
+// right away, still off the caller's goroutine.
+func (d *debouncer) Trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return
+	}
+	if d.window <= 0 {
+		go d.run()
+		return
+	}
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.timer = time.AfterFunc(d.window, d.run)
+}
+
+// Stop cancels any pending run and ignores further triggers
+func (d *debouncer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+func (d *debouncer) run() {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+	d.fn()
+}
@@ -0,0 +1,104 @@
+package alert
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebouncerCoalescesBurst(t *testing.T) {
+	var reloads atomic.Int32
+	d := newDebouncer(30*time.Millisecond, func() {
+		reloads.Add(1)
+	})
+	defer d.Stop()
+
+	// Burst of 50 changes within the window
+	for i := 0; i < 50; i++ {
+		d.Trigger()
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := reloads.Load(); got != 1 {
+		t.Fatalf("Expected 1 reload for the burst, got %d", got)
+	}
+
+	// A later change still gets its own trailing reload
+	d.Trigger()
+	time.Sleep(100 * time.Millisecond)
+	if got := reloads.Load(); got != 2 {
+		t.Errorf("Expected trailing reload for the later change, got %d reloads", got)
+	}
+}
+
+func TestDebouncerTriggerDuringRun(t *testing.T) {
+	var reloads atomic.Int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	d := newDebouncer(10*time.Millisecond, func() {
+		reloads.Add(1)
+		started <- struct{}{}
+		<-release
+	})
+	defer d.Stop()
+
+	d.Trigger()
+	<-started
+
+	// Change arrives while the first reload is still running
+	d.Trigger()
+	close(release)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a trailing reload for the change during the running reload")
+	}
+	if got := reloads.Load(); got != 2 {
+		t.Errorf("Expected 2 reloads, got %d", got)
+	}
+}
+
+func TestDebouncerZeroWindow(t *testing.T) {
+	reloads := make(chan struct{}, 3)
+	d := newDebouncer(0, func() {
+		reloads <- struct{}{}
+	})
+
+	d.Trigger()
+	d.Trigger()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-reloads:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a reload per trigger without debouncing, got %d", i)
+		}
+	}
+
+	// Stopped debouncers ignore triggers even without a window
+	d.Stop()
+	d.Trigger()
+	select {
+	case <-reloads:
+		t.Errorf("Expected no reload after Stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDebouncerStop(t *testing.T) {
+	var reloads atomic.Int32
+	d := newDebouncer(10*time.Millisecond, func() {
+		reloads.Add(1)
+	})
+
+	d.Trigger()
+	d.Stop()
+	d.Trigger()
+
+	time.Sleep(50 * time.Millisecond)
+	if got := reloads.Load(); got != 0 {
+		t.Errorf("Expected no reload after Stop, got %d", got)
+	}
+}
@@ -0,0 +1,220 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goalert-engine/config"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Built-in payload formats, selected with PAYLOAD_FORMAT
+const (
+	FormatJSON      = "json"      // {"address": "D100", "value": 42}
+	FormatRaw       = "raw"       // A bare value, addressed by the topic's last segment
+	FormatCSV       = "csv"       // address,value
+	FormatSparkplug = "sparkplug" // Sparkplug B NDATA/DDATA, one device per metric
+)
+
+var (
+	ErrMissingAddress = errors.New("payload missing 'address' field")
+	ErrMissingValue   = errors.New("payload missing 'value' field")
+)
+
+// PayloadDecoder extracts the device address and value from an MQTT payload
+type PayloadDecoder interface {
+	Decode(payload []byte, topic string) (address string, value any, err error)
+}
+
+// DecodedValue is one device value carried by a payload. Topic is the topic
+// the value is cached and routed under, the message's topic when empty.
+type DecodedValue struct {
+	Topic   string
+	Address string
+	Value   any
+}
+
+// MultiPayloadDecoder is implemented by decoders of payloads carrying several
+// device values, e.g. Sparkplug B. The manager prefers DecodeAll over Decode.
+type MultiPayloadDecoder interface {
+	PayloadDecoder
+	DecodeAll(payload []byte, topic string) ([]DecodedValue, error)
+}
+
+// MessageDecoder is implemented by decoders of payloads with named fields,
+// e.g. JSON. Besides the device value it returns the decoded message, which
+// the manager looks the dedup sequence field up in.
+type MessageDecoder interface {
+	PayloadDecoder
+	DecodeMessage(payload []byte, topic string) (address string, value any, msg map[string]any, err error)
+}
+
+// DecoderFactory builds a PayloadDecoder from the configuration
+type DecoderFactory func(cfg config.Config) (PayloadDecoder, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]DecoderFactory{
+		FormatJSON:      newJSONDecoder,
+		FormatRaw:       func(config.Config) (PayloadDecoder, error) { return RawDecoder{}, nil },
+		FormatCSV:       func(config.Config) (PayloadDecoder, error) { return CSVDecoder{}, nil },
+		FormatSparkplug: newSparkplugDecoder,
+	}
+)
+
+// RegisterDecoder makes a payload format available to PAYLOAD_FORMAT under
+// name, replacing any format registered under the same name
+func RegisterDecoder(name string, factory DecoderFactory) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[name] = factory
+}
+
+// NewDecoder returns the decoder for the configured payload format, JSON by default
+func NewDecoder(cfg config.Config) (PayloadDecoder, error) {
+	name := cfg.PayloadFormat
+	if name == "" {
+		name = FormatJSON
+	}
+
+	decodersMu.RLock()
+	factory, ok := decoders[name]
+	decodersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown payload format %q, expected one of %s", name, strings.Join(decoderNames(), ", "))
+	}
+	return factory(cfg)
+}
+
+func decoderNames() []string {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// JSONDecoder decodes {"address": ..., "value": ...} objects, validating them
+// against Schema when it is set. With UseNumber, numbers are kept as
+// json.Number so integers beyond 2^53, e.g. 64-bit counters, keep their
+// identity instead of rounding to the nearest float64.
+type JSONDecoder struct {
+	Schema    *PayloadSchema
+	UseNumber bool
+}
+
+func newJSONDecoder(cfg config.Config) (PayloadDecoder, error) {
+	schema, err := ParsePayloadSchema(cfg.PayloadSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONDecoder{Schema: schema, UseNumber: cfg.PayloadUseNumber}, nil
+}
+
+// Decode implements PayloadDecoder. Schema violations are returned as
+// *PayloadValidationError.
+func (d *JSONDecoder) Decode(payload []byte, topic string) (string, any, error) {
+	address, value, _, err := d.DecodeMessage(payload, topic)
+	return address, value, err
+}
+
+// DecodeMessage implements MessageDecoder
+func (d *JSONDecoder) DecodeMessage(payload []byte, topic string) (string, any, map[string]any, error) {
+	var msg map[string]any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	if d.UseNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(&msg); err != nil {
+		return "", nil, nil, fmt.Errorf("failed to parse payload: %w", err)
+	}
+	if dec.More() {
+		return "", nil, nil, errors.New("failed to parse payload: unexpected data after the JSON object")
+	}
+
+	if err := d.Schema.Validate(msg); err != nil {
+		return "", nil, nil, err
+	}
+
+	address, ok := msg["address"].(string)
+	if !ok {
+		return "", nil, nil, ErrMissingAddress
+	}
+
+	value, ok := msg["value"]
+	if !ok {
+		return "", nil, nil, ErrMissingValue
+	}
+
+	return address, value, msg, nil
+}
+
+// RawDecoder decodes payloads carrying only the value, e.g. "42.5" or "true",
+// published on a topic ending with the device address. Values that aren't
+// numbers or booleans are kept as strings.
+type RawDecoder struct{}
+
+// Decode implements PayloadDecoder
+func (RawDecoder) Decode(payload []byte, topic string) (string, any, error) {
+	address := extractAddressFromTopic(topic)
+	if address == "" {
+		return "", nil, fmt.Errorf("topic %q has no device address", topic)
+	}
+
+	value, err := parseRawValue(string(payload))
+	if err != nil {
+		return "", nil, err
+	}
+	return address, value, nil
+}
+
+// CSVDecoder decodes a single "address,value" record, e.g. "D100,42.5". Values
+// are parsed like RawDecoder's and fields may be quoted.
+type CSVDecoder struct{}
+
+// Decode implements PayloadDecoder
+func (CSVDecoder) Decode(payload []byte, topic string) (string, any, error) {
+	reader := csv.NewReader(bytes.NewReader(payload))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	record, err := reader.Read()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse CSV payload: %w", err)
+	}
+
+	address := strings.TrimSpace(record[0])
+	if address == "" {
+		return "", nil, ErrMissingAddress
+	}
+	value, err := parseRawValue(record[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return address, value, nil
+}
+
+// parseRawValue parses a textual value as a number, then a boolean, keeping
+// it as a string otherwise
+func parseRawValue(s string) (any, error) {
+	raw := strings.TrimSpace(s)
+	if raw == "" {
+		return nil, ErrMissingValue
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f, nil
+	}
+	if b, err := strconv.ParseBool(raw); err == nil {
+		return b, nil
+	}
+	return raw, nil
+}
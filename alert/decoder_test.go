@@ -0,0 +1,186 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestJSONDecoder(t *testing.T) {
+	schema, err := ParsePayloadSchema("address:string,value:number")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		decoder *JSONDecoder
+		payload string
+		address string
+		value   any
+		wantErr error
+	}{
+		{"number", &JSONDecoder{}, `{"address": "D100", "value": 42.5}`, "D100", 42.5, nil},
+		{"bool", &JSONDecoder{}, `{"address": "D100", "value": true}`, "D100", true, nil},
+		{"missing address", &JSONDecoder{}, `{"value": 1}`, "", nil, ErrMissingAddress},
+		{"missing value", &JSONDecoder{}, `{"address": "D100"}`, "", nil, ErrMissingValue},
+		{"schema", &JSONDecoder{Schema: schema}, `{"address": "D100", "value": 7}`, "D100", 7.0, nil},
+		{"use number", &JSONDecoder{Schema: schema, UseNumber: true}, `{"address": "D100", "value": 9007199254740993}`, "D100", json.Number("9007199254740993"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, value, err := tt.decoder.Decode([]byte(tt.payload), "plc/D100")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if address != tt.address || value != tt.value {
+				t.Errorf("Expected %s=%v, got %s=%v", tt.address, tt.value, address, value)
+			}
+		})
+	}
+
+	if _, _, err := (&JSONDecoder{}).Decode([]byte(`not json`), "plc/D100"); err == nil {
+		t.Error("Expected an error for a malformed payload")
+	}
+
+	var validationErr *PayloadValidationError
+	if _, _, err := (&JSONDecoder{Schema: schema}).Decode([]byte(`{"address": "D100", "value": "7"}`), "plc/D100"); !errors.As(err, &validationErr) {
+		t.Errorf("Expected a schema validation error, got %v", err)
+	}
+}
+
+func TestRawDecoder(t *testing.T) {
+	tests := []struct {
+		payload string
+		value   any
+	}{
+		{"42.5", 42.5},
+		{" 7\n", 7.0},
+		{"true", true},
+		{"RUNNING", "RUNNING"},
+	}
+
+	for _, tt := range tests {
+		address, value, err := RawDecoder{}.Decode([]byte(tt.payload), "plc/holding/D100")
+		if err != nil {
+			t.Fatalf("Decode(%q) failed: %v", tt.payload, err)
+		}
+		if address != "D100" || value != tt.value {
+			t.Errorf("Decode(%q) = %s=%v, want D100=%v", tt.payload, address, value, tt.value)
+		}
+	}
+
+	if _, _, err := (RawDecoder{}).Decode([]byte("  "), "plc/D100"); !errors.Is(err, ErrMissingValue) {
+		t.Errorf("Expected ErrMissingValue for an empty payload, got %v", err)
+	}
+	if _, _, err := (RawDecoder{}).Decode([]byte("1"), "plc/"); err == nil {
+		t.Error("Expected an error for a topic without an address")
+	}
+}
+
+// pipeDecoder decodes "address|value" payloads, to exercise the registry
+type pipeDecoder struct{}
+
+func (pipeDecoder) Decode(payload []byte, topic string) (string, any, error) {
+	address, value, ok := strings.Cut(string(payload), "|")
+	if !ok {
+		return "", nil, ErrMissingValue
+	}
+	return address, value, nil
+}
+
+func TestCSVDecoder(t *testing.T) {
+	tests := []struct {
+		payload string
+		address string
+		value   any
+	}{
+		{"D100,42.5", "D100", 42.5},
+		{"D100, 7\n", "D100", 7.0},
+		{" D100 ,true", "D100", true},
+		{`D100,"RUNNING, AUTO"`, "D100", "RUNNING, AUTO"},
+	}
+
+	for _, tt := range tests {
+		address, value, err := CSVDecoder{}.Decode([]byte(tt.payload), "plc/holding/D100")
+		if err != nil {
+			t.Fatalf("Decode(%q) failed: %v", tt.payload, err)
+		}
+		if address != tt.address || value != tt.value {
+			t.Errorf("Decode(%q) = %s=%v, want %s=%v", tt.payload, address, value, tt.address, tt.value)
+		}
+	}
+
+	for _, tt := range []struct {
+		payload string
+		wantErr error
+	}{
+		{",42", ErrMissingAddress},
+		{"D100, ", ErrMissingValue},
+	} {
+		if _, _, err := (CSVDecoder{}).Decode([]byte(tt.payload), "plc/D100"); !errors.Is(err, tt.wantErr) {
+			t.Errorf("Decode(%q) error = %v, want %v", tt.payload, err, tt.wantErr)
+		}
+	}
+	for _, payload := range []string{"42", "D100,1,2", ""} {
+		if _, _, err := (CSVDecoder{}).Decode([]byte(payload), "plc/D100"); err == nil {
+			t.Errorf("Expected an error for %q", payload)
+		}
+	}
+
+	// CSV payloads flow through the manager like JSON ones
+	cfg := config.Config{PayloadFormat: FormatCSV}
+	rm := NewRuleManager(context.Background(), nil, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	rm.HandleMQTTMessage("plc/D100", []byte("D100,12.5"), cfg)
+	if cached, ok := rm.deviceCache.get(cacheKey{Topic: "plc/D100", Address: "D100"}); !ok || cached.value != 12.5 {
+		t.Errorf("Expected csv value to be cached, got %+v", cached)
+	}
+}
+
+func TestNewDecoder(t *testing.T) {
+	if d, err := NewDecoder(config.Config{}); err != nil {
+		t.Errorf("Expected JSON decoder by default, got error %v", err)
+	} else if _, ok := d.(*JSONDecoder); !ok {
+		t.Errorf("Expected JSON decoder by default, got %T", d)
+	}
+
+	if d, err := NewDecoder(config.Config{PayloadFormat: FormatRaw}); err != nil || d != (RawDecoder{}) {
+		t.Errorf("Expected raw decoder, got %T, %v", d, err)
+	}
+	if d, err := NewDecoder(config.Config{PayloadFormat: FormatCSV}); err != nil || d != (CSVDecoder{}) {
+		t.Errorf("Expected CSV decoder, got %T, %v", d, err)
+	}
+
+	if _, err := NewDecoder(config.Config{PayloadFormat: "xml"}); err == nil || !strings.Contains(err.Error(), "json, raw") {
+		t.Errorf("Expected unknown format error listing the formats, got %v", err)
+	}
+	if _, err := NewDecoder(config.Config{PayloadSchema: "value:decimal"}); err == nil {
+		t.Error("Expected invalid schema to fail the JSON decoder")
+	}
+
+	RegisterDecoder("pipe", func(config.Config) (PayloadDecoder, error) { return pipeDecoder{}, nil })
+	t.Cleanup(func() {
+		decodersMu.Lock()
+		delete(decoders, "pipe")
+		decodersMu.Unlock()
+	})
+
+	// Registered formats are used for incoming messages
+	cfg := config.Config{PayloadFormat: "pipe"}
+	rm := NewRuleManager(context.Background(), nil, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	rm.HandleMQTTMessage("plc/D100", []byte("D100|RUNNING"), cfg)
+	if cached, ok := rm.deviceCache.get(cacheKey{Topic: "plc/D100", Address: "D100"}); !ok || cached.value != "RUNNING" {
+		t.Errorf("Expected pipe value to be cached, got %+v", cached)
+	}
+}
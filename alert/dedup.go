@@ -0,0 +1,83 @@
+package alert
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// MessageMeta carries broker-level delivery details for an MQTT message.
+type MessageMeta struct {
+	ID       uint16 // MQTT packet identifier (0 for QoS 0 deliveries)
+	Arrival  uint64 // Arrival order from RuleManager.NextArrival, 0 stamps the message when it is handled
+	Retained bool   // Retained message replayed by the broker on subscribe rather than a live publish
+}
+
+// messageDeduper drops messages that were already seen within a short window,
+// e.g. QoS 1 redeliveries of the same publish.
+type messageDeduper struct {
+	window    time.Duration
+	seqField  string
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newMessageDeduper(window time.Duration, seqField string) *messageDeduper {
+	return &messageDeduper{
+		window:   window,
+		seqField: seqField,
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// dedupKey builds the identity of a message. A sequence number in the decoded
+// message msg wins over the MQTT packet ID; messages with neither are not
+// deduped.
+func (d *messageDeduper) dedupKey(topic string, payload []byte, msg map[string]any, meta MessageMeta) string {
+	if seq, ok := msg[d.seqField]; ok && d.seqField != "" && seq != nil {
+		return fmt.Sprintf("%s|seq|%v", topic, seq)
+	}
+	if meta.ID != 0 {
+		// Packet IDs are reused by the broker, so include the payload hash to
+		// only match exact redeliveries.
+		sum := sha1.Sum(payload)
+		return fmt.Sprintf("%s|id|%d|%s", topic, meta.ID, hex.EncodeToString(sum[:]))
+	}
+	return ""
+}
+
+// alertDedupKey identifies an alert by content, so identical alerts raised
+// by overlapping rules collapse into one delivery
+func alertDedupKey(alert AlertMessage) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%v|%s", alert.Device, alert.Severity, math.Round(alert.Current), alert.Message)))
+	return hex.EncodeToString(sum[:])
+}
+
+// isDuplicate records key and reports whether it was already seen within the window.
+func (d *messageDeduper) isDuplicate(key string, now time.Time) bool {
+	if key == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) > d.window {
+		for k, seenAt := range d.seen {
+			if now.Sub(seenAt) > d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	if seenAt, exists := d.seen[key]; exists && now.Sub(seenAt) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
@@ -0,0 +1,36 @@
+package alert
+
+import (
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+// dryRunSink takes the place of the inserter in dry-run mode, logging the
+// alerts that would have been inserted
+type dryRunSink struct {
+	logger *zap.Logger
+}
+
+func (s dryRunSink) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	s.logger.Info("Dry run, alert not delivered",
+		zap.String("table", table),
+		zap.String("device", device),
+		zap.String("category", category),
+		zap.String("machine", machine),
+		zap.String("level", level),
+		zap.String("message", message),
+	)
+	return nil
+}
+
+// applyDryRun swaps the inserter and notifiers for the logging sink, leaving
+// evaluation, cooldowns and metrics untouched
+func (m *RuleManager) applyDryRun() {
+	m.logger.Info("Dry run enabled, alerts are logged instead of delivered")
+	m.alertInserter = dryRunSink{logger: m.logger}
+	for _, notifier := range m.notifiers {
+		m.logger.Info("Dry run, notifier disabled", zap.String("sink", notifier.Name()))
+	}
+	m.notifiers = nil
+}
@@ -0,0 +1,78 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDryRunSkipsDelivery(t *testing.T) {
+	inserter := &MockSupabaseClient{
+		InsertAlertFunc: func(cfg config.Config, table, device, message, category, machine, level string) error {
+			t.Errorf("Expected no insert in dry-run mode, got one for %s", device)
+			return nil
+		},
+	}
+	notifier := &fakeNotifier{name: "chat"}
+	core, logs := observer.New(zap.InfoLevel)
+
+	rules := []AlertRule{
+		*NewAlertRule("dry", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelCritical},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{DryRun: true}
+	rm := NewManager(context.Background(), rules, cfg,
+		WithInserter(inserter),
+		WithNotifiers(notifier),
+		WithLogger(zap.New(core)),
+	)
+	defer rm.Shutdown()
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+
+	evaluations := metrics.EvaluationDuration.WithLabelValues("CRITICAL")
+	inserts := metrics.InsertDuration.WithLabelValues("CRITICAL")
+	beforeEvaluations := histogramCount(t, evaluations)
+	beforeInserts := histogramCount(t, inserts)
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	// The cooldown still applies to the second evaluation
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(notifier.notifications) != 0 {
+		t.Errorf("Expected no notifications in dry-run mode, got %d", len(notifier.notifications))
+	}
+	if got := histogramCount(t, evaluations) - beforeEvaluations; got != 2 {
+		t.Errorf("Expected 2 evaluation observations, got %d", got)
+	}
+	if got := histogramCount(t, inserts) - beforeInserts; got != 1 {
+		t.Errorf("Expected 1 insert observation, got %d", got)
+	}
+
+	if len(results) != 2 || results[0].Status != AlertDelivered || results[1].Status != AlertSuppressed {
+		t.Fatalf("Expected a delivered then a suppressed alert, got %v", results)
+	}
+	if len(results[0].SinkResults) != 1 {
+		t.Errorf("Expected only the dry-run sink, got %v", results[0].SinkResults)
+	}
+
+	if got := logs.FilterMessage("Dry run, alert not delivered").Len(); got != 1 {
+		t.Errorf("Expected 1 would-be alert logged, got %d", got)
+	}
+	if got := logs.FilterMessage("Dry run, notifier disabled").Len(); got != 1 {
+		t.Errorf("Expected the notifier to be disabled, got %d", got)
+	}
+}
@@ -0,0 +1,61 @@
+package alert
+
+// EscalationPolicy raises the severity of a condition that keeps firing
+// without clearing: every After consecutive alerts step the level up by one,
+// up to MaxLevel.
+type EscalationPolicy struct {
+	After    int `json:"after"`     // Consecutive alerts per escalation step
+	MaxLevel int `json:"max_level"` // Highest level to escalate to (default Critical)
+}
+
+// escalatedLevel returns the effective level of base after consecutive prior
+// alerts of the same alertKey
+func (p *EscalationPolicy) escalatedLevel(base, consecutive int) int {
+	if p == nil || p.After <= 0 {
+		return base
+	}
+
+	maxLevel := p.MaxLevel
+	if maxLevel == 0 {
+		maxLevel = LevelCritical
+	}
+
+	level := base + consecutive/p.After
+	if level > maxLevel {
+		level = maxLevel
+	}
+	if level < base {
+		level = base
+	}
+	return level
+}
+
+// effectiveLevel returns the severity the next alert for alertKey is raised at
+func (m *RuleManager) effectiveLevel(rule *AlertRule, alertKey string, base int) int {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+	return m.effectiveLevelLocked(rule, alertKey, base)
+}
+
+// effectiveLevelLocked is effectiveLevel, callers must hold alertMu
+func (m *RuleManager) effectiveLevelLocked(rule *AlertRule, alertKey string, base int) int {
+	return rule.Escalation.escalatedLevel(base, m.consecutive[alertKey])
+}
+
+// recordConsecutiveAlert counts an alert for alertKey. Unlike alertCounts it
+// is only reset when the condition clears, not by the backoff window.
+func (m *RuleManager) recordConsecutiveAlert(alertKey string) {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+	m.consecutive[alertKey]++
+}
+
+// clearAlertState resets escalation and re-arms an acknowledged alert once
+// the condition no longer holds
+func (m *RuleManager) clearAlertState(alertKey string) {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+	delete(m.consecutive, alertKey)
+	delete(m.acked, alertKey)
+	delete(m.pendingSince, alertKey)
+}
@@ -0,0 +1,105 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestEscalationPolicyLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      *EscalationPolicy
+		base        int
+		consecutive int
+		want        int
+	}{
+		{"no policy", nil, LevelWarning, 10, LevelWarning},
+		{"disabled", &EscalationPolicy{}, LevelWarning, 10, LevelWarning},
+		{"before first step", &EscalationPolicy{After: 3}, LevelWarning, 2, LevelWarning},
+		{"first step", &EscalationPolicy{After: 3}, LevelWarning, 3, LevelError},
+		{"second step", &EscalationPolicy{After: 3}, LevelWarning, 6, LevelCritical},
+		{"capped at critical", &EscalationPolicy{After: 1}, LevelWarning, 10, LevelCritical},
+		{"capped at max level", &EscalationPolicy{After: 1, MaxLevel: LevelError}, LevelWarning, 10, LevelError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.escalatedLevel(tt.base, tt.consecutive); got != tt.want {
+				t.Errorf("escalatedLevel(%d, %d) = %d, want %d", tt.base, tt.consecutive, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscalationOnConsecutiveTriggers(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:         "2f3e4d5c-6b7a-4898-a7b6-c5d4e3f2a1b0",
+			Topics:     []string{"sensor/device1"},
+			Table:      "alerts",
+			Escalation: &EscalationPolicy{After: 2},
+			Conditions: []AlertCondition{
+				{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+			},
+		},
+	}
+
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), rules, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	var severities []string
+	rm.OnAlert = func(alert AlertMessage, rule *AlertRule, condition AlertCondition) {
+		if alert.Severity != getLevelString(condition.Level) {
+			t.Errorf("Alert severity %s doesn't match condition level %d", alert.Severity, condition.Level)
+		}
+		severities = append(severities, alert.Severity)
+	}
+
+	rule := &rm.Rules[0]
+	key := cacheKey{Topic: "sensor/device1", Address: "device1"}
+
+	evaluate := func(value int) {
+		rm.deviceCache.set(key, cachedValue{value: value, timestamp: time.Now()})
+
+		rm.evaluateRule(rule, cfg)
+
+		// Let every cooldown expire before the next reading
+		rule.mu.Lock()
+		for id := range rule.LastAlertTime {
+			rule.LastAlertTime[id] = time.Now().Add(-24 * time.Hour)
+		}
+		rule.mu.Unlock()
+		rm.alertMu.Lock()
+		for k := range rm.lastAlertTimes {
+			rm.lastAlertTimes[k] = time.Now().Add(-24 * time.Hour)
+		}
+		rm.alertMu.Unlock()
+	}
+
+	for i := 0; i < 6; i++ {
+		evaluate(15)
+	}
+
+	want := []string{"WARNING", "WARNING", "ERROR", "ERROR", "CRITICAL", "CRITICAL"}
+	if len(severities) != len(want) {
+		t.Fatalf("Expected %d alerts, got %d: %v", len(want), len(severities), severities)
+	}
+	for i := range want {
+		if severities[i] != want[i] {
+			t.Errorf("Trigger %d: expected %s, got %s", i+1, want[i], severities[i])
+		}
+	}
+
+	// Clearing the condition resets escalation
+	evaluate(5)
+	evaluate(15)
+	if last := severities[len(severities)-1]; last != "WARNING" {
+		t.Errorf("Expected severity to reset to WARNING after clearing, got %s", last)
+	}
+}
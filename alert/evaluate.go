@@ -0,0 +1,111 @@
+package alert
+
+import "time"
+
+// RuleMatch is a condition of a rule that holds for the evaluated values
+type RuleMatch struct {
+	ConditionID int          `json:"condition_id"`
+	Alert       AlertMessage `json:"alert"`
+	Message     string       `json:"message"` // The alert as it would be inserted
+}
+
+// EvaluateOnce evaluates every condition of rule against values, device
+// address -> value, and returns the alerts that would fire, e.g. to test rules
+// against synthetic payloads. Cooldowns, acks, snoozes and warm-up are
+// ignored. A copy of rule is evaluated against a history holding only values,
+// so neither the rule, the device cache, the history nor any alert state is
+// touched and repeated calls with the same values return the same alerts.
+func (m *RuleManager) EvaluateOnce(rule *AlertRule, values map[string]any) []AlertMessage {
+	rule = copyRule(rule)
+	m.initRule(rule, m.Cfg)
+
+	history := newSampleHistory(m.history.size)
+	keys := make(map[string]cacheKey, len(values))
+	for device, value := range values {
+		keys[device] = cacheKey{Address: device}
+		if sample, ok := sampleValue(value); ok {
+			history.record(keys[device], sample)
+		}
+	}
+
+	var alerts []AlertMessage
+	for _, match := range m.matchConditions(rule, values, history.of(keys)) {
+		alerts = append(alerts, match.Alert)
+	}
+	return alerts
+}
+
+// TestRule is EvaluateOnce for the loaded rule ruleID, returning the matching
+// conditions and false when no such rule is loaded
+func (m *RuleManager) TestRule(ruleID string, values map[string]any) ([]RuleMatch, bool) {
+	var rule *AlertRule
+	m.mu.RLock()
+	for i := range m.Rules {
+		if m.Rules[i].ID == ruleID {
+			rule = &m.Rules[i]
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if rule == nil {
+		return nil, false
+	}
+
+	// Loaded rules are initialized already. Reloads replace the rules instead
+	// of changing them, so the rule can be evaluated without m.mu, which the
+	// enrichment of its alerts mustn't block.
+	return m.matchConditions(rule, values, m.history.of(ruleKeys(rule))), true
+}
+
+// matchConditions evaluates the conditions of an initialized rule without
+// touching any state, trend and anomaly conditions against history
+func (m *RuleManager) matchConditions(rule *AlertRule, values map[string]any, history deviceSamples) []RuleMatch {
+	var matches []RuleMatch
+	for _, condition := range rule.Conditions {
+		state, floatValues := rule.checkCondition(values, history, condition)
+		if state != conditionTriggered {
+			continue
+		}
+		alert := rule.generateAlertMessage(condition, floatValues)
+		alert.TriggeredAt = m.now().In(m.location).Format(time.RFC3339)
+		matches = append(matches, RuleMatch{
+			ConditionID: condition.ID,
+			Alert:       alert,
+			Message:     rule.marshalAlertMessage(alert),
+		})
+	}
+	return matches
+}
+
+// ruleKeys returns the cache keys of the devices on the rule's topics, by
+// address, for TestRule to look at their history. Wildcard topics are left out, they have no single device.
+func ruleKeys(rule *AlertRule) map[string]cacheKey {
+	keys := make(map[string]cacheKey, len(rule.Topics))
+	for _, ruleTopic := range rule.Topics {
+		if isWildcardTopic(ruleTopic) {
+			continue
+		}
+		devAddr := extractAddressFromTopic(ruleTopic)
+		if _, ok := keys[devAddr]; !ok {
+			keys[devAddr] = cacheKey{Topic: ruleTopic, Address: devAddr}
+		}
+	}
+	return keys
+}
+
+// copyRule returns a copy of the rule's definition, without its alert state
+func copyRule(rule *AlertRule) *AlertRule {
+	c := NewAlertRule(rule.ID, rule.Topics, rule.Table, rule.Field, rule.Category, rule.Machine, rule.Conditions, rule.logger)
+	c.Escalation = rule.Escalation
+	c.WarmupSeconds = rule.WarmupSeconds
+	c.Transforms = rule.Transforms
+	c.Precision = rule.Precision
+	c.IgnoreRetained = rule.IgnoreRetained
+	c.Priority = rule.Priority
+	c.ThrottlePeriod = rule.ThrottlePeriod
+	c.MessageTemplates = rule.MessageTemplates
+	c.InstanceMatch = rule.InstanceMatch
+	c.QoS = rule.QoS
+	c.CooldownPeriod = rule.CooldownPeriod
+	return c
+}
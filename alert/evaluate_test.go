@@ -0,0 +1,87 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestEvaluateOnce(t *testing.T) {
+	rm := NewManager(context.Background(), nil, config.Config{}, WithInserter(NoopInserter{}))
+	defer rm.Shutdown()
+
+	rule := NewAlertRule("oven", []string{"sensor/D800", "sensor/D801"}, "alerts", "", "", "", []AlertCondition{
+		{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: LevelWarning},
+		{ID: 2, Device: "D800", Operator: "D800 > 900 AND D801 == 1", Threshold: 900, Level: LevelCritical},
+		{ID: 3, Device: "D800", Level: LevelError, Match: &ConditionTree{Op: MatchOR, Children: []ConditionTree{
+			{Device: "D800", Operator: "<", Threshold: 100},
+			{Device: "D801", Operator: "==", Threshold: 2},
+		}}},
+	}, zap.NewNop())
+
+	tests := []struct {
+		name       string
+		values     map[string]any
+		severities []string
+	}{
+		{"simple condition", map[string]any{"D800": 950.0, "D801": 0.0}, []string{"WARNING"}},
+		{"complex condition", map[string]any{"D800": 950.0, "D801": 1.0}, []string{"WARNING", "CRITICAL"}},
+		{"condition tree", map[string]any{"D800": 50.0, "D801": 0.0}, []string{"ERROR"}},
+		{"nothing holds", map[string]any{"D800": 500.0, "D801": 0.0}, nil},
+		{"missing device", map[string]any{"D801": 2.0}, []string{"ERROR"}},
+		{"no values", map[string]any{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Repeated evaluations aren't held back by cooldowns
+			for range 2 {
+				alerts := rm.EvaluateOnce(rule, tt.values)
+				if len(alerts) != len(tt.severities) {
+					t.Fatalf("Expected %d alerts, got %+v", len(tt.severities), alerts)
+				}
+				for i, alert := range alerts {
+					if alert.Severity != tt.severities[i] {
+						t.Errorf("Expected alert %d with severity %s, got %s", i, tt.severities[i], alert.Severity)
+					}
+				}
+			}
+		})
+	}
+
+	if rm.deviceCache.len() != 0 {
+		t.Errorf("Expected the device cache untouched, got %d values", rm.deviceCache.len())
+	}
+	if len(rm.history.devices) != 0 {
+		t.Errorf("Expected the history untouched, got %d devices", len(rm.history.devices))
+	}
+	if rule.Precision != nil || rule.clock != nil {
+		t.Errorf("Expected the caller's rule left uninitialized, got precision %v, clock %v", rule.Precision, rule.clock)
+	}
+}
+
+func TestEvaluateOnceAlertMessage(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	rm := NewManager(context.Background(), nil, config.Config{}, WithInserter(NoopInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	rule := NewAlertRule("oven", []string{"sensor/D800"}, "alerts", "", "", "", []AlertCondition{
+		{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: LevelError, Unit: []string{"°C"}},
+	}, zap.NewNop())
+
+	alerts := rm.EvaluateOnce(rule, map[string]any{"D800": 950.25})
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+	alert := alerts[0]
+	if alert.Device != "D800" || alert.Current != 950 || alert.CurrentRaw != 950.25 || alert.Threshold != 900 || len(alert.Unit) != 1 {
+		t.Errorf("Unexpected alert %+v", alert)
+	}
+	if alert.TriggeredAt != "2024-05-01T08:00:00Z" {
+		t.Errorf("Expected the manager's time in the alert, got %s", alert.TriggeredAt)
+	}
+}
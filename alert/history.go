@@ -0,0 +1,155 @@
+package alert
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// defaultHistorySize is the number of samples kept per device when
+// HISTORY_SIZE isn't set
+const defaultHistorySize = 32
+
+// sampleHistory keeps the most recent values of each cached device, oldest
+// first, for conditions that look at more than the latest reading. Like the
+// device cache it is keyed by topic and address, so the same address on
+// different topics (e.g. the instances of a wildcard rule) has separate
+// histories, and entries leave it along with the cache's.
+type sampleHistory struct {
+	size    int
+	mu      sync.RWMutex
+	devices map[cacheKey]*sampleRing
+}
+
+// sampleRing is a fixed-size ring buffer of device values
+type sampleRing struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+// historyCapacity is the number of samples a history of size keeps
+func historyCapacity(size int) int {
+	if size <= 0 {
+		return defaultHistorySize
+	}
+	return size
+}
+
+func newSampleHistory(size int) *sampleHistory {
+	return &sampleHistory{
+		size:    historyCapacity(size),
+		devices: make(map[cacheKey]*sampleRing),
+	}
+}
+
+// record appends value to the device's history, dropping the oldest sample
+// once the buffer is full
+func (h *sampleHistory) record(key cacheKey, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ring, ok := h.devices[key]
+	if !ok {
+		ring = &sampleRing{values: make([]float64, h.size)}
+		h.devices[key] = ring
+	}
+
+	ring.values[ring.next] = value
+	ring.next = (ring.next + 1) % len(ring.values)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// remove drops the histories of the given devices, e.g. once their cached
+// values expired
+func (h *sampleHistory) remove(keys ...cacheKey) {
+	if len(keys) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range keys {
+		delete(h.devices, key)
+	}
+}
+
+// samples returns up to n of the device's most recent values, oldest first.
+// A nil history has no samples.
+func (h *sampleHistory) samples(key cacheKey, n int) []float64 {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ring, ok := h.devices[key]
+	if !ok {
+		return nil
+	}
+
+	count := ring.next
+	if ring.full {
+		count = len(ring.values)
+	}
+	if n > count {
+		n = count
+	}
+
+	out := make([]float64, n)
+	start := ring.next - n
+	if start < 0 {
+		start += len(ring.values)
+	}
+	for i := range out {
+		out[i] = ring.values[(start+i)%len(ring.values)]
+	}
+	return out
+}
+
+// deviceSamples returns up to n of the most recent values of a device,
+// oldest first, by the address conditions refer to it by
+type deviceSamples func(device string, n int) []float64
+
+// of returns the samples of the devices of a snapshot, keys mapping their
+// addresses to the cache keys their values were resolved from
+func (h *sampleHistory) of(keys map[string]cacheKey) deviceSamples {
+	if h == nil {
+		return nil
+	}
+	return func(device string, n int) []float64 {
+		key, ok := keys[device]
+		if !ok {
+			return nil
+		}
+		return h.samples(key, n)
+	}
+}
+
+// samples calls d, a nil deviceSamples has no samples
+func (d deviceSamples) samples(device string, n int) []float64 {
+	if d == nil {
+		return nil
+	}
+	return d(device, n)
+}
+
+// sampleValue converts a payload value to a history sample
+func sampleValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case bool:
+		return boolToFloat(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
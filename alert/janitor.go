@@ -0,0 +1,58 @@
+package alert
+
+import (
+	"time"
+
+	"goalert-engine/metrics"
+
+	"go.uber.org/zap"
+)
+
+// cacheJanitor evicts expired device values every interval until Shutdown,
+// then refreshes the cache metrics. Snapshot reads only skip stale values of
+// the devices a rule references, so without it devices that stop reporting
+// would stay cached forever.
+func (m *RuleManager) cacheJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.janitorStop:
+			return
+		case <-ticker.C:
+			now := m.now()
+			if removed := m.sweepExpired(now); removed > 0 {
+				m.logger.Debug("Evicted expired device values", zap.Int("count", removed))
+			}
+			m.updateCacheMetrics(now)
+		}
+	}
+}
+
+// sweepExpired removes the device values older than the cache TTL and returns
+// how many were removed
+func (m *RuleManager) sweepExpired(now time.Time) int {
+	// Hold the LRU lock across the sweep, so a value re-cached meanwhile
+	// isn't dropped from the LRU order
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
+
+	removed := m.deviceCache.sweep(now.Add(-m.cacheTTL))
+	for _, key := range removed {
+		m.cacheLRU.remove(key)
+	}
+	m.instances.remove(removed...)
+	m.history.remove(removed...)
+
+	metrics.DeviceCacheExpirations.Add(float64(len(removed)))
+	return len(removed)
+}
+
+// updateCacheMetrics sets the cache size and value age metrics, e.g. to spot
+// sensors that stopped reporting before their values expire
+func (m *RuleManager) updateCacheMetrics(now time.Time) {
+	ages := m.deviceCache.ages(now)
+	metrics.DeviceCacheEntries.Set(float64(len(ages)))
+	metrics.DeviceCacheAges.Set(ages)
+}
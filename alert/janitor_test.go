@@ -0,0 +1,121 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+func TestSweepExpired(t *testing.T) {
+	cfg := config.Config{DeviceCacheMaxEntries: 10}
+	rm := NewRuleManager(context.Background(), nil, cfg, &RecordingInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	now := time.Now()
+	expired := cacheKey{Topic: "sensor/D1", Address: "D1"}
+	fresh := cacheKey{Topic: "sensor/D2", Address: "D2"}
+
+	rm.HandleMQTTMessage("sensor/D1", []byte(`{"address": "D1", "value": 1}`), cfg)
+	rm.HandleMQTTMessage("sensor/D2", []byte(`{"address": "D2", "value": 2}`), cfg)
+	rm.deviceCache.set(expired, cachedValue{value: 1, timestamp: now.Add(-rm.cacheTTL - time.Second)})
+
+	if removed := rm.sweepExpired(now); removed != 1 {
+		t.Errorf("Expected 1 expired entry removed, got %d", removed)
+	}
+	if _, ok := rm.deviceCache.get(expired); ok {
+		t.Error("Expected expired entry to be evicted")
+	}
+	if _, ok := rm.deviceCache.get(fresh); !ok {
+		t.Error("Expected fresh entry to be kept")
+	}
+
+	rm.lruMu.Lock()
+	defer rm.lruMu.Unlock()
+	if _, ok := rm.cacheLRU.elems[expired]; ok {
+		t.Error("Expected expired entry to be removed from the LRU order")
+	}
+	if _, ok := rm.cacheLRU.elems[fresh]; !ok {
+		t.Error("Expected fresh entry to stay in the LRU order")
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	rm := NewRuleManager(context.Background(), nil, config.Config{}, &RecordingInserter{}, zap.NewNop())
+	rm.cacheTTL = 20 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		rm.cacheJanitor(5 * time.Millisecond)
+		close(done)
+	}()
+
+	key := cacheKey{Topic: "sensor/D1", Address: "D1"}
+	rm.deviceCache.set(key, cachedValue{value: 1, timestamp: time.Now()})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := rm.deviceCache.get(key); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected janitor to evict the expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rm.Shutdown()
+	rm.Shutdown() // Shutdown may be called more than once
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected janitor to stop on Shutdown")
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), nil, cfg, &RecordingInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	for _, device := range []string{"D1", "D2", "D3"} {
+		rm.HandleMQTTMessage("sensor/"+device, []byte(`{"address": "`+device+`", "value": 1}`), cfg)
+	}
+	now := time.Now()
+	rm.deviceCache.set(cacheKey{Topic: "sensor/D3", Address: "D3"}, cachedValue{value: 1, timestamp: now.Add(-10 * time.Minute)})
+
+	rm.updateCacheMetrics(now)
+
+	if got := testutil.ToFloat64(metrics.DeviceCacheEntries); got != 3 {
+		t.Errorf("Expected 3 cached devices, got %v", got)
+	}
+
+	ch := make(chan prometheus.Metric, 1)
+	metrics.DeviceCacheAges.Collect(ch)
+	var m dto.Metric
+	if err := (<-ch).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	histogram := m.GetHistogram()
+	if histogram.GetSampleCount() != 3 {
+		t.Errorf("Expected an age per cached device, got %d", histogram.GetSampleCount())
+	}
+	for _, bucket := range histogram.GetBucket() {
+		// Two values are fresh, the third is 10 minutes old
+		want := uint64(2)
+		if bucket.GetUpperBound() >= 600 {
+			want = 3
+		}
+		if bucket.GetCumulativeCount() != want {
+			t.Errorf("Expected %d values within %vs, got %d", want, bucket.GetUpperBound(), bucket.GetCumulativeCount())
+		}
+	}
+}
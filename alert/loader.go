@@ -6,10 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"goalert-engine/config"
+	"goalert-engine/metrics"
 	"io/ioutil"
 	"log"
+	"math/rand/v2"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"goalert-engine/realtime" // Import your realtime package
@@ -19,6 +23,19 @@ import (
 	"go.uber.org/zap"
 )
 
+// newRealtimeClient creates the realtime client, replaced in tests
+var newRealtimeClient = realtime.NewClient
+
+// MaxReloadJitter bounds the random delay before loading rules
+const MaxReloadJitter = time.Minute
+
+// jitterInt64N returns a random delay in [0, n), replaced in tests
+var jitterInt64N = rand.Int64N
+
+// realtimeRetryInterval is how often the loader retries a realtime connection
+// that failed at startup
+const realtimeRetryInterval = 30 * time.Second
+
 type SupabaseRuleLoader struct {
 	client            *supabase.Client
 	cache             *ristretto.Cache
@@ -31,8 +48,21 @@ type SupabaseRuleLoader struct {
 	ForeignKey        string
 	ForeignKeyCheck   string
 	RealtimeTableName string
+	reloadDebounce    time.Duration
+	reloadMaxLag      time.Duration // Ignore changes committed longer ago than this (0 disables)
+	reloadJitter      time.Duration // Random delay of up to this before loading rules (0 disables)
+	cacheFile         string        // Last-known-good rules, used while Supabase is unreachable
+	retryInterval     time.Duration // Realtime reconnect interval after a failed startup
+	historySize       int           // Samples the rule manager keeps per device
+
+	mu                sync.Mutex
+	realtimeConnected bool
+	reloadMu          sync.Mutex // Serializes reloads
 }
 
+// ErrReloadInProgress is returned by Reload while another reload runs
+var ErrReloadInProgress = errors.New("rules reload already in progress")
+
 func NewSupabaseRuleLoader(cfg config.Config, logger *zap.Logger) (*SupabaseRuleLoader, error) {
 	apiURL := cfg.Supabase.URL
 	apiKey := cfg.Supabase.Key
@@ -61,11 +91,27 @@ func NewSupabaseRuleLoader(cfg config.Config, logger *zap.Logger) (*SupabaseRule
 		return nil, fmt.Errorf("failed to initialize Supabase client: %w", err)
 	}
 
-	rtClient := realtime.CreateRealtimeClient(projectRef, apiKey, logger)
-
-	// Connect the realtime client
+	rtClient := newRealtimeClient(
+		realtime.WithURL(realtime.ProjectURL(projectRef, apiKey)),
+		realtime.WithAPIKey(apiKey),
+		realtime.WithLogger(logger),
+		realtime.WithHeartbeat(cfg.RealtimeHeartbeatInterval, cfg.RealtimeHeartbeatTimeout),
+		realtime.WithDialTimeout(cfg.RealtimeDialTimeout),
+		realtime.WithReconnect(cfg.RealtimeReconnectInterval),
+	)
+
+	// Connect the realtime client. With a rules cache the engine can run on
+	// the last-known-good rules while WatchChanges keeps retrying.
+	connected := true
 	if err := rtClient.Connect(); err != nil {
-		return nil, fmt.Errorf("failed to connect to realtime service: %w", err)
+		if cfg.RulesCacheFile == "" {
+			return nil, fmt.Errorf("failed to connect to realtime service: %w", err)
+		}
+		logger.Warn("Realtime service unreachable, continuing with cached rules",
+			zap.String("cacheFile", cfg.RulesCacheFile),
+			zap.Error(err),
+		)
+		connected = false
 	}
 
 	return &SupabaseRuleLoader{
@@ -80,65 +126,72 @@ func NewSupabaseRuleLoader(cfg config.Config, logger *zap.Logger) (*SupabaseRule
 		RealtimeTableName: cfg.Supabase.Realtime,
 		ForeignKey:        cfg.Supabase.ForeignKey,
 		ForeignKeyCheck:   cfg.Supabase.ForeignKeyCheck,
+		reloadDebounce:    cfg.Supabase.ReloadDebounce,
+		historySize:       historyCapacity(cfg.HistorySize),
+		reloadMaxLag:      cfg.Supabase.ReloadMaxLag,
+		reloadJitter:      min(cfg.Supabase.ReloadJitter, MaxReloadJitter),
+		cacheFile:         cfg.RulesCacheFile,
+		retryInterval:     realtimeRetryInterval,
+		realtimeConnected: connected,
 	}, nil
 }
 
 func (s *SupabaseRuleLoader) WatchChanges(ctx context.Context, onUpdate func([]AlertRule)) error {
-	// Subscribe to PostgreSQL changes directly
-	err := s.realtime.ListenToPostgresChanges(realtime.PostgresChangesOptions{
-		Schema: s.schema,
-		Table:  s.RealtimeTableName,
-		Filter: "*", // Listen to all changes
-	}, func(payload map[string]any) {
-		s.logger.Info("Database change detected",
-			zap.Any("payload", payload))
-
-		// Extract change type and record
-		if data, ok := payload["payload"].(map[string]any); ok {
-			changeType, _ := data["type"].(string)
-
-			var record map[string]any
-
-			if r, ok := data["record"].(map[string]any); ok {
-				record = r
-			} else if or, ok := data["old_record"].(map[string]any); ok {
-				record = or
-			} else {
-				record = nil
-			}
-
-			s.logger.Debug("Change details",
-				zap.String("type", changeType),
-				zap.Any("record", record))
-
-			// Invalidate cache and reload rules on any change event
-			s.cache.Del("all_rules")
-			updatedRules, err := s.GetRules()
-			if err != nil {
-				s.logger.Error("Failed to reload rules after DB change", zap.Error(err))
-				return
-			}
-			onUpdate(updatedRules)
-		}
-
-		// Invalidate cache and reload rules
-		s.cache.Del("all_rules")
-		updatedRules, err := s.GetRules()
+	// Coalesce bursts of changes (e.g. a bulk edit) into a single reload
+	reloader := newDebouncer(s.reloadDebounce, func() {
+		// A flapping connection reloads once it is back up instead
+		if s.realtime.State() == realtime.StateReconnecting {
+			s.logger.Info("Skipping rule reload while the realtime service reconnects")
+			return
+		}
+
+		// Stagger the reloads of replicas notified of the same change
+		if err := s.WaitJitter(ctx); err != nil {
+			return
+		}
+
+		s.reloadMu.Lock()
+		updatedRules, err := s.reload()
+		s.reloadMu.Unlock()
 		if err != nil {
-			s.logger.Error("Failed to reload rules", zap.Error(err))
+			s.logger.Error("Failed to reload rules after DB change", zap.Error(err))
 			return
 		}
 		onUpdate(updatedRules)
 	})
 
-	if err != nil {
-		return fmt.Errorf("failed to listen to postgres changes: %w", err)
+	// Reload once a lost connection is back, to catch the changes made while
+	// it was down
+	previous := s.realtime.State()
+	s.realtime.OnStateChange(func(state realtime.State) {
+		s.logger.Info("Realtime connection state changed", zap.Stringer("state", state))
+		if state == realtime.StateConnected && previous == realtime.StateReconnecting {
+			go reloader.Trigger()
+		}
+		previous = state
+	})
+
+	// Realtime is down since startup: keep retrying in the background and
+	// reload once connected, to catch changes made during the outage
+	if !s.isRealtimeConnected() {
+		go s.retryRealtime(ctx, reloader)
+		go func() {
+			<-ctx.Done()
+			reloader.Stop()
+		}()
+		return nil
+	}
+
+	if err := s.listen(reloader); err != nil {
+		reloader.Stop()
+		return err
 	}
 
 	// Handle context cancellation
 	go func() {
 		<-ctx.Done()
 		s.logger.Info("Stopping realtime changes watcher")
+		reloader.Stop()
 		// The connection will be closed when the client is garbage collected
 		// or you can explicitly call s.realtime.Disconnect() if needed
 	}()
@@ -146,6 +199,157 @@ func (s *SupabaseRuleLoader) WatchChanges(ctx context.Context, onUpdate func([]A
 	return nil
 }
 
+// WaitJitter waits a random delay of up to the reload jitter, so replicas
+// loading rules at the same moment spread their queries. It returns early with
+// the context's error when ctx is done.
+func (s *SupabaseRuleLoader) WaitJitter(ctx context.Context) error {
+	delay := s.jitterDelay()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	s.logger.Debug("Delaying rule load", zap.Duration("jitter", delay))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jitterDelay picks the delay of the next rule load in [0, reloadJitter)
+func (s *SupabaseRuleLoader) jitterDelay() time.Duration {
+	if s.reloadJitter <= 0 {
+		return 0
+	}
+	return time.Duration(jitterInt64N(int64(s.reloadJitter)))
+}
+
+// listen subscribes to changes of the rules table, triggering reloader
+func (s *SupabaseRuleLoader) listen(reloader *debouncer) error {
+	// Subscribe to PostgreSQL changes directly
+	err := s.realtime.ListenToChanges(realtime.PostgresChangesOptions{
+		Schema: s.schema,
+		Table:  s.RealtimeTableName,
+		Filter: "*", // Listen to all changes
+	}, func(change realtime.Change) {
+		if !s.shouldReload(change) {
+			return
+		}
+		reloader.Trigger()
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to listen to postgres changes: %w", err)
+	}
+	return nil
+}
+
+// shouldReload logs a change of the rules table and reports whether it needs
+// a reload. Updates that changed no column, e.g. a save without edits, don't,
+// nor do changes committed longer ago than the reload max lag.
+func (s *SupabaseRuleLoader) shouldReload(change realtime.Change) bool {
+	record := change.Record
+	if change.Type == realtime.ChangeDelete {
+		record = change.OldRecord
+	}
+	var lag time.Duration
+	if !change.Committed.IsZero() {
+		lag = time.Since(change.Committed)
+		metrics.RealtimeChangeLag.Observe(lag.Seconds())
+	}
+	s.logger.Info("Database change detected",
+		zap.String("type", change.Type),
+		zap.Strings("changed", change.Changed),
+		zap.Duration("lag", lag),
+		zap.Any("record", record))
+
+	if s.reloadMaxLag > 0 && lag > s.reloadMaxLag {
+		s.logger.Warn("Skipping reload, the change is stale",
+			zap.Duration("lag", lag),
+			zap.Duration("maxLag", s.reloadMaxLag))
+		return false
+	}
+
+	if change.Type == realtime.ChangeUpdate && len(change.Changed) == 0 {
+		s.logger.Debug("Skipping reload, the update changed no column")
+		return false
+	}
+	return true
+}
+
+// retryRealtime connects the realtime client every retryInterval until it
+// succeeds or ctx is done, then listens for changes and triggers a reload
+func (s *SupabaseRuleLoader) retryRealtime(ctx context.Context, reloader *debouncer) {
+	ticker := time.NewTicker(s.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.realtime.Connect(); err != nil {
+			s.logger.Warn("Realtime service still unreachable", zap.Error(err))
+			continue
+		}
+		if err := s.listen(reloader); err != nil {
+			s.logger.Warn("Failed to listen for rule changes after reconnect", zap.Error(err))
+			continue
+		}
+
+		s.mu.Lock()
+		s.realtimeConnected = true
+		s.mu.Unlock()
+
+		s.logger.Info("Realtime service reconnected, reloading rules")
+		reloader.Trigger()
+		return
+	}
+}
+
+// RealtimeConnected reports whether the realtime link delivering rule changes
+// is up
+func (s *SupabaseRuleLoader) RealtimeConnected() bool {
+	return s.isRealtimeConnected() && s.realtime.Connected()
+}
+
+func (s *SupabaseRuleLoader) isRealtimeConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.realtimeConnected
+}
+
+// Reload loads the rules from Supabase, bypassing the cached rules, e.g. to
+// force a reload after a manual migration that produced no change events.
+// Unlike GetRules it doesn't fall back to the rules cache file, a failed
+// query is returned. It fails with ErrReloadInProgress while another reload
+// runs.
+func (s *SupabaseRuleLoader) Reload(ctx context.Context) ([]AlertRule, error) {
+	if !s.reloadMu.TryLock() {
+		return nil, ErrReloadInProgress
+	}
+	defer s.reloadMu.Unlock()
+
+	s.logger.Info("Reloading rules on request")
+	rules, err := s.loadFromSupabase(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rules: %w", err)
+	}
+	s.remember(rules)
+	return rules, nil
+}
+
+// reload invalidates the cache and loads the rules, callers must hold reloadMu
+func (s *SupabaseRuleLoader) reload() ([]AlertRule, error) {
+	s.cache.Del("all_rules")
+	return s.GetRules()
+}
+
 func (s *SupabaseRuleLoader) GetRules() ([]AlertRule, error) {
 	if val, ok := s.cache.Get("all_rules"); ok {
 		if rules, ok := val.([]AlertRule); ok {
@@ -154,37 +358,113 @@ func (s *SupabaseRuleLoader) GetRules() ([]AlertRule, error) {
 		return nil, errors.New("invalid cache type")
 	}
 
-	rules, err := s.loadFromSupabase()
+	rules, err := s.loadFromSupabase(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("failed to load rules: %w", err)
+		if s.cacheFile == "" {
+			return nil, fmt.Errorf("failed to load rules: %w", err)
+		}
+		cached, cacheErr := readRulesCache(s.cacheFile, s.logger)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("failed to load rules: %w (fallback: %v)", err, cacheErr)
+		}
+		s.logger.Warn("Failed to load rules from Supabase, using cached rules",
+			zap.String("cacheFile", s.cacheFile),
+			zap.Int("rules", len(cached)),
+			zap.Error(err),
+		)
+		return cached, nil
 	}
 
-	s.cache.SetWithTTL("all_rules", rules, 1, s.ttl)
+	s.remember(rules)
 	return rules, nil
 }
 
-func (s *SupabaseRuleLoader) loadFromSupabase() ([]AlertRule, error) {
-	var dbRules []struct {
-		ID         string           `json:"id"`
-		Topics     []string         `json:"topics"`
-		Table      string           `json:"table"`
-		Field      string           `json:"field"`
-		Category   string           `json:"category"`
-		Machine    string           `json:"machine"`
-		Conditions []AlertCondition `json:"conditions"`
-	}
-
-	_, err := s.client.
-		From(s.TableName).
-		Select(s.ForeignKey, "", false).
-		Eq(fmt.Sprintf("%s.%s", s.RealtimeTableName, s.ForeignKeyCheck), "true").
-		ExecuteTo(&dbRules)
+// remember caches rules loaded from Supabase and persists them as the
+// last-known-good rules
+func (s *SupabaseRuleLoader) remember(rules []AlertRule) {
+	s.cache.SetWithTTL("all_rules", rules, 1, s.ttl)
+	if s.cacheFile != "" {
+		if err := writeRulesCache(s.cacheFile, rules); err != nil {
+			s.logger.Warn("Failed to persist rules cache", zap.String("cacheFile", s.cacheFile), zap.Error(err))
+		}
+	}
+}
+
+// LastKnownRules returns the rules persisted by the last successful load, or
+// nil when there is no usable rules cache. A missing or corrupt file is logged
+// and otherwise ignored, the next successful load replaces it.
+func (s *SupabaseRuleLoader) LastKnownRules() []AlertRule {
+	if s.cacheFile == "" {
+		return nil
+	}
+
+	rules, err := readRulesCache(s.cacheFile, s.logger)
 	if err != nil {
-		return nil, fmt.Errorf("supabase query failed: %w", err)
+		if errors.Is(err, os.ErrNotExist) {
+			s.logger.Info("No rules cache yet", zap.String("cacheFile", s.cacheFile))
+		} else {
+			s.logger.Warn("Ignoring unusable rules cache", zap.String("cacheFile", s.cacheFile), zap.Error(err))
+		}
+		return nil
+	}
+	return rules
+}
+
+func (s *SupabaseRuleLoader) loadFromSupabase(ctx context.Context) ([]AlertRule, error) {
+	var dbRules []struct {
+		ID         string                    `json:"id"`
+		Topics     []string                  `json:"topics"`
+		Table      string                    `json:"table"`
+		Field      string                    `json:"field"`
+		Category   string                    `json:"category"`
+		Machine    string                    `json:"machine"`
+		Conditions []AlertCondition          `json:"conditions"`
+		Escalation *EscalationPolicy         `json:"escalation"`
+		Warmup     int                       `json:"warmup_seconds"`
+		Transforms map[string]ValueTransform `json:"transforms"`
+		Precision  *int                      `json:"precision"`
+		Retained   bool                      `json:"ignore_retained"`
+		Priority   int                       `json:"priority"`
+		Throttle   int                       `json:"throttle_period"`
+		Templates  map[int]string            `json:"message_templates"`
+		Instances  string                    `json:"instance_match"`
+		QoS        int                       `json:"qos"`
+	}
+
+	// The query takes no context, stop waiting for it once ctx is done
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.client.
+			From(s.TableName).
+			Select(s.ForeignKey, "", false).
+			Eq(fmt.Sprintf("%s.%s", s.RealtimeTableName, s.ForeignKeyCheck), "true").
+			ExecuteTo(&dbRules)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("supabase query failed: %w", err)
+		}
+	case <-ctx.Done():
+		return nil, fmt.Errorf("supabase query failed: %w", ctx.Err())
 	}
 
 	rules := make([]AlertRule, len(dbRules))
-	for i, dbRule := range dbRules {
+	i := 0
+	for _, dbRule := range dbRules {
+		conditions, err := validConditions(dbRule.ID, dbRule.Conditions, s.historySize, s.logger)
+		if err != nil {
+			s.logger.Warn("Rejecting rule", zap.String("rule_id", dbRule.ID), zap.Error(err))
+			continue
+		}
+		if err := validateQoS(dbRule.QoS); err != nil {
+			s.logger.Warn("Rejecting rule", zap.String("rule_id", dbRule.ID), zap.Error(err))
+			continue
+		}
+		if err := validateTopics(dbRule.Topics); err != nil {
+			s.logger.Warn("Keeping rule that is never evaluated", zap.String("rule_id", dbRule.ID), zap.Error(err))
+		}
 		rules[i] = *NewAlertRule(
 			dbRule.ID,
 			dbRule.Topics,
@@ -192,12 +472,23 @@ func (s *SupabaseRuleLoader) loadFromSupabase() ([]AlertRule, error) {
 			dbRule.Field,
 			dbRule.Category,
 			dbRule.Machine,
-			dbRule.Conditions,
+			conditions,
 			s.logger,
 		)
+		rules[i].Escalation = dbRule.Escalation
+		rules[i].WarmupSeconds = dbRule.Warmup
+		rules[i].Transforms = dbRule.Transforms
+		rules[i].Precision = dbRule.Precision
+		rules[i].IgnoreRetained = dbRule.Retained
+		rules[i].Priority = dbRule.Priority
+		rules[i].setThrottlePeriod(dbRule.Throttle)
+		rules[i].MessageTemplates = dbRule.Templates
+		rules[i].InstanceMatch = dbRule.Instances
+		rules[i].QoS = dbRule.QoS
+		i++
 	}
 
-	return rules, nil
+	return rules[:i], nil
 }
 
 // Close cleans up resources
@@ -215,14 +506,23 @@ func LoadRulesFromFile(path string, logger *zap.Logger) []AlertRule {
 	}
 
 	var fileRules []struct {
-		ID             string           `json:"id"`
-		Topics         []string         `json:"topics"`
-		Table          string           `json:"table"`
-		Field          string           `json:"field"`
-		Category       string           `json:"category"`
-		Machine        string           `json:"machine"`
-		Conditions     []AlertCondition `json:"conditions"`
-		ThrottlePeriod int              `json:"throttle_period"`
+		ID               string                    `json:"id"`
+		Topics           []string                  `json:"topics"`
+		Table            string                    `json:"table"`
+		Field            string                    `json:"field"`
+		Category         string                    `json:"category"`
+		Machine          string                    `json:"machine"`
+		Conditions       []AlertCondition          `json:"conditions"`
+		Escalation       *EscalationPolicy         `json:"escalation"`
+		Warmup           int                       `json:"warmup_seconds"`
+		Transforms       map[string]ValueTransform `json:"transforms"`
+		Precision        *int                      `json:"precision"`
+		IgnoreRetained   bool                      `json:"ignore_retained"`
+		Priority         int                       `json:"priority"`
+		ThrottlePeriod   int                       `json:"throttle_period"`
+		MessageTemplates map[int]string            `json:"message_templates"`
+		InstanceMatch    string                    `json:"instance_match"`
+		QoS              int                       `json:"qos"`
 	}
 
 	if err := json.Unmarshal(data, &fileRules); err != nil {
@@ -231,7 +531,21 @@ func LoadRulesFromFile(path string, logger *zap.Logger) []AlertRule {
 
 	// Convert to proper AlertRule with initialization
 	rules := make([]AlertRule, len(fileRules))
-	for i, fileRule := range fileRules {
+	i := 0
+	for _, fileRule := range fileRules {
+		// Without the config the history size is unknown, it isn't checked
+		conditions, err := validConditions(fileRule.ID, fileRule.Conditions, 0, logger)
+		if err != nil {
+			logger.Warn("Rejecting rule", zap.String("rule_id", fileRule.ID), zap.Error(err))
+			continue
+		}
+		if err := validateQoS(fileRule.QoS); err != nil {
+			logger.Warn("Rejecting rule", zap.String("rule_id", fileRule.ID), zap.Error(err))
+			continue
+		}
+		if err := validateTopics(fileRule.Topics); err != nil {
+			logger.Warn("Keeping rule that is never evaluated", zap.String("rule_id", fileRule.ID), zap.Error(err))
+		}
 		rules[i] = *NewAlertRule(
 			fileRule.ID,
 			fileRule.Topics,
@@ -239,10 +553,21 @@ func LoadRulesFromFile(path string, logger *zap.Logger) []AlertRule {
 			fileRule.Field,
 			fileRule.Category,
 			fileRule.Machine,
-			fileRule.Conditions,
+			conditions,
 			logger,
 		)
+		rules[i].Escalation = fileRule.Escalation
+		rules[i].WarmupSeconds = fileRule.Warmup
+		rules[i].Transforms = fileRule.Transforms
+		rules[i].Precision = fileRule.Precision
+		rules[i].IgnoreRetained = fileRule.IgnoreRetained
+		rules[i].Priority = fileRule.Priority
+		rules[i].setThrottlePeriod(fileRule.ThrottlePeriod)
+		rules[i].MessageTemplates = fileRule.MessageTemplates
+		rules[i].InstanceMatch = fileRule.InstanceMatch
+		rules[i].QoS = fileRule.QoS
+		i++
 	}
 
-	return rules
+	return rules[:i]
 }
@@ -0,0 +1,430 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+	"goalert-engine/realtime"
+
+	"github.com/dgraph-io/ristretto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/supabase-community/supabase-go"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// unreachableURL returns the URL of a server that is no longer listening
+func unreachableURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+// withUnreachableRealtime makes the loader's realtime client dial addr
+func withUnreachableRealtime(t *testing.T, addr string) {
+	t.Helper()
+	orig := newRealtimeClient
+	newRealtimeClient = func(opts ...realtime.Option) *realtime.Client {
+		return realtime.NewClient(append(opts, realtime.WithURL(strings.Replace(addr, "http://", "ws://", 1)))...)
+	}
+	t.Cleanup(func() { newRealtimeClient = orig })
+}
+
+func TestLoaderFallsBackToRulesCache(t *testing.T) {
+	addr := unreachableURL(t)
+	withUnreachableRealtime(t, addr)
+
+	cacheFile := filepath.Join(t.TempDir(), "rules.json")
+	cached := []AlertRule{
+		*NewAlertRule("cached", []string{"sensor/device1"}, "alerts", "", "line", "m1", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelError},
+		}, zap.NewNop()),
+	}
+	cached[0].Transforms = map[string]ValueTransform{"device1": {Scale: 0.1}}
+	if err := writeRulesCache(cacheFile, cached); err != nil {
+		t.Fatalf("Failed to write rules cache: %v", err)
+	}
+
+	cfg := config.Config{RulesCacheFile: cacheFile}
+	cfg.Supabase.URL = addr
+	cfg.Supabase.Key = "key"
+	cfg.Supabase.Table = "rules"
+
+	loader, err := NewSupabaseRuleLoader(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Expected loader to start with a rules cache, got %v", err)
+	}
+
+	rules, err := loader.GetRules()
+	if err != nil {
+		t.Fatalf("Expected cached rules, got %v", err)
+	}
+	if len(rules) != 1 || rules[0].ID != "cached" || rules[0].Conditions[0].Level != LevelError {
+		t.Fatalf("Unexpected rules from cache: %d rules", len(rules))
+	}
+	if rules[0].Transforms["device1"].Scale != 0.1 || rules[0].logger == nil {
+		t.Errorf("Expected cached rule to be fully initialized, got transforms %+v", rules[0].Transforms)
+	}
+
+	// Watching keeps retrying in the background instead of failing
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := loader.WatchChanges(ctx, func([]AlertRule) {}); err != nil {
+		t.Errorf("Expected WatchChanges to retry in the background, got %v", err)
+	}
+}
+
+func TestLoaderFailsWithoutRulesCache(t *testing.T) {
+	addr := unreachableURL(t)
+	withUnreachableRealtime(t, addr)
+
+	cfg := config.Config{}
+	cfg.Supabase.URL = addr
+	cfg.Supabase.Key = "key"
+
+	if _, err := NewSupabaseRuleLoader(cfg, zap.NewNop()); err == nil {
+		t.Error("Expected realtime connect failure without a rules cache")
+	}
+}
+
+func TestLoaderSkipsNoOpUpdates(t *testing.T) {
+	loader := &SupabaseRuleLoader{logger: zap.NewNop()}
+
+	tests := []struct {
+		change realtime.Change
+		reload bool
+	}{
+		{realtime.Change{Type: realtime.ChangeInsert}, true},
+		{realtime.Change{Type: realtime.ChangeDelete}, true},
+		{realtime.Change{Type: realtime.ChangeUpdate, Changed: []string{"conditions"}}, true},
+		{realtime.Change{Type: realtime.ChangeUpdate, Changed: []string{}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := loader.shouldReload(tt.change); got != tt.reload {
+			t.Errorf("shouldReload(%+v) = %v, want %v", tt.change, got, tt.reload)
+		}
+	}
+}
+
+func TestLoaderSkipsStaleChanges(t *testing.T) {
+	loader := &SupabaseRuleLoader{logger: zap.NewNop(), reloadMaxLag: time.Minute}
+
+	lagSamples := func() uint64 {
+		var m dto.Metric
+		if err := metrics.RealtimeChangeLag.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := lagSamples()
+	stale := realtime.Change{Type: realtime.ChangeInsert, Committed: time.Now().Add(-10 * time.Minute)}
+	if loader.shouldReload(stale) {
+		t.Error("Expected a change committed 10m ago to be skipped with a 1m max lag")
+	}
+	recent := realtime.Change{Type: realtime.ChangeInsert, Committed: time.Now().Add(-time.Second)}
+	if !loader.shouldReload(recent) {
+		t.Error("Expected a recent change to reload")
+	}
+	if !loader.shouldReload(realtime.Change{Type: realtime.ChangeInsert}) {
+		t.Error("Expected a change without commit timestamp to reload")
+	}
+	if got := lagSamples() - before; got != 2 {
+		t.Errorf("Expected the lag of the 2 timestamped changes observed, got %d", got)
+	}
+
+	// Without a max lag old changes still reload
+	loader.reloadMaxLag = 0
+	if !loader.shouldReload(stale) {
+		t.Error("Expected no staleness bound by default")
+	}
+}
+
+func TestLoaderReloadJitter(t *testing.T) {
+	loader := &SupabaseRuleLoader{logger: zap.NewNop(), reloadJitter: 50 * time.Millisecond}
+
+	// Random delays stay within the bound
+	for range 100 {
+		if delay := loader.jitterDelay(); delay < 0 || delay >= loader.reloadJitter {
+			t.Fatalf("Expected a delay in [0, %s), got %s", loader.reloadJitter, delay)
+		}
+	}
+
+	// The load waits out the picked delay
+	orig := jitterInt64N
+	defer func() { jitterInt64N = orig }()
+	jitterInt64N = func(n int64) int64 { return n - 1 }
+
+	start := time.Now()
+	if err := loader.WaitJitter(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 49*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the load delayed by up to the 50ms jitter, waited %s", elapsed)
+	}
+
+	// Cancelling the context stops the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	loader.reloadJitter = time.Hour
+	if err := loader.WaitJitter(ctx); err != context.Canceled {
+		t.Errorf("Expected the wait cancelled, got %v", err)
+	}
+
+	// Without jitter the load isn't delayed
+	loader.reloadJitter = 0
+	start = time.Now()
+	if err := loader.WaitJitter(context.Background()); err != nil || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("Expected no delay without jitter, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestLoaderReload(t *testing.T) {
+	var ruleID atomic.Value
+	ruleID.Store("before")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"id": %q, "topics": ["sensor/a"],
+			"conditions": [{"id": 1, "device": "a", "operator": "a > 1", "threshold": 1, "level": 1}]}]`, ruleID.Load())
+	}))
+	defer srv.Close()
+
+	client, err := supabase.NewClient(srv.URL, "key", &supabase.ClientOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create Supabase client: %v", err)
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 100, MaxCost: 100, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	loader := &SupabaseRuleLoader{client: client, cache: cache, ttl: time.Minute, TableName: "rules", logger: zap.NewNop()}
+
+	if _, err := loader.GetRules(); err != nil {
+		t.Fatalf("GetRules failed: %v", err)
+	}
+	cache.Wait()
+
+	// The cached rules hide the change until a forced reload
+	ruleID.Store("after")
+	if rules, _ := loader.GetRules(); len(rules) != 1 || rules[0].ID != "before" {
+		t.Fatalf("Expected the cached rules, got %+v", rules)
+	}
+	rules, err := loader.Reload(context.Background())
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if len(rules) != 1 || rules[0].ID != "after" {
+		t.Errorf("Expected the reload to pick up the new rules, got %+v", rules)
+	}
+
+	// Only one reload runs at a time
+	loader.reloadMu.Lock()
+	if _, err := loader.Reload(context.Background()); !errors.Is(err, ErrReloadInProgress) {
+		t.Errorf("Expected ErrReloadInProgress during another reload, got %v", err)
+	}
+	loader.reloadMu.Unlock()
+}
+
+// newBurstServer is a realtime server sending n changes of table at once
+// after the first channel join
+func newBurstServer(t *testing.T, table string, n int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+		for {
+			var msg map[string]any
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				return
+			}
+			if msg["event"] == realtime.JOIN_EVENT {
+				break
+			}
+		}
+		for i := 0; i < n; i++ {
+			change := map[string]any{
+				"event":   realtime.POSTGRES_CHANGE_EVENT,
+				"topic":   "realtime:public:" + table,
+				"payload": map[string]any{"data": map[string]any{"type": realtime.ChangeInsert, "table": table}},
+			}
+			if err := wsjson.Write(ctx, conn, change); err != nil {
+				return
+			}
+		}
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWatchChangesCoalescesBurst(t *testing.T) {
+	var queries atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"id": "rule", "topics": ["sensor/a"],
+			"conditions": [{"id": 1, "device": "a", "operator": "a > 1", "threshold": 1, "level": 1}]}]`)
+	}))
+	defer srv.Close()
+
+	client, err := supabase.NewClient(srv.URL, "key", &supabase.ClientOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create Supabase client: %v", err)
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 100, MaxCost: 100, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	// A bulk edit of 20 rules
+	rt := realtime.NewClient(realtime.WithURL(strings.Replace(newBurstServer(t, "rules", 20).URL, "http://", "ws://", 1)))
+	if err := rt.Connect(); err != nil {
+		t.Fatalf("Realtime connect failed: %v", err)
+	}
+	defer rt.Disconnect()
+
+	const debounce = 200 * time.Millisecond
+	loader := &SupabaseRuleLoader{
+		client:            client,
+		cache:             cache,
+		ttl:               time.Minute,
+		logger:            zap.NewNop(),
+		realtime:          rt,
+		schema:            "public",
+		TableName:         "rules",
+		RealtimeTableName: "rules",
+		reloadDebounce:    debounce,
+		realtimeConnected: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var updates atomic.Int32
+	if err := loader.WatchChanges(ctx, func([]AlertRule) { updates.Add(1) }); err != nil {
+		t.Fatalf("WatchChanges failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for updates.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// No trailing reload follows the first
+	time.Sleep(3 * debounce)
+
+	if n := updates.Load(); n != 1 {
+		t.Errorf("Expected the burst coalesced into 1 update, got %d", n)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected the burst to query the rules once, got %d", n)
+	}
+}
+
+func TestLoaderReloadReturnsSupabaseErrors(t *testing.T) {
+	var slow atomic.Bool
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			<-block
+		}
+		http.Error(w, `{"message": "database down"}`, http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	// A last-known-good rules file exists, but a forced reload reports the
+	// failure instead of applying it
+	cacheFile := filepath.Join(t.TempDir(), "rules-cache.json")
+	if err := writeRulesCache(cacheFile, []AlertRule{*NewAlertRule("cached", []string{"sensor/a"}, "alerts", "", "", "", nil, zap.NewNop())}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := supabase.NewClient(srv.URL, "key", &supabase.ClientOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create Supabase client: %v", err)
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 100, MaxCost: 100, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	loader := &SupabaseRuleLoader{client: client, cache: cache, ttl: time.Minute, TableName: "rules", cacheFile: cacheFile, logger: zap.NewNop()}
+
+	if rules, err := loader.Reload(context.Background()); err == nil {
+		t.Errorf("Expected the Supabase error, got rules %+v", rules)
+	}
+
+	// The query stops with the context of the reload
+	slow.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := loader.Reload(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the reload to stop at the deadline, got %v", err)
+	}
+}
+
+func TestLoadRulesFromFileThrottlePeriod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	data := `[
+		{"id": "throttled", "topics": ["sensor/a"], "throttle_period": 120,
+		 "conditions": [{"id": 1, "device": "a", "operator": "a > 1", "threshold": 1, "level": 1}]},
+		{"id": "default", "topics": ["sensor/b"],
+		 "conditions": [{"id": 1, "device": "b", "operator": "b > 1", "threshold": 1, "level": 1}]}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+
+	rules := LoadRulesFromFile(path, zap.NewNop())
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(rules))
+	}
+	if rules[0].CooldownPeriod != 2*time.Minute || rules[0].ThrottlePeriod != 120 {
+		t.Errorf("Expected throttle_period to set a 2m cooldown, got %s", rules[0].CooldownPeriod)
+	}
+	if want := NewAlertRule("", nil, "", "", "", "", nil, nil).CooldownPeriod; rules[1].CooldownPeriod != want {
+		t.Errorf("Expected default cooldown %s without throttle_period, got %s", want, rules[1].CooldownPeriod)
+	}
+}
+
+func TestLoadFromSupabaseThrottlePeriod(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id": "throttled", "topics": ["sensor/a"], "throttle_period": 120,
+			"conditions": [{"id": 1, "device": "a", "operator": "a > 1", "threshold": 1, "level": 1}]}]`))
+	}))
+	defer srv.Close()
+
+	client, err := supabase.NewClient(srv.URL, "key", &supabase.ClientOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create Supabase client: %v", err)
+	}
+	loader := &SupabaseRuleLoader{client: client, TableName: "rules", logger: zap.NewNop()}
+
+	rules, err := loader.loadFromSupabase(context.Background())
+	if err != nil {
+		t.Fatalf("loadFromSupabase failed: %v", err)
+	}
+	if len(rules) != 1 || rules[0].CooldownPeriod != 2*time.Minute {
+		t.Errorf("Expected throttle_period to set a 2m cooldown, got %+v", rules)
+	}
+}
@@ -0,0 +1,49 @@
+package alert
+
+import "container/list"
+
+// cacheLRU orders device cache keys by their last update so the cache can be
+// bounded by evicting the least recently updated entries.
+type cacheLRU struct {
+	order *list.List // front = most recently updated
+	elems map[cacheKey]*list.Element
+}
+
+func newCacheLRU() *cacheLRU {
+	return &cacheLRU{
+		order: list.New(),
+		elems: make(map[cacheKey]*list.Element),
+	}
+}
+
+// touch marks key as the most recently updated entry
+func (l *cacheLRU) touch(key cacheKey) {
+	if elem, ok := l.elems[key]; ok {
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.elems[key] = l.order.PushFront(key)
+}
+
+// remove forgets key
+func (l *cacheLRU) remove(key cacheKey) {
+	if elem, ok := l.elems[key]; ok {
+		l.order.Remove(elem)
+		delete(l.elems, key)
+	}
+}
+
+// victim returns the least recently updated key, preferring keys for which
+// keep returns false so that devices used by rules are evicted last.
+func (l *cacheLRU) victim(keep func(cacheKey) bool) (cacheKey, bool) {
+	for elem := l.order.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(cacheKey)
+		if !keep(key) {
+			return key, true
+		}
+	}
+	if elem := l.order.Back(); elem != nil {
+		return elem.Value.(cacheKey), true
+	}
+	return cacheKey{}, false
+}
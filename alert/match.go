@@ -0,0 +1,128 @@
+package alert
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Logical operators of ConditionTree nodes
+const (
+	MatchAND = "AND"
+	MatchOR  = "OR"
+)
+
+// ConditionTree is a structured alternative to AND/OR operator strings, e.g.
+// temperature high AND smoke detected. An inner node combines its Children
+// with Op, a leaf compares Device with Threshold, or ThresholdDevice's value,
+// using a comparison Operator. A leaf's Level, when set, is the severity of
+// the alert it triggers, the highest among the leaves that held.
+type ConditionTree struct {
+	Op       string          `json:"op,omitempty"` // AND or OR, for inner nodes
+	Children []ConditionTree `json:"children,omitempty"`
+
+	Device          string  `json:"device,omitempty"`
+	Operator        string  `json:"operator,omitempty"`
+	Threshold       float64 `json:"threshold,omitempty"`
+	ThresholdDevice string  `json:"threshold_device,omitempty"`
+	Level           int     `json:"level,omitempty"` // 0 keeps the condition's level
+}
+
+// treeResult is the outcome of evaluating a ConditionTree node
+type treeResult struct {
+	held  bool
+	known bool // Every device the outcome depends on had a value
+	level int  // Highest level of the leaves that held
+}
+
+// evaluateTree evaluates a condition tree against the device values. A leaf
+// whose devices have no value is unknown: AND nodes hold only when every child
+// held, and fail as soon as a known child failed, OR nodes hold as soon as a
+// child held, and fail only when every child failed.
+func (r *AlertRule) evaluateTree(node ConditionTree, values map[string]float64, exact map[string]int64) treeResult {
+	if len(node.Children) == 0 {
+		return r.evaluateLeaf(node, values, exact)
+	}
+
+	switch strings.ToUpper(node.Op) {
+	case MatchAND:
+		result := treeResult{held: true, known: true}
+		for _, child := range node.Children {
+			c := r.evaluateTree(child, values, exact)
+			if c.known && !c.held {
+				return treeResult{known: true}
+			}
+			result.known = result.known && c.known
+			result.level = max(result.level, c.level)
+		}
+		if !result.known {
+			return treeResult{}
+		}
+		return result
+	case MatchOR:
+		result := treeResult{known: true}
+		for _, child := range node.Children {
+			c := r.evaluateTree(child, values, exact)
+			if c.held {
+				result.held = true
+				result.level = max(result.level, c.level)
+			}
+			result.known = result.known && c.known
+		}
+		if result.held {
+			result.known = true
+		} else if !result.known {
+			return treeResult{}
+		}
+		return result
+	default:
+		r.logger.Warn("Invalid condition tree operator", zap.String("rule_id", r.ID), zap.String("op", node.Op))
+		return treeResult{}
+	}
+}
+
+// evaluateLeaf compares a leaf's device with its threshold
+func (r *AlertRule) evaluateLeaf(leaf ConditionTree, values map[string]float64, exact map[string]int64) treeResult {
+	if _, ok := values[leaf.Device]; !ok {
+		return treeResult{}
+	}
+	if _, ok := values[leaf.ThresholdDevice]; leaf.ThresholdDevice != "" && !ok {
+		return treeResult{}
+	}
+	if !isComparisonOperator(leaf.Operator) {
+		r.logger.Warn("Invalid condition tree leaf operator", zap.String("rule_id", r.ID), zap.String("operator", leaf.Operator))
+		return treeResult{}
+	}
+
+	held := r.checkSimpleCondition(AlertCondition{
+		Device:          leaf.Device,
+		Operator:        leaf.Operator,
+		Threshold:       leaf.Threshold,
+		ThresholdDevice: leaf.ThresholdDevice,
+	}, values, exact)
+	if !held {
+		return treeResult{known: true}
+	}
+	return treeResult{held: true, known: true, level: leaf.Level}
+}
+
+// maxLevel returns the highest level of the tree's leaves
+func (node ConditionTree) maxLevel() int {
+	level := node.Level
+	for _, child := range node.Children {
+		level = max(level, child.maxLevel())
+	}
+	return level
+}
+
+// triggeredLevel is the level of an alert of condition: for condition trees
+// the highest level among the leaves that held, else the condition's level
+func (r *AlertRule) triggeredLevel(condition AlertCondition, values map[string]float64, exact map[string]int64) int {
+	if condition.Match == nil {
+		return condition.Level
+	}
+	if result := r.evaluateTree(*condition.Match, values, exact); result.held && result.level > 0 {
+		return result.level
+	}
+	return condition.Level
+}
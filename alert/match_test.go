@@ -0,0 +1,103 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestConditionTree(t *testing.T) {
+	fire := &ConditionTree{Op: MatchAND, Children: []ConditionTree{
+		{Device: "temp", Operator: ">", Threshold: 80},
+		{Device: "smoke", Operator: "==", Threshold: 1},
+	}}
+	either := &ConditionTree{Op: MatchOR, Children: []ConditionTree{
+		{Device: "temp", Operator: ">", Threshold: 80},
+		{Device: "smoke", Operator: "==", Threshold: 1},
+	}}
+	nested := &ConditionTree{Op: MatchOR, Children: []ConditionTree{
+		{Op: MatchAND, Children: fire.Children},
+		{Device: "temp", Operator: ">", ThresholdDevice: "limit"},
+	}}
+
+	tests := []struct {
+		name    string
+		tree    *ConditionTree
+		payload map[string]any
+		want    conditionState
+	}{
+		{"AND all held", fire, map[string]any{"temp": 95.0, "smoke": true}, conditionTriggered},
+		{"AND one failed", fire, map[string]any{"temp": 95.0, "smoke": false}, conditionClear},
+		{"AND held with device missing", fire, map[string]any{"temp": 95.0}, conditionUnknown},
+		{"AND failed with device missing", fire, map[string]any{"temp": 20.0}, conditionClear},
+		{"OR one held", either, map[string]any{"temp": 20.0, "smoke": true}, conditionTriggered},
+		{"OR held with device missing", either, map[string]any{"temp": 95.0}, conditionTriggered},
+		{"OR failed with device missing", either, map[string]any{"temp": 20.0}, conditionUnknown},
+		{"OR none held", either, map[string]any{"temp": 20.0, "smoke": false}, conditionClear},
+		{"OR no devices", either, map[string]any{}, conditionUnknown},
+		{"nested AND held", nested, map[string]any{"temp": 95.0, "smoke": true, "limit": 100.0}, conditionTriggered},
+		{"nested threshold device", nested, map[string]any{"temp": 95.0, "smoke": false, "limit": 90.0}, conditionTriggered},
+		{"nested none held", nested, map[string]any{"temp": 95.0, "smoke": false, "limit": 100.0}, conditionClear},
+		{"invalid op", &ConditionTree{Op: "XOR", Children: fire.Children}, map[string]any{"temp": 95.0, "smoke": true}, conditionUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := AlertCondition{ID: 1, Device: "temp", Match: tt.tree, Level: LevelWarning}
+			rule := NewAlertRule("fire", []string{"sensor/temp", "sensor/smoke"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop())
+
+			if state, _ := rule.checkCondition(tt.payload, nil, condition); state != tt.want {
+				t.Errorf("Expected state %v, got %v", tt.want, state)
+			}
+		})
+	}
+}
+
+func TestConditionTreeLeafLevels(t *testing.T) {
+	var condition AlertCondition
+	data := `{"id": 1, "device": "temp", "level": 1, "match": {"op": "OR", "children": [
+		{"device": "temp", "operator": ">", "threshold": 80, "level": 2},
+		{"device": "smoke", "operator": "==", "threshold": 1, "level": 3}
+	]}}`
+	if err := json.Unmarshal([]byte(data), &condition); err != nil {
+		t.Fatalf("Failed to unmarshal condition tree: %v", err)
+	}
+
+	rules := []AlertRule{
+		*NewAlertRule("fire", []string{"sensor/temp", "sensor/smoke"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+	}
+	cfg := config.Config{}
+	clock := NewManualClock(time.Now())
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	var severities []string
+	rm.OnAlert = func(alert AlertMessage, rule *AlertRule, condition AlertCondition) {
+		severities = append(severities, alert.Severity)
+	}
+	if rm.Rules[0].getMaxLevel() != LevelCritical {
+		t.Errorf("Expected the leaves' highest level to set the rule's max level, got %d", rm.Rules[0].getMaxLevel())
+	}
+
+	// Only the temperature leaf holds
+	now := clock.Now()
+	rm.deviceCache.set(cacheKey{Topic: "sensor/temp", Address: "temp"}, cachedValue{value: 95.0, timestamp: now})
+	rm.deviceCache.set(cacheKey{Topic: "sensor/smoke", Address: "smoke"}, cachedValue{value: false, timestamp: now})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	// Both leaves hold once the cooldowns passed
+	clock.Advance(time.Hour)
+	now = clock.Now()
+	rm.deviceCache.set(cacheKey{Topic: "sensor/temp", Address: "temp"}, cachedValue{value: 95.0, timestamp: now})
+	rm.deviceCache.set(cacheKey{Topic: "sensor/smoke", Address: "smoke"}, cachedValue{value: true, timestamp: now})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(severities) != 2 || severities[0] != "ERROR" || severities[1] != "CRITICAL" {
+		t.Errorf("Expected ERROR then CRITICAL from the leaves that held, got %v", severities)
+	}
+}
@@ -0,0 +1,185 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"goalert-engine/config"
+
+	"github.com/supabase-community/supabase-go"
+	"go.uber.org/zap"
+)
+
+// defaultMetadataTTL is how long device metadata is used before reloading,
+// unless configured
+const defaultMetadataTTL = 5 * time.Minute
+
+// metadataLoadTimeout bounds a load of the metadata source
+const metadataLoadTimeout = 10 * time.Second
+
+// DeviceInfo is the human-readable metadata of a device address
+type DeviceInfo struct {
+	Address  string `json:"address"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+// MetadataSource loads the metadata of every known device
+type MetadataSource func(ctx context.Context) ([]DeviceInfo, error)
+
+// DeviceMetadata caches the device metadata of a source, reloading it once
+// it is older than its TTL. Reloads run in the background, lookups get the
+// previous metadata meanwhile, and a failed reload keeps it until the next
+// TTL. Only the first load is waited for.
+type DeviceMetadata struct {
+	source MetadataSource
+	ttl    time.Duration
+	clock  Clock // Set by the manager, the system clock when nil
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	devices  map[string]DeviceInfo // address -> metadata
+	loadedAt time.Time
+	loading  bool           // A load is running
+	reloads  sync.WaitGroup // Background reloads, for tests
+}
+
+// NewDeviceMetadata caches the metadata of source for ttl, the default of
+// 5 minutes when it isn't positive
+func NewDeviceMetadata(source MetadataSource, ttl time.Duration, logger *zap.Logger) *DeviceMetadata {
+	if ttl <= 0 {
+		ttl = defaultMetadataTTL
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &DeviceMetadata{source: source, ttl: ttl, logger: logger}
+}
+
+// Lookup returns the metadata of address. The first lookup waits for the
+// source to load, once the cache expired the source is reloaded in the
+// background.
+func (d *DeviceMetadata) Lookup(address string) (DeviceInfo, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if !d.loading && (d.devices == nil || now.Sub(d.loadedAt) >= d.ttl) {
+		d.loading = true
+		d.loadedAt = now
+		if d.devices == nil {
+			// Nothing to serve yet
+			d.mu.Unlock()
+			d.reload()
+			d.mu.Lock()
+		} else {
+			d.reloads.Add(1)
+			go func() {
+				defer d.reloads.Done()
+				d.reload()
+			}()
+		}
+	}
+	info, ok := d.devices[address]
+	return info, ok
+}
+
+// reload replaces the cached metadata with the source's. d.mu must not be
+// held, the source is called without it.
+func (d *DeviceMetadata) reload() {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataLoadTimeout)
+	defer cancel()
+	devices, err := d.source(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.loading = false
+	if err != nil {
+		d.logger.Warn("Failed to load device metadata, keeping previous", zap.Error(err))
+		if d.devices == nil {
+			d.devices = make(map[string]DeviceInfo)
+		}
+		return
+	}
+
+	d.devices = make(map[string]DeviceInfo, len(devices))
+	for _, device := range devices {
+		d.devices[device.Address] = device
+	}
+}
+
+func (d *DeviceMetadata) now() time.Time {
+	if d.clock == nil {
+		return time.Now()
+	}
+	return d.clock.Now()
+}
+
+// FileMetadataSource loads device metadata from a JSON file holding an array
+// of {"address", "name", "location"} objects
+func FileMetadataSource(path string) MetadataSource {
+	return func(ctx context.Context) ([]DeviceInfo, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read device metadata: %w", err)
+		}
+		var devices []DeviceInfo
+		if err := json.Unmarshal(data, &devices); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal device metadata %s: %w", path, err)
+		}
+		return devices, nil
+	}
+}
+
+// SupabaseMetadataSource loads device metadata from the address, name and
+// location columns of a Supabase table
+func SupabaseMetadataSource(cfg config.Config, table string) (MetadataSource, error) {
+	client, err := supabase.NewClient(cfg.Supabase.URL, cfg.Supabase.Key, &supabase.ClientOptions{
+		Schema: cfg.Supabase.Schema,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Supabase client: %w", err)
+	}
+
+	return func(ctx context.Context) ([]DeviceInfo, error) {
+		// The query takes no context, stop waiting for it once ctx is done
+		type result struct {
+			devices []DeviceInfo
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			var devices []DeviceInfo
+			_, err := client.From(table).Select("address,name,location", "", false).ExecuteTo(&devices)
+			done <- result{devices, err}
+		}()
+
+		select {
+		case r := <-done:
+			if r.err != nil {
+				return nil, fmt.Errorf("supabase query failed: %w", r.err)
+			}
+			return r.devices, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("supabase query failed: %w", ctx.Err())
+		}
+	}, nil
+}
+
+// enrich adds the device's name and location to the alert. With metadata
+// configured the name falls back to the raw address.
+func (d *DeviceMetadata) enrich(alert *AlertMessage) {
+	if d == nil {
+		return
+	}
+	info, ok := d.Lookup(alert.Device)
+	if !ok || info.Name == "" {
+		info.Name = alert.Device
+	}
+	alert.DeviceName = info.Name
+	alert.Location = info.Location
+}
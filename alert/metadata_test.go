@@ -0,0 +1,160 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+// staticMetadata is a MetadataSource counting its loads
+func staticMetadata(loads *int, devices ...DeviceInfo) MetadataSource {
+	return func(ctx context.Context) ([]DeviceInfo, error) {
+		*loads++
+		return devices, nil
+	}
+}
+
+func TestAlertEnrichedWithDeviceMetadata(t *testing.T) {
+	var loads int
+	metadata := NewDeviceMetadata(staticMetadata(&loads, DeviceInfo{Address: "D800", Name: "Oven temperature", Location: "Line 2"}), time.Minute, zap.NewNop())
+
+	rules := []AlertRule{
+		*NewAlertRule("oven", []string{"sensor/D800"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: LevelError},
+		}, zap.NewNop()),
+		*NewAlertRule("dryer", []string{"sensor/D801"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D801", Operator: "D801 > 900", Threshold: 900, Level: LevelError},
+		}, zap.NewNop()),
+	}
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}), WithDeviceMetadata(metadata))
+	defer rm.Shutdown()
+
+	alerts := map[string]string{}
+	rm.OnAlert = func(alert AlertMessage, rule *AlertRule, condition AlertCondition) {
+		alerts[alert.Device] = rule.marshalAlertMessage(alert)
+	}
+
+	now := time.Now()
+	rm.deviceCache.set(cacheKey{Topic: "sensor/D800", Address: "D800"}, cachedValue{value: 950.0, timestamp: now})
+	rm.deviceCache.set(cacheKey{Topic: "sensor/D801", Address: "D801"}, cachedValue{value: 950.0, timestamp: now})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	rm.evaluateRule(&rm.Rules[1], cfg)
+
+	if !strings.Contains(alerts["D800"], `"device_name":"Oven temperature"`) || !strings.Contains(alerts["D800"], `"location":"Line 2"`) {
+		t.Errorf("Expected enriched D800 alert, got %s", alerts["D800"])
+	}
+	if !strings.Contains(alerts["D800"], `"device":"D800"`) {
+		t.Errorf("Expected the raw address to stay in the alert, got %s", alerts["D800"])
+	}
+
+	// Devices without metadata fall back to their address
+	if !strings.Contains(alerts["D801"], `"device_name":"D801"`) || strings.Contains(alerts["D801"], `"location"`) {
+		t.Errorf("Expected D801 alert named by its address, got %s", alerts["D801"])
+	}
+	if loads != 1 {
+		t.Errorf("Expected metadata to load once within its TTL, got %d loads", loads)
+	}
+}
+
+func TestAlertWithoutDeviceMetadata(t *testing.T) {
+	rule := NewAlertRule("plain", []string{"sensor/D800"}, "alerts", "", "", "", nil, zap.NewNop())
+	alert := rule.generateAlertMessage(AlertCondition{Device: "D800", Operator: "D800 > 900", Threshold: 900}, map[string]float64{"D800": 950})
+	if message := rule.marshalAlertMessage(alert); strings.Contains(message, "device_name") || strings.Contains(message, "location") {
+		t.Errorf("Expected no enrichment without metadata, got %s", message)
+	}
+}
+
+func TestDeviceMetadataTTL(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	var loads int
+	fail := false
+	metadata := NewDeviceMetadata(func(ctx context.Context) ([]DeviceInfo, error) {
+		loads++
+		if fail {
+			return nil, errors.New("unreachable")
+		}
+		return []DeviceInfo{{Address: "D800", Name: "Oven"}}, nil
+	}, time.Minute, zap.NewNop())
+	metadata.clock = clock
+
+	if info, ok := metadata.Lookup("D800"); !ok || info.Name != "Oven" {
+		t.Fatalf("Expected D800 metadata, got %+v, %v", info, ok)
+	}
+	clock.Advance(30 * time.Second)
+	metadata.Lookup("D800")
+	if loads != 1 {
+		t.Errorf("Expected cached metadata within the TTL, got %d loads", loads)
+	}
+
+	// A failed reload keeps the previous metadata
+	fail = true
+	clock.Advance(time.Minute)
+	metadata.Lookup("D800")
+	metadata.reloads.Wait()
+	if info, ok := metadata.Lookup("D800"); !ok || info.Name != "Oven" || loads != 2 {
+		t.Errorf("Expected previous metadata after a failed reload, got %+v, %v after %d loads", info, ok, loads)
+	}
+}
+
+func TestDeviceMetadataReloadsInBackground(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	release := make(chan struct{})
+	var loads atomic.Int32
+	metadata := NewDeviceMetadata(func(ctx context.Context) ([]DeviceInfo, error) {
+		if loads.Add(1) == 1 {
+			return []DeviceInfo{{Address: "D800", Name: "Oven"}}, nil
+		}
+		<-release
+		return []DeviceInfo{{Address: "D800", Name: "Oven 2"}}, nil
+	}, time.Minute, zap.NewNop())
+	metadata.clock = clock
+
+	metadata.Lookup("D800")
+	clock.Advance(2 * time.Minute)
+
+	// The stuck reload doesn't hold up lookups, they get the stale metadata
+	for range 3 {
+		if info, ok := metadata.Lookup("D800"); !ok || info.Name != "Oven" {
+			t.Fatalf("Expected the stale metadata during the reload, got %+v, %v", info, ok)
+		}
+	}
+
+	close(release)
+	metadata.reloads.Wait()
+	if loads.Load() != 2 {
+		t.Errorf("Expected a single reload while one runs, got %d loads", loads.Load())
+	}
+	if info, _ := metadata.Lookup("D800"); info.Name != "Oven 2" {
+		t.Errorf("Expected the reloaded metadata, got %+v", info)
+	}
+}
+
+func TestFileMetadataSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	data := `[{"address": "D800", "name": "Oven temperature", "location": "Line 2"}]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("Failed to write metadata file: %v", err)
+	}
+
+	devices, err := FileMetadataSource(path)(context.Background())
+	if err != nil {
+		t.Fatalf("FileMetadataSource failed: %v", err)
+	}
+	if len(devices) != 1 || devices[0] != (DeviceInfo{Address: "D800", Name: "Oven temperature", Location: "Line 2"}) {
+		t.Errorf("Unexpected devices: %+v", devices)
+	}
+
+	if _, err := FileMetadataSource(filepath.Join(t.TempDir(), "missing.json"))(context.Background()); err == nil {
+		t.Error("Expected an error for a missing metadata file")
+	}
+}
@@ -0,0 +1,145 @@
+package alert
+
+import (
+	"context"
+	"strings"
+
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// inserterSink names the alert inserter in SinkResults
+const inserterSink = "inserter"
+
+// Notifier delivers triggered alerts to an additional sink, e.g. chat or
+// paging, after the alert inserter
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// Notification is a triggered alert as handed to a Notifier
+type Notification struct {
+	RuleID   string
+	Table    string
+	Category string
+	Machine  string
+	Level    int
+	Alert    AlertMessage
+	Message  string // Alert rendered as JSON, as stored by the inserter
+}
+
+// AlertStatus is the outcome of an alert
+type AlertStatus string
+
+const (
+	AlertDelivered  AlertStatus = "delivered"  // Every sink accepted the alert
+	AlertSuppressed AlertStatus = "suppressed" // The condition held but no alert was sent
+	AlertFailed     AlertStatus = "failed"     // At least one sink failed
+)
+
+// SinkResult is the delivery outcome for one sink
+type SinkResult struct {
+	Sink string
+	Err  error
+}
+
+// AlertResult reports what happened to an alert raised by a condition
+type AlertResult struct {
+	RuleID      string
+	ConditionID int
+	AlertKey    string
+	Status      AlertStatus
+	Reason      string // Why the alert was suppressed or failed
+	Alert       AlertMessage
+	SinkResults []SinkResult // Empty for suppressed alerts
+}
+
+// deliver hands the alert to the inserter and every notifier, returning the
+// outcome per sink
+func (m *RuleManager) deliver(ctx context.Context, cfg config.Config, rule *AlertRule, condition AlertCondition, alert AlertMessage, message string) []SinkResult {
+	results := make([]SinkResult, 0, len(m.notifiers)+1)
+
+	// Insert the alert into the database
+	insertTimer := prometheus.NewTimer(metrics.InsertDuration.WithLabelValues(getLevelString(condition.Level)))
+	err := m.insertAlert(ctx, cfg, rule, condition, message)
+	insertTimer.ObserveDuration()
+	if err != nil {
+		m.logger.Error("Failed to insert alert", zap.Error(err))
+		m.deadLetter(ctx, rule, condition, message, err)
+	}
+	results = append(results, SinkResult{Sink: inserterSink, Err: err})
+
+	notification := Notification{
+		RuleID:   rule.ID,
+		Table:    rule.Table,
+		Category: rule.Category,
+		Machine:  rule.Machine,
+		Level:    condition.Level,
+		Alert:    alert,
+		Message:  message,
+	}
+	for _, notifier := range m.notifiers {
+		err := m.notify(ctx, notifier, notification)
+		if err != nil {
+			m.logger.Error("Failed to notify alert",
+				zap.String("sink", notifier.Name()),
+				zap.Error(err),
+			)
+		}
+		results = append(results, SinkResult{Sink: notifier.Name(), Err: err})
+	}
+
+	return results
+}
+
+// notify delivers the notification in a child span of ctx
+func (m *RuleManager) notify(ctx context.Context, notifier Notifier, notification Notification) error {
+	ctx, span := m.tracer.Start(ctx, "Notify", trace.WithAttributes(
+		attribute.String("rule.id", notification.RuleID),
+		attribute.String("alert.sink", notifier.Name()),
+	))
+	defer span.End()
+
+	err := notifier.Notify(ctx, notification)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "notify failed")
+	}
+	return err
+}
+
+// newDeliveryResult completes result from the sink outcomes
+func newDeliveryResult(result AlertResult, sinks []SinkResult) AlertResult {
+	result.SinkResults = sinks
+	result.Status = AlertDelivered
+
+	var failed []string
+	for _, sink := range sinks {
+		if sink.Err != nil {
+			failed = append(failed, sink.Sink+": "+sink.Err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		result.Status = AlertFailed
+		result.Reason = strings.Join(failed, "; ")
+	}
+	return result
+}
+
+// emitResult counts suppressed alerts by reason and hands the result to
+// OnAlertResult, if set
+func (m *RuleManager) emitResult(result AlertResult) {
+	if result.Status == AlertSuppressed {
+		metrics.AlertsSuppressed.WithLabelValues(result.Reason).Inc()
+	}
+	if m.OnAlertResult != nil {
+		m.OnAlertResult(result)
+	}
+}
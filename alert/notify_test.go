@@ -0,0 +1,121 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+// fakeNotifier records notifications and fails with err when set
+type fakeNotifier struct {
+	name          string
+	err           error
+	notifications []Notification
+}
+
+func (f *fakeNotifier) Name() string { return f.name }
+
+func (f *fakeNotifier) Notify(ctx context.Context, notification Notification) error {
+	f.notifications = append(f.notifications, notification)
+	return f.err
+}
+
+func newResultTestManager(t *testing.T, cfg config.Config, notifiers ...Notifier) (*RuleManager, *[]AlertResult) {
+	t.Helper()
+
+	rules := []AlertRule{
+		*NewAlertRule("results", []string{"sensor/device1"}, "alerts", "", "line", "m1", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(&RecordingInserter{}), WithNotifiers(notifiers...))
+	t.Cleanup(rm.Shutdown)
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+	return rm, &results
+}
+
+func TestAlertResultDeliveredAndSuppressed(t *testing.T) {
+	cfg := config.Config{}
+	notifier := &fakeNotifier{name: "chat"}
+	rm, results := newResultTestManager(t, cfg, notifier)
+
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(*results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(*results))
+	}
+
+	delivered := (*results)[0]
+	if delivered.Status != AlertDelivered || delivered.RuleID != "results" || delivered.ConditionID != 1 {
+		t.Errorf("Unexpected delivered result: %+v", delivered)
+	}
+	if len(delivered.SinkResults) != 2 ||
+		delivered.SinkResults[0].Sink != inserterSink || delivered.SinkResults[0].Err != nil ||
+		delivered.SinkResults[1].Sink != "chat" || delivered.SinkResults[1].Err != nil {
+		t.Errorf("Unexpected sink results: %+v", delivered.SinkResults)
+	}
+	if delivered.Alert.Current != 15 || delivered.Alert.Severity != "WARNING" {
+		t.Errorf("Unexpected alert: %+v", delivered.Alert)
+	}
+
+	if len(notifier.notifications) != 1 || notifier.notifications[0].Machine != "m1" || notifier.notifications[0].Message == "" {
+		t.Errorf("Expected 1 notification for the alert, got %+v", notifier.notifications)
+	}
+
+	suppressed := (*results)[1]
+	if suppressed.Status != AlertSuppressed || suppressed.Reason == "" {
+		t.Errorf("Expected cooldown suppression with a reason, got %+v", suppressed)
+	}
+	if len(suppressed.SinkResults) != 0 {
+		t.Errorf("Expected no sink results for a suppressed alert, got %+v", suppressed.SinkResults)
+	}
+	if suppressed.Alert.Device != "device1" {
+		t.Errorf("Expected suppressed result to carry the alert, got %+v", suppressed.Alert)
+	}
+}
+
+func TestAlertResultSinkFailure(t *testing.T) {
+	cfg := config.Config{}
+	rm, results := newResultTestManager(t, cfg, &fakeNotifier{name: "pager", err: errors.New("unreachable")})
+
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(*results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(*results))
+	}
+	result := (*results)[0]
+	if result.Status != AlertFailed {
+		t.Errorf("Expected failed status, got %s", result.Status)
+	}
+	if result.Reason != "pager: unreachable" {
+		t.Errorf("Expected failing sink in reason, got %q", result.Reason)
+	}
+	if result.SinkResults[0].Err != nil || result.SinkResults[1].Err == nil {
+		t.Errorf("Unexpected sink results: %+v", result.SinkResults)
+	}
+}
+
+func TestAlertResultWarmup(t *testing.T) {
+	cfg := config.Config{WarmupPeriod: time.Hour}
+	rm, results := newResultTestManager(t, cfg)
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now(), firstSeen: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(*results) != 1 || (*results)[0].Status != AlertSuppressed || (*results)[0].Reason != "warming up" {
+		t.Errorf("Expected warm-up suppression, got %+v", *results)
+	}
+}
@@ -0,0 +1,111 @@
+package alert
+
+import (
+	"cmp"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Option customizes a RuleManager built by NewManager
+type Option func(*managerOptions)
+
+type managerOptions struct {
+	inserter    AlertInserter
+	notifiers   []Notifier
+	deadLetters DeadLetterSink
+	logger      *zap.Logger
+	cacheTTL    time.Duration
+	cooldowns   CooldownConfig
+	clock       Clock
+	metadata    *DeviceMetadata
+}
+
+// CooldownConfig holds the base cooldown of each alert level. A rule without
+// its own cooldown uses the base of its highest level, and repeated alerts
+// back off exponentially from the base. Zero durations keep the default.
+type CooldownConfig struct {
+	Warning  time.Duration
+	Error    time.Duration
+	Critical time.Duration
+}
+
+// DefaultCooldownConfig returns the base cooldowns used unless configured
+func DefaultCooldownConfig() CooldownConfig {
+	return CooldownConfig{
+		Warning:  5 * time.Minute,
+		Error:    1 * time.Minute,
+		Critical: 30 * time.Second,
+	}
+}
+
+// base returns the base cooldown of level
+func (c CooldownConfig) base(level int) time.Duration {
+	defaults := DefaultCooldownConfig()
+	switch level {
+	case LevelCritical:
+		return cmp.Or(c.Critical, defaults.Critical)
+	case LevelError:
+		return cmp.Or(c.Error, defaults.Error)
+	default:
+		return cmp.Or(c.Warning, defaults.Warning)
+	}
+}
+
+// WithInserter stores alerts through inserter instead of Supabase
+func WithInserter(inserter AlertInserter) Option {
+	return func(o *managerOptions) {
+		o.inserter = inserter
+	}
+}
+
+// WithNotifiers delivers alerts to notifiers after the inserter
+func WithNotifiers(notifiers ...Notifier) Option {
+	return func(o *managerOptions) {
+		o.notifiers = append(o.notifiers, notifiers...)
+	}
+}
+
+// WithDeadLetterSink keeps alerts that failed to insert in sink, e.g. to
+// replay them once the database is reachable again
+func WithDeadLetterSink(sink DeadLetterSink) Option {
+	return func(o *managerOptions) {
+		o.deadLetters = sink
+	}
+}
+
+// WithLogger logs through logger instead of discarding the manager's logs
+func WithLogger(logger *zap.Logger) Option {
+	return func(o *managerOptions) {
+		o.logger = logger
+	}
+}
+
+// WithCacheTTL keeps device values usable for ttl after they were received
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *managerOptions) {
+		o.cacheTTL = ttl
+	}
+}
+
+// WithCooldownConfig replaces the base cooldowns of the alert levels
+func WithCooldownConfig(cooldowns CooldownConfig) Option {
+	return func(o *managerOptions) {
+		o.cooldowns = cooldowns
+	}
+}
+
+// WithClock reads the time from clock instead of the system clock, e.g. a
+// ManualClock for deterministic cooldowns in replays and tests
+func WithClock(clock Clock) Option {
+	return func(o *managerOptions) {
+		o.clock = clock
+	}
+}
+
+// WithDeviceMetadata names and locates the devices of alerts with metadata
+func WithDeviceMetadata(metadata *DeviceMetadata) Option {
+	return func(o *managerOptions) {
+		o.metadata = metadata
+	}
+}
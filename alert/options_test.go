@@ -0,0 +1,87 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+	"goalert-engine/supabase"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNewManagerOptions(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:     "options",
+			Topics: []string{"sensor/device1"},
+			Table:  "alerts",
+			Conditions: []AlertCondition{
+				{ID: 1, Device: "device1", Operator: "device1 > 10", Level: LevelError},
+			},
+		},
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	inserter := &RecordingInserter{}
+	notifier := &fakeNotifier{name: "chat"}
+
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), rules, cfg,
+		WithInserter(inserter),
+		WithNotifiers(notifier),
+		WithLogger(zap.New(core)),
+		WithCacheTTL(time.Minute),
+		WithCooldownConfig(CooldownConfig{Error: 10 * time.Second}),
+	)
+	defer rm.Shutdown()
+
+	if rm.cacheTTL != time.Minute {
+		t.Errorf("Expected cache TTL 1m, got %s", rm.cacheTTL)
+	}
+	if rm.Rules[0].CooldownPeriod != 10*time.Second {
+		t.Errorf("Expected rule cooldown from the Error base, got %s", rm.Rules[0].CooldownPeriod)
+	}
+	if rm.getBaseCooldown(LevelError) != 10*time.Second || rm.getBaseCooldown(LevelCritical) != 30*time.Second {
+		t.Errorf("Expected configured Error base and default Critical base, got %s and %s",
+			rm.getBaseCooldown(LevelError), rm.getBaseCooldown(LevelCritical))
+	}
+
+	// Values older than the TTL are ignored
+	key := cacheKey{Topic: "sensor/device1", Address: "device1"}
+	rm.deviceCache.set(key, cachedValue{value: 15, timestamp: time.Now().Add(-2 * time.Minute)})
+	if snapshot := rm.createRuleSnapshot(&rm.Rules[0]); snapshot != nil {
+		t.Errorf("Expected value older than the cache TTL to be ignored, got %v", snapshot)
+	}
+
+	rm.deviceCache.set(key, cachedValue{value: 15, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(inserter.Alerts()) != 1 {
+		t.Errorf("Expected the alert in the configured inserter, got %d", len(inserter.Alerts()))
+	}
+	if len(notifier.notifications) != 1 {
+		t.Errorf("Expected the configured notifier to be notified, got %d", len(notifier.notifications))
+	}
+	if logs.FilterMessage("Triggered alert").Len() != 1 {
+		t.Error("Expected the alert to be logged through the configured logger")
+	}
+}
+
+func TestNewManagerDefaults(t *testing.T) {
+	rm := NewManager(context.Background(), nil, config.Config{})
+	defer rm.Shutdown()
+
+	if _, ok := rm.alertInserter.(*supabase.SupabaseInserter); !ok {
+		t.Errorf("Expected Supabase inserter by default, got %T", rm.alertInserter)
+	}
+	if rm.logger == nil || rm.cacheTTL != 5*time.Minute || len(rm.notifiers) != 0 {
+		t.Errorf("Unexpected defaults: logger %v, TTL %s, notifiers %d", rm.logger, rm.cacheTTL, len(rm.notifiers))
+	}
+	if rm.getBaseCooldown(LevelWarning) != DefaultCooldownConfig().Warning {
+		t.Errorf("Expected default Warning cooldown, got %s", rm.getBaseCooldown(LevelWarning))
+	}
+}
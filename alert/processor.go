@@ -1,23 +1,57 @@
 package alert
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"goalert-engine/config"
+	"goalert-engine/metrics"
 	"goalert-engine/supabase"
 	"math"
-	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// tracerName identifies the spans of the alert pipeline
+const tracerName = "goalert-engine/alert"
+
+// defaultCountResetFactor is how many base cooldowns without alerts restart
+// the cooldown backoff unless ALERT_COUNT_RESET_FACTOR is set
+const defaultCountResetFactor = 4
+
+// Cooldown policies, selected with ALERT_COOLDOWN_POLICY
+const (
+	CooldownImmediateFirst = "immediate_first" // The first alert of a condition fires right away
+	CooldownThrottleAll    = "throttle_all"    // Even the first alert waits until the condition held for a cooldown
+)
+
 type cachedValue struct {
 	value     any
 	timestamp time.Time
+	firstSeen time.Time // When the cache first saw this topic/address
+	address   string    // Payload address, set when it is trusted over the topic's
+	arrival   uint64    // Arrival order of the message carrying value
+	retained  bool      // Value came from a retained message, ignored by rules with IgnoreRetained
+}
+
+// newerThan reports whether v was received after other, by arrival order when
+// both carry one
+func (v cachedValue) newerThan(other cachedValue) bool {
+	if v.arrival != 0 && other.arrival != 0 {
+		return v.arrival > other.arrival
+	}
+	return v.timestamp.After(other.timestamp)
 }
 
 type cacheKey struct {
@@ -26,84 +60,231 @@ type cacheKey struct {
 }
 
 type AlertInserter interface {
-	InsertAlert(cfg config.Config, table, device, message, category, machine string) error
+	InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error
+}
+
+// ContextAlertInserter is implemented by inserters that accept a context,
+// which carries the evaluation's trace. It is preferred over InsertAlert.
+type ContextAlertInserter interface {
+	InsertAlertContext(ctx context.Context, cfg config.Config, table, device, message, category, machine, level string) error
 }
 
 type RuleManager struct {
 	Rules          []AlertRule
 	Cfg            config.Config
-	ruleChans      map[string]chan struct{}
-	deviceCache    map[cacheKey]cachedValue // Store values with timestamps
-	mu             sync.RWMutex             // Use RWMutex for better read performance
-	cacheTTL       time.Duration            // How long values stay in cache
-	lastAlertTimes map[string]time.Time     // ruleID -> last alert time
-	alertCounts    map[string]int           // ruleID -> alert count
-	alertMu        sync.Mutex               // Mutex for alert tracking
+	ruleChans      map[string]chan ruleSignal
+	topicIndex     *topicIndex          // Topic -> IDs of the rules referencing it
+	routeMu        sync.RWMutex         // Guards ruleChans, topicIndex and the worker context
+	deviceCache    *deviceCache         // Store values with timestamps, sharded by key
+	cacheLRU       *cacheLRU            // Update order of deviceCache entries
+	lruMu          sync.Mutex           // Guards cacheLRU
+	maxCacheSize   int                  // Maximum deviceCache entries (0 = unbounded)
+	history        *sampleHistory       // Recent values per cached device, for trend and anomaly conditions
+	instances      *instanceIndex       // Cached devices matching each wildcard rule topic
+	mu             sync.RWMutex         // Guards Rules
+	cacheTTL       time.Duration        // How long values stay in cache
+	cooldowns      CooldownConfig       // Base cooldown per alert level
+	countReset     int                  // Base cooldowns without alerts after which the backoff restarts (0 = default)
+	cooldownPolicy string               // CooldownImmediateFirst or CooldownThrottleAll, empty is immediate
+	warmup         time.Duration        // Suppress alerts until every device of a rule was seen this long ago
+	graceUntil     time.Time            // No alert is delivered before this time, StartupGracePeriod after NewManager
+	graceHeld      atomic.Int64         // Alerts suppressed during the startup grace period
+	graceDone      atomic.Bool          // The grace period ended and its summary was logged
+	location       *time.Location       // Timezone alert timestamps are rendered in
+	clock          Clock                // Source of the current time
+	lastAlertTimes map[string]time.Time // ruleID -> last alert time
+	alertCounts    map[string]int       // ruleID -> alert count
+	pendingSince   map[string]time.Time // alertKey -> first trigger of an alert held back by CooldownThrottleAll
+	alertsTotal    uint64               // Alerts that passed cooldown since start
+	ruleFires      map[string]*fireLog  // Rule ID -> alerts delivered, kept across reloads while the rule is loaded
+	arrivals       atomic.Uint64        // Last arrival order handed out by NextArrival
+	lastMessage    atomic.Int64         // UnixNano time the last MQTT message was handled, for the watchdog
+	consecutive    map[string]int       // alertKey -> alerts since the condition last cleared
+	acked          map[string]bool      // alertKey -> acknowledged until the condition clears
+	snoozed        map[string]time.Time // alertKey -> muted until this time
+	snoozedRules   map[string]time.Time // ruleID -> every alert muted until this time, kept across rule reloads
+	alertMu        sync.Mutex           // Mutex for alert tracking
 	alertInserter  AlertInserter
-	ctx            context.Context
-	cancel         context.CancelFunc
-	logger         *zap.Logger
+	notifiers      []Notifier      // Sinks alerts are delivered to after the inserter
+	deadLetters    DeadLetterSink  // Keeps alerts that failed to insert, nil drops them
+	replayMu       sync.Mutex      // Serializes dead-letter replays
+	metadata       *DeviceMetadata // Names and locations of devices, nil disables enrichment
+
+	// OnAlert, when set, is called for every alert that passes cooldown,
+	// alongside the inserter. Set it before messages are handled.
+	OnAlert func(alert AlertMessage, rule *AlertRule, condition AlertCondition)
+
+	// OnAlertResult, when set, is called with the outcome of every alert the
+	// evaluation path raises or suppresses. Like OnAlert it runs on the rule's
+	// worker without locks held.
+	OnAlertResult func(result AlertResult)
+
+	rulesUpdated func(rules []AlertRule) // Set through OnRulesUpdated, guarded by mu
+
+	deduper      *messageDeduper // nil unless MQTT dedup is enabled
+	alertDeduper *messageDeduper // nil unless alert dedup is enabled
+	tracer       trace.Tracer    // From the global OTel provider, a no-op unless one is installed
+	decoder      PayloadDecoder  // Extracts address and value from payloads
+
+	pendingEvals int        // Signals sent to rule workers and not evaluated yet
+	evalMu       sync.Mutex // Guards pendingEvals
+	evalIdle     sync.Cond  // Broadcast when pendingEvals drops to zero
+
+	janitorStop chan struct{} // Closed on Stop to stop the cache janitor
+	janitorOnce sync.Once
+
+	started      bool               // Start ran, guarded by routeMu
+	ctx          context.Context    // Lifetime of the manager, done on Stop
+	cancel       context.CancelFunc // Stops the manager
+	workerCtx    context.Context    // Lifetime of the current rule workers, guarded by routeMu
+	workerCancel context.CancelFunc // Stops the current rule workers, guarded by routeMu
+	logger       *zap.Logger
 }
 
+// NewRuleManager is NewManager storing alerts through inserter, or Supabase
+// when it is nil
 func NewRuleManager(ctx context.Context, rules []AlertRule, cfg config.Config, inserter AlertInserter, logger *zap.Logger) *RuleManager {
+	return NewManager(ctx, rules, cfg, WithInserter(inserter), WithLogger(logger))
+}
+
+// NewManager creates a RuleManager for rules. It doesn't evaluate anything
+// until Start runs its workers, and stops for good when ctx is done or on
+// Stop. Without options alerts are stored in Supabase and logs are discarded.
+func NewManager(ctx context.Context, rules []AlertRule, cfg config.Config, opts ...Option) *RuleManager {
+	options := managerOptions{cacheTTL: 5 * time.Minute}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	inserter := options.inserter
+	if inserter == nil {
+		inserter = &supabase.SupabaseInserter{}
+	}
+	logger := options.logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
+	workerCtx, workerCancel := context.WithCancel(ctx)
 	rm := &RuleManager{
 		Rules:          rules,
 		Cfg:            cfg,
-		cacheTTL:       5 * time.Minute,
-		deviceCache:    make(map[cacheKey]cachedValue),
+		cacheTTL:       options.cacheTTL,
+		cooldowns:      options.cooldowns,
+		countReset:     cfg.AlertCountResetFactor,
+		cooldownPolicy: cfg.AlertCooldownPolicy,
+		warmup:         cfg.WarmupPeriod,
+		location:       loadLocation(cfg.Timezone, logger),
+		clock:          cmp.Or[Clock](options.clock, systemClock{}),
+		deviceCache:    newDeviceCache(),
+		cacheLRU:       newCacheLRU(),
+		maxCacheSize:   cfg.DeviceCacheMaxEntries,
+		history:        newSampleHistory(cfg.HistorySize),
+		topicIndex:     newTopicIndex(rules),
+		instances:      newInstanceIndex(),
 		lastAlertTimes: make(map[string]time.Time),
 		alertCounts:    make(map[string]int),
-		ruleChans:      make(map[string]chan struct{}),
+		pendingSince:   make(map[string]time.Time),
+		ruleFires:      make(map[string]*fireLog),
+		consecutive:    make(map[string]int),
+		acked:          make(map[string]bool),
+		snoozed:        make(map[string]time.Time),
+		snoozedRules:   make(map[string]time.Time),
+		ruleChans:      make(map[string]chan ruleSignal),
+		tracer:         otel.Tracer(tracerName),
+		janitorStop:    make(chan struct{}),
 		alertInserter:  inserter,
+		notifiers:      options.notifiers,
+		deadLetters:    options.deadLetters,
+		metadata:       options.metadata,
 		ctx:            ctx,
 		cancel:         cancel,
+		workerCtx:      workerCtx,
+		workerCancel:   workerCancel,
 		logger:         logger,
 	}
 
-	// Initialize default cooldown periods if not set
-	for i := range rm.Rules {
-		rule := &rm.Rules[i]
+	if cfg.MQTTDedupWindow > 0 {
+		rm.deduper = newMessageDeduper(cfg.MQTTDedupWindow, cfg.MQTTDedupSeqField)
+	}
+	if cfg.AlertDedupWindow > 0 {
+		rm.alertDeduper = newMessageDeduper(cfg.AlertDedupWindow, "")
+	}
 
-		if rule.logger == nil {
-			rule.logger = logger
-		}
+	if cfg.StartupGracePeriod > 0 {
+		rm.graceUntil = rm.clock.Now().Add(cfg.StartupGracePeriod)
+	}
 
-		if rm.Rules[i].CooldownPeriod == 0 {
-			switch rm.Rules[i].getMaxLevel() {
-			case LevelCritical:
-				rm.Rules[i].CooldownPeriod = 30 * time.Second
-			case LevelError:
-				rm.Rules[i].CooldownPeriod = 1 * time.Minute
-			default:
-				rm.Rules[i].CooldownPeriod = 5 * time.Minute
-			}
-		}
+	rm.evalIdle.L = &rm.evalMu
+
+	if rm.metadata != nil && rm.metadata.clock == nil {
+		rm.metadata.clock = rm.clock
+	}
+
+	if cfg.DryRun {
+		rm.applyDryRun()
+	}
 
-		ch := make(chan struct{}, 1) // buffered channel to avoid blocking
-		rm.ruleChans[rule.ID] = ch
-		go rm.ruleWorker(rule, ch, cfg)
+	if decoder, err := NewDecoder(cfg); err != nil {
+		logger.Error("Invalid payload format, decoding JSON without validation", zap.Error(err))
+		rm.decoder = &JSONDecoder{}
+	} else {
+		rm.decoder = decoder
+	}
+
+	for i := range rm.Rules {
+		rm.initRule(&rm.Rules[i], cfg)
 	}
 
 	return rm
 }
 
+// HandleMQTTMessage caches the device value of an MQTT message and signals the
+// rules watching it. It is safe for concurrent use, so the MQTT client may
+// deliver messages in parallel when MQTT_ORDER_MATTERS is false.
 func (m *RuleManager) HandleMQTTMessage(topic string, payload []byte, cfg config.Config) {
-	var msg map[string]any
-	if err := json.Unmarshal(payload, &msg); err != nil {
-		m.logger.Error("Failed to parse payload", zap.Error(err))
-		return
+	m.HandleMQTTMessageWithMeta(topic, payload, MessageMeta{}, cfg)
+}
+
+// HandleMQTTMessageWithMeta is HandleMQTTMessage with broker delivery details,
+// used to drop duplicate deliveries when dedup is enabled and to apply the
+// updates of a device in arrival order: a message handled after one that
+// arrived later is dropped instead of overwriting the newer value.
+func (m *RuleManager) HandleMQTTMessageWithMeta(topic string, payload []byte, meta MessageMeta, cfg config.Config) {
+	if meta.Arrival == 0 {
+		meta.Arrival = m.NextArrival()
 	}
+	m.lastMessage.Store(m.now().UnixNano())
 
-	address, ok := msg["address"].(string)
-	if !ok {
-		m.logger.Warn("Payload missing 'address' field", zap.Any("payload", msg))
+	// Root span of the message's trace, evaluations and inserts are children
+	ctx, span := m.tracer.Start(context.Background(), "HandleMQTTMessage",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", topic),
+			attribute.Int("messaging.message.id", int(meta.ID)),
+		),
+	)
+	defer span.End()
+
+	if multi, ok := m.decoder.(MultiPayloadDecoder); ok {
+		m.handleDecodedValues(ctx, topic, payload, meta, multi)
 		return
 	}
 
-	value, ok := msg["value"]
-	if !ok {
-		m.logger.Warn("Payload missing 'value' field", zap.Any("payload", msg))
+	var (
+		address string
+		value   any
+		msg     map[string]any
+		err     error
+	)
+	if decoder, ok := m.decoder.(MessageDecoder); ok {
+		address, value, msg, err = decoder.DecodeMessage(payload, topic)
+	} else {
+		address, value, err = m.decoder.Decode(payload, topic)
+	}
+	if err != nil {
+		m.rejectPayload(ctx, topic, payload, err)
 		return
 	}
 
@@ -111,162 +292,876 @@ func (m *RuleManager) HandleMQTTMessage(topic string, payload []byte, cfg config
 		return
 	}
 
-	if extractAddressFromTopic(topic) != address {
-		m.logger.Warn("Topic-address mismatch",
+	// Values are cached under the topic's address. Gateways publishing a
+	// canonical address in the payload are only accepted when it is trusted,
+	// their values then reach rules under the payload address.
+	topicAddress := extractAddressFromTopic(topic)
+	if topicAddress == "" {
+		m.logger.Warn("Topic has no device address, message dropped", zap.String("topic", topic))
+		return
+	}
+	if topicAddress != address {
+		if !cfg.TrustPayloadAddress {
+			m.logger.Warn("Topic-address mismatch",
+				zap.String("topic", topic),
+				zap.String("address", address),
+				zap.ByteString("payload", payload),
+			)
+			return
+		}
+		m.logger.Debug("Using payload address over topic address",
 			zap.String("topic", topic),
 			zap.String("address", address),
-			zap.Any("payload", msg),
 		)
+	}
+
+	if m.isDuplicateMessage(topic, payload, msg, meta) {
 		return
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock() // Use defer to ensure unlock
+	if m.storeValue(cacheKey{Topic: topic, Address: topicAddress}, address, value, meta) {
+		m.signalRules(ctx, topic)
+	}
+}
 
-	if m.deviceCache == nil {
-		m.deviceCache = make(map[cacheKey]cachedValue)
+// handleDecodedValues caches every value of a payload carrying several
+// devices, each under its own topic, and wakes the rules of those topics
+func (m *RuleManager) handleDecodedValues(ctx context.Context, topic string, payload []byte, meta MessageMeta, decoder MultiPayloadDecoder) {
+	values, err := decoder.DecodeAll(payload, topic)
+	if err != nil {
+		m.rejectPayload(ctx, topic, payload, err)
+		return
+	}
+	if len(values) == 0 || m.isDuplicateMessage(topic, payload, nil, meta) {
+		return
 	}
 
-	key := cacheKey{
-		Topic:   topic,
-		Address: address,
+	for _, v := range values {
+		if !isValidValue(v.Value) {
+			continue
+		}
+		valueTopic := cmp.Or(v.Topic, topic)
+		topicAddress := extractAddressFromTopic(valueTopic)
+		if topicAddress == "" {
+			m.logger.Warn("Topic has no device address, value dropped", zap.String("topic", valueTopic))
+			continue
+		}
+		if m.storeValue(cacheKey{Topic: valueTopic, Address: topicAddress}, v.Address, v.Value, meta) {
+			m.signalRules(ctx, valueTopic)
+		}
 	}
+}
 
-	now := time.Now()
+// rejectPayload records a payload the decoder failed on
+func (m *RuleManager) rejectPayload(ctx context.Context, topic string, payload []byte, err error) {
+	span := trace.SpanFromContext(ctx)
 
-	// Always update the cache with new values
-	m.deviceCache[key] = cachedValue{
-		value:     value,
-		timestamp: now,
+	var validationErr *PayloadValidationError
+	if errors.As(err, &validationErr) {
+		metrics.InvalidPayloads.WithLabelValues(validationErr.Reason()).Inc()
+		span.SetStatus(codes.Error, err.Error())
+		m.logger.Warn("Rejected payload",
+			zap.String("topic", topic),
+			zap.String("reason", err.Error()),
+			zap.ByteString("payload", payload),
+		)
+		return
 	}
 
-	// Signal relevant rules
-	for i := range m.Rules {
-		rule := &m.Rules[i]
-		if slices.Contains(rule.Topics, topic) {
-			ch, ok := m.ruleChans[rule.ID]
-			if !ok {
-				m.logger.Warn("Rule channel missing", zap.String("ruleID", rule.ID))
-				continue
-			}
-			select {
-			case ch <- struct{}{}:
-			default:
-			}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, "invalid payload")
+	m.logger.Warn("Failed to decode payload",
+		zap.String("topic", topic),
+		zap.ByteString("payload", payload),
+		zap.Error(err),
+	)
+}
+
+// isDuplicateMessage reports whether the message is a redelivery within the
+// dedup window. msg is the decoded payload, nil unless the decoder is a
+// MessageDecoder.
+func (m *RuleManager) isDuplicateMessage(topic string, payload []byte, msg map[string]any, meta MessageMeta) bool {
+	if m.deduper == nil || !m.deduper.isDuplicate(m.deduper.dedupKey(topic, payload, msg, meta), m.now()) {
+		return false
+	}
+	m.logger.Debug("Dropping duplicate message",
+		zap.String("topic", topic),
+		zap.Uint16("messageID", meta.ID),
+	)
+	return true
+}
+
+// storeValue caches the value of the device at address under key and records
+// it in the device's history. An address differing from the key's is kept so
+// rules refer to the device by it. It reports false, leaving the cache as is,
+// when a message that arrived later already updated the device.
+func (m *RuleManager) storeValue(key cacheKey, address string, value any, meta MessageMeta) bool {
+	arrival := meta.Arrival
+	cachedAddress := ""
+	if address != key.Address {
+		cachedAddress = address
+	}
+
+	now := m.now()
+
+	// Update the cache with the new value, keeping the first sighting. Only
+	// the key's shard is locked, so other devices and snapshot readers aren't
+	// blocked, while updates of the same device apply in arrival order.
+	stale := false
+	m.deviceCache.update(key, func(prev cachedValue, exists bool) cachedValue {
+		if exists && prev.arrival > arrival {
+			stale = true
+			return prev
 		}
+		firstSeen := now
+		if exists && !prev.firstSeen.IsZero() {
+			firstSeen = prev.firstSeen
+		}
+		return cachedValue{
+			value:     value,
+			timestamp: now,
+			firstSeen: firstSeen,
+			address:   cachedAddress,
+			arrival:   arrival,
+			retained:  meta.Retained,
+		}
+	})
+	if stale {
+		m.logger.Debug("Dropping out-of-order message",
+			zap.String("topic", key.Topic),
+			zap.Uint64("arrival", arrival),
+		)
+		return false
+	}
+	m.trackInstance(key)
+	m.evictOverflow(key)
+
+	if sample, ok := sampleValue(value); ok {
+		m.history.record(key, sample)
+	}
+	return true
+}
+
+// NextArrival returns the arrival order of a message just received. Stamping
+// messages on receipt, before they are queued to concurrent handlers, keeps
+// each device's cached value the one of its latest message even when the
+// handlers finish out of order.
+func (m *RuleManager) NextArrival() uint64 {
+	return m.arrivals.Add(1)
+}
+
+// signalRules wakes the workers of the rules subscribed to topic. The span in
+// ctx becomes the parent of the evaluations it triggers.
+func (m *RuleManager) signalRules(ctx context.Context, topic string) {
+	parent := trace.SpanContextFromContext(ctx)
+
+	m.routeMu.RLock()
+	defer m.routeMu.RUnlock()
+
+	// Before Start values are only cached
+	if !m.started {
+		return
+	}
+
+	m.signalTiers(m.topicIndex.lookup(topic), parent)
+}
+
+// signalTiers signals the rules ruleIDs, sorted by descending priority. Rules
+// of equal priority form a tier, each tier evaluates once the tier of higher
+// priority did. Callers hold routeMu.
+func (m *RuleManager) signalTiers(ruleIDs []string, parent trace.SpanContext) {
+	var after <-chan struct{}
+	for start := 0; start < len(ruleIDs); {
+		priority := m.topicIndex.priority(ruleIDs[start])
+		end := start + 1
+		for end < len(ruleIDs) && m.topicIndex.priority(ruleIDs[end]) == priority {
+			end++
+		}
+
+		var done *evalBarrier
+		if end < len(ruleIDs) {
+			done = newEvalBarrier(end - start)
+		}
+		for _, ruleID := range ruleIDs[start:end] {
+			m.signalRule(ruleID, ruleSignal{parent: parent, after: after, done: done})
+		}
+		if done != nil {
+			after = done.done
+		}
+		start = end
+	}
+}
+
+// signalRule hands signal to the rule's worker. Callers hold routeMu.
+func (m *RuleManager) signalRule(ruleID string, signal ruleSignal) {
+	ch, ok := m.ruleChans[ruleID]
+	if !ok {
+		m.logger.Warn("Rule channel missing", zap.String("ruleID", ruleID))
+		signal.done.release()
+		return
+	}
+	m.evalMu.Lock()
+	m.pendingEvals++
+	m.evalMu.Unlock()
+
+	select {
+	case ch <- signal:
+	default:
+		// An evaluation is already pending and will see the new value. Rules
+		// of lower priority don't wait for it.
+		signal.done.release()
+		m.evaluationDone()
+	}
+}
+
+// evictOverflow records the update of key and drops the least recently
+// updated entries until the cache is within maxCacheSize. Devices referenced
+// by rules are only evicted once no other entries are left.
+func (m *RuleManager) evictOverflow(key cacheKey) {
+	if m.maxCacheSize <= 0 {
+		return
+	}
+
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
+	m.cacheLRU.touch(key)
+
+	m.routeMu.RLock()
+	defer m.routeMu.RUnlock()
+
+	for m.deviceCache.len() > m.maxCacheSize {
+		key, ok := m.cacheLRU.victim(func(k cacheKey) bool {
+			return m.topicIndex.referenced(k.Topic)
+		})
+		if !ok {
+			return
+		}
+
+		m.deviceCache.delete(key)
+		m.cacheLRU.remove(key)
+		m.instances.remove(key)
+		m.history.remove(key)
+		metrics.DeviceCacheEvictions.Inc()
 	}
 }
 
 func (m *RuleManager) evaluateRule(rule *AlertRule, cfg config.Config) {
-	// Create a snapshot of the required device values
-	snapshot := m.createRuleSnapshot(rule)
+	m.evaluateRuleContext(context.Background(), rule, cfg)
+}
+
+// evaluateRuleContext is evaluateRule traced as a child of the span in ctx
+func (m *RuleManager) evaluateRuleContext(ctx context.Context, rule *AlertRule, cfg config.Config) {
+	ctx, span := m.tracer.Start(ctx, "evaluateRule", trace.WithAttributes(attribute.String("rule.id", rule.ID)))
+	defer span.End()
+
+	// Create a snapshot of the required device values, one per instance of
+	// wildcard topics
+	snapshots := m.createRuleSnapshots(rule)
 
-	if snapshot != nil {
-		// m.logger.Info("DEBUG: Evaluating rule",
-		// 	zap.Any("id", rule.ID),
-		// 	zap.Any("payload", snapshot),
-		// )
+	if len(snapshots) > 0 {
+		inGrace := m.inStartupGrace()
 
 		for _, condition := range rule.Conditions {
-			triggered, message := rule.Evaluate(snapshot, condition)
-
-			if triggered {
-				alertKey := fmt.Sprintf("%s_%d", rule.ID, condition.Level)
-
-				if m.shouldTriggerAlert(alertKey, condition.Level) {
-					m.logger.Info(
-						"Triggered alert",
-						zap.Any("Level", getLevelString(condition.Level)),
-						zap.String("message", message),
-					)
-					// Insert the alert into the database
-					err := supabase.InsertAlert(cfg, rule.Table, condition.Device, message, rule.Category, rule.Machine)
-					if err != nil {
-						m.logger.Error("Failed to insert alert", zap.Error(err))
-					}
-
-					m.markAlertTriggered(alertKey, condition.Level)
-				}
-			}
+			snapshot := rule.selectSnapshot(snapshots, m.history, condition)
+			m.evaluateRuleCondition(ctx, rule, condition, snapshot, m.isWarmingUp(rule, snapshot), inGrace, cfg)
+		}
+	}
+}
+
+// evaluateRuleCondition evaluates one condition of the rule against the snapshot
+// and raises its alert
+func (m *RuleManager) evaluateRuleCondition(ctx context.Context, rule *AlertRule, condition AlertCondition, snapshot ruleSnapshot, warmingUp, inGrace bool, cfg config.Config) {
+	// Observed on every return path, or before the alert is delivered, which
+	// isn't part of the evaluation; the insert is timed separately
+	timer := prometheus.NewTimer(metrics.EvaluationDuration.WithLabelValues(getLevelString(condition.Level)))
+	observeEvaluation := sync.OnceFunc(func() { timer.ObserveDuration() })
+	defer observeEvaluation()
+
+	alertKey := conditionAlertKey(rule.ID, condition)
+	condition = rule.throttled(condition)
+
+	// Conditions are still evaluated during warm-up, but never alert
+	if warmingUp {
+		state, values := rule.checkCondition(snapshot.values, m.history.of(snapshot.keys), condition)
+		if state == conditionClear {
+			m.clearAlertState(alertKey)
+		} else if state == conditionTriggered {
+			m.logger.Info("Rule warming up, alert suppressed",
+				zap.String("ruleID", rule.ID),
+				zap.String("device", condition.Device),
+			)
+			m.emitResult(AlertResult{
+				RuleID:      rule.ID,
+				ConditionID: condition.ID,
+				AlertKey:    alertKey,
+				Status:      AlertSuppressed,
+				Reason:      "warming up",
+				Alert:       snapshot.alertMessage(rule, condition, values),
+			})
+		}
+		return
+	}
+
+	// Likewise during the startup grace period. No cooldown is started, so
+	// conditions still holding afterwards alert right away. Every rule may
+	// breach at once while the caches fill, the alerts aren't enriched.
+	if inGrace {
+		state, values := rule.checkCondition(snapshot.values, m.history.of(snapshot.keys), condition)
+		if state == conditionClear {
+			m.clearAlertState(alertKey)
+		} else if state == conditionTriggered {
+			m.graceHeld.Add(1)
+			m.emitResult(AlertResult{
+				RuleID:      rule.ID,
+				ConditionID: condition.ID,
+				AlertKey:    alertKey,
+				Status:      AlertSuppressed,
+				Reason:      "startup grace",
+				Alert:       snapshot.suppressedAlertMessage(rule, condition, values),
+			})
+		}
+		return
+	}
+
+	state, alert := rule.evaluateAlert(snapshot.values, m.history.of(snapshot.keys), condition)
+	alert.Instance = snapshot.instance
+
+	if state == conditionClear {
+		m.clearAlertState(alertKey)
+		return
+	}
+	if state == conditionCooldown {
+		m.emitResult(AlertResult{
+			RuleID:      rule.ID,
+			ConditionID: condition.ID,
+			AlertKey:    alertKey,
+			Status:      AlertSuppressed,
+			Reason:      "rule cooldown",
+			Alert:       alert,
+		})
+		return
+	}
+	if state != conditionTriggered {
+		return
+	}
+	if m.isAcked(alertKey) {
+		m.emitResult(AlertResult{
+			RuleID:      rule.ID,
+			ConditionID: condition.ID,
+			AlertKey:    alertKey,
+			Status:      AlertSuppressed,
+			Reason:      "acknowledged",
+			Alert:       alert,
+		})
+		return
+	}
+
+	// Escalate conditions that keep firing without clearing
+	condition.Level = m.effectiveLevel(rule, alertKey, alert.level)
+	alert.Severity = getLevelString(condition.Level)
+	alert.TriggeredAt = m.now().In(m.location).Format(time.RFC3339)
+
+	if m.isSnoozed(alertKey) || m.isRuleSnoozed(rule.ID) {
+		m.emitResult(AlertResult{
+			RuleID:      rule.ID,
+			ConditionID: condition.ID,
+			AlertKey:    alertKey,
+			Status:      AlertSuppressed,
+			Reason:      "snoozed",
+			Alert:       alert,
+		})
+		return
+	}
+	if !m.shouldTriggerAlert(alertKey, condition) {
+		m.emitResult(AlertResult{
+			RuleID:      rule.ID,
+			ConditionID: condition.ID,
+			AlertKey:    alertKey,
+			Status:      AlertSuppressed,
+			Reason:      "cooldown",
+			Alert:       alert,
+		})
+		return
+	}
+
+	// Overlapping rules may raise the same alert, only the first is delivered
+	if m.alertDeduper != nil && m.alertDeduper.isDuplicate(alertDedupKey(alert), m.now()) {
+		m.logger.Info("Duplicate alert collapsed",
+			zap.String("ruleID", rule.ID),
+			zap.String("device", condition.Device),
+		)
+		m.markAlertTriggered(alertKey, condition)
+		m.recordConsecutiveAlert(alertKey)
+		m.emitResult(AlertResult{
+			RuleID:      rule.ID,
+			ConditionID: condition.ID,
+			AlertKey:    alertKey,
+			Status:      AlertSuppressed,
+			Reason:      "duplicate alert",
+			Alert:       alert,
+		})
+		return
+	}
+
+	message := rule.marshalAlertMessage(alert)
+	m.logger.Info(
+		"Triggered alert",
+		zap.Any("Level", getLevelString(condition.Level)),
+		zap.String("message", message),
+	)
+
+	observeEvaluation()
+
+	// Hand the alert to external consumers, no locks are held here
+	if m.OnAlert != nil {
+		m.OnAlert(alert, rule, condition)
+	}
+
+	sinks := m.deliver(ctx, cfg, rule, condition, alert, message)
+
+	m.markAlertTriggered(alertKey, condition)
+	m.recordRuleFire(rule.ID)
+	m.recordConsecutiveAlert(alertKey)
+
+	m.emitResult(newDeliveryResult(AlertResult{
+		RuleID:      rule.ID,
+		ConditionID: condition.ID,
+		AlertKey:    alertKey,
+		Alert:       alert,
+	}, sinks))
+}
+
+// insertAlert stores the alert through the inserter in a child span of ctx
+func (m *RuleManager) insertAlert(ctx context.Context, cfg config.Config, rule *AlertRule, condition AlertCondition, message string) error {
+	ctx, span := m.tracer.Start(ctx, "InsertAlertContext", trace.WithAttributes(
+		attribute.String("rule.id", rule.ID),
+		attribute.String("alert.table", rule.Table),
+		attribute.String("alert.device", condition.Device),
+		attribute.String("alert.severity", getLevelString(condition.Level)),
+	))
+	defer span.End()
+
+	var err error
+	if inserter, ok := m.alertInserter.(ContextAlertInserter); ok {
+		err = inserter.InsertAlertContext(ctx, cfg, rule.Table, condition.Device, message, rule.Category, rule.Machine, getLevelString(condition.Level))
+	} else {
+		err = m.alertInserter.InsertAlert(cfg, rule.Table, condition.Device, message, rule.Category, rule.Machine, getLevelString(condition.Level))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "insert failed")
+	}
+	return err
+}
+
+// inStartupGrace reports whether the startup grace period is still running.
+// The first call after it ended logs how many alerts it suppressed.
+func (m *RuleManager) inStartupGrace() bool {
+	if m.graceUntil.IsZero() {
+		return false
+	}
+	if m.now().Before(m.graceUntil) {
+		return true
+	}
+	if m.graceDone.CompareAndSwap(false, true) {
+		m.logger.Info("Startup grace period over, delivering alerts",
+			zap.Int64("suppressed", m.graceHeld.Load()),
+		)
+	}
+	return false
+}
+
+// isWarmingUp reports whether any device value of the snapshot, the one the
+// rule is evaluated against, was first seen less than the warm-up period ago.
+// Instances of wildcard topics warm up on their own, a new instance doesn't
+// hold back the alerts of the others.
+func (m *RuleManager) isWarmingUp(rule *AlertRule, snapshot ruleSnapshot) bool {
+	warmup := m.warmup
+	if rule.WarmupSeconds > 0 {
+		warmup = time.Duration(rule.WarmupSeconds) * time.Second
+	}
+	if warmup <= 0 {
+		return false
+	}
+
+	now := m.now()
+	for _, key := range snapshot.keys {
+		cached, exists := m.deviceCache.get(key)
+		if !exists {
+			continue
+		}
+
+		firstSeen := cached.firstSeen
+		if firstSeen.IsZero() {
+			firstSeen = cached.timestamp
+		}
+		if now.Sub(firstSeen) < warmup {
+			return true
 		}
 	}
+	return false
 }
 
+// createRuleSnapshot resolves every device referenced by the rule's topics.
+// A device published on several topics (e.g. primary/backup) uses the
+// freshest valid value across them. Each device's value is the latest one
+// applied in arrival order, so an evaluation never sees a device go back to
+// an older value.
 func (m *RuleManager) createRuleSnapshot(rule *AlertRule) map[string]any {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	snapshot, ok := m.resolveRuleSnapshot(rule)
+	if !ok {
+		return nil
+	}
+	return snapshot.values
+}
+
+// resolveRuleSnapshot is createRuleSnapshot keeping the cache keys of the
+// values, reporting false unless every device resolved
+func (m *RuleManager) resolveRuleSnapshot(rule *AlertRule) (ruleSnapshot, bool) {
+	if len(rule.Topics) == 0 {
+		return ruleSnapshot{}, false
+	}
 
-	snapshot := make(map[string]any)
-	now := time.Now()
+	resolved := make(map[string]resolvedValue)
+	addresses := make(map[string]struct{})
+	now := m.now()
 
 	for _, ruleTopic := range rule.Topics {
 		devAddr := extractAddressFromTopic(ruleTopic)
-		key := cacheKey{Topic: ruleTopic, Address: devAddr}
-		cached, exists := m.deviceCache[key]
+		addresses[devAddr] = struct{}{}
+		m.resolveValue(rule, cacheKey{Topic: ruleTopic, Address: devAddr}, devAddr, now, resolved)
+	}
 
-		// Skip if value doesn't exist or is expired
-		if !exists || now.Sub(cached.timestamp) > m.cacheTTL || !isValidValue(cached.value) {
-			return nil
-		}
+	// Only return snapshot if we have all required values
+	if len(resolved) != len(addresses) {
+		return ruleSnapshot{}, false
+	}
+	return newRuleSnapshot("", resolved), true
+}
+
+// resolvedValue is the value a device of a rule resolved to and the key it is
+// cached under
+type resolvedValue struct {
+	cachedValue
+	key cacheKey
+}
 
-		snapshot[devAddr] = cached.value
+// resolveValue adds the cached value of key to resolved under devAddr, unless
+// it is missing or unusable or resolved holds a newer value of the device
+func (m *RuleManager) resolveValue(rule *AlertRule, key cacheKey, devAddr string, now time.Time, resolved map[string]resolvedValue) {
+	cached, exists := m.deviceCache.get(key)
+
+	// Skip if value doesn't exist or is expired, another topic may still provide the device
+	if !exists || now.Sub(cached.timestamp) > m.cacheTTL || !isValidValue(cached.value) {
+		return
 	}
 
-	// fmt.Printf("Snapshot for rule %d:\n", rule.ID)
-	// for k, v := range snapshot {
-	// 	fmt.Printf(" - %s: %v (age: %v)\n", k, v, now.Sub(m.deviceCache[k].timestamp))
-	// }
+	// Retained values may be stale, some rules only act on live ones
+	if cached.retained && rule.IgnoreRetained {
+		return
+	}
 
-	// Only return snapshot if we have all required values
-	if len(snapshot) == len(rule.Topics) {
-		return snapshot
+	// Prefer the most recently updated topic for the device
+	if last, ok := resolved[devAddr]; ok && !cached.newerThan(last.cachedValue) {
+		return
 	}
-	return nil
+
+	resolved[devAddr] = resolvedValue{cachedValue: cached, key: key}
+}
+
+// newRuleSnapshot returns the snapshot of the resolved devices, under the
+// address their values were published with
+func newRuleSnapshot(instance string, resolved map[string]resolvedValue) ruleSnapshot {
+	snapshot := ruleSnapshot{
+		instance: instance,
+		values:   make(map[string]any, len(resolved)),
+		keys:     make(map[string]cacheKey, len(resolved)),
+	}
+	for devAddr, r := range resolved {
+		if r.address != "" {
+			devAddr = r.address
+		}
+		snapshot.values[devAddr] = r.value
+		snapshot.keys[devAddr] = r.key
+	}
+	return snapshot
 }
 
 func (m *RuleManager) UpdateRules(newRules []AlertRule, cfg config.Config) {
 	m.logger.Info("Updating rules", zap.Int("newRuleCount", len(newRules)))
 
+	// Run the hook outside the locks, it may call back into the manager
+	if hook := m.replaceRules(newRules, cfg); hook != nil {
+		hook(newRules)
+	}
+}
+
+// replaceRules swaps in the new rules and, once started, restarts the
+// workers, returning the rules-updated hook
+func (m *RuleManager) replaceRules(newRules []AlertRule, cfg config.Config) func(rules []AlertRule) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-
-	// First cancel old context to shut down old workers
-	m.cancel()
-
-	// Create a new context for new workers
-	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.routeMu.Lock()
+	defer m.routeMu.Unlock()
 
 	// Reset everything from scratch
 	m.Rules = newRules
-	m.ruleChans = make(map[string]chan struct{})
-
-	// Start a worker for each new rule
+	m.topicIndex = newTopicIndex(newRules)
+	var cached []cacheKey
+	if len(m.topicIndex.wildcards) > 0 {
+		cached = m.deviceCache.keys()
+	}
+	m.instances.reset(m.topicIndex, cached)
+	m.pruneRuleFires(newRules)
 	for i := range newRules {
-		ch := make(chan struct{}, 1)
-		m.ruleChans[newRules[i].ID] = ch
-		go m.ruleWorker(&newRules[i], ch, cfg)
+		m.initRule(&newRules[i], cfg)
 	}
 
-	m.logger.Info("Rules updated and workers restarted", zap.Int("count", len(newRules)))
+	if m.started {
+		// Shut down the old workers before starting the new ones
+		m.workerCancel()
+		m.workerCtx, m.workerCancel = context.WithCancel(m.ctx)
+		m.startWorkers(cfg)
+		m.logger.Info("Rules updated and workers restarted", zap.Int("count", len(newRules)))
+
+		// Evaluate the new rules against the values already cached, instead of
+		// waiting for their devices' next messages
+		ruleIDs := make([]string, 0, len(m.ruleChans))
+		for i := range newRules {
+			if _, ok := m.ruleChans[newRules[i].ID]; ok {
+				ruleIDs = append(ruleIDs, newRules[i].ID)
+			}
+		}
+		m.topicIndex.sortByPriority(ruleIDs)
+		m.signalTiers(ruleIDs, trace.SpanContext{})
+	} else {
+		m.logger.Info("Rules updated", zap.Int("count", len(newRules)))
+	}
+	return m.rulesUpdated
 }
 
-func (m *RuleManager) ruleWorker(rule *AlertRule, triggerChan chan struct{}, cfg config.Config) {
+// OnRulesUpdated registers fn to be called with the new rules after every
+// UpdateRules, e.g. to adjust MQTT subscriptions
+func (m *RuleManager) OnRulesUpdated(fn func(rules []AlertRule)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rulesUpdated = fn
+}
+
+// Subscriptions returns the minimal set of MQTT filters covering the current
+// rules' topics and any extra filters, with the QoS to subscribe to each at
+func (m *RuleManager) Subscriptions(extra ...string) map[string]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return SubscriptionQoS(m.Rules, SubscriptionTopics(m.Rules, extra...), m.Cfg.MQTTQoS)
+}
+
+// ruleWorker evaluates the rule whenever it is signalled. Evaluations snapshot
+// the cache when they run, so they see the latest value of every device rather
+// than the one that signalled. With a coalesce window, signals arriving within
+// it after the first are folded into a single evaluation.
+func (m *RuleManager) ruleWorker(ctx context.Context, rule *AlertRule, triggerChan chan ruleSignal, cfg config.Config) {
 	for {
 		select {
-		case <-m.ctx.Done():
+		case <-ctx.Done():
 			m.logger.Info("Shutting down rule worker", zap.String("ruleID", rule.ID))
+			// A signal sent before the shutdown is never evaluated
+			select {
+			case signal := <-triggerChan:
+				signal.done.release()
+				m.evaluationDone()
+			default:
+			}
 			return
-		case <-triggerChan:
-			m.evaluateRule(rule, cfg)
+		case signal := <-triggerChan:
+			signals := []ruleSignal{signal}
+			if cfg.EvaluationCoalesceWindow > 0 {
+				signals = m.coalesceSignals(ctx, triggerChan, signals, cfg.EvaluationCoalesceWindow)
+			}
+			// Let the higher-priority rules sharing the signals go first
+			if waitSignals(ctx, signals) {
+				// Trace the evaluation as part of the message that triggered it
+				parent := signals[len(signals)-1].parent
+				m.evaluateRuleContext(trace.ContextWithSpanContext(context.Background(), parent), rule, cfg)
+			}
+			for _, signal := range signals {
+				signal.done.release()
+			}
+			m.evaluationDone()
 		}
 	}
 }
 
-func (m *RuleManager) Shutdown() {
+// coalesceSignals folds the signals arriving within window into the pending
+// evaluation, returning them after signals
+func (m *RuleManager) coalesceSignals(ctx context.Context, triggerChan chan ruleSignal, signals []ruleSignal, window time.Duration) []ruleSignal {
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+
+	for {
+		select {
+		case next := <-triggerChan:
+			m.evaluationDone()
+			signals = append(signals, next)
+		case <-timer.C:
+			return signals
+		case <-ctx.Done():
+			return signals
+		}
+	}
+}
+
+// ruleSignal asks a rule worker to evaluate its rule
+type ruleSignal struct {
+	parent trace.SpanContext // Span of the message that triggered the evaluation
+	after  <-chan struct{}   // Closed once the higher-priority rules signalled by the same message evaluated, nil if none
+	done   *evalBarrier      // Released once evaluated, nil unless lower-priority rules wait for it
+}
+
+// waitSignals blocks until the higher-priority rules of every signal
+// evaluated, returning false when ctx is done first
+func waitSignals(ctx context.Context, signals []ruleSignal) bool {
+	for _, signal := range signals {
+		if signal.after == nil {
+			continue
+		}
+		select {
+		case <-signal.after:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// evalBarrier closes done once each evaluation of a priority tier released it
+type evalBarrier struct {
+	remaining atomic.Int32
+	done      chan struct{}
+}
+
+func newEvalBarrier(n int) *evalBarrier {
+	b := &evalBarrier{done: make(chan struct{})}
+	b.remaining.Store(int32(n))
+	return b
+}
+
+// release records that one evaluation of the tier completed, a nil barrier
+// is ignored
+func (b *evalBarrier) release() {
+	if b != nil && b.remaining.Add(-1) == 0 {
+		close(b.done)
+	}
+}
+
+// evaluationDone records that a signalled evaluation finished
+func (m *RuleManager) evaluationDone() {
+	m.evalMu.Lock()
+	defer m.evalMu.Unlock()
+	m.pendingEvals--
+	if m.pendingEvals == 0 {
+		m.evalIdle.Broadcast()
+	}
+}
+
+// waitIdle blocks until every signalled evaluation finished
+func (m *RuleManager) waitIdle() {
+	m.evalMu.Lock()
+	defer m.evalMu.Unlock()
+	for m.pendingEvals > 0 {
+		m.evalIdle.Wait()
+	}
+}
+
+// Start runs a worker per rule and the cache janitor until ctx is done or
+// Stop. A manager starts only once, and not after Stop.
+func (m *RuleManager) Start(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.routeMu.Lock()
+	defer m.routeMu.Unlock()
+
+	if m.started {
+		return errors.New("rule manager already started")
+	}
+	if m.ctx.Err() != nil {
+		return errors.New("rule manager stopped")
+	}
+	m.started = true
+
+	m.startWorkers(m.Cfg)
+	if m.Cfg.DeviceCacheSweepInterval > 0 {
+		go m.cacheJanitor(m.Cfg.DeviceCacheSweepInterval)
+	}
+
+	// Stop with ctx, unless the manager stops first
+	stop := context.AfterFunc(ctx, m.Stop)
+	context.AfterFunc(m.ctx, func() { stop() })
+
+	m.logger.Info("RuleManager started", zap.Int("rules", len(m.Rules)))
+	return nil
+}
+
+// startWorkers starts a worker per rule under workerCtx. Callers hold mu and
+// routeMu.
+func (m *RuleManager) startWorkers(cfg config.Config) {
+	m.ruleChans = make(map[string]chan ruleSignal, len(m.Rules))
+	for i := range m.Rules {
+		rule := &m.Rules[i]
+		if len(rule.Topics) == 0 {
+			continue // Never signalled, see initRule
+		}
+		ch := make(chan ruleSignal, 1) // buffered channel to avoid blocking
+		m.ruleChans[rule.ID] = ch
+		go m.ruleWorker(m.workerCtx, rule, ch, cfg)
+	}
+}
+
+// initRule prepares a rule for evaluation by the manager. Rules without
+// topics are kept, but no message can signal them, so they get no worker;
+// the loaders warn about them.
+func (m *RuleManager) initRule(rule *AlertRule, cfg config.Config) {
+	if rule.logger == nil {
+		rule.logger = m.logger
+	}
+	rule.clock = m.clock
+	rule.metadata = m.metadata
+	if rule.Precision == nil {
+		precision := cfg.AlertPrecision
+		rule.Precision = &precision
+	}
+	if rule.CooldownPeriod == 0 {
+		rule.CooldownPeriod = m.cooldowns.base(rule.getMaxLevel())
+	}
+}
+
+// Stop stops the workers, the cache janitor and the watchdog for good
+func (m *RuleManager) Stop() {
+	m.routeMu.Lock()
 	m.cancel()
+	m.routeMu.Unlock()
+	m.janitorOnce.Do(func() { close(m.janitorStop) })
 	m.logger.Info("RuleManager shutdown initiated")
 }
 
+// Shutdown is Stop
+func (m *RuleManager) Shutdown() {
+	m.Stop()
+}
+
+// loadLocation resolves the configured timezone, falling back to UTC
+func loadLocation(name string, logger *zap.Logger) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Error("Invalid timezone, using UTC", zap.String("timezone", name), zap.Error(err))
+		return time.UTC
+	}
+	return location
+}
+
 func getLevelString(level int) string {
 	switch level {
 	case LevelCritical:
@@ -285,59 +1180,89 @@ func (r *AlertRule) getMaxLevel() int {
 		if cond.Level > max {
 			max = cond.Level
 		}
+		if cond.Match != nil && cond.Match.maxLevel() > max {
+			max = cond.Match.maxLevel()
+		}
 	}
 	return max
 }
 
-func (m *RuleManager) shouldTriggerAlert(alertKey string, level int) bool {
+// conditionAlertKey identifies the alert state (cooldown, escalation and
+// acknowledgement) of a condition as <ruleID>_<conditionID>_<level>, so the
+// conditions of a rule alert independently
+func conditionAlertKey(ruleID string, condition AlertCondition) string {
+	return fmt.Sprintf("%s_%d_%d", ruleID, condition.ID, condition.Level)
+}
+
+func (m *RuleManager) shouldTriggerAlert(alertKey string, condition AlertCondition) bool {
 	m.alertMu.Lock()
 	defer m.alertMu.Unlock()
 
-	now := time.Now()
+	now := m.now()
 	lastTime, exists := m.lastAlertTimes[alertKey]
 
 	// Cooldown Checks
 	//log.Printf("Cooldown check for alertKey=%s, level=%d, count=%d\n", alertKey, level, m.alertCounts[alertKey])
 
-	// First time alert or cooldown expired
-	if !exists || now.Sub(lastTime) > m.getCooldown(alertKey, level) {
-		return true
+	if !exists {
+		if m.cooldownPolicy != CooldownThrottleAll {
+			return true
+		}
+		// The first alert waits until the condition held for a cooldown
+		first, pending := m.pendingSince[alertKey]
+		if !pending {
+			m.pendingSince[alertKey] = now
+			return false
+		}
+		return now.Sub(first) > m.getCooldown(alertKey, condition)
 	}
 
-	return false
+	// Cooldown expired
+	return now.Sub(lastTime) > m.getCooldown(alertKey, condition)
 }
 
-func (m *RuleManager) markAlertTriggered(alertKey string, level int) {
+func (m *RuleManager) markAlertTriggered(alertKey string, condition AlertCondition) {
 	m.alertMu.Lock()
 	defer m.alertMu.Unlock()
 
-	now := time.Now()
+	now := m.now()
 	lastTime, exists := m.lastAlertTimes[alertKey]
 
-	// Reset count if last alert was long ago (e.g., > 4x base cooldown)
-	baseCooldown := m.getBaseCooldown(level)
-	if exists && now.Sub(lastTime) > (baseCooldown*4) {
+	// Reset count if last alert was long ago (> 4x base cooldown by default)
+	baseCooldown := m.conditionBaseCooldown(condition)
+	resetAfter := baseCooldown * time.Duration(cmp.Or(m.countReset, defaultCountResetFactor))
+	if exists && now.Sub(lastTime) > resetAfter {
 		m.alertCounts[alertKey] = 0
 	}
 
 	m.alertCounts[alertKey]++
 	m.lastAlertTimes[alertKey] = now
+	delete(m.pendingSince, alertKey)
+	m.alertsTotal++
 }
 
 func (m *RuleManager) getBaseCooldown(level int) time.Duration {
-	switch level {
-	case LevelCritical:
-		return 30 * time.Second
-	case LevelError:
-		return 1 * time.Minute
-	default:
-		return 5 * time.Minute
+	return m.cooldowns.base(level)
+}
+
+// conditionBaseCooldown is the condition's own cooldown when it sets one,
+// the one of its level otherwise
+func (m *RuleManager) conditionBaseCooldown(condition AlertCondition) time.Duration {
+	if condition.CooldownSeconds > 0 {
+		return time.Duration(condition.CooldownSeconds) * time.Second
 	}
+	return m.getBaseCooldown(condition.Level)
 }
 
-func (m *RuleManager) getCooldown(alertKey string, level int) time.Duration {
+// getCooldown is the time the alert of condition is held back after firing.
+// A condition's own cooldown is fixed, the level-derived one backs off
+// exponentially while the alert keeps firing.
+func (m *RuleManager) getCooldown(alertKey string, condition AlertCondition) time.Duration {
+	if condition.CooldownSeconds > 0 {
+		return time.Duration(condition.CooldownSeconds) * time.Second
+	}
 	count := m.alertCounts[alertKey]
-	baseCooldown := m.getBaseCooldown(level)
+	baseCooldown := m.getBaseCooldown(condition.Level)
 
 	// Exponential backoff with max cooldown of 8x base
 	maxCooldown := baseCooldown * 8
@@ -359,8 +1284,13 @@ func isValidValue(value any) bool {
 		return v != 0
 	case int64:
 		return v != 0
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f != 0
 	case string:
 		return v != "" && v != "0" && v != "0.0"
+	case bool:
+		return true // false is a reading, not a missing value
 	case nil:
 		return false
 	default:
@@ -368,10 +1298,9 @@ func isValidValue(value any) bool {
 	}
 }
 
+// extractAddressFromTopic returns the device address a topic ends with, its
+// last level, e.g. "D800" for "plant//D800". Empty topics and topics ending
+// with "/" have no address and give "", which is never a valid address.
 func extractAddressFromTopic(topic string) string {
-	parts := strings.Split(topic, "/")
-	if len(parts) == 0 {
-		return ""
-	}
-	return parts[len(parts)-1]
+	return topic[strings.LastIndex(topic, "/")+1:]
 }
@@ -2,17 +2,37 @@ package alert
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"goalert-engine/config"
+	"goalert-engine/metrics"
 	"goalert-engine/supabase"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
+// startManager starts rm's workers
+func startManager(t *testing.T, rm *RuleManager) {
+	t.Helper()
+	if err := rm.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start rule manager: %v", err)
+	}
+}
+
 func TestNewRuleManager(t *testing.T) {
 	rules := []AlertRule{
 		{
@@ -34,6 +54,8 @@ func TestNewRuleManager(t *testing.T) {
 	cfg := config.Config{}
 	inserter := &supabase.SupabaseInserter{}
 	rm := NewRuleManager(context.Background(), rules, cfg, inserter, nil)
+	defer rm.Shutdown()
+	startManager(t, rm)
 
 	if len(rm.ruleChans) != 1 {
 		t.Errorf("Expected 1 rule channel, got %d", len(rm.ruleChans))
@@ -44,6 +66,205 @@ func TestNewRuleManager(t *testing.T) {
 	}
 }
 
+func TestManagerRunsNoWorkersUntilStart(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("deferred", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+
+	// Constructed managers cache values without evaluating them
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 15}`), cfg)
+	rm.UpdateRules([]AlertRule{*NewAlertRule("deferred", []string{"sensor/device1"}, "alerts", "", "", "", rules[0].Conditions, zap.NewNop())}, cfg)
+	rm.waitIdle()
+	if len(rm.ruleChans) != 0 || len(recorder.Alerts()) != 0 {
+		t.Fatalf("Expected no workers before Start, got %d channels and %d alerts", len(rm.ruleChans), len(recorder.Alerts()))
+	}
+
+	startManager(t, rm)
+	if len(rm.ruleChans) != 1 {
+		t.Errorf("Expected a worker per rule after Start, got %d", len(rm.ruleChans))
+	}
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 16}`), cfg)
+	rm.waitIdle()
+	if len(recorder.Alerts()) != 1 {
+		t.Errorf("Expected 1 alert once started, got %d", len(recorder.Alerts()))
+	}
+
+	if err := rm.Start(context.Background()); err == nil {
+		t.Error("Expected a second Start to fail")
+	}
+}
+
+func TestReloadEvaluatesCachedValues(t *testing.T) {
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	rules := []AlertRule{
+		*NewAlertRule("pump", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 100", Threshold: 100, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+	startManager(t, rm)
+
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 15}`), cfg)
+	rm.waitIdle()
+	if len(recorder.Alerts()) != 0 {
+		t.Fatalf("Expected no alert before the reload, got %d", len(recorder.Alerts()))
+	}
+
+	// The reloaded rule holds on the cached value without another message
+	rm.UpdateRules([]AlertRule{
+		*NewAlertRule("pump", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+		}, zap.NewNop()),
+	}, cfg)
+	rm.waitIdle()
+	if alerts := recorder.Alerts(); len(alerts) != 1 || alerts[0].Device != "device1" {
+		t.Errorf("Expected the reloaded rule to alert on the cached value, got %+v", alerts)
+	}
+}
+
+func TestInsertedAlertLevel(t *testing.T) {
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	levels := map[string]int{"WARNING": LevelWarning, "ERROR": LevelError, "CRITICAL": LevelCritical}
+	var rules []AlertRule
+	for name, level := range levels {
+		// Each rule inserts into a table named after its level
+		rules = append(rules, *NewAlertRule(name, []string{"sensor/device1"}, name, "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: level},
+		}, zap.NewNop()))
+	}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15.0, timestamp: time.Now()})
+	for i := range rm.Rules {
+		rm.evaluateRule(&rm.Rules[i], cfg)
+	}
+
+	// Each alert carries the level of the condition that raised it
+	alerts := recorder.Alerts()
+	if len(alerts) != len(levels) {
+		t.Fatalf("Expected %d alerts, got %d", len(levels), len(alerts))
+	}
+	for _, alert := range alerts {
+		if alert.Level != alert.Table {
+			t.Errorf("Expected level %s in table %s, got %s", alert.Table, alert.Table, alert.Level)
+		}
+	}
+}
+
+func TestManagerStopsWithStartContext(t *testing.T) {
+	rm := NewRuleManager(context.Background(), nil, config.Config{}, NoopInserter{}, zap.NewNop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startManager(t, rm)
+	rm.Stop()
+	if err := rm.Start(ctx); err == nil {
+		t.Error("Expected Start to fail after Stop")
+	}
+	cancel()
+
+	rm = NewRuleManager(context.Background(), nil, config.Config{}, NoopInserter{}, zap.NewNop())
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := rm.Start(ctx); err != nil {
+		t.Fatalf("Failed to start rule manager: %v", err)
+	}
+	cancel()
+
+	select {
+	case <-rm.ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected the manager to stop with the Start context")
+	}
+}
+
+func TestZeroTopicRuleGetsNoWorker(t *testing.T) {
+	condition := AlertCondition{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning}
+	rules := []AlertRule{
+		*NewAlertRule("topicless", nil, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+		*NewAlertRule("routed", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+	}
+
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+
+	// Every worker is started with its rule's channel
+	startManager(t, rm)
+	rm.routeMu.RLock()
+	_, routed := rm.ruleChans["routed"]
+	workers := len(rm.ruleChans)
+	rm.routeMu.RUnlock()
+	if !routed || workers != 1 {
+		t.Errorf("Expected only the worker of the routed rule, got %d workers", workers)
+	}
+
+	// Evaluating it directly finds no snapshot instead of an empty one
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15.0, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	if len(recorder.Alerts()) != 0 {
+		t.Errorf("Expected no alert from the zero-topic rule, got %d", len(recorder.Alerts()))
+	}
+
+	// Reloads skip it as well
+	rm.UpdateRules([]AlertRule{*NewAlertRule("topicless", []string{}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop())}, cfg)
+	if len(rm.ruleChans) != 0 {
+		t.Errorf("Expected no workers after reloading a zero-topic rule, got %d", len(rm.ruleChans))
+	}
+}
+
+func TestExtractAddressFromTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"sensor/D800", "D800"},
+		{"D800", "D800"},
+		{"sensor/D800/", ""},
+		{"sensor/D800//", ""},
+		{"sensor//D800", "D800"},
+		{"/D800", "D800"},
+		{"", ""},
+		{"/", ""},
+		{"///", ""},
+	}
+
+	for _, tt := range tests {
+		if got := extractAddressFromTopic(tt.topic); got != tt.want {
+			t.Errorf("extractAddressFromTopic(%q) = %q, want %q", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestHandleMQTTMessageWithoutTopicAddress(t *testing.T) {
+	cfg := config.Config{TrustPayloadAddress: true}
+	rm := NewRuleManager(context.Background(), nil, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	for _, topic := range []string{"", "/", "sensor/device1/", "sensor//"} {
+		rm.HandleMQTTMessage(topic, []byte(`{"address": "device1", "value": 15}`), cfg)
+	}
+	if n := rm.deviceCache.len(); n != 0 {
+		t.Errorf("Expected messages without a topic address to be dropped, %d values cached", n)
+	}
+
+	// Empty levels before the address are fine
+	rm.HandleMQTTMessage("sensor//device1", []byte(`{"address": "device1", "value": 15}`), cfg)
+	if _, ok := rm.deviceCache.get(cacheKey{Topic: "sensor//device1", Address: "device1"}); !ok {
+		t.Error("Expected the value cached under its device address")
+	}
+}
+
 func TestHandleMQTTMessage(t *testing.T) {
 	logger := zap.NewNop()
 	rules := []AlertRule{
@@ -75,9 +296,7 @@ func TestHandleMQTTMessage(t *testing.T) {
 		Address: "device1",
 	}
 
-	rm.mu.RLock()
-	cached, exists := rm.deviceCache[key]
-	rm.mu.RUnlock()
+	cached, exists := rm.deviceCache.get(key)
 
 	if !exists {
 		t.Error("Expected device1 to be in cache")
@@ -94,17 +313,17 @@ func TestHandleMQTTMessage(t *testing.T) {
 
 // MockSupabaseClient implements the AlertInserter interface for testing
 type MockSupabaseClient struct {
-	InsertAlertFunc func(cfg config.Config, table, device, message, category, machine string) error
+	InsertAlertFunc func(cfg config.Config, table, device, message, category, machine, level string) error
 }
 
-func (m *MockSupabaseClient) InsertAlert(cfg config.Config, table, device, message, category, machine string) error {
-	return m.InsertAlertFunc(cfg, table, device, message, category, machine)
+func (m *MockSupabaseClient) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	return m.InsertAlertFunc(cfg, table, device, message, category, machine, level)
 }
 
 func TestEvaluateRule(t *testing.T) {
 	// Create our mock client
 	mockClient := &MockSupabaseClient{
-		InsertAlertFunc: func(cfg config.Config, table, device, message, category, machine string) error {
+		InsertAlertFunc: func(cfg config.Config, table, device, message, category, machine, level string) error {
 			if table != "alerts" {
 				t.Errorf("Expected table 'alerts', got '%s'", table)
 			}
@@ -128,10 +347,12 @@ func TestEvaluateRule(t *testing.T) {
 
 	rules := []AlertRule{
 		{
-			ID:     "3d5df7e3-5ac8-42b8-ae79-4a54cf7e90e7",
-			logger: logger,
-			Topics: []string{"sensor/device1", "sensor/device2"},
-			Table:  "alerts",
+			ID:       "3d5df7e3-5ac8-42b8-ae79-4a54cf7e90e7",
+			logger:   logger,
+			Topics:   []string{"sensor/device1", "sensor/device2"},
+			Table:    "alerts",
+			Category: "sensors",
+			Machine:  "press-1",
 			Conditions: []AlertCondition{
 				{
 					Device:    "device1",
@@ -163,10 +384,8 @@ func TestEvaluateRule(t *testing.T) {
 	rm := NewRuleManager(context.Background(), rules, cfg, mockClient, logger)
 
 	// Prime the cache with values
-	rm.mu.Lock()
-	rm.deviceCache[key] = cachedValue{value: 15, timestamp: time.Now()}
-	rm.deviceCache[key2] = cachedValue{value: 3, timestamp: time.Now()}
-	rm.mu.Unlock()
+	rm.deviceCache.set(key, cachedValue{value: 8, timestamp: time.Now()})
+	rm.deviceCache.set(key2, cachedValue{value: 3, timestamp: time.Now()})
 
 	rm.evaluateRule(&rules[0], cfg)
 }
@@ -179,21 +398,21 @@ func TestShouldTriggerAlert(t *testing.T) {
 	alertKey := "1_2" // rule 1, level 2 (Error)
 
 	// First alert should always trigger
-	if !rm.shouldTriggerAlert(alertKey, LevelError) {
+	if !rm.shouldTriggerAlert(alertKey, AlertCondition{Level: LevelError}) {
 		t.Error("First alert should trigger")
 	}
 
 	// Mark alert as triggered
-	rm.markAlertTriggered(alertKey, LevelError)
+	rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
 
 	// Immediate retry should not trigger (in cooldown)
-	if rm.shouldTriggerAlert(alertKey, LevelError) {
+	if rm.shouldTriggerAlert(alertKey, AlertCondition{Level: LevelError}) {
 		t.Error("Alert should be in cooldown")
 	}
 
 	// Wait longer than base cooldown (1 minute for Error)
 	rm.lastAlertTimes[alertKey] = time.Now().Add(-2 * time.Minute)
-	if !rm.shouldTriggerAlert(alertKey, LevelError) {
+	if !rm.shouldTriggerAlert(alertKey, AlertCondition{Level: LevelError}) {
 		t.Error("Alert should trigger after cooldown")
 	}
 }
@@ -209,11 +428,11 @@ func TestAlertCooldownBackoff(t *testing.T) {
 
 	// Trigger alerts multiple times
 	for i := 0; i < 3; i++ {
-		rm.markAlertTriggered(alertKey, LevelError)
+		rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
 	}
 
 	// Cooldown should increase with each alert
-	cooldown := rm.getCooldown(alertKey, LevelError)
+	cooldown := rm.getCooldown(alertKey, AlertCondition{Level: LevelError})
 	expected := time.Duration(float64(baseCooldown) * math.Pow(2, 3))
 	if cooldown != expected {
 		t.Errorf("Expected cooldown %v, got %v", expected, cooldown)
@@ -221,15 +440,236 @@ func TestAlertCooldownBackoff(t *testing.T) {
 
 	// Test max cooldown
 	for i := 0; i < 10; i++ {
-		rm.markAlertTriggered(alertKey, LevelError)
+		rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
 	}
-	cooldown = rm.getCooldown(alertKey, LevelError)
+	cooldown = rm.getCooldown(alertKey, AlertCondition{Level: LevelError})
 	maxCooldown := baseCooldown * 8
 	if cooldown > maxCooldown {
 		t.Errorf("Cooldown %v exceeds max %v", cooldown, maxCooldown)
 	}
 }
 
+func TestAlertCountReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		factor int
+		after  time.Duration // Multiple of the Error base cooldown, 1m
+	}{
+		{"default factor", 0, 4 * time.Minute},
+		{"configured factor", 2, 2 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewManualClock(time.Now())
+			rm := NewManager(context.Background(), nil, config.Config{AlertCountResetFactor: tt.factor}, WithInserter(NoopInserter{}), WithClock(clock))
+			defer rm.Shutdown()
+
+			alertKey := "1_2"
+			rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
+			rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
+
+			// At the boundary the count is kept
+			clock.Advance(tt.after)
+			rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
+			if rm.alertCounts[alertKey] != 3 {
+				t.Errorf("Expected count 3 at the reset boundary, got %d", rm.alertCounts[alertKey])
+			}
+
+			// Past it the backoff restarts
+			clock.Advance(tt.after + time.Nanosecond)
+			rm.markAlertTriggered(alertKey, AlertCondition{Level: LevelError})
+			if rm.alertCounts[alertKey] != 1 {
+				t.Errorf("Expected count reset past the boundary, got %d", rm.alertCounts[alertKey])
+			}
+		})
+	}
+}
+
+func TestThrottlePeriodReplacesLevelCooldown(t *testing.T) {
+	cfg := config.Config{}
+	clock := NewManualClock(time.Now())
+	rules := []AlertRule{
+		*NewAlertRule("throttled", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+	rules[0].setThrottlePeriod(10)
+	recorder := &RecordingInserter{}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(recorder), WithClock(clock))
+	defer rm.Shutdown()
+
+	evaluate := func() int {
+		rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: clock.Now()})
+		rm.evaluateRule(&rm.Rules[0], cfg)
+		return len(recorder.Alerts())
+	}
+
+	if got := evaluate(); got != 1 {
+		t.Fatalf("Expected the first alert, got %d", got)
+	}
+	clock.Advance(5 * time.Second)
+	if got := evaluate(); got != 1 {
+		t.Errorf("Expected no alert within the 10s throttle, got %d", got)
+	}
+
+	// Well within the 5m Warning cooldown, the throttle alone decides and
+	// doesn't back off
+	for want := 2; want <= 4; want++ {
+		clock.Advance(11 * time.Second)
+		if got := evaluate(); got != want {
+			t.Errorf("Expected %d alerts once the throttle expired, got %d", want, got)
+		}
+	}
+}
+
+func TestConditionCooldowns(t *testing.T) {
+	cfg := config.Config{}
+	clock := NewManualClock(time.Now())
+	rules := []AlertRule{
+		*NewAlertRule("mixed", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning, CooldownSeconds: 10},
+			{ID: 2, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+			{ID: 3, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning, CooldownSeconds: 120},
+		}, zap.NewNop()),
+	}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	var delivered []int
+	rm.OnAlertResult = func(result AlertResult) {
+		if result.Status == AlertDelivered {
+			delivered = append(delivered, result.ConditionID)
+		}
+	}
+	evaluate := func() []int {
+		t.Helper()
+		delivered = nil
+		rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: clock.Now()})
+		rm.evaluateRule(&rm.Rules[0], cfg)
+		slices.Sort(delivered)
+		return delivered
+	}
+
+	// Conditions of the same level alert independently
+	if got := evaluate(); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Fatalf("Expected every condition to alert at first, got %v", got)
+	}
+
+	// Only the 10s cooldown has passed, and it doesn't back off
+	for range 3 {
+		clock.Advance(11 * time.Second)
+		if got := evaluate(); !slices.Equal(got, []int{1}) {
+			t.Errorf("Expected only condition 1 past its 10s cooldown, got %v", got)
+		}
+	}
+
+	// Past 120s the third condition alerts, the second keeps the level-derived
+	// cooldown, backed off to 10m after its first alert
+	clock.Advance(90 * time.Second)
+	if got := evaluate(); !slices.Equal(got, []int{1, 3}) {
+		t.Errorf("Expected conditions 1 and 3 past 120s, got %v", got)
+	}
+	clock.Advance(10 * time.Minute)
+	if got := evaluate(); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("Expected every condition past the Warning cooldown, got %v", got)
+	}
+}
+
+func TestCooldownPolicy(t *testing.T) {
+	newManager := func(t *testing.T, policy string) (*ManualClock, func(value float64) []AlertResult) {
+		t.Helper()
+		clock := NewManualClock(time.Now())
+		rules := []AlertRule{
+			*NewAlertRule("policy", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+				{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning, CooldownSeconds: 60},
+			}, zap.NewNop()),
+		}
+		cfg := config.Config{AlertCooldownPolicy: policy}
+		rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}), WithClock(clock))
+		t.Cleanup(rm.Shutdown)
+
+		var results []AlertResult
+		rm.OnAlertResult = func(result AlertResult) {
+			results = append(results, result)
+		}
+		evaluate := func(value float64) []AlertResult {
+			results = nil
+			rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: value, timestamp: clock.Now()})
+			rm.evaluateRule(&rm.Rules[0], cfg)
+			return results
+		}
+		return clock, evaluate
+	}
+	delivered := func(results []AlertResult) bool {
+		return len(results) == 1 && results[0].Status == AlertDelivered
+	}
+
+	t.Run("immediate first", func(t *testing.T) {
+		_, evaluate := newManager(t, CooldownImmediateFirst)
+		if results := evaluate(15); !delivered(results) {
+			t.Errorf("Expected the first trigger to alert right away, got %+v", results)
+		}
+	})
+
+	t.Run("throttle all", func(t *testing.T) {
+		clock, evaluate := newManager(t, CooldownThrottleAll)
+		if results := evaluate(15); delivered(results) {
+			t.Errorf("Expected the first trigger held back, got %+v", results)
+		}
+		clock.Advance(40 * time.Second)
+		if results := evaluate(15); delivered(results) {
+			t.Errorf("Expected the alert held back within the cooldown, got %+v", results)
+		}
+
+		// Clearing restarts the wait
+		evaluate(5)
+		clock.Advance(30 * time.Second)
+		if results := evaluate(15); delivered(results) {
+			t.Errorf("Expected the wait restarted after clearing, got %+v", results)
+		}
+		clock.Advance(61 * time.Second)
+		if results := evaluate(15); !delivered(results) {
+			t.Errorf("Expected the alert once the condition held for the cooldown, got %+v", results)
+		}
+
+		// Later alerts follow the usual cooldown
+		clock.Advance(61 * time.Second)
+		if results := evaluate(15); !delivered(results) {
+			t.Errorf("Expected the next alert after the cooldown, got %+v", results)
+		}
+	})
+}
+
+func TestSameLevelConditionsAlertIndependently(t *testing.T) {
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	rules := []AlertRule{
+		*NewAlertRule("line", []string{"sensor/device1", "sensor/device2"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+			{ID: 2, Device: "device2", Operator: "device2 > 10", Threshold: 10, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15.0, timestamp: time.Now()})
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device2", Address: "device2"}, cachedValue{value: 5.0, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	// The second WARNING condition fires while the first is in cooldown
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device2", Address: "device2"}, cachedValue{value: 15.0, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	alerts := recorder.Alerts()
+	if len(alerts) != 2 || alerts[0].Device != "device1" || alerts[1].Device != "device2" {
+		t.Fatalf("Expected both conditions to alert, got %+v", alerts)
+	}
+	if key1, key2 := conditionAlertKey("line", rules[0].Conditions[0]), conditionAlertKey("line", rules[0].Conditions[1]); key1 == key2 {
+		t.Errorf("Expected distinct alert keys, both are %s", key1)
+	}
+}
+
 func TestCreateRuleSnapshot(t *testing.T) {
 	rules := []AlertRule{
 		{
@@ -262,10 +702,8 @@ func TestCreateRuleSnapshot(t *testing.T) {
 	now := time.Now()
 
 	// Add fresh values to cache
-	rm.mu.Lock()
-	rm.deviceCache[key] = cachedValue{value: 10, timestamp: now}
-	rm.deviceCache[key2] = cachedValue{value: 20, timestamp: now}
-	rm.mu.Unlock()
+	rm.deviceCache.set(key, cachedValue{value: 10, timestamp: now})
+	rm.deviceCache.set(key2, cachedValue{value: 20, timestamp: now})
 
 	snapshot := rm.createRuleSnapshot(&rules[0])
 	if snapshot == nil {
@@ -277,9 +715,7 @@ func TestCreateRuleSnapshot(t *testing.T) {
 	}
 
 	// Test with expired cache
-	rm.mu.Lock()
-	rm.deviceCache[key] = cachedValue{value: 10, timestamp: now.Add(-10 * time.Minute)}
-	rm.mu.Unlock()
+	rm.deviceCache.set(key, cachedValue{value: 10, timestamp: now.Add(-10 * time.Minute)})
 
 	snapshot = rm.createRuleSnapshot(&rules[0])
 	if snapshot != nil {
@@ -299,6 +735,10 @@ func TestIsValidValue(t *testing.T) {
 		{nil, false},
 		{5, true},
 		{0, false},
+		{true, true},
+		{false, true},
+		{json.Number("9007199254740993"), true},
+		{json.Number("0.0"), false},
 	}
 
 	for _, tt := range tests {
@@ -307,3 +747,1162 @@ func TestIsValidValue(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleMQTTMessageDedup(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:     "3d5df7e3-5ac8-42b8-ae79-4a54cf7e90e7",
+			Topics: []string{"sensor/device1"},
+			Table:  "alerts",
+		},
+	}
+
+	cfg := config.Config{MQTTDedupWindow: time.Minute, MQTTDedupSeqField: "seq"}
+	rm := NewRuleManager(context.Background(), rules, cfg, &supabase.SupabaseInserter{}, zap.NewNop())
+
+	key := cacheKey{Topic: "sensor/device1", Address: "device1"}
+	stale := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		payload string
+		meta    MessageMeta
+	}{
+		{"payload sequence number", `{"address": "device1", "value": 15, "seq": 7}`, MessageMeta{}},
+		{"mqtt message id", `{"address": "device1", "value": 16}`, MessageMeta{ID: 42}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rm.HandleMQTTMessageWithMeta("sensor/device1", []byte(tt.payload), tt.meta, cfg)
+
+			// Age the cached entry so a second processing would be visible
+			cached, _ := rm.deviceCache.get(key)
+			cached.timestamp = stale
+			rm.deviceCache.set(key, cached)
+
+			rm.HandleMQTTMessageWithMeta("sensor/device1", []byte(tt.payload), tt.meta, cfg)
+
+			cached, _ = rm.deviceCache.get(key)
+
+			if !cached.timestamp.Equal(stale) {
+				t.Error("Expected duplicate delivery to be dropped")
+			}
+		})
+	}
+
+	// Messages without a sequence number or ID are never deduped
+	payload := `{"address": "device1", "value": 17}`
+	rm.HandleMQTTMessage("sensor/device1", []byte(payload), cfg)
+	rm.HandleMQTTMessage("sensor/device1", []byte(payload), cfg)
+
+	cached, _ := rm.deviceCache.get(key)
+
+	if cached.timestamp.Equal(stale) {
+		t.Error("Expected message without identity to be processed")
+	}
+}
+
+// seqDecoder decodes "address|value|seq" payloads, returning the sequence
+// number in the decoded message
+type seqDecoder struct{}
+
+func (d seqDecoder) Decode(payload []byte, topic string) (string, any, error) {
+	address, value, _, err := d.DecodeMessage(payload, topic)
+	return address, value, err
+}
+
+func (seqDecoder) DecodeMessage(payload []byte, topic string) (string, any, map[string]any, error) {
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return "", nil, nil, fmt.Errorf("expected address|value|seq, got %q", payload)
+	}
+	return fields[0], fields[1], map[string]any{"seq": fields[2]}, nil
+}
+
+func TestDedupSequenceFromDecodedMessage(t *testing.T) {
+	cfg := config.Config{MQTTDedupWindow: time.Minute, MQTTDedupSeqField: "seq"}
+	rm := NewRuleManager(context.Background(), nil, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+	rm.decoder = seqDecoder{}
+
+	key := cacheKey{Topic: "plc/D100", Address: "D100"}
+	handle := func(payload string) any {
+		rm.HandleMQTTMessage("plc/D100", []byte(payload), cfg)
+		cached, _ := rm.deviceCache.get(key)
+		return cached.value
+	}
+
+	// The sequence number of the decoded message identifies non-JSON payloads too
+	handle("D100|RUNNING|1")
+	if value := handle("D100|STOPPED|1"); value != "RUNNING" {
+		t.Errorf("Expected the message with a seen sequence number dropped, got %v", value)
+	}
+	if value := handle("D100|STOPPED|2"); value != "STOPPED" {
+		t.Errorf("Expected the next sequence number cached, got %v", value)
+	}
+}
+
+func TestCreateRuleSnapshotFreshestTopic(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:     "0c6a2b8e-7f51-4d2a-9a57-2f1f3d1a8c11",
+			Topics: []string{"primary/D800", "backup/D800", "primary/D392"},
+			Conditions: []AlertCondition{
+				{Device: "D800"},
+			},
+		},
+	}
+
+	primary := cacheKey{Topic: "primary/D800", Address: "D800"}
+	backup := cacheKey{Topic: "backup/D800", Address: "D800"}
+	other := cacheKey{Topic: "primary/D392", Address: "D392"}
+
+	rm := NewRuleManager(context.Background(), rules, config.Config{}, &supabase.SupabaseInserter{}, zap.NewNop())
+	now := time.Now()
+
+	// Backup topic has the newer value
+	rm.deviceCache.set(primary, cachedValue{value: 10, timestamp: now.Add(-time.Minute)})
+	rm.deviceCache.set(backup, cachedValue{value: 20, timestamp: now})
+	rm.deviceCache.set(other, cachedValue{value: 5, timestamp: now})
+
+	snapshot := rm.createRuleSnapshot(&rules[0])
+	if snapshot == nil {
+		t.Fatal("Expected non-nil snapshot")
+	}
+	if len(snapshot) != 2 {
+		t.Errorf("Expected snapshot with 2 devices, got %d", len(snapshot))
+	}
+	if snapshot["D800"] != 20 {
+		t.Errorf("Expected backup value 20 for D800, got %v", snapshot["D800"])
+	}
+
+	// Expired backup falls back to the primary topic
+	rm.deviceCache.set(backup, cachedValue{value: 20, timestamp: now.Add(-10 * time.Minute)})
+
+	snapshot = rm.createRuleSnapshot(&rules[0])
+	if snapshot == nil {
+		t.Fatal("Expected non-nil snapshot")
+	}
+	if snapshot["D800"] != 10 {
+		t.Errorf("Expected primary value 10 for D800, got %v", snapshot["D800"])
+	}
+
+	// No topic provides D800
+	rm.deviceCache.delete(primary)
+
+	if snapshot = rm.createRuleSnapshot(&rules[0]); snapshot != nil {
+		t.Error("Expected nil snapshot when a device has no fresh value")
+	}
+}
+
+func TestDeviceCacheLRUEviction(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:     "5b0f3c1e-2d4a-4e8b-9c6d-7a1b2c3d4e5f",
+			Topics: []string{"sensor/D1"},
+		},
+	}
+
+	cfg := config.Config{DeviceCacheMaxEntries: 3}
+	rm := NewRuleManager(context.Background(), rules, cfg, &supabase.SupabaseInserter{}, zap.NewNop())
+
+	publish := func(device string) {
+		payload := fmt.Sprintf(`{"address": "%s", "value": 1}`, device)
+		rm.HandleMQTTMessage("sensor/"+device, []byte(payload), cfg)
+	}
+
+	before := testutil.ToFloat64(metrics.DeviceCacheEvictions)
+
+	// D1 is the oldest but used by a rule; D3 is the least recently updated otherwise
+	publish("D1")
+	publish("D2")
+	publish("D3")
+	publish("D2")
+	publish("D4")
+
+	if rm.deviceCache.len() != 3 {
+		t.Errorf("Expected cache capped at 3 entries, got %d", rm.deviceCache.len())
+	}
+	for _, device := range []string{"D1", "D2", "D4"} {
+		if _, ok := rm.deviceCache.get(cacheKey{Topic: "sensor/" + device, Address: device}); !ok {
+			t.Errorf("Expected %s to remain cached", device)
+		}
+	}
+	if _, ok := rm.deviceCache.get(cacheKey{Topic: "sensor/D3", Address: "D3"}); ok {
+		t.Error("Expected least recently updated D3 to be evicted")
+	}
+
+	if got := testutil.ToFloat64(metrics.DeviceCacheEvictions) - before; got != 1 {
+		t.Errorf("Expected 1 eviction recorded, got %v", got)
+	}
+}
+
+func TestConditionsAlertIndependently(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("line", []string{"sensor/device1", "sensor/device2"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelCritical},
+			{ID: 2, Device: "device2", Operator: "device2 < 5", Threshold: 5, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	recorder := &RecordingInserter{}
+	rm := NewRuleManager(context.Background(), rules, config.Config{}, recorder, zap.NewNop())
+	defer rm.Shutdown()
+
+	// Only device1 breaches, device2 must not be reported along with it
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device2", Address: "device2"}, cachedValue{value: 8, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 1 || alerts[0].Device != "device1" {
+		t.Fatalf("Expected only the alert of device1, got %+v", alerts)
+	}
+
+	// Once device2 breaches as well, its condition alerts on its own
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device2", Address: "device2"}, cachedValue{value: 2, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 2 || alerts[1].Device != "device2" {
+		t.Errorf("Expected the alert of device2 next, got %+v", alerts)
+	}
+}
+
+func TestOnAlertHook(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:       "7e8f9a0b-1c2d-4e3f-8a4b-5c6d7e8f9a0b",
+			Topics:   []string{"sensor/device1", "sensor/device2"},
+			Table:    "alerts",
+			Category: "coating",
+			Machine:  "nk3",
+			Conditions: []AlertCondition{
+				{
+					ID:              1,
+					Device:          "device1",
+					Level:           LevelCritical,
+					Operator:        "device1 > 10",
+					Threshold:       10,
+					Unit:            []string{"℃"},
+					MessageTemplate: "is above",
+				},
+				{
+					ID:        2,
+					Device:    "device2",
+					Level:     LevelWarning,
+					Operator:  "device2 < 5",
+					Threshold: 5,
+				},
+			},
+		},
+	}
+
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+
+	type hookCall struct {
+		alert     AlertMessage
+		ruleID    string
+		condition AlertCondition
+	}
+	var calls []hookCall
+	rm.OnAlert = func(alert AlertMessage, rule *AlertRule, condition AlertCondition) {
+		// Locks must be released while the hook runs
+		if !rm.mu.TryLock() {
+			t.Error("Expected OnAlert to be called without the rules lock held")
+		} else {
+			rm.mu.Unlock()
+		}
+		calls = append(calls, hookCall{alert: alert, ruleID: rule.ID, condition: condition})
+	}
+
+	// Only device1 breaches
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device2", Address: "device2"}, cachedValue{value: 8, timestamp: time.Now()})
+
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 OnAlert call, got %d", len(calls))
+	}
+
+	call := calls[0]
+	if call.ruleID != rules[0].ID {
+		t.Errorf("Expected rule %s, got %s", rules[0].ID, call.ruleID)
+	}
+	if call.condition.ID != 1 {
+		t.Errorf("Expected condition 1, got %d", call.condition.ID)
+	}
+	if call.alert.Device != "device1" || call.alert.Current != 15 || call.alert.Threshold != 10 {
+		t.Errorf("Unexpected alert values: %+v", call.alert)
+	}
+	if call.alert.Severity != "CRITICAL" || call.alert.Message != "is above" {
+		t.Errorf("Unexpected alert severity/message: %+v", call.alert)
+	}
+
+	if inserted := recorder.Alerts(); len(inserted) != 1 || inserted[0].Device != "device1" {
+		t.Errorf("Expected the inserter to receive the same alert, got %+v", inserted)
+	}
+}
+
+// benchmarkHandleMQTTMessage handles messages spread over many devices, one
+// at a time as the MQTT client does with ordering on, or concurrently as with
+// MQTT_ORDER_MATTERS false
+func benchmarkHandleMQTTMessage(b *testing.B, ordered bool) {
+	const devices = 64
+
+	topics := make([]string, devices)
+	payloads := make([][]byte, devices)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("sensor/D%d", i)
+		payloads[i] = []byte(fmt.Sprintf(`{"address": "D%d", "value": %d}`, i, i+1))
+	}
+	rules := []AlertRule{
+		*NewAlertRule("bench", topics, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D0", Operator: "D0 > 1000000", Threshold: 1000000, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	ctx := context.Background()
+	cfg := config.Config{}
+	rm := NewManager(ctx, rules, cfg, WithInserter(NoopInserter{}))
+	defer rm.Shutdown()
+	if err := rm.Start(ctx); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	if ordered {
+		for i := 0; i < b.N; i++ {
+			rm.HandleMQTTMessage(topics[i%devices], payloads[i%devices], cfg)
+		}
+		return
+	}
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1)) % devices
+			rm.HandleMQTTMessage(topics[i], payloads[i], cfg)
+		}
+	})
+}
+
+func BenchmarkHandleMQTTMessageOrdered(b *testing.B) {
+	benchmarkHandleMQTTMessage(b, true)
+}
+
+func BenchmarkHandleMQTTMessageUnordered(b *testing.B) {
+	benchmarkHandleMQTTMessage(b, false)
+}
+
+func TestConcurrentMessagesAndSnapshots(t *testing.T) {
+	const devices = 20
+
+	topics := make([]string, devices)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("sensor/D%d", i)
+	}
+	newRules := func() []AlertRule {
+		return []AlertRule{
+			{
+				ID:     "8c7b6a59-4837-4261-9f0e-d1c2b3a4f5e6",
+				Topics: topics,
+				Conditions: []AlertCondition{
+					{ID: 1, Device: "D0", Operator: "D0 > 1000000", Level: LevelWarning},
+				},
+			},
+		}
+	}
+
+	cfg := config.Config{DeviceCacheMaxEntries: devices}
+	rm := NewRuleManager(context.Background(), newRules(), cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				device := fmt.Sprintf("D%d", (w+i)%devices)
+				payload := fmt.Sprintf(`{"address": "%s", "value": %d}`, device, i+1)
+				rm.HandleMQTTMessage("sensor/"+device, []byte(payload), cfg)
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				rm.mu.RLock()
+				rule := &rm.Rules[0]
+				rm.mu.RUnlock()
+				rm.createRuleSnapshot(rule)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			rm.UpdateRules(newRules(), cfg)
+		}
+	}()
+
+	wg.Wait()
+
+	if rm.deviceCache.len() != devices {
+		t.Errorf("Expected %d cached devices, got %d", devices, rm.deviceCache.len())
+	}
+}
+
+func TestWarmupSuppressesAlerts(t *testing.T) {
+	newRules := func(warmupSeconds int) []AlertRule {
+		return []AlertRule{
+			{
+				ID:            "4d3c2b1a-0f9e-48d7-b6c5-a4b3c2d1e0f9",
+				Topics:        []string{"sensor/device1"},
+				Table:         "alerts",
+				WarmupSeconds: warmupSeconds,
+				Conditions: []AlertCondition{
+					{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelCritical},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		cfg    config.Config
+		warmup int
+	}{
+		{"global warm-up", config.Config{WarmupPeriod: time.Hour}, 0},
+		{"per-rule warm-up", config.Config{}, 3600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.InfoLevel)
+			recorder := &RecordingInserter{}
+			rm := NewRuleManager(context.Background(), newRules(tt.warmup), tt.cfg, recorder, zap.New(core))
+			rm.Shutdown() // Evaluate synchronously below
+
+			rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 15}`), tt.cfg)
+			rm.evaluateRule(&rm.Rules[0], tt.cfg)
+
+			if alerts := recorder.Alerts(); len(alerts) != 0 {
+				t.Fatalf("Expected no alerts during warm-up, got %d", len(alerts))
+			}
+			if logs.FilterMessage("Rule warming up, alert suppressed").Len() != 1 {
+				t.Error("Expected warm-up suppression to be logged")
+			}
+
+			// Move the first sighting past the warm-up window
+			key := cacheKey{Topic: "sensor/device1", Address: "device1"}
+			cached, _ := rm.deviceCache.get(key)
+			cached.firstSeen = time.Now().Add(-2 * time.Hour)
+			rm.deviceCache.set(key, cached)
+
+			// Updates keep the original first sighting
+			rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 16}`), tt.cfg)
+			rm.evaluateRule(&rm.Rules[0], tt.cfg)
+
+			if alerts := recorder.Alerts(); len(alerts) != 1 {
+				t.Errorf("Expected 1 alert after warm-up, got %d", len(alerts))
+			}
+		})
+	}
+}
+
+func TestStartupGraceSuppressesAlerts(t *testing.T) {
+	rules := []AlertRule{
+		{
+			ID:             "grace",
+			Topics:         []string{"sensor/device1"},
+			Table:          "alerts",
+			CooldownPeriod: time.Hour,
+			Conditions: []AlertCondition{
+				{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelCritical},
+			},
+		},
+	}
+	cfg := config.Config{StartupGracePeriod: time.Minute}
+	clock := NewManualClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	core, logs := observer.New(zapcore.InfoLevel)
+	recorder := &RecordingInserter{}
+	var metadataLoads atomic.Int32
+	metadata := NewDeviceMetadata(func(ctx context.Context) ([]DeviceInfo, error) {
+		metadataLoads.Add(1)
+		return nil, nil
+	}, time.Hour, nil)
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(recorder), WithClock(clock), WithLogger(zap.New(core)), WithDeviceMetadata(metadata))
+	rm.Shutdown() // Evaluate synchronously below
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+	evaluate := func() {
+		rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: clock.Now()})
+		rm.evaluateRule(&rm.Rules[0], cfg)
+	}
+
+	evaluate()
+	clock.Advance(30 * time.Second)
+	evaluate()
+
+	if alerts := recorder.Alerts(); len(alerts) != 0 {
+		t.Fatalf("Expected no alerts during the grace period, got %d", len(alerts))
+	}
+	if len(results) != 2 || results[0].Status != AlertSuppressed || results[0].Reason != "startup grace" {
+		t.Fatalf("Expected both alerts suppressed by the grace period, got %+v", results)
+	}
+	if results[0].Alert.Current != 15 || results[0].Alert.Severity != "CRITICAL" {
+		t.Errorf("Expected the suppressed alert's value and level, got %+v", results[0].Alert)
+	}
+	if n := metadataLoads.Load(); n != 0 {
+		t.Errorf("Expected no device metadata loaded for suppressed alerts, got %d loads", n)
+	}
+
+	// The condition still holds once the grace period is over, neither the
+	// rule's nor the alert's cooldown holds it back
+	clock.Advance(30 * time.Second)
+	evaluate()
+
+	if alerts := recorder.Alerts(); len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert after the grace period, got %d", len(alerts))
+	}
+	if results[2].Status != AlertDelivered {
+		t.Errorf("Expected the alert delivered after the grace period, got %+v", results[2])
+	}
+	entries := logs.FilterMessage("Startup grace period over, delivering alerts").All()
+	if len(entries) != 1 || entries[0].ContextMap()["suppressed"] != int64(2) {
+		t.Errorf("Expected the end of the grace period logged with 2 suppressed alerts, got %v", entries)
+	}
+}
+
+// histogramCount returns the number of observations of a histogram series
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestEvaluationDurationMetrics(t *testing.T) {
+	errorEval := metrics.EvaluationDuration.WithLabelValues("ERROR")
+	warningEval := metrics.EvaluationDuration.WithLabelValues("WARNING")
+	errorInsert := metrics.InsertDuration.WithLabelValues("ERROR")
+	warningInsert := metrics.InsertDuration.WithLabelValues("WARNING")
+
+	var errorEvalAtInsert uint64
+	inserter := &MockSupabaseClient{
+		InsertAlertFunc: func(cfg config.Config, table, device, message, category, machine, level string) error {
+			errorEvalAtInsert = histogramCount(t, errorEval)
+			return fmt.Errorf("insert failed")
+		},
+	}
+
+	rules := []AlertRule{
+		*NewAlertRule("timed", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelError},
+			{ID: 2, Device: "device1", Operator: "device1 > 100", Threshold: 100, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), rules, cfg, inserter, zap.NewNop())
+	defer rm.Shutdown()
+
+	beforeErrorEval := histogramCount(t, errorEval)
+	beforeWarningEval := histogramCount(t, warningEval)
+	beforeErrorInsert := histogramCount(t, errorInsert)
+	beforeWarningInsert := histogramCount(t, warningInsert)
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	// Both conditions are timed, the cleared one included
+	if got := histogramCount(t, errorEval) - beforeErrorEval; got != 1 {
+		t.Errorf("Expected 1 ERROR evaluation observation, got %d", got)
+	}
+	if got := histogramCount(t, warningEval) - beforeWarningEval; got != 1 {
+		t.Errorf("Expected 1 WARNING evaluation observation, got %d", got)
+	}
+
+	// The evaluation is observed before the alert is delivered, the delivery
+	// isn't part of it
+	if got := errorEvalAtInsert - beforeErrorEval; got != 1 {
+		t.Errorf("Expected the ERROR evaluation observed before the insert, got %d observations", got)
+	}
+
+	// The failed insert is still timed
+	if got := histogramCount(t, errorInsert) - beforeErrorInsert; got != 1 {
+		t.Errorf("Expected 1 ERROR insert observation, got %d", got)
+	}
+	if got := histogramCount(t, warningInsert) - beforeWarningInsert; got != 0 {
+		t.Errorf("Expected no WARNING insert observation, got %d", got)
+	}
+}
+
+func TestBooleanDeviceValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		operator string
+		value    string
+		want     int
+	}{
+		{"open matches == true", "door == true", "true", 1},
+		{"closed doesn't match == true", "door == true", "false", 0},
+		{"closed matches == 0", "door == 0", "false", 1},
+		{"open matches == 1", "door == 1", "true", 1},
+		{"closed matches != true", "door != true", "false", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := []AlertRule{
+				*NewAlertRule("door", []string{"sensor/door"}, "alerts", "", "", "", []AlertCondition{
+					{ID: 1, Device: "door", Operator: tt.operator, Level: LevelWarning},
+				}, zap.NewNop()),
+			}
+
+			recorder := &RecordingInserter{}
+			cfg := config.Config{}
+			rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+			defer rm.Shutdown()
+
+			rm.HandleMQTTMessage("sensor/door", []byte(fmt.Sprintf(`{"address": "door", "value": %s}`, tt.value)), cfg)
+			if _, ok := rm.deviceCache.get(cacheKey{Topic: "sensor/door", Address: "door"}); !ok {
+				t.Fatal("Expected boolean value to be cached")
+			}
+
+			rm.evaluateRule(&rm.Rules[0], cfg)
+
+			// The rule's worker may have raised the alert concurrently
+			deadline := time.Now().Add(time.Second)
+			for len(recorder.Alerts()) < tt.want && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			if got := len(recorder.Alerts()); got != tt.want {
+				t.Errorf("Expected %d alerts, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAlertTimestampTimezone(t *testing.T) {
+	tests := []struct {
+		timezone string
+		offset   int
+	}{
+		{"", 0},
+		{"UTC", 0},
+		{"Asia/Bangkok", 7 * 60 * 60},
+		{"Not/AZone", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			rules := []AlertRule{
+				*NewAlertRule("tz", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+					{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+				}, zap.NewNop()),
+			}
+
+			recorder := &RecordingInserter{}
+			cfg := config.Config{Timezone: tt.timezone}
+			rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+			defer rm.Shutdown()
+
+			rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+			rm.evaluateRule(&rm.Rules[0], cfg)
+
+			alerts := recorder.Alerts()
+			if len(alerts) != 1 {
+				t.Fatalf("Expected 1 alert, got %d", len(alerts))
+			}
+
+			var message AlertMessage
+			if err := json.Unmarshal([]byte(alerts[0].Message), &message); err != nil {
+				t.Fatalf("Failed to decode alert message: %v", err)
+			}
+			triggeredAt, err := time.Parse(time.RFC3339, message.TriggeredAt)
+			if err != nil {
+				t.Fatalf("Expected RFC 3339 triggered_at, got %q", message.TriggeredAt)
+			}
+			if _, offset := triggeredAt.Zone(); offset != tt.offset {
+				t.Errorf("Expected offset %ds, got %ds (%s)", tt.offset, offset, message.TriggeredAt)
+			}
+			if time.Since(triggeredAt) > time.Minute {
+				t.Errorf("Expected triggered_at to be now, got %s", message.TriggeredAt)
+			}
+		})
+	}
+}
+
+func TestAlertDedupAcrossRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   int
+	}{
+		{"disabled", 0, 2},
+		{"enabled", time.Minute, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := AlertCondition{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, MessageTemplate: "too hot", Level: LevelError}
+			rules := []AlertRule{
+				*NewAlertRule("line-a", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+				*NewAlertRule("line-b", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+			}
+
+			recorder := &RecordingInserter{}
+			cfg := config.Config{AlertDedupWindow: tt.window}
+			rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+			defer rm.Shutdown()
+
+			var results []AlertResult
+			rm.OnAlertResult = func(result AlertResult) {
+				results = append(results, result)
+			}
+
+			rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: time.Now()})
+			rm.evaluateRule(&rm.Rules[0], cfg)
+			rm.evaluateRule(&rm.Rules[1], cfg)
+
+			if got := len(recorder.Alerts()); got != tt.want {
+				t.Errorf("Expected %d deliveries, got %d", tt.want, got)
+			}
+			if tt.want == 1 && (len(results) != 2 || results[1].Status != AlertSuppressed || results[1].RuleID != "line-b") {
+				t.Errorf("Expected the second rule's alert to be collapsed, got %+v", results)
+			}
+		})
+	}
+}
+
+func TestRulePriorityClaimsSharedDedup(t *testing.T) {
+	// Workers run concurrently, repeat to catch a low-priority rule racing ahead
+	for i := 0; i < 20; i++ {
+		condition := AlertCondition{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, MessageTemplate: "too hot", Level: LevelError}
+		rules := []AlertRule{
+			*NewAlertRule("line-a", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+			*NewAlertRule("line-b", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+			*NewAlertRule("line-c", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop()),
+		}
+		rules[1].Priority = 10
+		rules[2].Priority = -1
+
+		cfg := config.Config{AlertDedupWindow: time.Minute}
+		rm := NewRuleManager(context.Background(), rules, cfg, &RecordingInserter{}, zap.NewNop())
+		startManager(t, rm)
+
+		var (
+			mu      sync.Mutex
+			results []AlertResult
+		)
+		rm.OnAlertResult = func(result AlertResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, result)
+		}
+
+		rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 15}`), cfg)
+		rm.waitIdle()
+		rm.Shutdown()
+
+		mu.Lock()
+		if len(results) != 3 || results[0].RuleID != "line-b" || results[0].Status != AlertDelivered || results[2].RuleID != "line-c" {
+			t.Fatalf("Expected line-b to claim the shared alert and line-c to go last, got %+v", results)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestValueTransform(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform ValueTransform
+		operator  string
+		current   float64
+		triggered bool
+	}{
+		{"scaled above threshold", ValueTransform{Scale: 0.1}, "temp > 37", 37.5, true},
+		{"scaled below threshold", ValueTransform{Scale: 0.1}, "temp > 38", 0, false},
+		{"raw value not compared", ValueTransform{Scale: 0.1}, "temp > 300", 0, false},
+		{"scale and offset", ValueTransform{Scale: 0.1, Offset: -30}, "temp < 10", 7.5, true},
+		{"offset only", ValueTransform{Offset: 25}, "temp == 400", 400, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := NewAlertRule("transform", []string{"sensor/temp"}, "alerts", "", "", "", []AlertCondition{
+				{ID: 1, Device: "temp", Operator: tt.operator, Level: LevelWarning},
+			}, zap.NewNop())
+			rule.Transforms = map[string]ValueTransform{"temp": tt.transform}
+
+			state, alert := rule.evaluateAlert(map[string]any{"temp": 375.0}, nil, rule.Conditions[0])
+			if (state == conditionTriggered) != tt.triggered {
+				t.Fatalf("Expected triggered = %v, got state %v", tt.triggered, state)
+			}
+			if tt.triggered && alert.Current != tt.current {
+				t.Errorf("Expected alert current %v, got %v", tt.current, alert.Current)
+			}
+		})
+	}
+
+	// Devices without a transform keep their raw values
+	rule := NewAlertRule("identity", []string{"sensor/temp"}, "alerts", "", "", "", []AlertCondition{
+		{ID: 1, Device: "temp", Operator: "temp > 300", Level: LevelWarning},
+	}, zap.NewNop())
+	if state, alert := rule.evaluateAlert(map[string]any{"temp": 375.0}, nil, rule.Conditions[0]); state != conditionTriggered || alert.Current != 375 {
+		t.Errorf("Expected untransformed value 375 to trigger, got state %v, current %v", state, alert.Current)
+	}
+}
+
+func TestAlertPrecision(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	tests := []struct {
+		name      string
+		precision *int
+		current   float64
+		threshold float64
+	}{
+		{"default one decimal", nil, 37.6, 37.3},
+		{"whole numbers", intPtr(0), 38, 37},
+		{"two decimals", intPtr(2), 37.64, 37.25},
+		{"unrounded", intPtr(-1), 37.637, 37.25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := NewAlertRule("precision", []string{"sensor/temp"}, "alerts", "", "", "", []AlertCondition{
+				{ID: 1, Device: "temp", Operator: "temp > 37.25", Threshold: 37.25, Level: LevelWarning},
+			}, zap.NewNop())
+			rule.Precision = tt.precision
+
+			state, alert := rule.evaluateAlert(map[string]any{"temp": 37.637}, nil, rule.Conditions[0])
+			if state != conditionTriggered {
+				t.Fatalf("Expected fractional threshold to trigger, got state %v", state)
+			}
+			if alert.Current != tt.current || alert.Threshold != tt.threshold {
+				t.Errorf("Expected current %v and threshold %v, got %v and %v", tt.current, tt.threshold, alert.Current, alert.Threshold)
+			}
+		})
+	}
+}
+
+func TestAlertPrecisionFromConfig(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("configured", []string{"sensor/temp"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "temp", Operator: "temp > 37.5", Threshold: 37.5, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{AlertPrecision: 2}
+	rm := NewRuleManager(context.Background(), rules, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	var message string
+	rm.OnAlert = func(alert AlertMessage, rule *AlertRule, condition AlertCondition) {
+		message = rule.marshalAlertMessage(alert)
+	}
+
+	rm.deviceCache.set(cacheKey{Topic: "sensor/temp", Address: "temp"}, cachedValue{value: 37.639, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+
+	if !strings.Contains(message, `"current":37.64`) || !strings.Contains(message, `"threshold":37.5`) {
+		t.Errorf("Expected message values with 2 decimals, got %s", message)
+	}
+}
+
+func TestAlertMessageRawValues(t *testing.T) {
+	precision := 0
+	rule := NewAlertRule("raw", []string{"sensor/temp"}, "alerts", "", "", "", nil, zap.NewNop())
+	rule.Precision = &precision
+
+	alert := rule.generateAlertMessage(AlertCondition{Device: "temp", Operator: "temp > 37.55", Threshold: 37.55, Level: LevelWarning},
+		map[string]float64{"temp": 37.639})
+	if alert.Current != 38 || alert.Threshold != 38 {
+		t.Errorf("Expected rounded current and threshold 38, got %v and %v", alert.Current, alert.Threshold)
+	}
+	if alert.CurrentRaw != 37.639 || alert.ThresholdRaw != 37.55 {
+		t.Errorf("Expected raw current 37.639 and threshold 37.55, got %v and %v", alert.CurrentRaw, alert.ThresholdRaw)
+	}
+
+	message := rule.marshalAlertMessage(alert)
+	for _, want := range []string{`"current":38`, `"threshold":38`, `"current_raw":37.639`, `"threshold_raw":37.55`} {
+		if !strings.Contains(message, want) {
+			t.Errorf("Expected %s in message, got %s", want, message)
+		}
+	}
+}
+
+func TestTrustPayloadAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		trust  bool
+		cached bool
+	}{
+		{"strict drops mismatch", false, false},
+		{"trusted payload address", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := []AlertRule{
+				*NewAlertRule("gateway", []string{"gw/plc1/D100"}, "alerts", "", "", "", []AlertCondition{
+					{ID: 1, Device: "line1.D100", Operator: "line1.D100 > 10", Level: LevelWarning},
+				}, zap.NewNop()),
+			}
+
+			cfg := config.Config{TrustPayloadAddress: tt.trust}
+			rm := NewRuleManager(context.Background(), rules, cfg, NoopInserter{}, zap.NewNop())
+			defer rm.Shutdown()
+
+			rm.HandleMQTTMessage("gw/plc1/D100", []byte(`{"address": "line1.D100", "value": 15}`), cfg)
+
+			_, exists := rm.deviceCache.get(cacheKey{Topic: "gw/plc1/D100", Address: "D100"})
+			if exists != tt.cached {
+				t.Fatalf("Expected cached=%v, got %v", tt.cached, exists)
+			}
+			if !tt.cached {
+				return
+			}
+
+			// Rules see the value under the payload address
+			snapshot := rm.createRuleSnapshot(&rm.Rules[0])
+			if snapshot["line1.D100"] != 15.0 {
+				t.Fatalf("Expected snapshot keyed by payload address, got %v", snapshot)
+			}
+			if state, _ := rm.Rules[0].checkCondition(snapshot, nil, rm.Rules[0].Conditions[0]); state != conditionTriggered {
+				t.Errorf("Expected condition on the payload address to trigger, got state %v", state)
+			}
+		})
+	}
+
+	// Matching addresses are unaffected by the mode
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), nil, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+	rm.HandleMQTTMessage("gw/plc1/D100", []byte(`{"address": "D100", "value": 15}`), cfg)
+	if cached, exists := rm.deviceCache.get(cacheKey{Topic: "gw/plc1/D100", Address: "D100"}); !exists || cached.address != "" {
+		t.Errorf("Expected matching address to be cached as before, got %+v", cached)
+	}
+}
+
+func TestLargeIntegerConditions(t *testing.T) {
+	rule := NewAlertRule("counter", []string{"plc/D1", "plc/D2"}, "alerts", "", "", "", nil, zap.NewNop())
+	decoder := &JSONDecoder{UseNumber: true}
+
+	payload := make(map[string]any)
+	for _, msg := range []string{
+		`{"address": "D1", "value": 9007199254740993}`,
+		`{"address": "D2", "value": 9007199254740992}`,
+	} {
+		address, value, err := decoder.Decode([]byte(msg), "plc/D1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload[address] = value
+	}
+
+	// 2^53+1 and 2^53 are the same float64, only exact comparison tells them apart
+	tests := []struct {
+		condition AlertCondition
+		want      conditionState
+	}{
+		{AlertCondition{Device: "D1", Operator: "!=", ThresholdDevice: "D2"}, conditionTriggered},
+		{AlertCondition{Device: "D1", Operator: ">", ThresholdDevice: "D2"}, conditionTriggered},
+		{AlertCondition{Operator: "D1 != 9007199254740992"}, conditionTriggered},
+		{AlertCondition{Operator: "D1 == 9007199254740993"}, conditionTriggered},
+		{AlertCondition{Operator: "D1 > D2 AND D2 == 9007199254740992"}, conditionTriggered},
+		{AlertCondition{Operator: "D1 <= D2"}, conditionClear},
+		{AlertCondition{Operator: "D2 > 0.5"}, conditionTriggered}, // Fractional thresholds compare as floats
+	}
+
+	for _, tt := range tests {
+		if got, _ := rule.checkCondition(payload, nil, tt.condition); got != tt.want {
+			t.Errorf("%+v = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestSimpleConditionThresholdDevice(t *testing.T) {
+	rule := NewAlertRule("ref", []string{"plc/D1", "plc/D2"}, "alerts", "", "", "", nil, zap.NewNop())
+
+	tests := []struct {
+		operator string
+		d1, d2   float64
+		want     bool
+	}{
+		{">", 6, 5, true},
+		{">", 5, 5, false},
+		{"<", 4, 5, true},
+		{"<", 5, 5, false},
+		{">=", 5, 5, true},
+		{">=", 4, 5, false},
+		{"<=", 5, 5, true},
+		{"<=", 6, 5, false},
+		{"==", 5, 5, true},
+		{"==", 4, 5, false},
+		{"!=", 4, 5, true},
+		{"!=", 5, 5, false},
+	}
+
+	for _, tt := range tests {
+		condition := AlertCondition{Device: "D1", Operator: tt.operator, ThresholdDevice: "D2", Threshold: 100}
+		values := map[string]float64{"D1": tt.d1, "D2": tt.d2}
+		if got := rule.evaluateCondition(condition, values, nil, nil); got != tt.want {
+			t.Errorf("D1(%v) %s D2(%v) = %v, want %v", tt.d1, tt.operator, tt.d2, got, tt.want)
+		}
+	}
+
+	// Static thresholds still apply without a threshold device
+	if !rule.checkSimpleCondition(AlertCondition{Device: "D1", Operator: "!=", Threshold: 5}, map[string]float64{"D1": 4}, nil) {
+		t.Error("Expected D1 != 5 to hold for a static threshold")
+	}
+
+	// A missing threshold device never triggers
+	if rule.checkSimpleCondition(AlertCondition{Device: "D1", Operator: "!=", ThresholdDevice: "D2"}, map[string]float64{"D1": 4}, nil) {
+		t.Error("Expected no trigger while the threshold device is missing")
+	}
+
+	// Alerts report the referenced device's value as the threshold
+	alert := rule.generateAlertMessage(AlertCondition{Device: "D1", Operator: "!=", ThresholdDevice: "D2"}, map[string]float64{"D1": 4, "D2": 5.04})
+	if alert.Current != 4 || alert.Threshold != 5 {
+		t.Errorf("Expected current 4 and threshold 5, got %v and %v", alert.Current, alert.Threshold)
+	}
+}
+
+func TestThresholdDeviceFormsAgree(t *testing.T) {
+	rule := NewAlertRule("ref", []string{"plc/D1", "plc/D2"}, "alerts", "", "", "", nil, zap.NewNop())
+
+	pairs := [][2]float64{{4, 5}, {5, 5}, {6, 5}, {4.5, 4.25}, {0.1, 0.1}, {-1, 1}}
+	for _, operator := range []string{">", "<", ">=", "<=", "==", "!="} {
+		for _, pair := range pairs {
+			values := map[string]float64{"D1": pair[0], "D2": pair[1]}
+			structured := rule.checkSimpleCondition(AlertCondition{Device: "D1", Operator: operator, ThresholdDevice: "D2"}, values, nil)
+			expression := rule.evaluateSingleCondition("D1 "+operator+" D2", values, nil)
+			if structured != expression {
+				t.Errorf("D1(%v) %s D2(%v): structured = %v, expression = %v", pair[0], operator, pair[1], structured, expression)
+			}
+		}
+	}
+}
+
+func TestOutOfOrderMessageKeepsNewerValue(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("order", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 100", Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{HistorySize: 8}
+	rm := NewRuleManager(context.Background(), rules, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	// Stamped on receipt in this order, handled in the opposite one
+	early := MessageMeta{ID: 1, Arrival: rm.NextArrival()}
+	late := MessageMeta{ID: 2, Arrival: rm.NextArrival()}
+
+	rm.HandleMQTTMessageWithMeta("sensor/device1", []byte(`{"address": "device1", "value": 20}`), late, cfg)
+	rm.HandleMQTTMessageWithMeta("sensor/device1", []byte(`{"address": "device1", "value": 10}`), early, cfg)
+
+	cached, _ := rm.deviceCache.get(cacheKey{Topic: "sensor/device1", Address: "device1"})
+	if cached.value != 20.0 {
+		t.Errorf("Expected the later message's value 20 to stay cached, got %v", cached.value)
+	}
+	if samples := rm.history.samples(cacheKey{Topic: "sensor/device1", Address: "device1"}, 8); len(samples) != 1 {
+		t.Errorf("Expected the stale value kept out of the history, got %v", samples)
+	}
+
+	// Messages handled without a stamp count as arriving when handled
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 30}`), cfg)
+	if cached, _ := rm.deviceCache.get(cacheKey{Topic: "sensor/device1", Address: "device1"}); cached.value != 30.0 {
+		t.Errorf("Expected the unstamped message to update the cache, got %v", cached.value)
+	}
+}
+
+func TestEvaluationCoalescesBurst(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("burst", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 100", Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{EvaluationCoalesceWindow: 50 * time.Millisecond}
+	rm := NewRuleManager(context.Background(), rules, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+	startManager(t, rm)
+
+	var (
+		mu      sync.Mutex
+		results []AlertResult
+	)
+	rm.OnAlertResult = func(result AlertResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+	}
+
+	for value := 101; value <= 110; value++ {
+		rm.HandleMQTTMessage("sensor/device1", []byte(fmt.Sprintf(`{"address": "device1", "value": %d}`, value)), cfg)
+	}
+	rm.waitIdle()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(results) != 1 {
+		t.Fatalf("Expected the burst to be evaluated once, got %d evaluations", len(results))
+	}
+	if results[0].Alert.Current != 110 {
+		t.Errorf("Expected the evaluation to use the final value 110, got %v", results[0].Alert.Current)
+	}
+}
+
+func TestIgnoreRetainedValues(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("any", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Level: LevelWarning},
+		}, zap.NewNop()),
+		*NewAlertRule("live", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+	rules[1].IgnoreRetained = true
+
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), rules, cfg, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	// The broker replays the retained value on subscribe
+	rm.HandleMQTTMessageWithMeta("sensor/device1", []byte(`{"address": "device1", "value": 15}`), MessageMeta{Retained: true}, cfg)
+	rm.waitIdle()
+
+	if snapshot := rm.createRuleSnapshot(&rm.Rules[0]); snapshot["device1"] != 15.0 {
+		t.Errorf("Expected the retained value to reach rules accepting it, got %v", snapshot)
+	}
+	if snapshot := rm.createRuleSnapshot(&rm.Rules[1]); snapshot != nil {
+		t.Errorf("Expected no snapshot from a retained value for a rule ignoring them, got %v", snapshot)
+	}
+
+	// A live publish replaces it
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 20}`), cfg)
+	rm.waitIdle()
+
+	if snapshot := rm.createRuleSnapshot(&rm.Rules[1]); snapshot["device1"] != 20.0 {
+		t.Errorf("Expected the live value for the rule ignoring retained ones, got %v", snapshot)
+	}
+}
@@ -0,0 +1,174 @@
+package alert
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func replayRules() []AlertRule {
+	return []AlertRule{
+		{
+			ID:       "9f1c2d3e-4b5a-4c6d-8e7f-0a1b2c3d4e5f",
+			Topics:   []string{"nk3/holding_register/all/D800"},
+			Table:    "alerts",
+			Category: "coating",
+			Machine:  "nk3",
+			Conditions: []AlertCondition{
+				{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: LevelCritical},
+			},
+		},
+		{
+			ID:       "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d",
+			Topics:   []string{"nk3/holding_register/all/D392"},
+			Table:    "alerts",
+			Category: "coating",
+			Machine:  "nk3",
+			Conditions: []AlertCondition{
+				{ID: 2, Device: "D392", Operator: "D392 < 10", Threshold: 10, Level: LevelWarning},
+			},
+		},
+	}
+}
+
+// waitForAlerts polls the recorder until it holds n alerts or the timeout expires
+func waitForAlerts(t *testing.T, recorder *RecordingInserter, n int) []RecordedAlert {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if alerts := recorder.Alerts(); len(alerts) >= n {
+			return alerts
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return recorder.Alerts()
+}
+
+func TestReplaySource(t *testing.T) {
+	logger := zap.NewNop()
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+
+	rm := NewRuleManager(context.Background(), replayRules(), cfg, recorder, logger)
+	defer rm.Shutdown()
+	startManager(t, rm)
+
+	source := NewReplaySource("testdata/replay.jsonl", false, logger)
+	count, err := source.Replay(context.Background(), rm, cfg)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 replayed records, got %d", count)
+	}
+
+	alerts := waitForAlerts(t, recorder, 2)
+	// Give workers a moment to emit anything unexpected
+	time.Sleep(50 * time.Millisecond)
+	alerts = recorder.Alerts()
+
+	if len(alerts) != 2 {
+		t.Fatalf("Expected 2 alerts, got %d: %+v", len(alerts), alerts)
+	}
+
+	devices := map[string]RecordedAlert{}
+	for _, a := range alerts {
+		devices[a.Device] = a
+	}
+	if a, ok := devices["D800"]; !ok || !strings.Contains(a.Message, `"current":950`) {
+		t.Errorf("Expected D800 alert at 950, got %+v", a)
+	}
+	if a, ok := devices["D392"]; !ok || !strings.Contains(a.Message, `"current":5`) {
+		t.Errorf("Expected D392 alert at 5, got %+v", a)
+	}
+}
+
+func TestReplaySourceRealTime(t *testing.T) {
+	logger := zap.NewNop()
+	cfg := config.Config{}
+
+	rm := NewRuleManager(context.Background(), replayRules(), cfg, NoopInserter{}, logger)
+	defer rm.Shutdown()
+
+	start := time.Now()
+	source := NewReplaySource("testdata/replay.jsonl", true, logger)
+	if _, err := source.Replay(context.Background(), rm, cfg); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	// Records are 10ms apart
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected real-time replay to take at least 30ms, took %v", elapsed)
+	}
+}
+
+func TestReplaySourceMissingFile(t *testing.T) {
+	rm := NewRuleManager(context.Background(), nil, config.Config{}, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	source := NewReplaySource("testdata/missing.jsonl", false, zap.NewNop())
+	if _, err := source.Replay(context.Background(), rm, config.Config{}); err == nil {
+		t.Error("Expected error for missing replay file")
+	}
+}
+
+func TestReplaySourceSimulatedClock(t *testing.T) {
+	logger := zap.NewNop()
+	cfg := config.Config{}
+	recorder := &RecordingInserter{}
+	clock := NewManualClock(time.Time{})
+
+	rm := NewManager(context.Background(), replayRules(), cfg, WithInserter(recorder), WithClock(clock))
+	defer rm.Shutdown()
+	startManager(t, rm)
+
+	source := NewReplaySource("testdata/replay_cooldown.jsonl", false, logger)
+	source.Clock = clock
+	if _, err := source.Replay(context.Background(), rm, cfg); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	// Each record is evaluated before the next, so the alerts are known once
+	// Replay returns. 960 and 980 arrive within the critical cooldown of the
+	// alert before them, measured on the recording's timestamps.
+	alerts := recorder.Alerts()
+	if len(alerts) != 2 {
+		t.Fatalf("Expected 2 alerts, got %d: %+v", len(alerts), alerts)
+	}
+	for i, want := range []string{`"current":950`, `"current":970`} {
+		if !strings.Contains(alerts[i].Message, want) {
+			t.Errorf("Expected alert %d with %s, got %s", i, want, alerts[i].Message)
+		}
+	}
+	if !strings.Contains(alerts[1].Message, `"triggered_at":"2025-05-16T08:45:25Z"`) {
+		t.Errorf("Expected the alert time from the recording, got %s", alerts[1].Message)
+	}
+}
+
+func TestReplaySourceRequiresManagerClock(t *testing.T) {
+	rm := NewRuleManager(context.Background(), nil, config.Config{}, NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	source := NewReplaySource("testdata/replay.jsonl", false, zap.NewNop())
+	source.Clock = NewManualClock(time.Time{})
+	if _, err := source.Replay(context.Background(), rm, config.Config{}); err == nil {
+		t.Error("Expected an error for a clock the manager doesn't use")
+	}
+}
+
+func TestReplaySourceSpeedup(t *testing.T) {
+	source := &ReplaySource{Speedup: 4}
+	if got := source.scaleGap(time.Second); got != 250*time.Millisecond {
+		t.Errorf("Expected a 4x shorter gap, got %v", got)
+	}
+
+	source.Speedup = 0
+	if got := source.scaleGap(time.Second); got != time.Second {
+		t.Errorf("Expected the recorded gap without a speedup, got %v", got)
+	}
+}
@@ -0,0 +1,36 @@
+package alert
+
+import "time"
+
+// rollingSlots is the number of minutes a rollingCounter covers
+const rollingSlots = 60
+
+// rollingCounter counts events over the last hour in one-minute slots, so
+// the count decays as the slots of older minutes fall out of the window
+type rollingCounter struct {
+	counts  [rollingSlots]int
+	minutes [rollingSlots]int64 // Minute since the epoch each slot counts, stale slots are reused
+}
+
+// add counts an event at now
+func (c *rollingCounter) add(now time.Time) {
+	minute := now.Unix() / 60
+	slot := minute % rollingSlots
+	if c.minutes[slot] != minute {
+		c.minutes[slot] = minute
+		c.counts[slot] = 0
+	}
+	c.counts[slot]++
+}
+
+// total returns the events counted within the hour before now
+func (c *rollingCounter) total(now time.Time) int {
+	minute := now.Unix() / 60
+	total := 0
+	for slot, counted := range c.minutes {
+		if age := minute - counted; age >= 0 && age < rollingSlots {
+			total += c.counts[slot]
+		}
+	}
+	return total
+}
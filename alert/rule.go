@@ -1,6 +1,7 @@
 package alert
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -19,36 +20,142 @@ const (
 )
 
 type AlertRule struct {
-	ID             string            `json:"id"`
-	Topics         []string          `json:"topics"`
-	Table          string            `json:"table"`
-	Field          string            `json:"field"`
-	Machine        string            `json:"machine"`
-	Category       string            `json:"category"`
-	Conditions     []AlertCondition  `json:"conditions"`
-	LastAlertTime  map[int]time.Time `json:"-"` // Track last alert time for each device
-	CooldownPeriod time.Duration     `json:"-"`
-	mu             sync.Mutex        `json:"-"`
-	logger         *zap.Logger
+	ID               string                    `json:"id"`
+	Topics           []string                  `json:"topics"`
+	Table            string                    `json:"table"`
+	Field            string                    `json:"field"`
+	Machine          string                    `json:"machine"`
+	Category         string                    `json:"category"`
+	Conditions       []AlertCondition          `json:"conditions"`
+	Escalation       *EscalationPolicy         `json:"escalation,omitempty"`
+	WarmupSeconds    int                       `json:"warmup_seconds,omitempty"`    // Overrides the global warm-up period
+	Transforms       map[string]ValueTransform `json:"transforms,omitempty"`        // Device -> transform applied to its raw values
+	Precision        *int                      `json:"precision,omitempty"`         // Decimals of alert values, negative keeps them unrounded (default ALERT_PRECISION)
+	IgnoreRetained   bool                      `json:"ignore_retained,omitempty"`   // Wait for live values instead of acting on retained MQTT messages
+	Priority         int                       `json:"priority,omitempty"`          // Higher priority rules evaluate first on topics shared with other rules
+	ThrottlePeriod   int                       `json:"throttle_period,omitempty"`   // Seconds between alerts of a condition, replacing the level cooldown; 0 keeps it
+	MessageTemplates map[int]string            `json:"message_templates,omitempty"` // Level -> message template of the rule's alerts at that level
+	InstanceMatch    string                    `json:"instance_match,omitempty"`    // InstanceMatchAny or InstanceMatchAll, how conditions hold across the instances of wildcard topics (default any)
+	QoS              int                       `json:"qos,omitempty"`               // MQTT QoS the rule's topics are subscribed at, at least MQTT_QOS; filters shared by rules use the highest
+	LastAlertTime    map[int]time.Time         `json:"-"`                           // Track last alert time for each device
+	CooldownPeriod   time.Duration             `json:"-"`
+	mu               sync.Mutex                `json:"-"`
+	clock            Clock                     // Set by the manager, the system clock when nil
+	metadata         *DeviceMetadata           // Set by the manager, nil without enrichment
+	logger           *zap.Logger
 }
 
 type AlertCondition struct {
 	ID              int      `json:"id"`
 	Device          string   `json:"device"`
 	Operator        string   `json:"operator"`
-	Threshold       int      `json:"threshold"`
+	Threshold       float64  `json:"threshold"`
+	ThresholdDevice string   `json:"threshold_device,omitempty"` // Compare against this device's value instead of Threshold
 	Unit            []string `json:"unit"`
 	MessageTemplate string   `json:"message_template"`
-	Level           int      `json:"level"` // 1=Warning, 2=Error, 3=Critical
+	Level           int      `json:"level"`           // 1=Warning, 2=Error, 3=Critical
+	Count           int      `json:"count,omitempty"` // Consecutive moves required by RISING/FALLING
+
+	// CooldownSeconds, when set, replaces the level-derived cooldown of the
+	// condition's alert with a fixed one
+	CooldownSeconds int `json:"cooldown_seconds,omitempty"`
+
+	// Match, when set, replaces Operator and Threshold with a tree of device
+	// comparisons. Device still names the device the alert reports.
+	Match *ConditionTree `json:"match,omitempty"`
+
+	// ANOMALY conditions compare the latest reading with the Window readings
+	// before it, once at least MinSamples of them are known
+	Window     int     `json:"window,omitempty"`
+	StdDevs    float64 `json:"std_devs,omitempty"`
+	MinSamples int     `json:"min_samples,omitempty"`
+}
+
+// UnmarshalJSON accepts the threshold and level as JSON numbers or as strings,
+// since PostgREST returns some numeric column types as strings
+func (c *AlertCondition) UnmarshalJSON(data []byte) error {
+	type plainCondition AlertCondition
+	aux := struct {
+		*plainCondition
+		Threshold flexibleNumber `json:"threshold"`
+		Level     flexibleNumber `json:"level"`
+	}{plainCondition: (*plainCondition)(c)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	level := float64(aux.Level)
+	if level != math.Trunc(level) {
+		return fmt.Errorf("invalid condition level %v, expected an integer", level)
+	}
+	c.Threshold = float64(aux.Threshold)
+	c.Level = int(level)
+	return nil
+}
+
+// flexibleNumber decodes a JSON number or a string holding one. Null and
+// empty strings decode as 0.
+type flexibleNumber float64
+
+func (n *flexibleNumber) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		*n = 0
+	case float64:
+		*n = flexibleNumber(v)
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			*n = 0
+			return nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		*n = flexibleNumber(f)
+	default:
+		return fmt.Errorf("invalid number %s", data)
+	}
+	return nil
+}
+
+// ValueTransform maps a raw device value to value*Scale + Offset, e.g. a scale
+// of 0.1 for a register with an implied decimal. A zero Scale means 1.
+type ValueTransform struct {
+	Scale  float64 `json:"scale"`
+	Offset float64 `json:"offset"`
+}
+
+func (t ValueTransform) apply(value float64) float64 {
+	scale := t.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return value*scale + t.Offset
 }
 
 type AlertMessage struct {
-	Device    string   `json:"device"`
-	Current   float64  `json:"current"`
-	Threshold float64  `json:"threshold"`
-	Message   string   `json:"message"`
-	Unit      []string `json:"unit"`
-	Severity  string
+	Device       string   `json:"device"`
+	Current      float64  `json:"current"`       // Rounded to the rule's precision for display
+	Threshold    float64  `json:"threshold"`     // Rounded to the rule's precision for display
+	CurrentRaw   float64  `json:"current_raw"`   // Unrounded current value, for exact math downstream
+	ThresholdRaw float64  `json:"threshold_raw"` // Unrounded threshold
+	Message      string   `json:"message"`
+	Unit         []string `json:"unit"`
+	Severity     string
+	TriggeredAt  string `json:"triggered_at,omitempty"` // RFC 3339, in the configured timezone
+	DeviceName   string `json:"device_name,omitempty"`  // From the device metadata, the address when the device has none
+	Location     string `json:"location,omitempty"`     // From the device metadata
+	Instance     string `json:"instance,omitempty"`     // Topic levels matched by the rule's wildcard topics, e.g. "line1" of plant/line1/temp
+
+	level int // Severity as a level, before escalation
 }
 
 // NewAlertRule is used to create a new AlertRule with the given parameters.
@@ -67,35 +174,108 @@ func NewAlertRule(id string, topics []string, table, field, category, machine st
 	}
 }
 
+// setThrottlePeriod overrides the rule's cooldown with seconds, zero keeps
+// the default cooldown. Its conditions use it in place of their level
+// cooldown, see throttled.
+func (r *AlertRule) setThrottlePeriod(seconds int) {
+	r.ThrottlePeriod = seconds
+	if seconds > 0 {
+		r.CooldownPeriod = time.Duration(seconds) * time.Second
+	}
+}
+
+// throttled returns condition with the rule's throttle period as its fixed
+// cooldown, unless the condition sets its own
+func (r *AlertRule) throttled(condition AlertCondition) AlertCondition {
+	if condition.CooldownSeconds == 0 && r.ThrottlePeriod > 0 {
+		condition.CooldownSeconds = r.ThrottlePeriod
+	}
+	return condition
+}
+
+// conditionState is the outcome of evaluating a single condition
+type conditionState int
+
+const (
+	conditionUnknown   conditionState = iota // Payload couldn't be evaluated
+	conditionClear                           // Condition doesn't hold
+	conditionCooldown                        // Condition holds but the rule is in cooldown
+	conditionTriggered                       // Condition holds and should alert
+)
+
 // Evaluate processes the payload and triggers an alert if conditions are met
 func (r *AlertRule) Evaluate(payload map[string]any, condition AlertCondition) (bool, string) {
-	// Convert payload values to float64 for consistent comparison
-	floatPayload, err := r.convertPayload(payload)
-	if err != nil {
-		r.logger.Warn("Failed to convert payload", zap.Error(err))
+	state, alert := r.evaluateAlert(payload, nil, condition)
+	if state != conditionTriggered {
 		return false, ""
 	}
+	return true, r.marshalAlertMessage(alert)
+}
 
-	// Evaluate conditions with the converted payload
-	triggered, _ := r.evaluateConditions(floatPayload)
-	if !triggered {
-		return false, ""
+// evaluateAlert is Evaluate returning the condition state and the structured
+// alert instead of its JSON form. history backs trend conditions and may be nil.
+func (r *AlertRule) evaluateAlert(payload map[string]any, history deviceSamples, condition AlertCondition) (conditionState, AlertMessage) {
+	state, floatPayload := r.checkCondition(payload, history, condition)
+	if state != conditionTriggered {
+		return state, AlertMessage{}
 	}
 
+	alert := r.generateAlertMessage(condition, floatPayload)
+
 	// Check if we should alert based on cooldown period
-	if !r.shouldAlert(condition.ID) {
-		return false, ""
+	if !r.shouldAlert(condition) {
+		return conditionCooldown, alert
 	}
 
-	// Format the alert message
-	message := r.generateAlertMessage(condition, floatPayload[condition.Device])
-	return true, message
+	return conditionTriggered, alert
 }
 
-func (r *AlertRule) convertPayload(payload map[string]any) (map[string]float64, error) {
+// checkCondition evaluates the condition against the payload without touching
+// the cooldown state. It returns conditionTriggered when the condition holds.
+func (r *AlertRule) checkCondition(payload map[string]any, history deviceSamples, condition AlertCondition) (conditionState, map[string]float64) {
+	// Convert payload values to float64 for consistent comparison
+	floatPayload, exact, err := r.convertPayload(payload)
+	if err != nil {
+		r.logger.Warn("Failed to convert payload", zap.Error(err))
+		return conditionUnknown, nil
+	}
+
+	// Condition trees are unknown until the devices they depend on report
+	if condition.Match != nil {
+		result := r.evaluateTree(*condition.Match, floatPayload, exact)
+		switch {
+		case !result.known:
+			return conditionUnknown, floatPayload
+		case !result.held:
+			return conditionClear, floatPayload
+		}
+		return conditionTriggered, floatPayload
+	}
+
+	// Evaluate the condition with the converted payload
+	if !r.evaluateCondition(condition, floatPayload, exact, history) {
+		return conditionClear, floatPayload
+	}
+	return conditionTriggered, floatPayload
+}
+
+// convertPayload converts the payload values to float64. Integers, e.g. from
+// payloads decoded with UseNumber, are also returned exactly, so comparisons
+// of registers beyond float64's 2^53 precision don't round.
+func (r *AlertRule) convertPayload(payload map[string]any) (map[string]float64, map[string]int64, error) {
 	floatPayload := make(map[string]float64)
+	exact := make(map[string]int64)
 	for k, v := range payload {
 		switch val := v.(type) {
+		case json.Number:
+			f, err := val.Float64()
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not convert number %v to float for device %s", val, k)
+			}
+			floatPayload[k] = f
+			if i, err := val.Int64(); err == nil {
+				exact[k] = i
+			}
 		case float64:
 			floatPayload[k] = val
 		case float32:
@@ -106,42 +286,120 @@ func (r *AlertRule) convertPayload(payload map[string]any) (map[string]float64,
 			floatPayload[k] = float64(val)
 		case int64:
 			floatPayload[k] = float64(val)
+			exact[k] = val
+		case bool:
+			floatPayload[k] = boolToFloat(val)
 		case string:
 			if f, err := strconv.ParseFloat(val, 64); err == nil {
 				floatPayload[k] = f
 			} else {
-				return nil, fmt.Errorf("could not convert string value %v to float for device %s", val, k)
+				return nil, nil, fmt.Errorf("could not convert string value %v to float for device %s", val, k)
 			}
 		default:
-			return nil, fmt.Errorf("unsupported value type %T for device %s", v, k)
+			return nil, nil, fmt.Errorf("unsupported value type %T for device %s", v, k)
+		}
+		if transform, ok := r.Transforms[k]; ok {
+			floatPayload[k] = transform.apply(floatPayload[k])
+			delete(exact, k)
 		}
 	}
-	return floatPayload, nil
+	return floatPayload, exact, nil
 }
 
-// evaluateConditions checks the payload against the conditions and returns whether any condition is triggered.
-func (r *AlertRule) evaluateConditions(deviceValues map[string]float64) (bool, string) {
-	for _, condition := range r.Conditions {
-		// Check if condition contains complex logic (AND/OR)
-		if strings.Contains(condition.Operator, "AND") || strings.Contains(condition.Operator, "OR") {
-			if r.evaluateComplexCondition(condition.Operator, deviceValues) {
-				return true, condition.Device
-			}
-		} else {
-			// Simple condition
-			// if r.checkSimpleCondition(condition, deviceValues) {
-			// 	return true, condition.Device
-			// }
-			if r.evaluateComplexCondition(condition.Operator, deviceValues) {
-				return true, condition.Device
-			}
-		}
+// maxExactFloat bounds the integers float64 represents exactly
+const maxExactFloat = 1 << 53
+
+// operand is a side of a comparison, with its integer value when it is known
+// exactly
+type operand struct {
+	value   float64
+	integer int64
+	exact   bool
+}
+
+// deviceOperand returns the device's value as an operand, false when the
+// device has no value
+func deviceOperand(device string, values map[string]float64, exact map[string]int64) (operand, bool) {
+	value, ok := values[device]
+	if !ok {
+		return operand{}, false
+	}
+	i, isExact := exact[device]
+	return valueOperand(value, i, isExact), true
+}
+
+// valueOperand returns value as an operand, integral when it is known
+// exactly: from exact, or value itself when it is integral within float64's
+// precision
+func valueOperand(value float64, exact int64, isExact bool) operand {
+	if isExact {
+		return operand{value: value, integer: exact, exact: true}
+	}
+	if value == math.Trunc(value) && math.Abs(value) <= maxExactFloat {
+		return operand{value: value, integer: int64(value), exact: true}
+	}
+	return operand{value: value}
+}
+
+// compareOperands applies a comparison operator. Operands both known as
+// exact integers are compared as integers, others as floats.
+func compareOperands(operator string, a, b operand) (bool, error) {
+	if !isComparisonOperator(operator) {
+		return false, fmt.Errorf("unsupported operator %q", operator)
+	}
+
+	var c int
+	switch {
+	case a.exact && b.exact:
+		c = cmp.Compare(a.integer, b.integer)
+	case math.IsNaN(a.value) || math.IsNaN(b.value):
+		// NaN compares unequal to everything, like the float operators do
+		return operator == "!=", nil
+	default:
+		c = cmp.Compare(a.value, b.value)
+	}
+
+	switch operator {
+	case ">":
+		return c > 0, nil
+	case "<":
+		return c < 0, nil
+	case ">=":
+		return c >= 0, nil
+	case "<=":
+		return c <= 0, nil
+	case "==":
+		return c == 0, nil
+	default: // "!="
+		return c != 0, nil
 	}
-	return false, ""
+}
+
+// evaluateCondition checks the payload against a single condition of the rule.
+// Each condition alerts only when it holds itself: a rule used to raise the
+// alerts of all its conditions as soon as any of them held, reporting devices
+// that were fine, and conditions have their own cooldowns since.
+func (r *AlertRule) evaluateCondition(condition AlertCondition, deviceValues map[string]float64, exact map[string]int64, history deviceSamples) bool {
+	if condition.Match != nil {
+		return r.evaluateTree(*condition.Match, deviceValues, exact).held
+	}
+	if isTrendOperator(condition.Operator) {
+		return r.evaluateTrend(condition, history)
+	}
+	if isAnomalyOperator(condition.Operator) {
+		return r.evaluateAnomaly(condition, history)
+	}
+
+	if isComparisonOperator(condition.Operator) {
+		return r.checkSimpleCondition(condition, deviceValues, exact)
+	}
+
+	// Simple expressions ("D800 < 900") and complex ones (AND/OR) share the expression path
+	return r.evaluateComplexCondition(condition.Operator, deviceValues, exact)
 }
 
 // evaluateComplexCondition checks complex conditions with AND/OR logic
-func (r *AlertRule) evaluateComplexCondition(operator string, values map[string]float64) bool {
+func (r *AlertRule) evaluateComplexCondition(operator string, values map[string]float64, exact map[string]int64) bool {
 	// Split into individual conditions
 	var conditions []string
 	if strings.Contains(operator, "AND") {
@@ -157,15 +415,15 @@ func (r *AlertRule) evaluateComplexCondition(operator string, values map[string]
 
 	// Evaluate based on AND or OR logic
 	if strings.Contains(operator, "AND") {
-		return r.evaluateANDConditions(conditions, values)
+		return r.evaluateANDConditions(conditions, values, exact)
 	}
-	return r.evaluateORConditions(conditions, values)
+	return r.evaluateORConditions(conditions, values, exact)
 }
 
 // evaluateANDConditions evaluates all conditions with AND logic
-func (r *AlertRule) evaluateANDConditions(conditions []string, values map[string]float64) bool {
+func (r *AlertRule) evaluateANDConditions(conditions []string, values map[string]float64, exact map[string]int64) bool {
 	for _, cond := range conditions {
-		if !r.evaluateSingleCondition(cond, values) {
+		if !r.evaluateSingleCondition(cond, values, exact) {
 			return false
 		}
 
@@ -175,9 +433,9 @@ func (r *AlertRule) evaluateANDConditions(conditions []string, values map[string
 }
 
 // evaluateORConditions evaluates conditions with OR logic
-func (r *AlertRule) evaluateORConditions(conditions []string, values map[string]float64) bool {
+func (r *AlertRule) evaluateORConditions(conditions []string, values map[string]float64, exact map[string]int64) bool {
 	for _, cond := range conditions {
-		if r.evaluateSingleCondition(cond, values) {
+		if r.evaluateSingleCondition(cond, values, exact) {
 			return true
 		}
 	}
@@ -185,7 +443,7 @@ func (r *AlertRule) evaluateORConditions(conditions []string, values map[string]
 }
 
 // evaluateSingleCondition evaluates a single condition (e.g., "D800 < 900")
-func (r *AlertRule) evaluateSingleCondition(condition string, values map[string]float64) bool {
+func (r *AlertRule) evaluateSingleCondition(condition string, values map[string]float64, exact map[string]int64) bool {
 	// Parse the condition into parts
 	parts := strings.Fields(condition)
 	if len(parts) != 3 {
@@ -198,76 +456,97 @@ func (r *AlertRule) evaluateSingleCondition(condition string, values map[string]
 	thresholdStr := parts[2]
 
 	// Get device value
-	val, exists := values[device]
+	val, exists := deviceOperand(device, values, exact)
 	if !exists {
 		r.logger.Warn("Device not found in payload", zap.String("device", device))
 		return false
 	}
 
-	// Get threshold value (either number or reference to another device)
-	threshold, err := strconv.ParseFloat(thresholdStr, 64)
-	if err != nil {
-		// Try to get value from another device
-		if refVal, exists := values[thresholdStr]; exists {
-			threshold = refVal
-		} else {
-			r.logger.Warn("Invalid threshold in condition", zap.String("condition", condition))
-			return false
-		}
+	// Get threshold value (either number, boolean or reference to another device)
+	var threshold operand
+	if f, err := parseThreshold(thresholdStr); err == nil {
+		i, err := strconv.ParseInt(thresholdStr, 10, 64)
+		threshold = valueOperand(f, i, err == nil)
+	} else if threshold, exists = deviceOperand(thresholdStr, values, exact); !exists {
+		r.logger.Warn("Invalid threshold in condition", zap.String("condition", condition))
+		return false
 	}
 
 	// Perform the comparison
-	switch operator {
-	case ">":
-		return val > threshold
-	case "<":
-		return val < threshold
-	case ">=":
-		return val >= threshold
-	case "<=":
-		return val <= threshold
-	case "==":
-		return val == threshold
-	case "!=":
-		return val != threshold
-	default:
+	result, err := compareOperands(operator, val, threshold)
+	if err != nil {
 		r.logger.Warn("Unsupported operator", zap.String("operator", operator))
 		return false
 	}
+	return result
+}
+
+// parseThreshold parses a numeric threshold, mapping true/false to 1/0 like
+// boolean device values
+func parseThreshold(s string) (float64, error) {
+	switch s {
+	case "true":
+		return 1, nil
+	case "false":
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// isComparisonOperator reports whether operator is a bare comparison,
+// comparing the condition's Device with its threshold
+func isComparisonOperator(operator string) bool {
+	switch operator {
+	case ">", "<", ">=", "<=", "==", "!=":
+		return true
+	}
+	return false
 }
 
-// checkCondition evaluates a simple condition based on the operator and threshold
-func (r *AlertRule) checkSimpleCondition(condition AlertCondition, values map[string]float64) bool {
-	val, exists := values[condition.Device]
+// conditionThreshold is the value the condition's device is compared with,
+// the referenced device's value when ThresholdDevice is set
+func conditionThreshold(condition AlertCondition, values map[string]float64) (float64, bool) {
+	if condition.ThresholdDevice == "" {
+		return condition.Threshold, true
+	}
+	threshold, exists := values[condition.ThresholdDevice]
+	return threshold, exists
+}
 
+// checkSimpleCondition compares the condition's device with its static
+// threshold or the value of its threshold device
+func (r *AlertRule) checkSimpleCondition(condition AlertCondition, values map[string]float64, exact map[string]int64) bool {
+	val, exists := deviceOperand(condition.Device, values, exact)
 	if !exists {
 		return false
 	}
-	threshold := float64(condition.Threshold)
 
-	fmt.Println(condition.Operator)
+	threshold := valueOperand(condition.Threshold, 0, false)
+	if condition.ThresholdDevice != "" {
+		if threshold, exists = deviceOperand(condition.ThresholdDevice, values, exact); !exists {
+			r.logger.Warn("Threshold device not found in payload", zap.String("device", condition.ThresholdDevice))
+			return false
+		}
+	}
 
-	switch condition.Operator {
-	case ">":
-		return val > threshold
-	case "<":
-		return val < threshold
-	case ">=":
-		return val >= threshold
-	case "<=":
-		return val <= threshold
-	case "==":
-		return val == threshold
-	case "!=":
-		return val != threshold
-	default:
+	result, err := compareOperands(condition.Operator, val, threshold)
+	if err != nil {
 		r.logger.Warn("Unsupported operator", zap.String("operator", condition.Operator))
 		return false
 	}
+	return result
 }
 
-// shouldAlert checks if we should trigger an alert based on cooldown period
-func (r *AlertRule) shouldAlert(id int) bool {
+// shouldAlert checks if we should trigger an alert based on cooldown period,
+// the condition's own cooldown replacing the rule's when set
+func (r *AlertRule) shouldAlert(condition AlertCondition) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -275,41 +554,99 @@ func (r *AlertRule) shouldAlert(id int) bool {
 		r.LastAlertTime = make(map[int]time.Time)
 	}
 
-	now := time.Now()
-	lastAlert, exists := r.LastAlertTime[id]
+	now := r.now()
+	lastAlert, exists := r.LastAlertTime[condition.ID]
 
-	if !exists || now.Sub(lastAlert) >= r.CooldownPeriod {
-		r.LastAlertTime[id] = now
+	cooldown := r.CooldownPeriod
+	if condition.CooldownSeconds > 0 {
+		cooldown = time.Duration(condition.CooldownSeconds) * time.Second
+	}
+	if !exists || now.Sub(lastAlert) >= cooldown {
+		r.LastAlertTime[condition.ID] = now
 		return true
 	}
 
 	return false
 }
 
-// generateAlertMessage creates the formatted alert message
-func (r *AlertRule) generateAlertMessage(condition AlertCondition, value float64) string {
+// defaultAlertPrecision is the number of decimals alert values keep when
+// neither the rule nor the config sets one
+const defaultAlertPrecision = 1
+
+// roundTo rounds value to precision decimals, a negative precision leaves it as is
+func roundTo(value float64, precision int) float64 {
+	if precision < 0 {
+		return value
+	}
+	pow := math.Pow(10, float64(precision))
+	return math.Round(value*pow) / pow
+}
+
+// generateAlertMessage creates the alert for a triggered condition from the
+// device values, rounding them to the rule's precision. Values of transformed
+// devices keep at least two decimals, since a transform usually restores an
+// implied decimal point. The raw fields keep the unrounded values. With device
+// metadata the alert names and locates its device.
+func (r *AlertRule) generateAlertMessage(condition AlertCondition, values map[string]float64) AlertMessage {
+	precision := defaultAlertPrecision
+	if r.Precision != nil {
+		precision = *r.Precision
+	}
+
+	round := func(device string, value float64) float64 {
+		if _, ok := r.Transforms[device]; ok && precision >= 0 {
+			return roundTo(value, max(precision, 2))
+		}
+		return roundTo(value, precision)
+	}
+
+	rawThreshold, _ := conditionThreshold(condition, values)
+	threshold := roundTo(rawThreshold, precision)
+	if condition.ThresholdDevice != "" {
+		threshold = round(condition.ThresholdDevice, rawThreshold)
+	}
+
+	level := r.triggeredLevel(condition, values, nil)
 	alert := AlertMessage{
-		Device:    condition.Device,
-		Current:   math.Round(value),
-		Threshold: math.Round(float64(condition.Threshold)),
-		Message:   condition.MessageTemplate,
-		Unit:      condition.Unit,
-		Severity:  getLevelString(condition.Level),
+		Device:       condition.Device,
+		Current:      round(condition.Device, values[condition.Device]),
+		Threshold:    threshold,
+		CurrentRaw:   values[condition.Device],
+		ThresholdRaw: rawThreshold,
+		Message:      r.renderMessage(r.messageTemplate(condition), values, round),
+		Unit:         condition.Unit,
+		Severity:     getLevelString(level),
+		level:        level,
+	}
+	r.metadata.enrich(&alert)
+	return alert
+}
+
+// suppressedAlertMessage is the alert of a condition that isn't delivered
+// anyway, its values and level without the rendered message and the device
+// metadata, which might have to be loaded
+func (r *AlertRule) suppressedAlertMessage(condition AlertCondition, values map[string]float64) AlertMessage {
+	threshold, _ := conditionThreshold(condition, values)
+	level := r.triggeredLevel(condition, values, nil)
+	return AlertMessage{
+		Device:       condition.Device,
+		Current:      values[condition.Device],
+		Threshold:    threshold,
+		CurrentRaw:   values[condition.Device],
+		ThresholdRaw: threshold,
+		Unit:         condition.Unit,
+		Severity:     getLevelString(level),
+		level:        level,
 	}
+}
 
+// marshalAlertMessage renders the alert as the JSON message stored with the alert
+func (r *AlertRule) marshalAlertMessage(alert AlertMessage) string {
 	jsonBytes, err := json.Marshal(alert)
 	if err != nil {
 		r.logger.Warn("Failed to marshal alert message", zap.Error(err))
 		return "{}"
 	}
 
-	// Add severity prefix if not already present
-	// if !strings.HasPrefix(message, getLevelString(condition.Level)) {
-	// 	message = fmt.Sprintf("%s: %s", getLevelString(condition.Level), message)
-	// }
-
-	// Log for debugging
-	//fmt.Println("Generated message:", strings.ReplaceAll(msg, "{{value}}", fmt.Sprintf("%.2f", val)))
-
 	return string(jsonBytes)
 }
@@ -0,0 +1,65 @@
+package alert
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAlertConditionUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		json      string
+		threshold float64
+		level     int
+	}{
+		{"numbers", `{"device": "D100", "threshold": 12.5, "level": 2}`, 12.5, 2},
+		{"strings", `{"device": "D100", "threshold": "12.5", "level": "2"}`, 12.5, 2},
+		{"padded strings", `{"device": "D100", "threshold": " -3 ", "level": " 3"}`, -3, 3},
+		{"integral float level", `{"device": "D100", "threshold": 7, "level": 1.0}`, 7, 1},
+		{"nulls", `{"device": "D100", "threshold": null, "level": null}`, 0, 0},
+		{"missing", `{"device": "D100"}`, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var condition AlertCondition
+			if err := json.Unmarshal([]byte(tt.json), &condition); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if condition.Threshold != tt.threshold || condition.Level != tt.level {
+				t.Errorf("Expected threshold %v and level %d, got %v and %d", tt.threshold, tt.level, condition.Threshold, condition.Level)
+			}
+			if condition.Device != "D100" {
+				t.Errorf("Expected the other fields decoded as usual, got device %q", condition.Device)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		`{"threshold": "abc"}`,
+		`{"threshold": true}`,
+		`{"level": "2.5"}`,
+	} {
+		var condition AlertCondition
+		if err := json.Unmarshal([]byte(invalid), &condition); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+
+	// Conditions keep round-tripping through the rules cache
+	var conditions []AlertCondition
+	if err := json.Unmarshal([]byte(`[{"id": 1, "operator": "D1 > 5", "threshold": "5", "level": "3", "unit": ["C"]}]`), &conditions); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []AlertCondition
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0].ID != 1 || decoded[0].Threshold != 5 || decoded[0].Level != 3 || decoded[0].Unit[0] != "C" {
+		t.Errorf("Expected the condition to round-trip, got %+v", decoded)
+	}
+}
@@ -0,0 +1,67 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// writeRulesCache persists rules as the last-known-good rule set. The file is
+// replaced atomically so a crash mid-write never leaves a truncated cache.
+func writeRulesCache(path string, rules []AlertRule) error {
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create rules cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write rules cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write rules cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace rules cache: %w", err)
+	}
+	return nil
+}
+
+// readRulesCache loads the rule set persisted by writeRulesCache
+func readRulesCache(path string, logger *zap.Logger) ([]AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules cache: %w", err)
+	}
+
+	var cached []AlertRule
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules cache %s: %w", path, err)
+	}
+
+	rules := make([]AlertRule, len(cached))
+	for i := range cached {
+		c := &cached[i]
+		rules[i] = *NewAlertRule(c.ID, c.Topics, c.Table, c.Field, c.Category, c.Machine, c.Conditions, logger)
+		rules[i].Escalation = c.Escalation
+		rules[i].WarmupSeconds = c.WarmupSeconds
+		rules[i].Transforms = c.Transforms
+		rules[i].Precision = c.Precision
+		rules[i].IgnoreRetained = c.IgnoreRetained
+		rules[i].Priority = c.Priority
+		rules[i].setThrottlePeriod(c.ThrottlePeriod)
+		rules[i].MessageTemplates = c.MessageTemplates
+		rules[i].InstanceMatch = c.InstanceMatch
+		rules[i].QoS = c.QoS
+	}
+	return rules, nil
+}
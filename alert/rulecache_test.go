@@ -0,0 +1,86 @@
+package alert
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRulesCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	precision := 2
+
+	cached := []AlertRule{*NewAlertRule("boiler", []string{"sensor/boiler"}, "alerts", "value", "heating", "b1", []AlertCondition{
+		{ID: 1, Device: "temp", Operator: "temp > 90.5", Threshold: 90.5, Unit: []string{"°C"}, MessageTemplate: "Boiler hot", Level: LevelCritical},
+		{ID: 2, Device: "temp", Operator: OperatorRising, Count: 3, Level: LevelWarning},
+	}, zap.NewNop())}
+	rule := &cached[0]
+	rule.Escalation = &EscalationPolicy{After: 2}
+	rule.WarmupSeconds = 30
+	rule.Transforms = map[string]ValueTransform{"temp": {Scale: 0.1, Offset: -5}}
+	rule.Precision = &precision
+	rule.setThrottlePeriod(120)
+
+	if err := writeRulesCache(path, cached); err != nil {
+		t.Fatalf("writeRulesCache failed: %v", err)
+	}
+
+	loader := &SupabaseRuleLoader{cacheFile: path, logger: zap.NewNop()}
+	rules := loader.LastKnownRules()
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 cached rule, got %d", len(rules))
+	}
+
+	got := &rules[0]
+	if got.ID != "boiler" || got.Table != "alerts" || got.Field != "value" || got.Category != "heating" || got.Machine != "b1" {
+		t.Errorf("Rule fields not restored: id=%s table=%s field=%s category=%s machine=%s", got.ID, got.Table, got.Field, got.Category, got.Machine)
+	}
+	if len(got.Conditions) != 2 || got.Conditions[0].Threshold != 90.5 || got.Conditions[0].MessageTemplate != "Boiler hot" || got.Conditions[1].Count != 3 {
+		t.Errorf("Conditions not restored: %+v", got.Conditions)
+	}
+	if got.Escalation == nil || got.Escalation.After != 2 || got.WarmupSeconds != 30 {
+		t.Errorf("Escalation or warm-up not restored: %+v, %d", got.Escalation, got.WarmupSeconds)
+	}
+	if got.Transforms["temp"] != (ValueTransform{Scale: 0.1, Offset: -5}) || got.Precision == nil || *got.Precision != 2 {
+		t.Errorf("Transforms or precision not restored: %+v, %v", got.Transforms, got.Precision)
+	}
+	if got.ThrottlePeriod != 120 || got.CooldownPeriod != 2*time.Minute {
+		t.Errorf("Throttle period not restored: %d, cooldown %s", got.ThrottlePeriod, got.CooldownPeriod)
+	}
+	if got.logger == nil || got.CooldownPeriod == 0 {
+		t.Error("Expected cached rule to be initialized like a loaded one")
+	}
+}
+
+func TestRulesCacheCorruptOrMissing(t *testing.T) {
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`[{"id": "trunc`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readRulesCache(corrupt, zap.NewNop()); err == nil {
+		t.Error("Expected an error for a corrupt rules cache")
+	}
+
+	for _, path := range []string{corrupt, filepath.Join(dir, "missing.json"), ""} {
+		loader := &SupabaseRuleLoader{cacheFile: path, logger: zap.NewNop()}
+		if rules := loader.LastKnownRules(); rules != nil {
+			t.Errorf("Expected no rules from %q, got %d", path, len(rules))
+		}
+	}
+
+	// A successful load replaces the corrupt file
+	if err := writeRulesCache(corrupt, []AlertRule{*NewAlertRule("ok", nil, "alerts", "", "", "", nil, zap.NewNop())}); err != nil {
+		t.Fatalf("writeRulesCache failed: %v", err)
+	}
+	if rules, err := readRulesCache(corrupt, zap.NewNop()); err != nil || len(rules) != 1 {
+		t.Errorf("Expected rewritten cache to load, got %d rules, err %v", len(rules), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no temporary files left behind, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,159 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field types understood by PayloadSchema
+const (
+	FieldString  = "string"
+	FieldNumber  = "number"  // JSON number
+	FieldNumeric = "numeric" // JSON number or a string holding one
+	FieldBool    = "bool"
+	FieldObject  = "object"
+	FieldArray   = "array"
+	FieldAny     = "any"
+)
+
+// PayloadSchema is a lightweight field-type spec incoming MQTT payloads are
+// validated against, e.g. "address:string,value:numeric,seq:number?".
+// Fields suffixed with "?" are optional; fields not listed are ignored.
+type PayloadSchema struct {
+	fields []schemaField
+}
+
+type schemaField struct {
+	name     string
+	kind     string
+	optional bool
+}
+
+// PayloadValidationError describes why a payload doesn't match the schema
+type PayloadValidationError struct {
+	Field    string
+	Expected string
+	Got      string // JSON type of the value, empty when the field is missing
+}
+
+func (e *PayloadValidationError) Error() string {
+	if e.Got == "" {
+		return fmt.Sprintf("missing field %q", e.Field)
+	}
+	return fmt.Sprintf("field %q is %s, expected %s", e.Field, e.Got, e.Expected)
+}
+
+// Reason is a short label for the failure, used for metrics
+func (e *PayloadValidationError) Reason() string {
+	if e.Got == "" {
+		return "missing_field"
+	}
+	return "type_mismatch"
+}
+
+// ParsePayloadSchema parses a comma-separated list of name:type fields.
+// An empty spec returns a nil schema, which accepts every payload.
+func ParsePayloadSchema(spec string) (*PayloadSchema, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	schema := &PayloadSchema{}
+	for _, part := range strings.Split(spec, ",") {
+		name, kind, ok := strings.Cut(strings.TrimSpace(part), ":")
+		name, kind = strings.TrimSpace(name), strings.TrimSpace(kind)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid payload schema field %q, expected name:type", part)
+		}
+
+		field := schemaField{name: name}
+		field.kind, field.optional = strings.CutSuffix(kind, "?")
+
+		switch field.kind {
+		case FieldString, FieldNumber, FieldNumeric, FieldBool, FieldObject, FieldArray, FieldAny:
+		default:
+			return nil, fmt.Errorf("unknown type %q for payload schema field %q", field.kind, name)
+		}
+		schema.fields = append(schema.fields, field)
+	}
+	return schema, nil
+}
+
+// Validate checks the decoded payload against the schema. A nil schema
+// accepts every payload.
+func (s *PayloadSchema) Validate(msg map[string]any) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, field := range s.fields {
+		value, ok := msg[field.name]
+		if !ok {
+			if field.optional {
+				continue
+			}
+			return &PayloadValidationError{Field: field.name, Expected: field.kind}
+		}
+		if !matchesFieldType(value, field.kind) {
+			return &PayloadValidationError{Field: field.name, Expected: field.kind, Got: jsonTypeName(value)}
+		}
+	}
+	return nil
+}
+
+func matchesFieldType(value any, kind string) bool {
+	switch kind {
+	case FieldAny:
+		return true
+	case FieldString:
+		_, ok := value.(string)
+		return ok
+	case FieldNumber:
+		switch value.(type) {
+		case float64, json.Number:
+			return true
+		}
+		return false
+	case FieldNumeric:
+		switch v := value.(type) {
+		case float64, json.Number:
+			return true
+		case string:
+			_, err := strconv.ParseFloat(v, 64)
+			return err == nil
+		}
+		return false
+	case FieldBool:
+		_, ok := value.(bool)
+		return ok
+	case FieldObject:
+		_, ok := value.(map[string]any)
+		return ok
+	case FieldArray:
+		_, ok := value.([]any)
+		return ok
+	}
+	return false
+}
+
+// jsonTypeName names the JSON type of a value decoded by encoding/json
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return FieldString
+	case float64, json.Number:
+		return FieldNumber
+	case bool:
+		return FieldBool
+	case map[string]any:
+		return FieldObject
+	case []any:
+		return FieldArray
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
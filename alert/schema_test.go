@@ -0,0 +1,82 @@
+package alert
+
+import (
+	"context"
+	"testing"
+
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParsePayloadSchema(t *testing.T) {
+	if schema, err := ParsePayloadSchema(""); err != nil || schema != nil {
+		t.Errorf("Expected empty spec to disable validation, got %v, %v", schema, err)
+	}
+	if _, err := ParsePayloadSchema("address:string, value:numeric, seq:number?"); err != nil {
+		t.Errorf("Expected valid spec, got %v", err)
+	}
+	for _, spec := range []string{"address", ":string", "value:float"} {
+		if _, err := ParsePayloadSchema(spec); err == nil {
+			t.Errorf("Expected spec %q to be rejected", spec)
+		}
+	}
+}
+
+func TestHandleMQTTMessageSchemaValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		reason  string // Empty when the payload is accepted
+	}{
+		{"valid", `{"address": "device1", "value": 15}`, ""},
+		{"valid numeric string", `{"address": "device1", "value": "15.5", "seq": 3}`, ""},
+		{"type mismatch", `{"address": "device1", "value": true}`, "type_mismatch"},
+		{"optional type mismatch", `{"address": "device1", "value": 15, "seq": "3"}`, "type_mismatch"},
+		{"missing field", `{"address": "device1"}`, "missing_field"},
+	}
+
+	cfg := config.Config{PayloadSchema: "address:string,value:numeric,seq:number?"}
+	key := cacheKey{Topic: "sensor/device1", Address: "device1"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.WarnLevel)
+			rm := NewRuleManager(context.Background(), nil, cfg, &RecordingInserter{}, zap.New(core))
+			defer rm.Shutdown()
+
+			var before float64
+			if tt.reason != "" {
+				before = testutil.ToFloat64(metrics.InvalidPayloads.WithLabelValues(tt.reason))
+			}
+
+			rm.HandleMQTTMessage("sensor/device1", []byte(tt.payload), cfg)
+
+			_, cached := rm.deviceCache.get(key)
+			if tt.reason == "" {
+				if !cached {
+					t.Error("Expected valid payload to be cached")
+				}
+				if logs.FilterMessage("Rejected payload").Len() != 0 {
+					t.Error("Expected valid payload not to be rejected")
+				}
+				return
+			}
+
+			if cached {
+				t.Error("Expected invalid payload to be dropped")
+			}
+			if got := testutil.ToFloat64(metrics.InvalidPayloads.WithLabelValues(tt.reason)) - before; got != 1 {
+				t.Errorf("Expected %s counter to increase by 1, got %v", tt.reason, got)
+			}
+			rejected := logs.FilterMessage("Rejected payload").All()
+			if len(rejected) != 1 || rejected[0].ContextMap()["reason"] == "" {
+				t.Errorf("Expected rejection to be logged with a reason, got %v", rejected)
+			}
+		})
+	}
+}
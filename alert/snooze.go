@@ -0,0 +1,85 @@
+package alert
+
+import "time"
+
+// Snooze mutes the alert for alertKey (ruleID_conditionID_level) for d,
+// without touching the rule or its other conditions. Unlike an ack the snooze
+// outlasts the condition clearing; once it expires the alert fires again as
+// usual. A non-positive d lifts the snooze.
+func (m *RuleManager) Snooze(alertKey string, d time.Duration) {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	m.pruneSnoozes()
+	if d <= 0 {
+		delete(m.snoozed, alertKey)
+		return
+	}
+	m.snoozed[alertKey] = m.now().Add(d)
+}
+
+// isSnoozed reports whether alerts for alertKey are snoozed, forgetting
+// expired snoozes
+func (m *RuleManager) isSnoozed(alertKey string) bool {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	until, ok := m.snoozed[alertKey]
+	if !ok {
+		return false
+	}
+	if !m.now().Before(until) {
+		delete(m.snoozed, alertKey)
+		return false
+	}
+	return true
+}
+
+// SnoozeRule mutes every alert of the rule ruleID until the given time. The
+// snooze is kept by rule ID, so it outlasts rule reloads. A time that isn't in
+// the future lifts the snooze.
+func (m *RuleManager) SnoozeRule(ruleID string, until time.Time) {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	m.pruneSnoozes()
+	if !until.After(m.now()) {
+		delete(m.snoozedRules, ruleID)
+		return
+	}
+	m.snoozedRules[ruleID] = until
+}
+
+// isRuleSnoozed reports whether the alerts of ruleID are snoozed, forgetting
+// an expired snooze
+func (m *RuleManager) isRuleSnoozed(ruleID string) bool {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	until, ok := m.snoozedRules[ruleID]
+	if !ok {
+		return false
+	}
+	if !m.now().Before(until) {
+		delete(m.snoozedRules, ruleID)
+		return false
+	}
+	return true
+}
+
+// pruneSnoozes forgets the expired snoozes, those of alerts and rules that
+// are never looked up again, e.g. of removed rules, included. Each snooze
+// prunes, so only live snoozes pile up. Callers hold alertMu.
+func (m *RuleManager) pruneSnoozes() {
+	now := m.now()
+	for alertKey, until := range m.snoozed {
+		if !now.Before(until) {
+			delete(m.snoozed, alertKey)
+		}
+	}
+	for ruleID, until := range m.snoozedRules {
+		if !now.Before(until) {
+			delete(m.snoozedRules, ruleID)
+		}
+	}
+}
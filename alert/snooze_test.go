@@ -0,0 +1,163 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestSnoozeMutesUntilExpiry(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	rules := []AlertRule{
+		*NewAlertRule("snooze", []string{"sensor/device1"}, "alerts", "", "line", "m1", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(&RecordingInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+
+	evaluate := func() AlertResult {
+		t.Helper()
+		rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 15, timestamp: clock.Now()})
+		rm.evaluateRule(&rm.Rules[0], cfg)
+		if len(results) == 0 {
+			t.Fatal("Expected an alert result")
+		}
+		return results[len(results)-1]
+	}
+
+	if result := evaluate(); result.Status != AlertDelivered {
+		t.Fatalf("Expected the first alert to be delivered, got %+v", result)
+	}
+
+	rm.Snooze("snooze_1_1", time.Hour)
+
+	// Past every cooldown, but within the snooze
+	clock.Advance(45 * time.Minute)
+	if result := evaluate(); result.Status != AlertSuppressed || result.Reason != "snoozed" {
+		t.Errorf("Expected the snoozed alert to be suppressed, got %+v", result)
+	}
+
+	// Clearing doesn't lift a snooze, unlike an ack
+	rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 5, timestamp: clock.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	if !rm.isSnoozed("snooze_1_1") {
+		t.Error("Expected the snooze to outlast the condition clearing")
+	}
+
+	clock.Advance(15 * time.Minute)
+	if result := evaluate(); result.Status != AlertDelivered {
+		t.Errorf("Expected the alert to fire once the snooze expired, got %+v", result)
+	}
+}
+
+func TestSnoozeLifted(t *testing.T) {
+	rm := NewManager(context.Background(), nil, config.Config{}, WithInserter(&RecordingInserter{}))
+	defer rm.Shutdown()
+
+	rm.Snooze("rule_1_1", time.Hour)
+	rm.Snooze("rule_1_1", 0)
+	if rm.isSnoozed("rule_1_1") {
+		t.Error("Expected a zero duration to lift the snooze")
+	}
+}
+
+func TestSnoozeRuleUntilExpiry(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	newRules := func() []AlertRule {
+		return []AlertRule{
+			*NewAlertRule("pump", []string{"sensor/device1"}, "alerts", "", "line", "m1", []AlertCondition{
+				{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelWarning},
+				{ID: 2, Device: "device1", Operator: "device1 > 50", Threshold: 50, Level: LevelCritical},
+			}, zap.NewNop()),
+		}
+	}
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), newRules(), cfg, WithInserter(&RecordingInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+	evaluate := func() []AlertResult {
+		results = nil
+		rm.deviceCache.set(cacheKey{Topic: "sensor/device1", Address: "device1"}, cachedValue{value: 60, timestamp: clock.Now()})
+		rm.evaluateRule(&rm.Rules[0], cfg)
+		return results
+	}
+
+	rm.SnoozeRule("pump", clock.Now().Add(2*time.Hour))
+
+	// Every condition of the rule is muted, also after a reload
+	for _, result := range evaluate() {
+		if result.Status != AlertSuppressed || result.Reason != "snoozed" {
+			t.Errorf("Expected the snoozed rule to be suppressed, got %+v", result)
+		}
+	}
+	rm.UpdateRules(newRules(), cfg)
+	clock.Advance(time.Hour)
+	for _, result := range evaluate() {
+		if result.Status != AlertSuppressed || result.Reason != "snoozed" {
+			t.Errorf("Expected the snooze to outlast the reload, got %+v", result)
+		}
+	}
+
+	clock.Advance(time.Hour)
+	delivered := 0
+	for _, result := range evaluate() {
+		if result.Status == AlertDelivered {
+			delivered++
+		}
+	}
+	if delivered == 0 {
+		t.Errorf("Expected the rule to fire once the snooze expired, got %+v", results)
+	}
+}
+
+func TestSnoozeRuleLifted(t *testing.T) {
+	rm := NewManager(context.Background(), nil, config.Config{}, WithInserter(&RecordingInserter{}))
+	defer rm.Shutdown()
+
+	rm.SnoozeRule("pump", time.Now().Add(time.Hour))
+	if !rm.isRuleSnoozed("pump") || rm.isRuleSnoozed("other") {
+		t.Error("Expected only the snoozed rule to be muted")
+	}
+	rm.SnoozeRule("pump", time.Now().Add(-time.Minute))
+	if rm.isRuleSnoozed("pump") {
+		t.Error("Expected a past time to lift the snooze")
+	}
+}
+
+func TestSnoozesPruned(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	rm := NewManager(context.Background(), nil, config.Config{}, WithInserter(&RecordingInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	// Snoozes of alerts and rules that are never evaluated again
+	rm.Snooze("removed_1_1", time.Minute)
+	rm.SnoozeRule("removed", clock.Now().Add(time.Minute))
+
+	clock.Advance(2 * time.Minute)
+	rm.Snooze("pump_1_1", time.Hour)
+	rm.SnoozeRule("pump", clock.Now().Add(time.Hour))
+
+	rm.alertMu.Lock()
+	defer rm.alertMu.Unlock()
+	if _, ok := rm.snoozed["removed_1_1"]; ok || len(rm.snoozed) != 1 {
+		t.Errorf("Expected only the live alert snooze kept, got %v", rm.snoozed)
+	}
+	if _, ok := rm.snoozedRules["removed"]; ok || len(rm.snoozedRules) != 1 {
+		t.Errorf("Expected only the live rule snooze kept, got %v", rm.snoozedRules)
+	}
+}
@@ -0,0 +1,315 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"goalert-engine/config"
+	"math"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// sparkplugNamespace is the first topic segment of Sparkplug B messages:
+// spBv1.0/<group>/<message type>/<edge node>[/<device>]
+const sparkplugNamespace = "spBv1.0"
+
+// Field numbers of the Sparkplug B Payload and Payload.Metric messages
+const (
+	spPayloadMetrics = 2
+
+	spMetricName     = 1
+	spMetricAlias    = 2
+	spMetricDatatype = 4
+	spMetricIsNull   = 7
+	spMetricInt      = 10
+	spMetricLong     = 11
+	spMetricFloat    = 12
+	spMetricDouble   = 13
+	spMetricBoolean  = 14
+	spMetricString   = 15
+)
+
+// Sparkplug B metric data types carried in int_value and long_value
+const (
+	spInt8  = 1
+	spInt16 = 2
+	spInt32 = 3
+	spInt64 = 4
+)
+
+var errNotSparkplug = errors.New("not a Sparkplug B topic")
+
+// SparkplugDecoder decodes Sparkplug B payloads, emitting one value per
+// metric. Each metric is cached under the data topic extended by its address,
+// e.g. spBv1.0/Plant/DDATA/Edge1/PLC1/Temperature, the address being the
+// metric name mapped through MetricMap or, when unmapped, the name with
+// topic separators and wildcards replaced by "_".
+//
+// Aliases are learned from NBIRTH and DBIRTH messages, which must therefore
+// be subscribed to as well, and their values are emitted like NDATA/DDATA.
+// Other message types are ignored.
+type SparkplugDecoder struct {
+	MetricMap map[string]string
+
+	mu      sync.Mutex
+	aliases map[string]map[uint64]string // Metric names by alias per edge node
+}
+
+func newSparkplugDecoder(cfg config.Config) (PayloadDecoder, error) {
+	metricMap, err := ParseMetricMap(cfg.SparkplugMetricMap)
+	if err != nil {
+		return nil, err
+	}
+	return &SparkplugDecoder{MetricMap: metricMap}, nil
+}
+
+// ParseMetricMap parses "name:address" pairs separated by commas, e.g.
+// "Line 1/Temperature:D100,Line 1/Speed:D101". Names may contain ":", the
+// address follows the last one.
+func ParseMetricMap(spec string) (map[string]string, error) {
+	metricMap := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid metric mapping %q, expected name:address", entry)
+		}
+		metricMap[strings.TrimSpace(entry[:i])] = strings.TrimSpace(entry[i+1:])
+	}
+	return metricMap, nil
+}
+
+// sparkplugTopic is a parsed Sparkplug B topic
+type sparkplugTopic struct {
+	group, messageType, node, device string
+}
+
+func parseSparkplugTopic(topic string) (sparkplugTopic, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != sparkplugNamespace {
+		return sparkplugTopic{}, fmt.Errorf("%w: %q", errNotSparkplug, topic)
+	}
+	t := sparkplugTopic{group: parts[1], messageType: parts[2], node: parts[3]}
+	if len(parts) == 5 {
+		t.device = parts[4]
+	}
+	return t, nil
+}
+
+// dataTopic is the NDATA/DDATA topic of the node or device
+func (t sparkplugTopic) dataTopic() string {
+	if t.device == "" {
+		return strings.Join([]string{sparkplugNamespace, t.group, "NDATA", t.node}, "/")
+	}
+	return strings.Join([]string{sparkplugNamespace, t.group, "DDATA", t.node, t.device}, "/")
+}
+
+// Decode implements PayloadDecoder, returning the first metric of the payload
+func (d *SparkplugDecoder) Decode(payload []byte, topic string) (string, any, error) {
+	values, err := d.DecodeAll(payload, topic)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(values) == 0 {
+		return "", nil, ErrMissingValue
+	}
+	return values[0].Address, values[0].Value, nil
+}
+
+// DecodeAll implements MultiPayloadDecoder
+func (d *SparkplugDecoder) DecodeAll(payload []byte, topic string) ([]DecodedValue, error) {
+	t, err := parseSparkplugTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	birth := false
+	switch t.messageType {
+	case "NBIRTH", "DBIRTH":
+		birth = true
+	case "NDATA", "DDATA":
+	default:
+		return nil, nil
+	}
+
+	metrics, err := parseSparkplugPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Aliases are unique per edge node and an NBIRTH starts a new session
+	nodeKey := t.group + "/" + t.node
+	if d.aliases == nil {
+		d.aliases = make(map[string]map[uint64]string)
+	}
+	if t.messageType == "NBIRTH" || d.aliases[nodeKey] == nil {
+		d.aliases[nodeKey] = make(map[uint64]string)
+	}
+	aliases := d.aliases[nodeKey]
+
+	base := t.dataTopic()
+	var values []DecodedValue
+	for _, metric := range metrics {
+		name := metric.name
+		if birth && metric.hasAlias && name != "" {
+			aliases[metric.alias] = name
+		}
+		if name == "" && metric.hasAlias {
+			name = aliases[metric.alias]
+		}
+		if name == "" || metric.value == nil {
+			continue // Unknown alias or null value
+		}
+
+		address := d.address(name)
+		values = append(values, DecodedValue{
+			Topic:   base + "/" + address,
+			Address: address,
+			Value:   metric.value,
+		})
+	}
+	return values, nil
+}
+
+// address maps a metric name to the device address rules refer to it by
+func (d *SparkplugDecoder) address(name string) string {
+	if address, ok := d.MetricMap[name]; ok {
+		return address
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// sparkplugMetric is the part of a Payload.Metric the engine uses
+type sparkplugMetric struct {
+	name     string
+	alias    uint64
+	hasAlias bool
+	value    any // float64, bool or string, nil when null or unsupported
+}
+
+// parseSparkplugPayload extracts the metrics of a Sparkplug B Payload
+func parseSparkplugPayload(payload []byte) ([]sparkplugMetric, error) {
+	var metrics []sparkplugMetric
+	err := walkFields(payload, func(num protowire.Number, typ protowire.Type, b []byte, v uint64) error {
+		if num != spPayloadMetrics || typ != protowire.BytesType {
+			return nil
+		}
+		metric, err := parseSparkplugMetric(b)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, metric)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Sparkplug payload: %w", err)
+	}
+	return metrics, nil
+}
+
+func parseSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	var (
+		metric   sparkplugMetric
+		datatype uint64
+		isNull   bool
+		raw      uint64 // int_value or long_value, signed per datatype
+		hasRaw   bool
+		value    any
+	)
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, b []byte, v uint64) error {
+		switch {
+		case num == spMetricName && typ == protowire.BytesType:
+			metric.name = string(b)
+		case num == spMetricAlias && typ == protowire.VarintType:
+			metric.alias, metric.hasAlias = v, true
+		case num == spMetricDatatype && typ == protowire.VarintType:
+			datatype = v
+		case num == spMetricIsNull && typ == protowire.VarintType:
+			isNull = v != 0
+		case (num == spMetricInt || num == spMetricLong) && typ == protowire.VarintType:
+			raw, hasRaw = v, true
+		case num == spMetricFloat && typ == protowire.Fixed32Type:
+			value = float64(math.Float32frombits(uint32(v)))
+		case num == spMetricDouble && typ == protowire.Fixed64Type:
+			value = math.Float64frombits(v)
+		case num == spMetricBoolean && typ == protowire.VarintType:
+			value = v != 0
+		case num == spMetricString && typ == protowire.BytesType:
+			value = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return sparkplugMetric{}, err
+	}
+
+	if hasRaw {
+		switch datatype {
+		case spInt8, spInt16, spInt32:
+			value = float64(int32(raw))
+		case spInt64:
+			value = float64(int64(raw))
+		default:
+			value = float64(raw)
+		}
+	}
+	if !isNull {
+		metric.value = value
+	}
+	return metric, nil
+}
+
+// walkFields calls fn for each field of a protobuf message with the field's
+// bytes for length-delimited fields and its value otherwise. Groups are
+// skipped.
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte, v uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v     uint64
+			bytes []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, bytes, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package alert
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"goalert-engine/config"
+
+	"go.opentelemetry.io/otel"
+	"go.uber.org/zap"
+)
+
+// readSparkplugPayload loads a Sparkplug B payload recorded from an edge node
+func readSparkplugPayload(t *testing.T, name string) []byte {
+	t.Helper()
+	payload, err := os.ReadFile("testdata/sparkplug/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestSparkplugDecoder(t *testing.T) {
+	decoder := &SparkplugDecoder{MetricMap: map[string]string{"Temperature": "D100"}}
+
+	nbirth, err := decoder.DecodeAll(readSparkplugPayload(t, "nbirth.bin"), "spBv1.0/Plant/NBIRTH/Edge1")
+	if err != nil {
+		t.Fatalf("Decoding NBIRTH failed: %v", err)
+	}
+	wantBirth := []DecodedValue{
+		{"spBv1.0/Plant/NDATA/Edge1/Node_Control_Rebirth", "Node_Control_Rebirth", false},
+		{"spBv1.0/Plant/NDATA/Edge1/Uptime", "Uptime", 3600.0},
+	}
+	assertDecodedValues(t, "NBIRTH", nbirth, wantBirth)
+
+	dbirth, err := decoder.DecodeAll(readSparkplugPayload(t, "dbirth.bin"), "spBv1.0/Plant/DBIRTH/Edge1/PLC1")
+	if err != nil {
+		t.Fatalf("Decoding DBIRTH failed: %v", err)
+	}
+	assertDecodedValues(t, "DBIRTH", dbirth, []DecodedValue{
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/D100", "D100", 21.5},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Line_1_Speed", "Line_1_Speed", -5.0},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Running", "Running", true},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Mode", "Mode", "AUTO"},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Counter", "Counter", -2.0},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Pressure", "Pressure", 1.5},
+	})
+
+	// DDATA only carries aliases. The null Mode and the metric with an
+	// alias missing from the birth are skipped.
+	ddata, err := decoder.DecodeAll(readSparkplugPayload(t, "ddata.bin"), "spBv1.0/Plant/DDATA/Edge1/PLC1")
+	if err != nil {
+		t.Fatalf("Decoding DDATA failed: %v", err)
+	}
+	assertDecodedValues(t, "DDATA", ddata, []DecodedValue{
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/D100", "D100", 85.25},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Line_1_Speed", "Line_1_Speed", 1200.0},
+		{"spBv1.0/Plant/DDATA/Edge1/PLC1/Pressure", "Pressure", 2.25},
+	})
+
+	address, value, err := decoder.Decode(readSparkplugPayload(t, "ddata.bin"), "spBv1.0/Plant/DDATA/Edge1/PLC1")
+	if err != nil || address != "D100" || value != 85.25 {
+		t.Errorf("Decode() = %s=%v, %v, want D100=85.25", address, value, err)
+	}
+
+	// A new session forgets the aliases of the previous one
+	if _, err := decoder.DecodeAll(readSparkplugPayload(t, "nbirth.bin"), "spBv1.0/Plant/NBIRTH/Edge1"); err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := decoder.DecodeAll(readSparkplugPayload(t, "ddata.bin"), "spBv1.0/Plant/DDATA/Edge1/PLC1"); len(values) != 0 {
+		t.Errorf("Expected no values before the device's rebirth, got %v", values)
+	}
+}
+
+func assertDecodedValues(t *testing.T, message string, got, want []DecodedValue) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: expected %d values, got %v", message, len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s: value %d = %v, want %v", message, i, got[i], want[i])
+		}
+	}
+}
+
+func TestSparkplugDecoderIgnoresOtherMessages(t *testing.T) {
+	decoder := &SparkplugDecoder{}
+
+	for _, topic := range []string{"spBv1.0/Plant/NDEATH/Edge1", "spBv1.0/Plant/DCMD/Edge1/PLC1"} {
+		values, err := decoder.DecodeAll([]byte{0xff}, topic)
+		if err != nil || values != nil {
+			t.Errorf("DecodeAll(%s) = %v, %v, want nothing", topic, values, err)
+		}
+	}
+
+	if _, err := decoder.DecodeAll(nil, "plant/line1/D100"); !errors.Is(err, errNotSparkplug) {
+		t.Errorf("Expected errNotSparkplug, got %v", err)
+	}
+
+	payload := readSparkplugPayload(t, "dbirth.bin")
+	if _, err := decoder.DecodeAll(payload[:len(payload)-20], "spBv1.0/Plant/DBIRTH/Edge1/PLC1"); err == nil {
+		t.Error("Expected an error for a truncated payload")
+	}
+}
+
+func TestParseMetricMap(t *testing.T) {
+	got, err := ParseMetricMap("Temperature:D100, Line 1/Speed:D101,ns:Mode:D102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"Temperature": "D100", "Line 1/Speed": "D101", "ns:Mode": "D102"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for name, address := range want {
+		if got[name] != address {
+			t.Errorf("Expected %s mapped to %s, got %q", name, address, got[name])
+		}
+	}
+
+	for _, spec := range []string{"Temperature", ":D100", "Temperature:"} {
+		if _, err := ParseMetricMap(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestHandleSparkplugMessage(t *testing.T) {
+	rules := []AlertRule{
+		{ID: "temperature", Topics: []string{"spBv1.0/Plant/DDATA/Edge1/PLC1/D100"}},
+		{ID: "mode", Topics: []string{"spBv1.0/Plant/DDATA/Edge1/PLC1/Mode"}},
+	}
+
+	decoder, err := NewDecoder(config.Config{PayloadFormat: FormatSparkplug, SparkplugMetricMap: "Temperature:D100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the manager without workers so signals stay in the channels
+	rm := &RuleManager{
+		Rules:       rules,
+		deviceCache: newDeviceCache(),
+		cacheLRU:    newCacheLRU(),
+		instances:   newInstanceIndex(),
+		history:     newSampleHistory(0),
+		decoder:     decoder,
+		tracer:      otel.Tracer(tracerName),
+		topicIndex:  newTopicIndex(rules),
+		ruleChans:   make(map[string]chan ruleSignal),
+		started:     true,
+		logger:      zap.NewNop(),
+	}
+	for _, ruleID := range []string{"temperature", "mode"} {
+		rm.ruleChans[ruleID] = make(chan ruleSignal, 1)
+	}
+
+	rm.HandleMQTTMessage("spBv1.0/Plant/DBIRTH/Edge1/PLC1", readSparkplugPayload(t, "dbirth.bin"), config.Config{})
+	for _, ch := range rm.ruleChans {
+		<-ch
+	}
+
+	rm.HandleMQTTMessage("spBv1.0/Plant/DDATA/Edge1/PLC1", readSparkplugPayload(t, "ddata.bin"), config.Config{})
+
+	cached, ok := rm.deviceCache.get(cacheKey{Topic: "spBv1.0/Plant/DDATA/Edge1/PLC1/D100", Address: "D100"})
+	if !ok || cached.value != 85.25 {
+		t.Errorf("Expected D100 cached as 85.25, got %v (cached %v)", cached.value, ok)
+	}
+	if len(rm.ruleChans["temperature"]) != 1 {
+		t.Error("Expected the temperature rule to be signaled")
+	}
+	if len(rm.ruleChans["mode"]) != 0 {
+		t.Error("Expected the mode rule not to be signaled by a null value")
+	}
+}
@@ -0,0 +1,137 @@
+package alert
+
+import "time"
+
+// ManagerStats is a snapshot of the manager's internal counters
+type ManagerStats struct {
+	Rules            int                  // Rules being evaluated
+	CachedValues     int                  // Device values in the cache
+	AlertsTriggered  uint64               // Alerts that passed cooldown since the manager started
+	AlertsInCooldown int                  // Conditions whose cooldown hasn't expired yet
+	LastAlertTimes   map[string]time.Time // Rule ID -> time of its latest alert, rules that never alerted are omitted
+}
+
+// Stats returns a snapshot of the manager's counters
+func (m *RuleManager) Stats() ManagerStats {
+	// Collect the alert keys first, the alert state is locked separately
+	type conditionKey struct {
+		rule      *AlertRule
+		key       string
+		condition AlertCondition
+	}
+
+	m.mu.RLock()
+	stats := ManagerStats{
+		Rules:          len(m.Rules),
+		LastAlertTimes: make(map[string]time.Time),
+	}
+	var keys []conditionKey
+	for i := range m.Rules {
+		rule := &m.Rules[i]
+		for _, condition := range rule.Conditions {
+			keys = append(keys, conditionKey{rule, conditionAlertKey(rule.ID, condition), rule.throttled(condition)})
+		}
+	}
+	m.mu.RUnlock()
+
+	stats.CachedValues = m.deviceCache.len()
+
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	stats.AlertsTriggered = m.alertsTotal
+
+	now := m.now()
+	inCooldown := make(map[string]bool)
+	for _, k := range keys {
+		last, ok := m.lastAlertTimes[k.key]
+		if !ok {
+			continue
+		}
+		if last.After(stats.LastAlertTimes[k.rule.ID]) {
+			stats.LastAlertTimes[k.rule.ID] = last
+		}
+		// The cooldown is the one of the level the alert escalated to
+		condition := k.condition
+		condition.Level = m.effectiveLevelLocked(k.rule, k.key, condition.Level)
+		if now.Sub(last) <= m.getCooldown(k.key, condition) {
+			inCooldown[k.key] = true
+		}
+	}
+	stats.AlertsInCooldown = len(inCooldown)
+
+	return stats
+}
+
+// fireLog tracks the delivered alerts of a rule
+type fireLog struct {
+	lastHour rollingCounter
+	last     time.Time
+}
+
+// recordRuleFire counts a delivered alert of the rule ruleID
+func (m *RuleManager) recordRuleFire(ruleID string) {
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	fires, ok := m.ruleFires[ruleID]
+	if !ok {
+		fires = &fireLog{}
+		m.ruleFires[ruleID] = fires
+	}
+	now := m.now()
+	fires.lastHour.add(now)
+	fires.last = now
+}
+
+// pruneRuleFires drops the fire logs of rules no longer loaded
+func (m *RuleManager) pruneRuleFires(rules []AlertRule) {
+	loaded := make(map[string]bool, len(rules))
+	for i := range rules {
+		loaded[rules[i].ID] = true
+	}
+
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+	for ruleID := range m.ruleFires {
+		if !loaded[ruleID] {
+			delete(m.ruleFires, ruleID)
+		}
+	}
+}
+
+// RuleStats is a loaded rule with its recent alert activity, e.g. to spot
+// noisy rules and rules that never fire
+type RuleStats struct {
+	ID            string     `json:"id"`
+	Topics        []string   `json:"topics"`
+	Conditions    int        `json:"conditions"`
+	TriggerRate1h int        `json:"trigger_rate_1h"` // Alerts delivered within the last hour
+	LastFired     *time.Time `json:"last_fired"`      // Latest delivered alert, nil when the rule never fired
+}
+
+// RuleStats returns the activity of every loaded rule, in evaluation order
+func (m *RuleManager) RuleStats() []RuleStats {
+	m.mu.RLock()
+	stats := make([]RuleStats, len(m.Rules))
+	for i := range m.Rules {
+		rule := &m.Rules[i]
+		stats[i] = RuleStats{ID: rule.ID, Topics: rule.Topics, Conditions: len(rule.Conditions)}
+	}
+	m.mu.RUnlock()
+
+	m.alertMu.Lock()
+	defer m.alertMu.Unlock()
+
+	now := m.now()
+	for i := range stats {
+		fires, ok := m.ruleFires[stats[i].ID]
+		if !ok {
+			continue
+		}
+		stats[i].TriggerRate1h = fires.lastHour.total(now)
+		last := fires.last
+		stats[i].LastFired = &last
+	}
+	return stats
+}
@@ -0,0 +1,174 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestStats(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("hot", []string{"plc/D100"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D100", Operator: "D100 > 50", Level: LevelWarning},
+			{ID: 2, Device: "D100", Operator: "D100 > 80", Level: LevelCritical},
+		}, zap.NewNop()),
+		*NewAlertRule("cold", []string{"plc/D200"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D200", Operator: "D200 < 0", Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}))
+	defer rm.Shutdown()
+
+	if stats := rm.Stats(); stats.Rules != 2 || stats.CachedValues != 0 || stats.AlertsTriggered != 0 || len(stats.LastAlertTimes) != 0 {
+		t.Fatalf("Expected empty stats for 2 rules, got %+v", stats)
+	}
+
+	start := time.Now()
+	rm.deviceCache.set(cacheKey{Topic: "plc/D100", Address: "D100"}, cachedValue{value: 90.0, timestamp: time.Now()})
+	rm.deviceCache.set(cacheKey{Topic: "plc/D200", Address: "D200"}, cachedValue{value: 20.0, timestamp: time.Now()})
+
+	// Both conditions of "hot" alert, then sit in cooldown
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	rm.evaluateRule(&rm.Rules[1], cfg)
+
+	stats := rm.Stats()
+	if stats.Rules != 2 {
+		t.Errorf("Expected 2 rules, got %d", stats.Rules)
+	}
+	if stats.CachedValues != 2 {
+		t.Errorf("Expected 2 cached values, got %d", stats.CachedValues)
+	}
+	if stats.AlertsTriggered != 2 {
+		t.Errorf("Expected 2 alerts triggered, got %d", stats.AlertsTriggered)
+	}
+	if stats.AlertsInCooldown != 2 {
+		t.Errorf("Expected 2 alerts in cooldown, got %d", stats.AlertsInCooldown)
+	}
+	if len(stats.LastAlertTimes) != 1 || stats.LastAlertTimes["hot"].Before(start) {
+		t.Errorf("Expected only a recent alert time for rule hot, got %v", stats.LastAlertTimes)
+	}
+}
+
+func TestStatsCooldownOfEscalatedLevel(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("hot", []string{"plc/D100"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D100", Operator: "D100 > 50", Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+	rules[0].Escalation = &EscalationPolicy{After: 1}
+
+	clock := NewManualClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	rm.deviceCache.set(cacheKey{Topic: "plc/D100", Address: "D100"}, cachedValue{value: 90.0, timestamp: clock.Now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	if stats := rm.Stats(); stats.AlertsTriggered != 1 || stats.AlertsInCooldown != 1 {
+		t.Fatalf("Expected 1 alert in cooldown, got %+v", stats)
+	}
+
+	// The next alert escalates to an error, whose 2m cooldown has passed
+	// while the 10m one of the warning hasn't
+	clock.Advance(3 * time.Minute)
+	if stats := rm.Stats(); stats.AlertsInCooldown != 0 {
+		t.Errorf("Expected the escalated cooldown expired, got %d alerts in cooldown", stats.AlertsInCooldown)
+	}
+}
+
+func TestRuleStatsRollingRate(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("noisy", []string{"plc/D100"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D100", Operator: "D100 > 50", Level: LevelWarning, CooldownSeconds: 60},
+		}, zap.NewNop()),
+		*NewAlertRule("dead", []string{"plc/D200"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "D200", Operator: "D200 < 0", Level: LevelWarning},
+		}, zap.NewNop()),
+	}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), rules, cfg, WithInserter(NoopInserter{}), WithClock(clock))
+	defer rm.Shutdown()
+
+	// "noisy" fires every 10 minutes for an hour
+	for i := 0; i < 6; i++ {
+		if i > 0 {
+			clock.Advance(10 * time.Minute)
+		}
+		rm.deviceCache.set(cacheKey{Topic: "plc/D100", Address: "D100"}, cachedValue{value: 90.0, timestamp: clock.Now()})
+		rm.evaluateRule(&rm.Rules[0], cfg)
+	}
+	lastFired := clock.Now()
+
+	check := func(wantRate int) {
+		t.Helper()
+		stats := rm.RuleStats()
+		if len(stats) != 2 || stats[0].ID != "noisy" || stats[1].ID != "dead" {
+			t.Fatalf("Expected stats of both rules in order, got %+v", stats)
+		}
+		if stats[0].TriggerRate1h != wantRate {
+			t.Errorf("Expected %d alerts within the hour, got %d", wantRate, stats[0].TriggerRate1h)
+		}
+		if stats[0].LastFired == nil || !stats[0].LastFired.Equal(lastFired) {
+			t.Errorf("Expected last fired at %v, got %v", lastFired, stats[0].LastFired)
+		}
+		if stats[1].TriggerRate1h != 0 || stats[1].LastFired != nil {
+			t.Errorf("Expected a rule that never fired to report nothing, got %+v", stats[1])
+		}
+	}
+
+	check(6)
+
+	// The rate decays as the alerts age out of the hour
+	clock.Advance(30 * time.Minute)
+	check(3)
+	clock.Advance(31 * time.Minute)
+	check(0)
+}
+
+func TestRuleStatsPrunedOnReload(t *testing.T) {
+	newRules := func(ids ...string) []AlertRule {
+		var rules []AlertRule
+		for _, id := range ids {
+			rules = append(rules, *NewAlertRule(id, []string{"plc/D100"}, "alerts", "", "", "", []AlertCondition{
+				{ID: 1, Device: "D100", Operator: "D100 > 50", Level: LevelWarning},
+			}, zap.NewNop()))
+		}
+		return rules
+	}
+
+	cfg := config.Config{}
+	rm := NewManager(context.Background(), newRules("kept", "removed"), cfg, WithInserter(NoopInserter{}))
+	defer rm.Shutdown()
+
+	rm.deviceCache.set(cacheKey{Topic: "plc/D100", Address: "D100"}, cachedValue{value: 90.0, timestamp: rm.now()})
+	rm.evaluateRule(&rm.Rules[0], cfg)
+	rm.evaluateRule(&rm.Rules[1], cfg)
+
+	rm.UpdateRules(newRules("kept"), cfg)
+	if stats := rm.RuleStats(); len(stats) != 1 || stats[0].TriggerRate1h != 1 {
+		t.Errorf("Expected the fires of the kept rule across the reload, got %+v", stats)
+	}
+
+	rm.alertMu.Lock()
+	_, ok := rm.ruleFires["removed"]
+	rm.alertMu.Unlock()
+	if ok {
+		t.Error("Expected the fires of the removed rule dropped")
+	}
+
+	// A rule loaded again under the same ID starts afresh
+	rm.UpdateRules(newRules("kept", "removed"), cfg)
+	if stats := rm.RuleStats(); stats[1].LastFired != nil {
+		t.Errorf("Expected no fires of the reloaded rule, got %+v", stats[1])
+	}
+}
@@ -0,0 +1,41 @@
+package alert
+
+import (
+	"regexp"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// deviceToken matches {{device:ADDR}} in message templates
+var deviceToken = regexp.MustCompile(`\{\{\s*device:([^{}\s]+)\s*\}\}`)
+
+// messageTemplate returns the rule's template for the condition's level,
+// falling back to the condition's own template, e.g. for a terse warning and
+// a detailed critical message about the same device
+func (r *AlertRule) messageTemplate(condition AlertCondition) string {
+	if template, ok := r.MessageTemplates[condition.Level]; ok {
+		return template
+	}
+	return condition.MessageTemplate
+}
+
+// renderMessage resolves the {{device:ADDR}} tokens of a message template
+// against the device values of the evaluation, so a message can mention
+// devices other than the one that breached, e.g. "Pump D1 tripped while
+// pressure D2 was {{device:D2}}". round formats the values like the alert's
+// current value. Tokens of devices missing from the values are left as they
+// are and logged.
+func (r *AlertRule) renderMessage(template string, values map[string]float64, round func(device string, value float64) float64) string {
+	return deviceToken.ReplaceAllStringFunc(template, func(token string) string {
+		device := deviceToken.FindStringSubmatch(token)[1]
+		value, ok := values[device]
+		if !ok {
+			r.logger.Warn("Unknown device in message template",
+				zap.String("rule_id", r.ID),
+				zap.String("device", device))
+			return token
+		}
+		return strconv.FormatFloat(round(device, value), 'f', -1, 64)
+	})
+}
@@ -0,0 +1,80 @@
+package alert
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRenderCrossDeviceTemplate(t *testing.T) {
+	rule := NewAlertRule("pump", []string{"plc/D1", "plc/D2"}, "alerts", "", "", "", nil, zap.NewNop())
+	condition := AlertCondition{
+		Device:          "D1",
+		Operator:        "==",
+		Threshold:       1,
+		MessageTemplate: "Pump D1 tripped while pressure D2 was {{device:D2}} ({{ device:D1 }}, {{device:D9}})",
+	}
+
+	alert := rule.generateAlertMessage(condition, map[string]float64{"D1": 1, "D2": 4.26})
+	want := "Pump D1 tripped while pressure D2 was 4.3 (1, {{device:D9}})"
+	if alert.Message != want {
+		t.Errorf("Expected message %q, got %q", want, alert.Message)
+	}
+
+	// Templates without tokens are kept verbatim
+	condition.MessageTemplate = "Pump {tripped}"
+	if alert := rule.generateAlertMessage(condition, map[string]float64{"D1": 1}); alert.Message != "Pump {tripped}" {
+		t.Errorf("Expected the template unchanged, got %q", alert.Message)
+	}
+}
+
+func TestLevelMessageTemplates(t *testing.T) {
+	rule := NewAlertRule("oven", []string{"plc/D800"}, "alerts", "", "", "", nil, zap.NewNop())
+	rule.MessageTemplates = map[int]string{
+		LevelWarning:  "Oven warm: {{device:D800}}",
+		LevelCritical: "Oven D800 at {{device:D800}}C, above the critical limit. Stop the line and check the burner.",
+	}
+	values := map[string]float64{"D800": 950}
+
+	tests := []struct {
+		name      string
+		condition AlertCondition
+		want      string
+	}{
+		{"warning", AlertCondition{Device: "D800", Operator: ">", Threshold: 900, Level: LevelWarning, MessageTemplate: "own"},
+			"Oven warm: 950"},
+		{"critical", AlertCondition{Device: "D800", Operator: ">", Threshold: 940, Level: LevelCritical},
+			"Oven D800 at 950C, above the critical limit. Stop the line and check the burner."},
+		{"falls back to the condition's template", AlertCondition{Device: "D800", Operator: ">", Threshold: 920, Level: LevelError, MessageTemplate: "Oven hot: {{device:D800}}"},
+			"Oven hot: 950"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if alert := rule.generateAlertMessage(tt.condition, values); alert.Message != tt.want {
+				t.Errorf("Expected message %q, got %q", tt.want, alert.Message)
+			}
+		})
+	}
+}
+
+func TestLoadLevelMessageTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[{"id": "oven", "topics": ["plc/D800"],
+		"message_templates": {"1": "terse", "3": "detailed"},
+		"conditions": [{"id": 1, "device": "D800", "operator": ">", "threshold": 900, "level": 3}]}]`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := LoadRulesFromFile(path, zap.NewNop())
+	if len(loaded) != 1 || loaded[0].MessageTemplates[LevelWarning] != "terse" || loaded[0].MessageTemplates[LevelCritical] != "detailed" {
+		t.Fatalf("Expected the level templates loaded, got %+v", loaded)
+	}
+	alert := loaded[0].generateAlertMessage(loaded[0].Conditions[0], map[string]float64{"D800": 950})
+	if alert.Message != "detailed" {
+		t.Errorf("Expected the critical template, got %q", alert.Message)
+	}
+}
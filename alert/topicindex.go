@@ -0,0 +1,223 @@
+package alert
+
+import (
+	"sort"
+	"strings"
+)
+
+// topicIndex maps MQTT topics to the IDs of the rules that reference them, so
+// an incoming message only signals the rules it is relevant to. Rule topics
+// containing MQTT wildcards (+, #) are matched against the incoming topic.
+// Lookups return the rules by descending priority.
+type topicIndex struct {
+	exact      map[string][]string
+	wildcards  []wildcardRoute
+	priorities map[string]int // Rule ID -> priority, nil when every rule has the default
+}
+
+type wildcardRoute struct {
+	filter  string
+	ruleIDs []string
+}
+
+func newTopicIndex(rules []AlertRule) *topicIndex {
+	idx := &topicIndex{exact: make(map[string][]string)}
+	wildcards := make(map[string]int) // filter -> position in idx.wildcards
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Priority != 0 {
+			if idx.priorities == nil {
+				idx.priorities = make(map[string]int)
+			}
+			idx.priorities[rule.ID] = rule.Priority
+		}
+		for _, topic := range rule.Topics {
+			if !isWildcardTopic(topic) {
+				idx.exact[topic] = appendUnique(idx.exact[topic], rule.ID)
+				continue
+			}
+
+			pos, ok := wildcards[topic]
+			if !ok {
+				pos = len(idx.wildcards)
+				wildcards[topic] = pos
+				idx.wildcards = append(idx.wildcards, wildcardRoute{filter: topic})
+			}
+			idx.wildcards[pos].ruleIDs = appendUnique(idx.wildcards[pos].ruleIDs, rule.ID)
+		}
+	}
+
+	for _, ruleIDs := range idx.exact {
+		idx.sortByPriority(ruleIDs)
+	}
+	return idx
+}
+
+// sortByPriority orders rule IDs by descending priority, keeping the rule
+// order among equal priorities
+func (idx *topicIndex) sortByPriority(ruleIDs []string) {
+	if idx.priorities == nil {
+		return
+	}
+	sort.SliceStable(ruleIDs, func(i, j int) bool {
+		return idx.priorities[ruleIDs[i]] > idx.priorities[ruleIDs[j]]
+	})
+}
+
+// priority returns the priority of the rule
+func (idx *topicIndex) priority(ruleID string) int {
+	return idx.priorities[ruleID]
+}
+
+// lookup returns the IDs of the rules subscribed to topic
+func (idx *topicIndex) lookup(topic string) []string {
+	ruleIDs := idx.exact[topic]
+	if len(idx.wildcards) == 0 {
+		return ruleIDs
+	}
+
+	matched := ruleIDs
+	copied := false
+	for _, route := range idx.wildcards {
+		if !topicMatches(route.filter, topic) {
+			continue
+		}
+		if !copied {
+			// Don't append into the slice owned by the exact map
+			matched = append([]string(nil), ruleIDs...)
+			copied = true
+		}
+		for _, id := range route.ruleIDs {
+			matched = appendUnique(matched, id)
+		}
+	}
+	if copied {
+		idx.sortByPriority(matched)
+	}
+	return matched
+}
+
+// wildcardFilters returns the wildcard rule topics matching topic
+func (idx *topicIndex) wildcardFilters(topic string) []string {
+	var filters []string
+	for _, route := range idx.wildcards {
+		if topicMatches(route.filter, topic) {
+			filters = append(filters, route.filter)
+		}
+	}
+	return filters
+}
+
+// referenced reports whether any rule is subscribed to topic
+func (idx *topicIndex) referenced(topic string) bool {
+	return len(idx.lookup(topic)) > 0
+}
+
+// topicMatches reports whether topic matches the MQTT topic filter, where +
+// matches a single level and a trailing # matches any remaining levels.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// filterCovers reports whether every topic matched by filter b is also
+// matched by filter a
+func filterCovers(a, b string) bool {
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	for i, level := range aLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(bLevels) || bLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != bLevels[i] {
+			return false
+		}
+	}
+	return len(aLevels) == len(bLevels)
+}
+
+// SubscriptionTopics returns the sorted minimal set of filters covering the
+// topics of the rules and any extra filters, dropping filters already covered
+// by a wildcard in the set.
+func SubscriptionTopics(rules []AlertRule, extra ...string) []string {
+	var filters []string
+	for i := range rules {
+		for _, topic := range rules[i].Topics {
+			if topic != "" {
+				filters = appendUnique(filters, topic)
+			}
+		}
+	}
+	for _, topic := range extra {
+		if topic != "" {
+			filters = appendUnique(filters, topic)
+		}
+	}
+
+	covering := make([]string, 0, len(filters))
+	for _, filter := range filters {
+		covered := false
+		for _, other := range filters {
+			if other != filter && filterCovers(other, filter) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			covering = append(covering, filter)
+		}
+	}
+
+	sort.Strings(covering)
+	return covering
+}
+
+// SubscriptionQoS returns the QoS to subscribe to each of filters at, the
+// highest of qos and the QoS of the rules with a topic it covers. Filters
+// covering no rule, e.g. MQTT_TOPIC, are subscribed at qos.
+func SubscriptionQoS(rules []AlertRule, filters []string, qos int) map[string]byte {
+	subscriptions := make(map[string]byte, len(filters))
+	for _, filter := range filters {
+		level := qos
+		for i := range rules {
+			if rules[i].QoS <= level {
+				continue
+			}
+			for _, topic := range rules[i].Topics {
+				if topic == filter || filterCovers(filter, topic) {
+					level = rules[i].QoS
+					break
+				}
+			}
+		}
+		subscriptions[filter] = byte(level)
+	}
+	return subscriptions
+}
+
+func appendUnique(ids []string, id string) []string {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
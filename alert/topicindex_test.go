@@ -0,0 +1,247 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+
+	"goalert-engine/config"
+
+	"go.opentelemetry.io/otel"
+	"go.uber.org/zap"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"nk3/holding_register/all/D800", "nk3/holding_register/all/D800", true},
+		{"nk3/holding_register/all/D800", "nk3/holding_register/all/D801", false},
+		{"nk3/+/all/D800", "nk3/holding_register/all/D800", true},
+		{"nk3/+/D800", "nk3/holding_register/all/D800", false},
+		{"nk3/#", "nk3/holding_register/all/D800", true},
+		{"nk3/#", "nk3", true},
+		{"#", "nk3/holding_register", true},
+		{"nk3/holding_register/+", "nk3/holding_register", false},
+		{"nk4/#", "nk3/holding_register/all/D800", false},
+	}
+
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.match)
+		}
+	}
+}
+
+func TestTopicIndexLookup(t *testing.T) {
+	rules := []AlertRule{
+		{ID: "a", Topics: []string{"nk3/all/D800", "nk3/all/D392"}},
+		{ID: "b", Topics: []string{"nk3/all/D800"}},
+		{ID: "c", Topics: []string{"nk3/+/D800", "nk3/#"}},
+		{ID: "d", Topics: []string{"nk4/all/D800"}},
+	}
+	idx := newTopicIndex(rules)
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"nk3/all/D800", []string{"a", "b", "c"}},
+		{"nk3/all/D392", []string{"a", "c"}},
+		{"nk4/all/D800", []string{"d"}},
+		{"nk5/all/D800", nil},
+	}
+
+	for _, tt := range tests {
+		got := idx.lookup(tt.topic)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("lookup(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+
+	// Lookups with wildcard matches must not modify the exact entries
+	if got := idx.exact["nk3/all/D800"]; len(got) != 2 {
+		t.Errorf("Expected exact entry to keep 2 rules, got %v", got)
+	}
+}
+
+func TestTopicIndexLookupByPriority(t *testing.T) {
+	rules := []AlertRule{
+		{ID: "a", Topics: []string{"nk3/all/D800"}},
+		{ID: "b", Topics: []string{"nk3/all/D800"}, Priority: 5},
+		{ID: "c", Topics: []string{"nk3/+/D800"}, Priority: 10},
+		{ID: "d", Topics: []string{"nk3/all/D800"}, Priority: -1},
+		{ID: "e", Topics: []string{"nk3/all/D800"}},
+	}
+	idx := newTopicIndex(rules)
+
+	if got, want := idx.lookup("nk3/all/D800"), []string{"c", "b", "a", "e", "d"}; !slices.Equal(got, want) {
+		t.Errorf("lookup() = %v, want %v", got, want)
+	}
+	if got, want := idx.exact["nk3/all/D800"], []string{"b", "a", "e", "d"}; !slices.Equal(got, want) {
+		t.Errorf("Expected the exact entry sorted by priority, got %v, want %v", got, want)
+	}
+}
+
+func TestHandleMQTTMessageSignalsIndexedRules(t *testing.T) {
+	rules := []AlertRule{
+		{ID: "a", Topics: []string{"sensor/device1"}},
+		{ID: "b", Topics: []string{"sensor/device2"}},
+		{ID: "c", Topics: []string{"sensor/+"}},
+	}
+
+	// Build the manager without workers so signals stay in the channels
+	rm := &RuleManager{
+		Rules:       rules,
+		deviceCache: newDeviceCache(),
+		cacheLRU:    newCacheLRU(),
+		instances:   newInstanceIndex(),
+		history:     newSampleHistory(0),
+		decoder:     &JSONDecoder{},
+		tracer:      otel.Tracer(tracerName),
+		topicIndex:  newTopicIndex(rules),
+		ruleChans:   make(map[string]chan ruleSignal),
+		started:     true,
+		logger:      zap.NewNop(),
+	}
+	for _, rule := range []string{"a", "b", "c"} {
+		rm.ruleChans[rule] = make(chan ruleSignal, 1)
+	}
+
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 1}`), config.Config{})
+
+	for ruleID, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		signaled := len(rm.ruleChans[ruleID]) == 1
+		if signaled != want {
+			t.Errorf("Rule %s signaled = %v, want %v", ruleID, signaled, want)
+		}
+	}
+}
+
+// benchmarkRules builds n rules with three topics each
+func benchmarkRules(n int) []AlertRule {
+	rules := make([]AlertRule, n)
+	for i := range rules {
+		rules[i] = AlertRule{
+			ID: fmt.Sprintf("rule-%d", i),
+			Topics: []string{
+				fmt.Sprintf("plant/line%d/D800", i),
+				fmt.Sprintf("plant/line%d/D392", i),
+				fmt.Sprintf("plant/line%d/D166", i),
+			},
+		}
+	}
+	return rules
+}
+
+// BenchmarkTopicLookupScan is the previous per-message scan over every rule
+func BenchmarkTopicLookupScan(b *testing.B) {
+	rules := benchmarkRules(1000)
+	topic := "plant/line999/D166"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var matched []string
+		for j := range rules {
+			if slices.Contains(rules[j].Topics, topic) {
+				matched = append(matched, rules[j].ID)
+			}
+		}
+		_ = matched
+	}
+}
+
+func BenchmarkTopicLookupIndex(b *testing.B) {
+	idx := newTopicIndex(benchmarkRules(1000))
+	topic := "plant/line999/D166"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = idx.lookup(topic)
+	}
+}
+
+// benchmarkHandleMQTTMessageRules handles messages for one of n rules, whose
+// cost shouldn't grow with n
+func benchmarkHandleMQTTMessageRules(b *testing.B, n int) {
+	ctx := context.Background()
+	cfg := config.Config{}
+	rm := NewManager(ctx, benchmarkRules(n), cfg, WithInserter(NoopInserter{}))
+	defer rm.Shutdown()
+	if err := rm.Start(ctx); err != nil {
+		b.Fatal(err)
+	}
+	topic := fmt.Sprintf("plant/line%d/D166", n-1)
+	payload := []byte(`{"address": "D166", "value": 1}`)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rm.HandleMQTTMessage(topic, payload, cfg)
+	}
+}
+
+func BenchmarkHandleMQTTMessage10Rules(b *testing.B) {
+	benchmarkHandleMQTTMessageRules(b, 10)
+}
+
+func BenchmarkHandleMQTTMessage1000Rules(b *testing.B) {
+	benchmarkHandleMQTTMessageRules(b, 1000)
+}
+
+func TestSubscriptionTopics(t *testing.T) {
+	tests := []struct {
+		name   string
+		topics [][]string
+		extra  []string
+		want   []string
+	}{
+		{"union", [][]string{{"plant/a/D1", "plant/a/D2"}, {"plant/b/D3", "plant/a/D1"}}, nil, []string{"plant/a/D1", "plant/a/D2", "plant/b/D3"}},
+		{"covered by single-level wildcard", [][]string{{"plant/a/D1"}, {"plant/+/D1", "plant/b/D2"}}, nil, []string{"plant/+/D1", "plant/b/D2"}},
+		{"covered by multi-level wildcard", [][]string{{"plant/a/D1", "plant/+/D2"}, {"plant/#"}}, nil, []string{"plant/#"}},
+		{"extra catch-all", [][]string{{"plant/a/D1"}}, []string{"#"}, []string{"#"}},
+		{"+ doesn't cover #", [][]string{{"plant/+", "plant/#"}}, nil, []string{"plant/#"}},
+		{"different depth", [][]string{{"plant/+", "plant/a/D1"}}, nil, []string{"plant/+", "plant/a/D1"}},
+		{"empty", nil, []string{""}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []AlertRule
+			for i, topics := range tt.topics {
+				rules = append(rules, AlertRule{ID: fmt.Sprint(i), Topics: topics})
+			}
+
+			got := SubscriptionTopics(rules, tt.extra...)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SubscriptionTopics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptionQoS(t *testing.T) {
+	rules := []AlertRule{
+		{ID: "default", Topics: []string{"plant/a/D1", "plant/b/D2"}},
+		{ID: "reliable", Topics: []string{"plant/a/D1"}, QoS: 1},
+		{ID: "exact", Topics: []string{"plant/c/D3"}, QoS: 2},
+	}
+	filters := []string{"plant/a/D1", "plant/b/D2", "plant/+/D3", "extra/#"}
+
+	got := SubscriptionQoS(rules, filters, 0)
+	want := map[string]byte{"plant/a/D1": 1, "plant/b/D2": 0, "plant/+/D3": 2, "extra/#": 0}
+	if !maps.Equal(got, want) {
+		t.Errorf("SubscriptionQoS() = %v, want %v", got, want)
+	}
+
+	// Rules never lower the configured QoS
+	got = SubscriptionQoS(rules, filters, 1)
+	want = map[string]byte{"plant/a/D1": 1, "plant/b/D2": 1, "plant/+/D3": 2, "extra/#": 1}
+	if !maps.Equal(got, want) {
+		t.Errorf("SubscriptionQoS() = %v, want %v", got, want)
+	}
+}
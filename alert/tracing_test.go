@@ -0,0 +1,89 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// contextInserter records the span context it was called with
+type contextInserter struct {
+	RecordingInserter
+	spans chan trace.SpanContext
+}
+
+func (c *contextInserter) InsertAlertContext(ctx context.Context, cfg config.Config, table, device, message, category, machine, level string) error {
+	c.spans <- trace.SpanContextFromContext(ctx)
+	return c.InsertAlert(cfg, table, device, message, category, machine, level)
+}
+
+func TestTracingSpanTree(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	rules := []AlertRule{
+		*NewAlertRule("traced", []string{"sensor/device1"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "device1", Operator: "device1 > 10", Threshold: 10, Level: LevelCritical},
+		}, zap.NewNop()),
+	}
+
+	inserter := &contextInserter{spans: make(chan trace.SpanContext, 1)}
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), rules, cfg, inserter, zap.NewNop())
+	defer rm.Shutdown()
+	startManager(t, rm)
+	rm.tracer = provider.Tracer(tracerName)
+
+	rm.HandleMQTTMessage("sensor/device1", []byte(`{"address": "device1", "value": 15}`), cfg)
+
+	var insertCtx trace.SpanContext
+	select {
+	case insertCtx = <-inserter.spans:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the alert to be inserted")
+	}
+
+	// The evaluation span ends after the insert returns
+	deadline := time.Now().Add(time.Second)
+	for len(exporter.GetSpans()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %v", exporter.GetSpans())
+	}
+
+	message := spans["HandleMQTTMessage"]
+	evaluation := spans["evaluateRule"]
+	insert := spans["InsertAlertContext"]
+
+	if message.Parent.IsValid() {
+		t.Error("Expected HandleMQTTMessage to be the root span")
+	}
+	if evaluation.Parent.SpanID() != message.SpanContext.SpanID() {
+		t.Error("Expected evaluateRule to be a child of HandleMQTTMessage")
+	}
+	if insert.Parent.SpanID() != evaluation.SpanContext.SpanID() {
+		t.Error("Expected InsertAlertContext to be a child of evaluateRule")
+	}
+	for name, span := range spans {
+		if span.SpanContext.TraceID() != message.SpanContext.TraceID() {
+			t.Errorf("Expected %s to share the message's trace", name)
+		}
+	}
+	if insertCtx.SpanID() != insert.SpanContext.SpanID() {
+		t.Error("Expected the inserter to receive the InsertAlertContext span")
+	}
+}
@@ -0,0 +1,47 @@
+package alert
+
+import "strings"
+
+// Trend operators compare a device's latest readings with each other instead
+// of with a threshold
+const (
+	OperatorRising  = "RISING"
+	OperatorFalling = "FALLING"
+)
+
+func isTrendOperator(operator string) bool {
+	switch strings.TrimSpace(operator) {
+	case OperatorRising, OperatorFalling:
+		return true
+	}
+	return false
+}
+
+// trendCount is the number of consecutive moves a trend condition requires
+func trendCount(condition AlertCondition) int {
+	if condition.Count <= 0 {
+		return 1
+	}
+	return condition.Count
+}
+
+// evaluateTrend reports whether the device's last Count moves all went in the
+// condition's direction. Flat readings break the trend.
+func (r *AlertRule) evaluateTrend(condition AlertCondition, history deviceSamples) bool {
+	count := trendCount(condition)
+	samples := history.samples(condition.Device, count+1)
+	if len(samples) < count+1 {
+		return false
+	}
+
+	rising := strings.TrimSpace(condition.Operator) == OperatorRising
+	for i := 1; i < len(samples); i++ {
+		if rising && samples[i] <= samples[i-1] {
+			return false
+		}
+		if !rising && samples[i] >= samples[i-1] {
+			return false
+		}
+	}
+	return true
+}
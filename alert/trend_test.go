@@ -0,0 +1,150 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+func TestSampleHistory(t *testing.T) {
+	key := cacheKey{Topic: "sensor/D1", Address: "D1"}
+	h := newSampleHistory(3)
+	if got := h.samples(key, 3); len(got) != 0 {
+		t.Errorf("Expected no samples, got %v", got)
+	}
+
+	for _, v := range []float64{1, 2, 3, 4, 5} {
+		h.record(key, v)
+	}
+
+	if got := fmt.Sprint(h.samples(key, 5)); got != "[3 4 5]" {
+		t.Errorf("Expected the last 3 samples, got %s", got)
+	}
+	if got := fmt.Sprint(h.samples(key, 2)); got != "[4 5]" {
+		t.Errorf("Expected the last 2 samples, got %s", got)
+	}
+
+	var nilHistory *sampleHistory
+	if got := nilHistory.samples(key, 2); got != nil {
+		t.Errorf("Expected nil history to have no samples, got %v", got)
+	}
+}
+
+func TestTrendConditions(t *testing.T) {
+	tests := []struct {
+		name     string
+		operator string
+		count    int
+		values   []float64
+		want     conditionState
+	}{
+		{"rising", OperatorRising, 3, []float64{1, 2, 3, 4}, conditionTriggered},
+		{"rising after dip", OperatorRising, 3, []float64{5, 1, 2, 3, 4}, conditionTriggered},
+		{"rising too short", OperatorRising, 3, []float64{1, 2, 3}, conditionClear},
+		{"rising broken", OperatorRising, 3, []float64{1, 2, 1, 4}, conditionClear},
+		{"rising on falling", OperatorRising, 2, []float64{3, 2, 1}, conditionClear},
+		{"falling", OperatorFalling, 3, []float64{9, 7, 5, 3}, conditionTriggered},
+		{"falling on rising", OperatorFalling, 2, []float64{1, 2, 3}, conditionClear},
+		{"flat rising", OperatorRising, 2, []float64{4, 4, 4}, conditionClear},
+		{"flat falling", OperatorFalling, 2, []float64{4, 4, 4}, conditionClear},
+		{"default count", OperatorRising, 0, []float64{1, 2}, conditionTriggered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := AlertCondition{ID: 1, Device: "D1", Operator: tt.operator, Count: tt.count, Level: LevelWarning}
+			rule := NewAlertRule("trend", []string{"sensor/D1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop())
+
+			key := cacheKey{Topic: "sensor/D1", Address: "D1"}
+			history := newSampleHistory(8)
+			for _, v := range tt.values {
+				history.record(key, v)
+			}
+
+			payload := map[string]any{"D1": tt.values[len(tt.values)-1]}
+			if state, _ := rule.checkCondition(payload, history.of(map[string]cacheKey{"D1": key}), condition); state != tt.want {
+				t.Errorf("Expected state %v, got %v", tt.want, state)
+			}
+		})
+	}
+}
+
+func TestTrendConditionFromMessages(t *testing.T) {
+	condition := AlertCondition{ID: 1, Device: "D1", Operator: OperatorRising, Count: 3, MessageTemplate: "is rising", Level: LevelWarning}
+	rules := []AlertRule{*NewAlertRule("trend", []string{"sensor/D1"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop())}
+
+	recorder := &RecordingInserter{}
+	cfg := config.Config{}
+	rm := NewRuleManager(context.Background(), rules, cfg, recorder, zap.NewNop())
+	defer rm.Shutdown()
+	startManager(t, rm)
+
+	for _, v := range []int{10, 11, 12, 13} {
+		rm.HandleMQTTMessage("sensor/D1", []byte(fmt.Sprintf(`{"address": "D1", "value": %d}`, v)), cfg)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.Alerts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	alerts := recorder.Alerts()
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+	if alerts[0].Device != "D1" {
+		t.Errorf("Expected alert for D1, got %s", alerts[0].Device)
+	}
+}
+
+func TestTrendHistoryPerTopic(t *testing.T) {
+	// Each line's temp has its own history, alternating readings of two
+	// lines rising on their own don't break each other's trend
+	condition := AlertCondition{ID: 1, Device: "temp", Operator: OperatorRising, Count: 2, Level: LevelWarning}
+	rules := []AlertRule{*NewAlertRule("trend", []string{"plant/+/temp"}, "alerts", "", "", "", []AlertCondition{condition}, zap.NewNop())}
+	rules[0].InstanceMatch = InstanceMatchAll
+
+	recorder := &RecordingInserter{}
+	rm := NewRuleManager(context.Background(), rules, config.Config{}, recorder, zap.NewNop())
+	rm.Shutdown() // Evaluate synchronously below
+
+	for _, v := range []int{10, 50, 11, 51, 12, 52} {
+		line := "line1"
+		if v >= 50 {
+			line = "line2"
+		}
+		rm.HandleMQTTMessage("plant/"+line+"/temp", []byte(fmt.Sprintf(`{"address": "temp", "value": %d}`, v)), rm.Cfg)
+	}
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 1 {
+		t.Errorf("Expected both lines rising, got %d alerts", len(alerts))
+	}
+}
+
+func TestHistoryExpiresWithCache(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	rm := NewManager(context.Background(), nil, config.Config{},
+		WithInserter(NoopInserter{}),
+		WithClock(clock),
+		WithCacheTTL(time.Minute),
+	)
+	rm.Shutdown()
+
+	rm.HandleMQTTMessage("sensor/D1", []byte(`{"address": "D1", "value": 1}`), rm.Cfg)
+	clock.Advance(2 * time.Minute)
+	rm.HandleMQTTMessage("sensor/D2", []byte(`{"address": "D2", "value": 2}`), rm.Cfg)
+	rm.sweepExpired(clock.Now())
+
+	if got := rm.history.samples(cacheKey{Topic: "sensor/D1", Address: "D1"}, 8); len(got) != 0 {
+		t.Errorf("Expected the history of the expired D1 dropped, got %v", got)
+	}
+	if got := rm.history.samples(cacheKey{Topic: "sensor/D2", Address: "D2"}, 8); len(got) != 1 {
+		t.Errorf("Expected the history of D2 kept, got %v", got)
+	}
+}
@@ -0,0 +1,275 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ValidateRule checks the operators of every condition of rule, so a bad
+// operator is reported once when the rule is loaded instead of on every
+// evaluation. It also reports conditions that can never trigger because they
+// require contradictory bounds of a device, e.g. "D1 > 10 AND D1 < 5".
+func ValidateRule(rule *AlertRule) error {
+	var errs []error
+	if err := validateTopics(rule.Topics); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateInstanceMatch(rule.InstanceMatch); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateQoS(rule.QoS); err != nil {
+		errs = append(errs, err)
+	}
+	for _, condition := range rule.Conditions {
+		if err := validateCondition(condition); err != nil {
+			errs = append(errs, fmt.Errorf("condition %d: %w", condition.ID, err))
+		} else if err := satisfiable(condition); err != nil {
+			errs = append(errs, fmt.Errorf("condition %d: %w", condition.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateTopics reports a rule without topics, which no message can signal
+// so it is never evaluated
+func validateTopics(topics []string) error {
+	if len(topics) == 0 {
+		return errors.New("no topics, the rule is never evaluated")
+	}
+	return nil
+}
+
+// validateQoS reports a QoS MQTT doesn't define
+func validateQoS(qos int) error {
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid qos %d, expected 0, 1 or 2", qos)
+	}
+	return nil
+}
+
+// validConditions returns the conditions of rule ruleID with valid operators
+// and, unless historySize is 0, looking at no more samples than the history
+// keeps, warning once about each invalid one. It fails when no condition is
+// left.
+func validConditions(ruleID string, conditions []AlertCondition, historySize int, logger *zap.Logger) ([]AlertCondition, error) {
+	valid := make([]AlertCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		err := validateCondition(condition)
+		if err == nil {
+			err = validateSamples(condition, historySize)
+		}
+		if err != nil {
+			logger.Warn("Skipping invalid condition",
+				zap.String("rule_id", ruleID),
+				zap.Int("condition_id", condition.ID),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err := satisfiable(condition); err != nil {
+			// Kept as it is valid, it just never fires
+			logger.Warn("Condition can never trigger",
+				zap.String("rule_id", ruleID),
+				zap.Int("condition_id", condition.ID),
+				zap.Error(err),
+			)
+		}
+		valid = append(valid, condition)
+	}
+	if len(valid) == 0 && len(conditions) > 0 {
+		return nil, errors.New("no valid condition")
+	}
+	return valid, nil
+}
+
+// validateCondition checks the condition the way evaluateCondition reads it
+func validateCondition(condition AlertCondition) error {
+	switch {
+	case condition.Match != nil:
+		return validateTree(*condition.Match)
+	case isTrendOperator(condition.Operator), isAnomalyOperator(condition.Operator), isComparisonOperator(condition.Operator):
+		return nil
+	}
+	return validateExpression(condition.Operator)
+}
+
+// validateSamples checks that a history of historySize samples per device
+// holds the samples the condition looks at, historySize 0 skips the check
+func validateSamples(condition AlertCondition, historySize int) error {
+	if historySize <= 0 {
+		return nil
+	}
+	if isTrendOperator(condition.Operator) {
+		if needed := trendCount(condition) + 1; needed > historySize {
+			return fmt.Errorf("trend of %d moves needs %d samples, the history keeps %d", trendCount(condition), needed, historySize)
+		}
+	}
+	if isAnomalyOperator(condition.Operator) {
+		// The window's baseline plus the latest reading
+		if window, _, _ := anomalyParams(condition); window+1 > historySize {
+			return fmt.Errorf("anomaly window of %d samples needs %d, the history keeps %d", window, window+1, historySize)
+		}
+	}
+	return nil
+}
+
+// validateTree checks the logical operators of a tree's inner nodes and the
+// comparison operators of its leaves
+func validateTree(node ConditionTree) error {
+	if len(node.Children) == 0 {
+		if !isComparisonOperator(node.Operator) {
+			return fmt.Errorf("unsupported operator %q of device %s", node.Operator, node.Device)
+		}
+		return nil
+	}
+
+	switch strings.ToUpper(node.Op) {
+	case MatchAND, MatchOR:
+	default:
+		return fmt.Errorf("unsupported logical operator %q", node.Op)
+	}
+	for _, child := range node.Children {
+		if err := validateTree(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateExpression checks an expression such as "D800 > 900 AND D801 == 1",
+// split like evaluateComplexCondition does
+func validateExpression(expr string) error {
+	separator := "OR"
+	if strings.Contains(expr, "AND") {
+		separator = "AND"
+	}
+	for _, part := range strings.Split(expr, separator) {
+		fields := strings.Fields(part)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid condition %q, expected <device> <operator> <threshold>", strings.TrimSpace(part))
+		}
+		if !isComparisonOperator(fields[1]) {
+			return fmt.Errorf("unsupported operator %q in %q", fields[1], strings.TrimSpace(part))
+		}
+	}
+	return nil
+}
+
+// bounds is the range of values a device may take for the comparisons of an
+// AND to hold
+type bounds struct {
+	lo, hi             float64
+	loStrict, hiStrict bool
+	excluded           []float64 // Values ruled out by !=
+}
+
+func newBounds() *bounds {
+	return &bounds{lo: math.Inf(-1), hi: math.Inf(1)}
+}
+
+// restrict narrows the bounds by the comparison "device operator threshold"
+func (b *bounds) restrict(operator string, threshold float64) {
+	switch operator {
+	case ">":
+		b.raiseLo(threshold, true)
+	case ">=":
+		b.raiseLo(threshold, false)
+	case "<":
+		b.lowerHi(threshold, true)
+	case "<=":
+		b.lowerHi(threshold, false)
+	case "==":
+		b.raiseLo(threshold, false)
+		b.lowerHi(threshold, false)
+	case "!=":
+		b.excluded = append(b.excluded, threshold)
+	}
+}
+
+func (b *bounds) raiseLo(value float64, strict bool) {
+	if value > b.lo || (value == b.lo && strict) {
+		b.lo, b.loStrict = value, strict
+	}
+}
+
+func (b *bounds) lowerHi(value float64, strict bool) {
+	if value < b.hi || (value == b.hi && strict) {
+		b.hi, b.hiStrict = value, strict
+	}
+}
+
+// empty reports whether no value is within the bounds
+func (b *bounds) empty() bool {
+	if b.lo > b.hi || (b.lo == b.hi && (b.loStrict || b.hiStrict)) {
+		return true
+	}
+	// A single allowed value may be excluded by !=
+	return b.lo == b.hi && slices.Contains(b.excluded, b.lo)
+}
+
+// satisfiable checks that the comparisons an AND requires of each device
+// with static thresholds can hold together. Comparisons with other devices
+// and OR branches are assumed satisfiable, so only obvious contradictions
+// are caught.
+func satisfiable(condition AlertCondition) error {
+	devices := make(map[string]*bounds)
+	restrict := func(device, operator string, threshold float64) {
+		b, ok := devices[device]
+		if !ok {
+			b = newBounds()
+			devices[device] = b
+		}
+		b.restrict(operator, threshold)
+	}
+
+	switch {
+	case condition.Match != nil:
+		collectTreeBounds(*condition.Match, restrict)
+	case strings.Contains(condition.Operator, "AND"):
+		for _, part := range strings.Split(condition.Operator, "AND") {
+			fields := strings.Fields(part)
+			if len(fields) != 3 {
+				continue
+			}
+			if threshold, err := parseThreshold(fields[2]); err == nil {
+				restrict(fields[0], fields[1], threshold)
+			}
+		}
+	default:
+		return nil // A single comparison, or an OR, can always hold
+	}
+
+	var contradicted []string
+	for device, b := range devices {
+		if b.empty() {
+			contradicted = append(contradicted, device)
+		}
+	}
+	if len(contradicted) == 0 {
+		return nil
+	}
+	slices.Sort(contradicted)
+	return fmt.Errorf("contradictory bounds of %s, the condition can never trigger", strings.Join(contradicted, ", "))
+}
+
+// collectTreeBounds passes the static comparisons of the AND nodes of a tree
+// to restrict, from the root down to its first OR
+func collectTreeBounds(node ConditionTree, restrict func(device, operator string, threshold float64)) {
+	if len(node.Children) == 0 {
+		if node.ThresholdDevice == "" {
+			restrict(node.Device, node.Operator, node.Threshold)
+		}
+		return
+	}
+	if strings.ToUpper(node.Op) != MatchAND {
+		return
+	}
+	for _, child := range node.Children {
+		collectTreeBounds(child, restrict)
+	}
+}
@@ -0,0 +1,254 @@
+package alert
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"github.com/supabase-community/supabase-go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition AlertCondition
+		wantErr   bool
+	}{
+		{"comparison", AlertCondition{Device: "D800", Operator: ">="}, false},
+		{"expression", AlertCondition{Operator: "D800 > 900"}, false},
+		{"AND expression", AlertCondition{Operator: "D800 > 900 AND D801 == D802"}, false},
+		{"OR expression", AlertCondition{Operator: "D800 < 100 OR D801 != true"}, false},
+		{"trend", AlertCondition{Device: "D800", Operator: OperatorRising}, false},
+		{"anomaly", AlertCondition{Device: "D800", Operator: OperatorAnomaly}, false},
+		{"tree", AlertCondition{Match: &ConditionTree{Op: "and", Children: []ConditionTree{
+			{Device: "D800", Operator: ">", Threshold: 900},
+			{Device: "D801", Operator: "==", Threshold: 1},
+		}}}, false},
+		{"bogus comparison", AlertCondition{Device: "D800", Operator: "=>"}, true},
+		{"bogus expression operator", AlertCondition{Operator: "D800 ~ 900"}, true},
+		{"bogus operator in AND", AlertCondition{Operator: "D800 > 900 AND D801 <> 1"}, true},
+		{"malformed expression", AlertCondition{Operator: "D800 >"}, true},
+		{"empty operator", AlertCondition{Device: "D800"}, true},
+		{"bogus tree op", AlertCondition{Match: &ConditionTree{Op: "XOR", Children: []ConditionTree{
+			{Device: "D800", Operator: ">", Threshold: 900},
+		}}}, true},
+		{"bogus tree leaf", AlertCondition{Match: &ConditionTree{Op: MatchOR, Children: []ConditionTree{
+			{Device: "D800", Operator: ">", Threshold: 900},
+			{Device: "D801", Operator: "===", Threshold: 1},
+		}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := NewAlertRule("rule", []string{"sensor/D800"}, "", "", "", "", []AlertCondition{tt.condition}, zap.NewNop())
+			if err := ValidateRule(rule); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRuleWithoutTopics(t *testing.T) {
+	condition := AlertCondition{Device: "D800", Operator: ">"}
+	for _, topics := range [][]string{nil, {}} {
+		rule := NewAlertRule("rule", topics, "", "", "", "", []AlertCondition{condition}, zap.NewNop())
+		if err := ValidateRule(rule); err == nil {
+			t.Errorf("Expected a rule with topics %v reported", topics)
+		}
+	}
+}
+
+func TestValidateRuleContradictions(t *testing.T) {
+	tests := []struct {
+		name          string
+		condition     AlertCondition
+		contradictory bool
+	}{
+		{"disjoint bounds", AlertCondition{Operator: "D1 > 10 AND D1 < 5"}, true},
+		{"touching strict bounds", AlertCondition{Operator: "D1 > 10 AND D1 <= 10"}, true},
+		{"two values", AlertCondition{Operator: "D1 == 1 AND D1 == 2"}, true},
+		{"value outside bounds", AlertCondition{Operator: "D1 == 20 AND D1 < 10"}, true},
+		{"value excluded", AlertCondition{Operator: "D1 >= 3 AND D1 <= 3 AND D1 != 3"}, true},
+		{"boolean", AlertCondition{Operator: "D1 == true AND D1 == false"}, true},
+		{"tree", AlertCondition{Match: &ConditionTree{Op: "and", Children: []ConditionTree{
+			{Device: "D1", Operator: ">", Threshold: 900},
+			{Op: MatchAND, Children: []ConditionTree{
+				{Device: "D2", Operator: "==", Threshold: 1},
+				{Device: "D1", Operator: "<", Threshold: 100},
+			}},
+		}}}, true},
+
+		{"range", AlertCondition{Operator: "D1 > 5 AND D1 < 10"}, false},
+		{"single value", AlertCondition{Operator: "D1 >= 10 AND D1 <= 10"}, false},
+		{"different devices", AlertCondition{Operator: "D1 > 10 AND D2 < 5"}, false},
+		{"OR", AlertCondition{Operator: "D1 > 10 OR D1 < 5"}, false},
+		{"device threshold", AlertCondition{Operator: "D1 > D2 AND D1 < 5"}, false},
+		{"excluded value within range", AlertCondition{Operator: "D1 > 1 AND D1 < 5 AND D1 != 3"}, false},
+		{"tree OR branch", AlertCondition{Match: &ConditionTree{Op: MatchAND, Children: []ConditionTree{
+			{Device: "D1", Operator: ">", Threshold: 900},
+			{Op: MatchOR, Children: []ConditionTree{
+				{Device: "D1", Operator: "<", Threshold: 100},
+				{Device: "D2", Operator: "==", Threshold: 1},
+			}},
+		}}}, false},
+		{"tree device threshold", AlertCondition{Match: &ConditionTree{Op: MatchAND, Children: []ConditionTree{
+			{Device: "D1", Operator: ">", Threshold: 900},
+			{Device: "D1", Operator: "<", ThresholdDevice: "D2"},
+		}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := NewAlertRule("rule", []string{"sensor/D800"}, "", "", "", "", []AlertCondition{tt.condition}, zap.NewNop())
+			if err := ValidateRule(rule); (err != nil) != tt.contradictory {
+				t.Errorf("ValidateRule() error = %v, contradictory %v", err, tt.contradictory)
+			}
+		})
+	}
+}
+
+func TestContradictoryConditionKeptWithWarning(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	conditions := []AlertCondition{{ID: 1, Device: "D1", Operator: "D1 > 10 AND D1 < 5"}}
+
+	valid, err := validConditions("rule", conditions, 0, zap.New(core))
+	if err != nil || len(valid) != 1 {
+		t.Fatalf("Expected the contradictory condition kept, got %+v, %v", valid, err)
+	}
+	if n := logs.FilterMessage("Condition can never trigger").Len(); n != 1 {
+		t.Errorf("Expected a warning about the contradiction, got %d", n)
+	}
+}
+
+func TestConditionsBeyondHistoryRejected(t *testing.T) {
+	conditions := []AlertCondition{
+		{ID: 1, Device: "D1", Operator: OperatorRising, Count: 32},
+		{ID: 2, Device: "D1", Operator: OperatorRising, Count: 31},
+		{ID: 3, Device: "D1", Operator: OperatorAnomaly, Window: 32},
+		{ID: 4, Device: "D1", Operator: OperatorAnomaly, Window: 31},
+		{ID: 5, Device: "D1", Operator: OperatorAnomaly}, // The default window
+	}
+
+	valid, err := validConditions("rule", conditions, 32, zap.NewNop())
+	if err != nil || len(valid) != 3 || valid[0].ID != 2 || valid[1].ID != 4 || valid[2].ID != 5 {
+		t.Errorf("Expected only the conditions fitting the history kept, got %+v, %v", valid, err)
+	}
+	if valid, _ := validConditions("rule", conditions, 0, zap.NewNop()); len(valid) != 5 {
+		t.Errorf("Expected no check without a history size, got %+v", valid)
+	}
+}
+
+const rulesWithBogusOperators = `[
+	{"id": "bogus", "topics": ["sensor/a"],
+	 "conditions": [{"id": 1, "device": "a", "operator": "a ~ 1", "threshold": 1, "level": 1}]},
+	{"id": "mixed", "topics": ["sensor/b"],
+	 "conditions": [
+		{"id": 1, "device": "b", "operator": "=>", "threshold": 1, "level": 1},
+		{"id": 2, "device": "b", "operator": ">", "threshold": 1, "level": 2}
+	 ]}
+]`
+
+// checkBogusRulesRejected checks the rules loaded from rulesWithBogusOperators
+// and that each invalid condition was warned about once
+func checkBogusRulesRejected(t *testing.T, rules []AlertRule, logs *observer.ObservedLogs) {
+	t.Helper()
+	if len(rules) != 1 || rules[0].ID != "mixed" {
+		t.Fatalf("Expected only the rule with a valid condition, got %+v", rules)
+	}
+	if len(rules[0].Conditions) != 1 || rules[0].Conditions[0].ID != 2 {
+		t.Errorf("Expected the invalid condition skipped, got %+v", rules[0].Conditions)
+	}
+	if n := logs.FilterMessage("Skipping invalid condition").Len(); n != 2 {
+		t.Errorf("Expected a warning per invalid condition, got %d", n)
+	}
+	if n := logs.FilterMessage("Rejecting rule").Len(); n != 1 {
+		t.Errorf("Expected the rule without valid conditions rejected once, got %d", n)
+	}
+}
+
+func TestLoadFromSupabaseRejectsBogusOperators(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(rulesWithBogusOperators))
+	}))
+	defer srv.Close()
+
+	client, err := supabase.NewClient(srv.URL, "key", &supabase.ClientOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create Supabase client: %v", err)
+	}
+	core, logs := observer.New(zap.WarnLevel)
+	loader := &SupabaseRuleLoader{client: client, TableName: "rules", logger: zap.New(core)}
+
+	rules, err := loader.loadFromSupabase(context.Background())
+	if err != nil {
+		t.Fatalf("loadFromSupabase failed: %v", err)
+	}
+	checkBogusRulesRejected(t, rules, logs)
+}
+
+func TestLoadRulesFromFileRejectsBogusOperators(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(rulesWithBogusOperators), 0o644); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	rules := LoadRulesFromFile(path, zap.New(core))
+	checkBogusRulesRejected(t, rules, logs)
+
+	// Evaluating the loaded rule logs nothing more about operators
+	rm := NewRuleManager(context.Background(), rules, config.Config{}, NoopInserter{}, zap.New(core))
+	defer rm.Shutdown()
+	rm.deviceCache.set(cacheKey{Topic: "sensor/b", Address: "b"}, cachedValue{value: 5.0, timestamp: time.Now()})
+	rm.evaluateRule(&rm.Rules[0], config.Config{})
+	if n := logs.FilterMessage("Unsupported operator").Len(); n != 0 {
+		t.Errorf("Expected no operator warnings at evaluation, got %d", n)
+	}
+}
+
+func TestLoadRulesFromFileReportsRulesWithoutTopics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[{"id": "topicless", "topics": [],
+		"conditions": [{"id": 1, "device": "a", "operator": ">", "threshold": 1, "level": 1}]}]`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+	if loaded := LoadRulesFromFile(path, zap.New(core)); len(loaded) != 1 {
+		t.Fatalf("Expected the rule kept, got %+v", loaded)
+	}
+	if n := logs.FilterMessage("Keeping rule that is never evaluated").Len(); n != 1 {
+		t.Errorf("Expected a warning about the rule without topics, got %d", n)
+	}
+}
+
+func TestLoadRulesFromFileQoS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	rules := `[
+		{"id": "reliable", "topics": ["sensor/a"], "qos": 1,
+			"conditions": [{"id": 1, "device": "a", "operator": ">", "threshold": 1, "level": 1}]},
+		{"id": "bogus", "topics": ["sensor/b"], "qos": 3,
+			"conditions": [{"id": 1, "device": "b", "operator": ">", "threshold": 1, "level": 1}]}
+	]`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+
+	loaded := LoadRulesFromFile(path, zap.NewNop())
+	if len(loaded) != 1 || loaded[0].ID != "reliable" || loaded[0].QoS != 1 {
+		t.Fatalf("Expected only the rule with a valid QoS loaded, got %+v", loaded)
+	}
+	if err := ValidateRule(&AlertRule{Topics: []string{"sensor/b"}, QoS: 3}); err == nil {
+		t.Error("Expected an invalid QoS rejected")
+	}
+}
@@ -0,0 +1,189 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EngineCategory is the reserved category of the alerts the engine raises
+// about its own health
+const EngineCategory = "engine"
+
+// Checks of the engine watchdog, used as the device of their alerts
+const (
+	CheckMQTTDisconnected     = "mqtt_disconnected"
+	CheckRealtimeDisconnected = "realtime_disconnected"
+	CheckNoMessages           = "no_messages"
+)
+
+// HealthProbe reports whether a connection the engine depends on is up
+type HealthProbe func() bool
+
+// WatchdogProbes are the connections the watchdog monitors. Nil probes
+// aren't checked.
+type WatchdogProbes struct {
+	MQTT     HealthProbe
+	Realtime HealthProbe
+}
+
+// watchdog tracks how long each health check has been failing. It is only
+// used from the watchdog goroutine.
+type watchdog struct {
+	probes    WatchdogProbes
+	started   time.Time
+	downSince map[string]time.Time // check -> when it started failing
+	firing    map[string]bool      // check -> alerted during the current outage
+}
+
+// StartWatchdog checks the engine's health every WATCHDOG_INTERVAL until
+// Shutdown, alerting through the notifiers and WATCHDOG_TABLE under
+// EngineCategory when MQTT or realtime stay disconnected or no MQTT message
+// arrives for longer than their configured thresholds. A check alerts once
+// per outage. Add notifiers before starting it.
+func (m *RuleManager) StartWatchdog(probes WatchdogProbes) {
+	if m.Cfg.WatchdogInterval <= 0 {
+		return
+	}
+
+	w := m.newWatchdog(probes)
+	go func() {
+		ticker := time.NewTicker(m.Cfg.WatchdogInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				m.checkHealth(w, m.now())
+			}
+		}
+	}()
+}
+
+func (m *RuleManager) newWatchdog(probes WatchdogProbes) *watchdog {
+	return &watchdog{
+		probes:    probes,
+		started:   m.now(),
+		downSince: make(map[string]time.Time),
+		firing:    make(map[string]bool),
+	}
+}
+
+// checkHealth runs every enabled check at now
+func (m *RuleManager) checkHealth(w *watchdog, now time.Time) {
+	if w.probes.MQTT != nil && m.Cfg.WatchdogMQTTDisconnected > 0 {
+		m.checkDown(w, CheckMQTTDisconnected, w.downFor(CheckMQTTDisconnected, !w.probes.MQTT(), now),
+			m.Cfg.WatchdogMQTTDisconnected, LevelCritical, "MQTT broker disconnected")
+	}
+	if w.probes.Realtime != nil && m.Cfg.WatchdogRealtimeDisconnected > 0 {
+		m.checkDown(w, CheckRealtimeDisconnected, w.downFor(CheckRealtimeDisconnected, !w.probes.Realtime(), now),
+			m.Cfg.WatchdogRealtimeDisconnected, LevelError, "Supabase realtime disconnected, rule changes aren't applied")
+	}
+	if m.Cfg.WatchdogNoMessages > 0 {
+		// Until the first message the silence counts from the watchdog's start
+		last := w.started
+		if nanos := m.lastMessage.Load(); nanos != 0 && time.Unix(0, nanos).After(last) {
+			last = time.Unix(0, nanos)
+		}
+		m.checkDown(w, CheckNoMessages, now.Sub(last),
+			m.Cfg.WatchdogNoMessages, LevelWarning, "No MQTT messages received")
+	}
+}
+
+// downFor returns how long the check has been failing, 0 while it passes
+func (w *watchdog) downFor(check string, failing bool, now time.Time) time.Duration {
+	if !failing {
+		delete(w.downSince, check)
+		return 0
+	}
+	since, ok := w.downSince[check]
+	if !ok {
+		since = now
+		w.downSince[check] = now
+	}
+	return now.Sub(since)
+}
+
+// checkDown alerts once a check has been failing for threshold, once per
+// outage
+func (m *RuleManager) checkDown(w *watchdog, check string, down, threshold time.Duration, level int, message string) {
+	if down < threshold {
+		if w.firing[check] {
+			m.logger.Info("Engine health check recovered", zap.String("check", check))
+			delete(w.firing, check)
+		}
+		return
+	}
+	if w.firing[check] {
+		return
+	}
+	w.firing[check] = true
+
+	m.raiseEngineAlert(check, level, AlertMessage{
+		Device:       check,
+		Current:      down.Seconds(),
+		Threshold:    threshold.Seconds(),
+		CurrentRaw:   down.Seconds(),
+		ThresholdRaw: threshold.Seconds(),
+		Message:      fmt.Sprintf("%s for %s", message, down.Round(time.Second)),
+		Unit:         []string{"s"},
+	})
+}
+
+// raiseEngineAlert delivers a self-monitoring alert to the notifiers and, when
+// WATCHDOG_TABLE is set, inserts it there under the category "engine". Engine
+// alerts have no rule, so the check stands in for the device.
+func (m *RuleManager) raiseEngineAlert(check string, level int, alert AlertMessage) {
+	alert.Severity = getLevelString(level)
+	alert.TriggeredAt = m.now().In(m.location).Format(time.RFC3339)
+
+	message, err := json.Marshal(alert)
+	if err != nil {
+		m.logger.Warn("Failed to marshal engine alert", zap.Error(err))
+		message = []byte("{}")
+	}
+
+	m.logger.Warn("Engine health check failed",
+		zap.String("check", check),
+		zap.String("message", alert.Message),
+	)
+
+	if m.Cfg.WatchdogTable != "" {
+		if err := m.insertEngineAlert(check, level, string(message)); err != nil {
+			m.logger.Error("Failed to insert engine alert",
+				zap.String("table", m.Cfg.WatchdogTable),
+				zap.String("check", check),
+				zap.Error(err),
+			)
+		}
+	}
+
+	notification := Notification{
+		RuleID:   EngineCategory + "/" + check,
+		Category: EngineCategory,
+		Level:    level,
+		Alert:    alert,
+		Message:  string(message),
+	}
+	for _, notifier := range m.notifiers {
+		if err := m.notify(context.Background(), notifier, notification); err != nil {
+			m.logger.Error("Failed to notify engine alert",
+				zap.String("sink", notifier.Name()),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// insertEngineAlert inserts an engine alert into WATCHDOG_TABLE
+func (m *RuleManager) insertEngineAlert(check string, level int, message string) error {
+	if inserter, ok := m.alertInserter.(ContextAlertInserter); ok {
+		return inserter.InsertAlertContext(context.Background(), m.Cfg, m.Cfg.WatchdogTable, check, message, EngineCategory, "", getLevelString(level))
+	}
+	return m.alertInserter.InsertAlert(m.Cfg, m.Cfg.WatchdogTable, check, message, EngineCategory, "", getLevelString(level))
+}
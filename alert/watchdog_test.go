@@ -0,0 +1,92 @@
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+)
+
+func TestWatchdogStalledMessageFlow(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	notifier := &fakeNotifier{name: "chat"}
+	cfg := config.Config{WatchdogNoMessages: time.Minute}
+	rm := NewManager(context.Background(), nil, cfg, WithInserter(&RecordingInserter{}), WithNotifiers(notifier), WithClock(clock))
+	defer rm.Shutdown()
+
+	w := rm.newWatchdog(WatchdogProbes{})
+	rm.HandleMQTTMessage("sensor/D1", []byte(`{"address": "D1", "value": 1}`), cfg)
+
+	clock.Advance(59 * time.Second)
+	rm.checkHealth(w, clock.Now())
+	if len(notifier.notifications) != 0 {
+		t.Fatalf("Expected no alert before the threshold, got %v", notifier.notifications)
+	}
+
+	// The flow stalls past the threshold: one alert per outage
+	clock.Advance(2 * time.Second)
+	rm.checkHealth(w, clock.Now())
+	clock.Advance(time.Minute)
+	rm.checkHealth(w, clock.Now())
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("Expected 1 engine alert, got %d", len(notifier.notifications))
+	}
+	notification := notifier.notifications[0]
+	if notification.Category != EngineCategory || notification.Alert.Device != CheckNoMessages || notification.Level != LevelWarning {
+		t.Errorf("Unexpected engine alert %+v", notification)
+	}
+	if notification.Alert.Current != 61 || notification.Alert.Threshold != 60 {
+		t.Errorf("Expected 61s silent against 60s, got %v against %v", notification.Alert.Current, notification.Alert.Threshold)
+	}
+
+	// Messages flowing again end the outage, the next stall alerts again
+	rm.HandleMQTTMessage("sensor/D1", []byte(`{"address": "D1", "value": 2}`), cfg)
+	rm.checkHealth(w, clock.Now())
+	clock.Advance(time.Minute)
+	rm.checkHealth(w, clock.Now())
+	if len(notifier.notifications) != 2 {
+		t.Errorf("Expected a second engine alert after the flow stalled again, got %d", len(notifier.notifications))
+	}
+}
+
+func TestWatchdogDisconnected(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	notifier := &fakeNotifier{name: "chat"}
+	cfg := config.Config{WatchdogMQTTDisconnected: 30 * time.Second}
+	rm := NewManager(context.Background(), nil, cfg, WithInserter(&RecordingInserter{}), WithNotifiers(notifier), WithClock(clock))
+	defer rm.Shutdown()
+
+	mqttUp := true
+	realtimeUp := false // Not checked without a threshold
+	w := rm.newWatchdog(WatchdogProbes{
+		MQTT:     func() bool { return mqttUp },
+		Realtime: func() bool { return realtimeUp },
+	})
+
+	rm.checkHealth(w, clock.Now())
+	mqttUp = false
+	clock.Advance(10 * time.Second)
+	rm.checkHealth(w, clock.Now()) // Disconnect noticed
+	clock.Advance(30 * time.Second)
+	rm.checkHealth(w, clock.Now())
+
+	if len(notifier.notifications) != 1 {
+		t.Fatalf("Expected 1 engine alert, got %v", notifier.notifications)
+	}
+	if got := notifier.notifications[0]; got.Alert.Device != CheckMQTTDisconnected || got.Level != LevelCritical || got.RuleID != "engine/mqtt_disconnected" {
+		t.Errorf("Unexpected engine alert %+v", got)
+	}
+
+	// A short blip after reconnecting doesn't alert
+	mqttUp = true
+	rm.checkHealth(w, clock.Now())
+	mqttUp = false
+	clock.Advance(10 * time.Second)
+	rm.checkHealth(w, clock.Now())
+	clock.Advance(10 * time.Second)
+	rm.checkHealth(w, clock.Now())
+	if len(notifier.notifications) != 1 {
+		t.Errorf("Expected no alert for a disconnect below the threshold, got %d alerts", len(notifier.notifications))
+	}
+}
@@ -0,0 +1,239 @@
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	InstanceMatchAny = "any" // A condition holds when it holds for any instance
+	InstanceMatchAll = "all" // A condition holds when it holds for every instance
+)
+
+// instanceIndex tracks the cached devices of the concrete topics matching each
+// wildcard rule topic, e.g. plant/a/temp and plant/b/temp for plant/+/temp,
+// so snapshots of wildcard rules don't scan the whole cache
+type instanceIndex struct {
+	mu   sync.RWMutex
+	keys map[string]map[cacheKey]struct{} // Filter -> cache keys of matching topics
+}
+
+func newInstanceIndex() *instanceIndex {
+	return &instanceIndex{keys: make(map[string]map[cacheKey]struct{})}
+}
+
+func (x *instanceIndex) add(filter string, key cacheKey) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	keys, ok := x.keys[filter]
+	if !ok {
+		keys = make(map[cacheKey]struct{})
+		x.keys[filter] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// remove drops keys no longer cached from every filter
+func (x *instanceIndex) remove(keys ...cacheKey) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, filterKeys := range x.keys {
+		for _, key := range keys {
+			delete(filterKeys, key)
+		}
+	}
+}
+
+// lookup returns the keys tracked for filter, sorted by topic
+func (x *instanceIndex) lookup(filter string) []cacheKey {
+	x.mu.RLock()
+	keys := make([]cacheKey, 0, len(x.keys[filter]))
+	for key := range x.keys[filter] {
+		keys = append(keys, key)
+	}
+	x.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Topic < keys[j].Topic
+	})
+	return keys
+}
+
+// reset replaces the tracked filters with those of idx, matching them against
+// the cached keys
+func (x *instanceIndex) reset(idx *topicIndex, cached []cacheKey) {
+	keys := make(map[string]map[cacheKey]struct{}, len(idx.wildcards))
+	for _, route := range idx.wildcards {
+		keys[route.filter] = make(map[cacheKey]struct{})
+	}
+	for _, key := range cached {
+		for _, filter := range idx.wildcardFilters(key.Topic) {
+			keys[filter][key] = struct{}{}
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.keys = keys
+}
+
+// topicInstance returns the levels of topic matched by the wildcards of
+// filter, e.g. "a" for plant/a/temp and plant/+/temp. Topics of different
+// filters with the same matched levels belong to the same instance.
+func topicInstance(filter, topic string) string {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	var matched []string
+	for i, level := range filterLevels {
+		if i >= len(topicLevels) {
+			break
+		}
+		switch level {
+		case "+":
+			matched = append(matched, topicLevels[i])
+		case "#":
+			matched = append(matched, topicLevels[i:]...)
+		}
+	}
+	return strings.Join(matched, "/")
+}
+
+// isWildcardTopic reports whether the rule topic is an MQTT topic filter
+func isWildcardTopic(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// validateInstanceMatch checks the instance match of a rule
+func validateInstanceMatch(match string) error {
+	switch match {
+	case "", InstanceMatchAny, InstanceMatchAll:
+		return nil
+	}
+	return fmt.Errorf("invalid instance match %q, expected %q or %q", match, InstanceMatchAny, InstanceMatchAll)
+}
+
+// ruleSnapshot holds the device values a rule is evaluated against
+type ruleSnapshot struct {
+	instance string // Levels matched by the wildcard topics, empty for rules without
+	values   map[string]any
+	keys     map[string]cacheKey // Cache keys of the values, for the devices' history
+}
+
+// alertMessage renders the alert of the condition from the values of the
+// snapshot's instance
+func (s ruleSnapshot) alertMessage(rule *AlertRule, condition AlertCondition, values map[string]float64) AlertMessage {
+	alert := rule.generateAlertMessage(condition, values)
+	alert.Instance = s.instance
+	return alert
+}
+
+// suppressedAlertMessage is AlertRule.suppressedAlertMessage of the instance
+func (s ruleSnapshot) suppressedAlertMessage(rule *AlertRule, condition AlertCondition, values map[string]float64) AlertMessage {
+	alert := rule.suppressedAlertMessage(condition, values)
+	alert.Instance = s.instance
+	return alert
+}
+
+// trackInstance records key under the wildcard rule topics matching its topic
+func (m *RuleManager) trackInstance(key cacheKey) {
+	m.routeMu.RLock()
+	defer m.routeMu.RUnlock()
+	for _, filter := range m.topicIndex.wildcardFilters(key.Topic) {
+		m.instances.add(filter, key)
+	}
+}
+
+// createRuleSnapshots resolves the devices of the rule. Rules with wildcard
+// topics get a snapshot per instance, holding the instance's devices and
+// those of the rule's other topics, sorted by instance. Instances missing a
+// device are left out.
+func (m *RuleManager) createRuleSnapshots(rule *AlertRule) []ruleSnapshot {
+	var filters []string
+	for _, ruleTopic := range rule.Topics {
+		if isWildcardTopic(ruleTopic) {
+			filters = append(filters, ruleTopic)
+		}
+	}
+	if len(filters) == 0 {
+		if snapshot, ok := m.resolveRuleSnapshot(rule); ok {
+			return []ruleSnapshot{snapshot}
+		}
+		return nil
+	}
+
+	// Devices of topics without wildcards are shared by every instance
+	shared := make(map[string]resolvedValue)
+	addresses := make(map[string]struct{})
+	now := m.now()
+	for _, ruleTopic := range rule.Topics {
+		devAddr := extractAddressFromTopic(ruleTopic)
+		addresses[devAddr] = struct{}{}
+		if !isWildcardTopic(ruleTopic) {
+			m.resolveValue(rule, cacheKey{Topic: ruleTopic, Address: devAddr}, devAddr, now, shared)
+		}
+	}
+
+	instances := make(map[string]map[string]resolvedValue)
+	for _, filter := range filters {
+		devAddr := extractAddressFromTopic(filter)
+		for _, key := range m.instances.lookup(filter) {
+			instance := topicInstance(filter, key.Topic)
+			resolved, ok := instances[instance]
+			if !ok {
+				resolved = make(map[string]resolvedValue)
+				instances[instance] = resolved
+			}
+			m.resolveValue(rule, key, devAddr, now, resolved)
+		}
+	}
+
+	names := make([]string, 0, len(instances))
+	for instance := range instances {
+		names = append(names, instance)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]ruleSnapshot, 0, len(names))
+	for _, instance := range names {
+		resolved := instances[instance]
+		for devAddr, cached := range shared {
+			resolved[devAddr] = cached
+		}
+		if len(resolved) != len(addresses) {
+			continue
+		}
+		snapshots = append(snapshots, newRuleSnapshot(instance, resolved))
+	}
+	return snapshots
+}
+
+// selectSnapshot picks the snapshot the condition is evaluated against. With
+// InstanceMatchAny it is the first instance the condition holds for, with
+// InstanceMatchAll the first it doesn't hold for. Otherwise the condition
+// held for every instance or for none, and the first snapshot that decides
+// the condition is used.
+func (r *AlertRule) selectSnapshot(snapshots []ruleSnapshot, history *sampleHistory, condition AlertCondition) ruleSnapshot {
+	if len(snapshots) == 1 {
+		return snapshots[0]
+	}
+
+	decided := -1
+	for i, snapshot := range snapshots {
+		state, _ := r.checkCondition(snapshot.values, history.of(snapshot.keys), condition)
+		switch {
+		case state == conditionTriggered && r.InstanceMatch != InstanceMatchAll:
+			return snapshot
+		case state == conditionClear && r.InstanceMatch == InstanceMatchAll:
+			return snapshot
+		case decided < 0 && (state == conditionTriggered || state == conditionClear):
+			decided = i
+		}
+	}
+	if decided < 0 {
+		return snapshots[0]
+	}
+	return snapshots[decided]
+}
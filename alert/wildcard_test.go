@@ -0,0 +1,226 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"goalert-engine/config"
+
+	"go.uber.org/zap"
+)
+
+// newWildcardTestManager returns a manager for a rule on plant/+/temp raising
+// an alert above 80, evaluated synchronously
+func newWildcardTestManager(t *testing.T, instanceMatch string) (*RuleManager, *RecordingInserter) {
+	t.Helper()
+
+	rules := []AlertRule{
+		*NewAlertRule("ovens", []string{"plant/+/temp"}, "alerts", "", "", "", []AlertCondition{
+			{ID: 1, Device: "temp", Operator: ">", Threshold: 80, Level: LevelError},
+		}, zap.NewNop()),
+	}
+	rules[0].InstanceMatch = instanceMatch
+
+	recorder := &RecordingInserter{}
+	rm := NewManager(context.Background(), rules, config.Config{},
+		WithInserter(recorder),
+		WithClock(NewManualClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))),
+	)
+	rm.Shutdown() // Evaluate synchronously below
+	return rm, recorder
+}
+
+func publishTemp(rm *RuleManager, line string, value float64) {
+	payload := fmt.Sprintf(`{"address": "temp", "value": %v}`, value)
+	rm.HandleMQTTMessage("plant/"+line+"/temp", []byte(payload), rm.Cfg)
+}
+
+func TestWildcardRuleAnyInstance(t *testing.T) {
+	rm, recorder := newWildcardTestManager(t, "")
+
+	var results []AlertResult
+	rm.OnAlertResult = func(result AlertResult) {
+		results = append(results, result)
+	}
+
+	publishTemp(rm, "line1", 70)
+	publishTemp(rm, "line2", 85)
+	publishTemp(rm, "line3", 60)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert for the instance above the threshold, got %d", len(alerts))
+	}
+	if len(results) != 1 || results[0].Alert.Instance != "line2" || results[0].Alert.Current != 85 {
+		t.Fatalf("Expected the alert of line2, got %+v", results)
+	}
+
+	// Once no instance is above the threshold the condition clears, the next
+	// breach of any instance alerts again after the cooldown
+	publishTemp(rm, "line2", 70)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+	rm.clock.(*ManualClock).Advance(time.Hour)
+	publishTemp(rm, "line3", 90)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 2 {
+		t.Fatalf("Expected a second alert after the condition cleared, got %d", len(alerts))
+	}
+	if last := results[len(results)-1]; last.Status != AlertDelivered || last.Alert.Instance != "line3" {
+		t.Errorf("Expected the alert of line3 delivered, got %+v", last)
+	}
+}
+
+func TestWildcardRuleAllInstances(t *testing.T) {
+	rm, recorder := newWildcardTestManager(t, InstanceMatchAll)
+
+	publishTemp(rm, "line1", 85)
+	publishTemp(rm, "line2", 70)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 0 {
+		t.Fatalf("Expected no alert while line2 is below the threshold, got %d", len(alerts))
+	}
+
+	publishTemp(rm, "line2", 90)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+
+	if alerts := recorder.Alerts(); len(alerts) != 1 {
+		t.Errorf("Expected 1 alert once every instance is above the threshold, got %d", len(alerts))
+	}
+}
+
+func TestWildcardRuleWarmup(t *testing.T) {
+	rm, recorder := newWildcardTestManager(t, "")
+	rm.warmup = time.Minute
+	clock := rm.clock.(*ManualClock)
+
+	publishTemp(rm, "line1", 85)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+	if alerts := recorder.Alerts(); len(alerts) != 0 {
+		t.Fatalf("Expected no alert while line1 warms up, got %d", len(alerts))
+	}
+
+	// Once line1 warmed up it alerts, a new instance still warming up
+	// doesn't hold it back
+	clock.Advance(2 * time.Minute)
+	publishTemp(rm, "line2", 70)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+	if alerts := recorder.Alerts(); len(alerts) != 1 {
+		t.Fatalf("Expected the alert of line1 after its warm-up, got %d", len(alerts))
+	}
+
+	// A breach of the new instance waits for its own warm-up
+	publishTemp(rm, "line1", 70)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+	clock.Advance(time.Hour)
+	publishTemp(rm, "line3", 90)
+	rm.evaluateRule(&rm.Rules[0], rm.Cfg)
+	if alerts := recorder.Alerts(); len(alerts) != 1 {
+		t.Errorf("Expected no alert while line3 warms up, got %d", len(alerts))
+	}
+}
+
+func TestWildcardRuleSnapshots(t *testing.T) {
+	rules := []AlertRule{
+		*NewAlertRule("lines", []string{"plant/+/temp", "plant/+/pressure", "plant/ambient"}, "alerts", "", "", "", nil, zap.NewNop()),
+	}
+	rm := NewRuleManager(context.Background(), rules, config.Config{}, NoopInserter{}, zap.NewNop())
+	rm.Shutdown()
+
+	messages := []struct {
+		topic   string
+		payload string
+	}{
+		{"plant/line1/temp", `{"address": "temp", "value": 85}`},
+		{"plant/line1/pressure", `{"address": "pressure", "value": 3}`},
+		{"plant/line2/temp", `{"address": "temp", "value": 75}`}, // No pressure yet
+		{"plant/line3/temp", `{"address": "temp", "value": 65}`},
+		{"plant/line3/pressure", `{"address": "pressure", "value": 4}`},
+		{"plant/ambient", `{"address": "ambient", "value": 20}`},
+		{"other/line4/temp", `{"address": "temp", "value": 95}`},
+	}
+	for _, msg := range messages {
+		rm.HandleMQTTMessage(msg.topic, []byte(msg.payload), rm.Cfg)
+	}
+
+	snapshots := rm.createRuleSnapshots(&rm.Rules[0])
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected snapshots of the complete instances line1 and line3, got %+v", snapshots)
+	}
+	want := []ruleSnapshot{
+		{instance: "line1", values: map[string]any{"temp": 85.0, "pressure": 3.0, "ambient": 20.0}},
+		{instance: "line3", values: map[string]any{"temp": 65.0, "pressure": 4.0, "ambient": 20.0}},
+	}
+	for i, snapshot := range snapshots {
+		if snapshot.instance != want[i].instance || fmt.Sprint(snapshot.values) != fmt.Sprint(want[i].values) {
+			t.Errorf("Snapshot %d: expected %+v, got %+v", i, want[i], snapshot)
+		}
+	}
+
+	// Without the shared ambient device no instance is complete
+	rm.deviceCache.delete(cacheKey{Topic: "plant/ambient", Address: "ambient"})
+	if snapshots := rm.createRuleSnapshots(&rm.Rules[0]); len(snapshots) != 0 {
+		t.Errorf("Expected no snapshot without the ambient device, got %+v", snapshots)
+	}
+}
+
+func TestWildcardInstancesTrackCache(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	rm := NewManager(context.Background(), nil, config.Config{},
+		WithInserter(NoopInserter{}),
+		WithClock(clock),
+		WithCacheTTL(time.Minute),
+	)
+	rm.Shutdown()
+
+	// Values cached before the rule exists are found once it is loaded
+	publishTemp(rm, "line1", 70)
+	rm.UpdateRules([]AlertRule{*NewAlertRule("ovens", []string{"plant/+/temp"}, "alerts", "", "", "", nil, zap.NewNop())}, rm.Cfg)
+	publishTemp(rm, "line2", 75)
+
+	if keys := rm.instances.lookup("plant/+/temp"); len(keys) != 2 || keys[0].Topic != "plant/line1/temp" || keys[1].Topic != "plant/line2/temp" {
+		t.Fatalf("Expected both lines tracked, got %v", keys)
+	}
+
+	// Expired values are no longer tracked
+	clock.Advance(2 * time.Minute)
+	publishTemp(rm, "line2", 80)
+	rm.sweepExpired(clock.Now())
+
+	if keys := rm.instances.lookup("plant/+/temp"); len(keys) != 1 || keys[0].Topic != "plant/line2/temp" {
+		t.Errorf("Expected only line2 tracked after line1 expired, got %v", keys)
+	}
+}
+
+func TestTopicInstance(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   string
+	}{
+		{"plant/+/temp", "plant/line1/temp", "line1"},
+		{"+/+/temp", "plant/line1/temp", "plant/line1"},
+		{"plant/#", "plant/line1/oven/temp", "line1/oven/temp"},
+		{"plant/line1/temp", "plant/line1/temp", ""},
+	}
+	for _, tt := range tests {
+		if got := topicInstance(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicInstance(%q, %q) = %q, want %q", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRuleInstanceMatch(t *testing.T) {
+	rule := NewAlertRule("ovens", []string{"plant/+/temp"}, "alerts", "", "", "", nil, zap.NewNop())
+	rule.InstanceMatch = "most"
+	if err := ValidateRule(rule); err == nil {
+		t.Error("Expected an unknown instance match rejected")
+	}
+	rule.InstanceMatch = InstanceMatchAll
+	if err := ValidateRule(rule); err != nil {
+		t.Errorf("Expected %q accepted, got %v", InstanceMatchAll, err)
+	}
+}
@@ -3,13 +3,17 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	MQTTBroker    string
+	MQTTBroker    string // Broker URL, e.g. "mqtts://host:8883" or, over WebSockets, "wss://host:8084/mqtt"
 	MQTTTopic     string
+	MQTTUsername  string
+	MQTTPassword  string
 	SupabaseURL   string // Supabase API endpoint's URL
 	SupabaseKey   string // Supabase Service Role Key
 	Schema        string // Supabase Custom Schema
@@ -17,6 +21,66 @@ type Config struct {
 	TLSClientCert string // Client certificate as a string (PEM format)
 	TLSClientKey  string // Client private key as a string (PEM format)
 
+	MQTTDedupWindow       time.Duration // Drop redelivered messages seen within this window (0 disables)
+	MQTTDedupSeqField     string        // Payload field carrying a publisher sequence number, looked up in the message decoded by a MessageDecoder, e.g. JSON
+	MQTTQoS               int           // QoS of the topic subscriptions
+	MQTTCleanSession      bool          // Ask the broker to discard the session on disconnect
+	MQTTOrderMatters      bool          // Deliver messages to the handler one at a time, in order
+	MQTTDisconnectQuiesce int           // Milliseconds the MQTT client may take to finish in-flight work on disconnect
+	MQTTConnectTimeout    time.Duration // How long the initial connect may wait for the broker
+	MQTTSubscribeTimeout  time.Duration // How long subscribing or unsubscribing may wait for the broker
+	ShutdownTimeout       time.Duration // How long shutdown waits for in-flight message handlers
+	MessageWorkers        int           // Goroutines processing MQTT messages
+	MessageQueueSize      int           // MQTT messages buffered while all workers are busy
+	MessageQueuePolicy    string        // What to do with a message when the queue is full: "block" or "shed"
+
+	DeviceCacheMaxEntries    int           // Maximum cached device values before LRU eviction (0 = unbounded)
+	DeviceCacheSweepInterval time.Duration // How often expired device values are evicted and the cache metrics refreshed (0 disables)
+	HistorySize              int           // Recent values kept per device for trend and anomaly conditions
+	PayloadFormat            string        // Decoder for MQTT payloads: "json" (default), "raw", "csv" or "sparkplug", see alert.RegisterDecoder
+	SparkplugMetricMap       string        // Device addresses of Sparkplug metrics, e.g. "Temperature:D100,Speed:D101"
+	TrustPayloadAddress      bool          // Accept payload addresses differing from the topic's last segment
+	PayloadSchema            string        // Field-type spec payloads must match, e.g. "address:string,value:numeric" (empty disables)
+	Timezone                 string        // IANA zone alert timestamps are rendered in, e.g. "Asia/Bangkok"
+	AlertDedupWindow         time.Duration // Collapse identical alerts from different rules within this window (0 disables)
+	AlertCountResetFactor    int           // Multiples of the base cooldown without alerts after which the cooldown backoff restarts
+	AlertCooldownPolicy      string        // "immediate_first" alerts on the first trigger, "throttle_all" only once it held for a cooldown
+	AlertPrecision           int           // Decimals of alert values unless a rule sets its own, negative keeps them unrounded
+	MetricsAddr              string        // Listen address for the Prometheus metrics and operator API endpoints (empty disables)
+	APISecret                string        // Bearer token the operator API requires (empty disables the API)
+	WarmupPeriod             time.Duration // Suppress alerts until a rule's devices have reported this long
+	StartupGracePeriod       time.Duration // Evaluate but don't deliver alerts for this long after the rule manager is created, once the first rules are loaded (0 disables)
+	RulesCacheFile           string        // Last-known-good rules, used on startup and while Supabase is unreachable (empty disables)
+	SupabaseInsertRPC        string        // Postgres function alerts are inserted through instead of the rule's table, "*" calls the function the rule's table names (empty disables)
+	SupabaseLevelColumn      string        // Column (or function parameter) receiving the alert level, e.g. "ERROR" (empty omits it)
+	SupabaseUserJWT          string        // Bearer token for inserts under row-level security, SupabaseKey stays the apikey (empty uses SupabaseKey)
+	SupabaseHTTPTimeout      time.Duration // How long an alert insert may take, including reading the response
+	DryRun                   bool          // Evaluate rules and log would-be alerts without inserting or notifying
+	EvaluationCoalesceWindow time.Duration // Fold the signals a rule receives within this window into one evaluation (0 disables)
+	PayloadUseNumber         bool          // Decode JSON numbers exactly, keeping integers beyond 2^53 from rounding
+
+	WatchdogInterval             time.Duration // How often the engine checks its own health (0 disables the watchdog)
+	WatchdogMQTTDisconnected     time.Duration // Alert when MQTT stays disconnected this long (0 disables)
+	WatchdogRealtimeDisconnected time.Duration // Alert when Supabase realtime stays disconnected this long (0 disables)
+	WatchdogNoMessages           time.Duration // Alert when no MQTT message arrives for this long (0 disables)
+	WatchdogTable                string        // Table engine alerts are inserted into with category "engine" (empty only logs and notifies)
+
+	SupabaseMaxIdleConns        int           // Idle connections the Supabase HTTP client keeps in total (0 uses the default of 100)
+	SupabaseMaxIdleConnsPerHost int           // Idle connections the Supabase HTTP client keeps per host (0 uses the default of 100)
+	SupabaseIdleConnTimeout     time.Duration // How long idle Supabase connections stay open (0 uses the default of 90s)
+
+	DeviceMetadataFile  string        // JSON file naming and locating device addresses (empty disables)
+	DeviceMetadataTable string        // Supabase table naming and locating device addresses, used when no file is set (empty disables)
+	DeviceMetadataTTL   time.Duration // How long device metadata is used before reloading
+
+	DeadLetterFile  string // File alerts that failed to insert are appended to as JSON lines (empty disables)
+	DeadLetterTable string // Supabase table alerts that failed to insert go to, used when no file is set (empty disables)
+
+	RealtimeHeartbeatInterval time.Duration // How often the realtime client sends a heartbeat
+	RealtimeHeartbeatTimeout  time.Duration // How long a heartbeat may take to send, must be below the interval
+	RealtimeDialTimeout       time.Duration // How long connecting to the realtime server may take
+	RealtimeReconnectInterval time.Duration // Wait between realtime reconnection attempts
+
 	Supabase struct {
 		URL             string
 		Key             string
@@ -25,6 +89,9 @@ type Config struct {
 		ForeignKey      string
 		ForeignKeyCheck string
 		Realtime        string
+		ReloadDebounce  time.Duration // Coalesce rule changes arriving within this window
+		ReloadMaxLag    time.Duration // Ignore rule changes committed longer ago than this (0 disables)
+		ReloadJitter    time.Duration // Random delay of up to this before loading rules, staggering replicas (0 disables)
 	}
 }
 
@@ -42,12 +109,75 @@ func Load() Config {
 	return Config{
 		MQTTBroker:    os.Getenv("MQTT_BROKER"),
 		MQTTTopic:     os.Getenv("MQTT_TOPIC"),
+		MQTTUsername:  getEnvString("MQTT_USERNAME", "emqx"),
+		MQTTPassword:  getEnvString("MQTT_PASSWORD", "public"),
 		SupabaseURL:   os.Getenv("SUPABASE_URL"),
 		SupabaseKey:   os.Getenv("SUPABASE_KEY"),
 		Schema:        schema,
 		TLSCACert:     os.Getenv("TLS_CA_CERT"),
 		TLSClientCert: os.Getenv("TLS_CLIENT_CERT"),
 		TLSClientKey:  os.Getenv("TLS_CLIENT_KEY"),
+
+		MQTTDedupWindow:       getEnvDuration("MQTT_DEDUP_WINDOW", 0),
+		MQTTDedupSeqField:     getEnvString("MQTT_DEDUP_SEQ_FIELD", "seq"),
+		MQTTQoS:               getEnvInt("MQTT_QOS", 0),
+		MQTTCleanSession:      getEnvBool("MQTT_CLEAN_SESSION", true),
+		MQTTOrderMatters:      getEnvBool("MQTT_ORDER_MATTERS", true),
+		MQTTDisconnectQuiesce: getEnvInt("MQTT_DISCONNECT_QUIESCE", 250),
+		MQTTConnectTimeout:    getEnvDuration("MQTT_CONNECT_TIMEOUT", 30*time.Second),
+		MQTTSubscribeTimeout:  getEnvDuration("MQTT_SUBSCRIBE_TIMEOUT", 10*time.Second),
+		ShutdownTimeout:       getEnvDuration("SHUTDOWN_TIMEOUT", 5*time.Second),
+		MessageWorkers:        getEnvInt("MESSAGE_WORKERS", 8),
+		MessageQueueSize:      getEnvInt("MESSAGE_QUEUE_SIZE", 1000),
+		MessageQueuePolicy:    getEnvString("MESSAGE_QUEUE_POLICY", "block"),
+
+		DeviceCacheMaxEntries:    getEnvInt("DEVICE_CACHE_MAX_ENTRIES", 0),
+		DeviceCacheSweepInterval: getEnvDuration("DEVICE_CACHE_SWEEP_INTERVAL", time.Minute),
+		HistorySize:              getEnvInt("HISTORY_SIZE", 32),
+		PayloadFormat:            getEnvString("PAYLOAD_FORMAT", "json"),
+		SparkplugMetricMap:       os.Getenv("SPARKPLUG_METRIC_MAP"),
+		TrustPayloadAddress:      getEnvBool("TRUST_PAYLOAD_ADDRESS", false),
+		PayloadSchema:            os.Getenv("PAYLOAD_SCHEMA"),
+		Timezone:                 getEnvString("TIMEZONE", "UTC"),
+		AlertDedupWindow:         getEnvDuration("ALERT_DEDUP_WINDOW", 0),
+		AlertCountResetFactor:    getEnvInt("ALERT_COUNT_RESET_FACTOR", 4),
+		AlertCooldownPolicy:      getEnvString("ALERT_COOLDOWN_POLICY", "immediate_first"),
+		AlertPrecision:           getEnvInt("ALERT_PRECISION", 1),
+		MetricsAddr:              os.Getenv("METRICS_ADDR"),
+		APISecret:                os.Getenv("API_SECRET"),
+		WarmupPeriod:             getEnvDuration("WARMUP_PERIOD", 0),
+		StartupGracePeriod:       getEnvDuration("STARTUP_GRACE_PERIOD", 0),
+		RulesCacheFile:           os.Getenv("RULES_CACHE_FILE"),
+		SupabaseInsertRPC:        os.Getenv("SUPABASE_INSERT_RPC"),
+		SupabaseLevelColumn:      os.Getenv("SUPABASE_LEVEL_COLUMN"),
+		SupabaseUserJWT:          os.Getenv("SUPABASE_USER_JWT"),
+		SupabaseHTTPTimeout:      getEnvDuration("SUPABASE_HTTP_TIMEOUT", 10*time.Second),
+		DryRun:                   getEnvBool("DRY_RUN", false),
+		EvaluationCoalesceWindow: getEnvDuration("EVALUATION_COALESCE_WINDOW", 0),
+		PayloadUseNumber:         getEnvBool("PAYLOAD_USE_NUMBER", false),
+
+		WatchdogInterval:             getEnvDuration("WATCHDOG_INTERVAL", 10*time.Second),
+		WatchdogMQTTDisconnected:     getEnvDuration("WATCHDOG_MQTT_DISCONNECTED", 0),
+		WatchdogRealtimeDisconnected: getEnvDuration("WATCHDOG_REALTIME_DISCONNECTED", 0),
+		WatchdogNoMessages:           getEnvDuration("WATCHDOG_NO_MESSAGES", 0),
+		WatchdogTable:                getEnvString("WATCHDOG_TABLE", ""),
+
+		SupabaseMaxIdleConns:        getEnvInt("SUPABASE_MAX_IDLE_CONNS", 100),
+		SupabaseMaxIdleConnsPerHost: getEnvInt("SUPABASE_MAX_IDLE_CONNS_PER_HOST", 100),
+		SupabaseIdleConnTimeout:     getEnvDuration("SUPABASE_IDLE_CONN_TIMEOUT", 90*time.Second),
+
+		DeviceMetadataFile:  os.Getenv("DEVICE_METADATA_FILE"),
+		DeviceMetadataTable: os.Getenv("DEVICE_METADATA_TABLE"),
+		DeviceMetadataTTL:   getEnvDuration("DEVICE_METADATA_TTL", 5*time.Minute),
+
+		DeadLetterFile:  os.Getenv("DEAD_LETTER_FILE"),
+		DeadLetterTable: os.Getenv("DEAD_LETTER_TABLE"),
+
+		RealtimeHeartbeatInterval: getEnvDuration("REALTIME_HEARTBEAT_INTERVAL", 20*time.Second),
+		RealtimeHeartbeatTimeout:  getEnvDuration("REALTIME_HEARTBEAT_TIMEOUT", 5*time.Second),
+		RealtimeDialTimeout:       getEnvDuration("REALTIME_DIAL_TIMEOUT", 10*time.Second),
+		RealtimeReconnectInterval: getEnvDuration("REALTIME_RECONNECT_INTERVAL", 500*time.Millisecond),
+
 		Supabase: struct {
 			URL             string
 			Key             string
@@ -56,6 +186,9 @@ func Load() Config {
 			ForeignKey      string
 			ForeignKeyCheck string
 			Realtime        string
+			ReloadDebounce  time.Duration
+			ReloadMaxLag    time.Duration
+			ReloadJitter    time.Duration
 		}{
 			URL:             os.Getenv("SUPABASE_URL"),
 			Key:             os.Getenv("SUPABASE_KEY"),
@@ -64,6 +197,60 @@ func Load() Config {
 			ForeignKey:      os.Getenv("SUPABASE_RULES_FK"),
 			ForeignKeyCheck: os.Getenv("SUPABASE_RULES_FK_EQ"),
 			Realtime:        os.Getenv("SUPABASE_REALTIME_TABLE"),
+			ReloadDebounce:  getEnvDuration("SUPABASE_RELOAD_DEBOUNCE", 500*time.Millisecond),
+			ReloadMaxLag:    getEnvDuration("SUPABASE_RELOAD_MAX_LAG", 0),
+			ReloadJitter:    getEnvDuration("SUPABASE_RELOAD_JITTER", 0),
 		},
 	}
 }
+
+// getEnvString returns the value of key, or def when it is unset.
+func getEnvString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// getEnvInt parses key as an int, or returns def when it is unset or invalid.
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Printf("Warning: invalid %s %q, using default %d\n", key, v, def)
+		return def
+	}
+	return i
+}
+
+// getEnvBool parses key as a bool, or returns def when it is unset or invalid.
+func getEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		fmt.Printf("Warning: invalid %s %q, using default %t\n", key, v, def)
+		return def
+	}
+	return b
+}
+
+// getEnvDuration parses key as a time.Duration (e.g. "5s"), or returns def
+// when it is unset or invalid.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("Warning: invalid %s %q, using default %s\n", key, v, def)
+		return def
+	}
+	return d
+}
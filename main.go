@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	_ "time/tzdata" // The runtime image has no zoneinfo for TIMEZONE
 
 	"go.uber.org/zap"
 )
@@ -36,6 +37,10 @@ func main() {
 
 	// Initialize service manager
 	serviceManager := setup.NewServiceManager(ctx, cfg, logger)
+
+	if cfg.MetricsAddr != "" {
+		setup.StartHTTPServer(ctx, cfg.MetricsAddr, setup.NewAPIHandler(serviceManager, cfg.APISecret, logger), logger)
+	}
 	if err := serviceManager.Start(); err != nil {
 		logger.Fatal("Failed to start services", zap.Error(err))
 	}
@@ -53,5 +58,7 @@ func main() {
 		logger.Info("Context cancelled")
 	}
 
+	serviceManager.Stop()
+
 	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,179 @@
+// Package metrics holds the Prometheus collectors exported by the engine.
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "goalert"
+
+// Registry is the registry all engine collectors are registered with
+var Registry = prometheus.NewRegistry()
+
+var (
+	// DeviceCacheEvictions counts device cache entries evicted to stay within the size cap
+	DeviceCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "device_cache_evictions_total",
+		Help:      "Number of device cache entries evicted to stay within the configured maximum.",
+	})
+
+	// DeviceCacheExpirations counts device cache entries removed by the janitor after their TTL
+	DeviceCacheExpirations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "device_cache_expirations_total",
+		Help:      "Number of device cache entries removed after exceeding the cache TTL.",
+	})
+
+	// DeviceCacheEntries is the number of device values cached, refreshed by
+	// the cache janitor
+	DeviceCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_cache_entries",
+		Help:      "Number of device values in the cache.",
+	})
+
+	// DeviceCacheAges is the age distribution of the cached device values,
+	// refreshed by the cache janitor
+	DeviceCacheAges = NewSnapshotHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "device_cache_value_age_seconds",
+		Help:      "Time since each cached device value was received, as of the last cache sweep.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	})
+
+	// InvalidPayloads counts MQTT payloads rejected by the payload schema, by reason
+	InvalidPayloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "invalid_payloads_total",
+		Help:      "Number of MQTT payloads rejected by payload schema validation.",
+	}, []string{"reason"})
+
+	// EvaluationDuration times the evaluation of each rule condition, by level
+	EvaluationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "evaluation_duration_seconds",
+		Help:      "Time spent evaluating a rule condition.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"level"})
+
+	// AlertsSuppressed counts alerts whose condition held but which weren't
+	// sent, by reason, e.g. "cooldown" or "snoozed"
+	AlertsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alerts_suppressed_total",
+		Help:      "Number of alerts not sent although their condition held, by reason.",
+	}, []string{"reason"})
+
+	// InsertDuration times alert inserts, by level, including failed ones
+	InsertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "insert_duration_seconds",
+		Help:      "Time spent inserting an alert, including failed inserts.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"level"})
+
+	// AlertsDeadLettered counts alerts that failed to insert and were kept in
+	// the dead-letter sink
+	AlertsDeadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alerts_dead_lettered_total",
+		Help:      "Number of alerts kept in the dead-letter sink after their insert failed.",
+	})
+
+	// MessageQueueDepth is the number of MQTT messages waiting for a worker
+	MessageQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "message_queue_depth",
+		Help:      "Number of MQTT messages queued for processing.",
+	})
+
+	// MessagesShed counts MQTT messages dropped because the queue was full
+	MessagesShed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_shed_total",
+		Help:      "Number of MQTT messages dropped because the processing queue was full.",
+	})
+
+	// MessageHandlerPanics counts MQTT messages whose handler panicked
+	MessageHandlerPanics = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "message_handler_panics_total",
+		Help:      "Number of MQTT messages whose handler panicked and was recovered.",
+	})
+
+	// RealtimeReconnects counts reconnections of the Supabase realtime link
+	RealtimeReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "realtime_reconnects_total",
+		Help:      "Number of times the Supabase realtime connection was re-established.",
+	})
+
+	// RealtimeConnected is 1 while the Supabase realtime link is up
+	RealtimeConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realtime_connected",
+		Help:      "Whether the Supabase realtime connection is up (1) or down (0).",
+	})
+
+	// RealtimeChangeLag is how long after their commit rule changes reach the engine
+	RealtimeChangeLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "realtime_change_lag_seconds",
+		Help:      "Time between the commit of a rules table change and its arrival over realtime.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 4, 10),
+	})
+
+	// RealtimeSinceLastConnect is the time since the realtime link last connected
+	RealtimeSinceLastConnect = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realtime_seconds_since_last_connect",
+		Help:      "Seconds since the Supabase realtime connection was last established, 0 if it never was.",
+	}, func() float64 {
+		last := realtimeLastConnect.Load()
+		if last == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, last)).Seconds()
+	})
+)
+
+// realtimeLastConnect is the UnixNano time the realtime link last connected
+var realtimeLastConnect atomic.Int64
+
+// MarkRealtimeConnected records that the realtime link connected at t
+func MarkRealtimeConnected(t time.Time) {
+	realtimeLastConnect.Store(t.UnixNano())
+	RealtimeConnected.Set(1)
+}
+
+func init() {
+	Registry.MustRegister(
+		DeviceCacheEvictions,
+		DeviceCacheExpirations,
+		DeviceCacheEntries,
+		DeviceCacheAges,
+		InvalidPayloads,
+		EvaluationDuration,
+		AlertsSuppressed,
+		InsertDuration,
+		AlertsDeadLettered,
+		MessageQueueDepth,
+		MessagesShed,
+		MessageHandlerPanics,
+		RealtimeReconnects,
+		RealtimeConnected,
+		RealtimeChangeLag,
+		RealtimeSinceLastConnect,
+	)
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
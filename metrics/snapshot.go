@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SnapshotHistogram is a histogram of the latest set of observations, which
+// Set replaces as a whole. Unlike a prometheus.Histogram it describes a state,
+// e.g. the ages of the values currently cached, rather than accumulating.
+type SnapshotHistogram struct {
+	desc    *prometheus.Desc
+	buckets []float64
+
+	mu     sync.Mutex
+	count  uint64
+	sum    float64
+	counts map[float64]uint64 // Upper bound -> cumulative count
+}
+
+// NewSnapshotHistogram creates a histogram with the name, help and buckets of
+// opts, the default buckets when it has none
+func NewSnapshotHistogram(opts prometheus.HistogramOpts) *SnapshotHistogram {
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	h := &SnapshotHistogram{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help, nil, opts.ConstLabels,
+		),
+		buckets: buckets,
+	}
+	h.Set(nil)
+	return h
+}
+
+// Set replaces the observations of the histogram with values
+func (h *SnapshotHistogram) Set(values []float64) {
+	counts := make(map[float64]uint64, len(h.buckets))
+	for _, bound := range h.buckets {
+		counts[bound] = 0 // Every bucket is exported, empty ones too
+	}
+	var sum float64
+	for _, value := range values {
+		sum += value
+		for _, bound := range h.buckets {
+			if value <= bound {
+				counts[bound]++
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count = uint64(len(values))
+	h.sum = sum
+	h.counts = counts
+}
+
+func (h *SnapshotHistogram) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *SnapshotHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch <- prometheus.MustNewConstHistogram(h.desc, h.count, h.sum, h.counts)
+}
@@ -3,8 +3,15 @@ package mqtts
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"goalert-engine/config"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -13,46 +20,140 @@ import (
 
 var mqttNewClient = mqtt.NewClient
 
+// newUUID generates the random part of client IDs, replaced in tests for a
+// predictable ID
+var newUUID = uuid.New
+
+// clientIDPrefix starts every client ID, the rest is a random UUID so
+// replicas don't take over each other's connection
+const clientIDPrefix = "go_mqtt_subscriber_"
+
+// defaultConnectTimeout bounds the initial connect unless MQTT_CONNECT_TIMEOUT
+// is set
+const defaultConnectTimeout = 30 * time.Second
+
+// defaultSubscribeTimeout bounds subscribe and unsubscribe waits unless
+// MQTT_SUBSCRIBE_TIMEOUT is set
+const defaultSubscribeTimeout = 10 * time.Second
+
+// ErrTimeout is returned when the broker doesn't confirm the connection or a
+// subscription change within its timeout
+var ErrTimeout = errors.New("MQTT broker didn't respond in time")
+
+// OptionsHook adjusts the client options before connecting, e.g. keep-alive,
+// ping timeout or ordered delivery, overriding the package's defaults
+type OptionsHook func(*mqtt.ClientOptions)
+
 type Client struct {
 	cfg    config.Config
 	Client mqtt.Client
+
+	mu     sync.Mutex
+	topics []string        // Topics subscribed through SubscribeAndListen
+	qos    map[string]byte // QoS each topic is subscribed at
 }
 
 func (c *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
 	c.Client.AddRoute(topic, callback)
 }
 
-func New(cfg config.Config) *Client {
+// New connects to the broker, failing when it doesn't accept the connection
+// within MQTT_CONNECT_TIMEOUT. Hooks run in order after the defaults are set.
+func New(cfg config.Config, hooks ...OptionsHook) (*Client, error) {
 	// MQTT over TLS
 	opts := mqtt.NewClientOptions().AddBroker(cfg.MQTTBroker)
-	opts.SetClientID("alert-engine")
+	opts.SetClientID(clientIDPrefix + newUUID().String())
 	opts.SetAutoReconnect(true)                    // Enable automatic reconnects
 	opts.SetMaxReconnectInterval(30 * time.Second) // Maximum interval between reconnections
 	opts.SetConnectRetry(true)                     // Retry connecting
+	opts.SetCleanSession(cfg.MQTTCleanSession)     // Keep or discard the broker session on disconnect
+	opts.SetOrderMatters(cfg.MQTTOrderMatters)     // Serialize handler calls or run them concurrently
+	opts.SetAutoAckDisabled(true)                  // Handlers ack once a message is processed, shed messages stay unacked
+	opts.SetUsername(cfg.MQTTUsername)
+	opts.SetPassword(cfg.MQTTPassword)
 
-	// Enable TLS (MQTTS) using certs and keys from environment variables
-	tlsConfig, err := createTLSConfig(cfg)
-	if err != nil {
-		panic(fmt.Errorf("failed to create mqtts TLS config: %v", err))
+	switch brokerScheme(cfg.MQTTBroker) {
+	case "ws":
+		// MQTT over WebSockets, through the environment's HTTP proxy if any
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyFromEnvironment})
+	case "wss":
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyFromEnvironment})
+		tlsConfig, err := createWebSocketTLSConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create wss TLS config: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	default:
+		// Enable TLS (MQTTS) using certs and keys from environment variables
+		tlsConfig, err := createTLSConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mqtts TLS config: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	for _, hook := range hooks {
+		hook(opts)
 	}
-	clientID := "go_mqtt_subscriber_" + uuid.New().String()
-	opts.SetTLSConfig(tlsConfig)
-	opts.SetClientID(clientID)
-	opts.SetUsername("emqx")
-	opts.SetPassword("public")
 
 	// Connect with MQTTS
 	client := mqttNewClient(opts)
+	timeout := cfg.MQTTConnectTimeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
 	token := client.Connect()
-	token.Wait()
-	if token.Error() != nil {
-		panic(token.Error())
+	if !token.WaitTimeout(timeout) {
+		// Stop the connect retries still running in the background
+		client.Disconnect(0)
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w (%s)", ErrTimeout, timeout)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
 	}
 
 	return &Client{
 		cfg:    cfg,
 		Client: client,
+	}, nil
+}
+
+// brokerScheme returns the lower-cased scheme of the broker URL
+func brokerScheme(broker string) string {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Scheme)
+}
+
+// createWebSocketTLSConfig is the TLS configuration of wss:// brokers. Cloud
+// brokers usually present a publicly trusted certificate and authenticate
+// clients by username and password, so the CA certificate is optional and
+// client certificates are only required without a username.
+func createWebSocketTLSConfig(cfg config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.TLSCACert != "" {
+		certPool := x509.NewCertPool()
+		if ok := certPool.AppendCertsFromPEM([]byte(cfg.TLSCACert)); !ok {
+			return nil, fmt.Errorf("failed to append CA certificate")
+		}
+		tlsConfig.RootCAs = certPool
 	}
+
+	switch {
+	case cfg.TLSClientCert != "" && cfg.TLSClientKey != "":
+		cert, err := tls.X509KeyPair([]byte(cfg.TLSClientCert), []byte(cfg.TLSClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate or key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case cfg.TLSClientCert != "" || cfg.TLSClientKey != "":
+		return nil, fmt.Errorf("client certificate or key is missing")
+	case cfg.MQTTUsername == "":
+		return nil, fmt.Errorf("either client certificates or a username are required")
+	}
+	return tlsConfig, nil
 }
 
 // createTLSConfig will load the necessary certificates for MQTTS from environment variables
@@ -87,16 +188,107 @@ func createTLSConfig(cfg config.Config) (*tls.Config, error) {
 	}, nil
 }
 
-// SubscribeAndListen subscribes to the topic and handles incoming messages
+// SubscribeAndListen subscribes to the topic at MQTT_QOS and handles incoming
+// messages. It fails when the broker doesn't confirm within
+// MQTT_SUBSCRIBE_TIMEOUT.
 func (c *Client) SubscribeAndListen(topic string, handler mqtt.MessageHandler) error {
-	token := c.Client.Subscribe(topic, 0, handler)
-	token.Wait()
-	if token.Error() != nil {
-		return token.Error()
+	return c.subscribe(topic, byte(c.cfg.MQTTQoS), handler)
+}
+
+// subscribe subscribes handler to the topic at qos, replacing any previous
+// subscription of the topic
+func (c *Client) subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	token := c.Client.Subscribe(topic, qos, handler)
+	if err := c.wait(token); err != nil {
+		return err
 	}
+
+	c.mu.Lock()
+	if !slices.Contains(c.topics, topic) {
+		c.topics = append(c.topics, topic)
+	}
+	if c.qos == nil {
+		c.qos = make(map[string]byte)
+	}
+	c.qos[topic] = qos
+	c.mu.Unlock()
+	return nil
+}
+
+// wait waits up to the subscribe timeout for the token to complete
+func (c *Client) wait(token mqtt.Token) error {
+	timeout := c.cfg.MQTTSubscribeTimeout
+	if timeout <= 0 {
+		timeout = defaultSubscribeTimeout
+	}
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("%w (%s)", ErrTimeout, timeout)
+	}
+	return token.Error()
+}
+
+// Topics returns the topics currently subscribed through SubscribeAndListen
+func (c *Client) Topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.topics)
+}
+
+// Unsubscribe removes the subscriptions for the given topics
+func (c *Client) Unsubscribe(topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	token := c.Client.Unsubscribe(topics...)
+	if err := c.wait(token); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.topics = slices.DeleteFunc(c.topics, func(t string) bool {
+		return slices.Contains(topics, t)
+	})
+	for _, topic := range topics {
+		delete(c.qos, topic)
+	}
+	c.mu.Unlock()
 	return nil
 }
 
+// SyncSubscriptions makes the subscriptions match subscriptions, topic ->
+// QoS, unsubscribing from topics no longer wanted and subscribing handler to
+// new ones and to those wanted at another QoS
+func (c *Client) SyncSubscriptions(subscriptions map[string]byte, handler mqtt.MessageHandler) (added, removed []string, err error) {
+	c.mu.Lock()
+	current := slices.Clone(c.topics)
+	currentQoS := maps.Clone(c.qos)
+	c.mu.Unlock()
+
+	for _, topic := range current {
+		if _, ok := subscriptions[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	for topic, want := range subscriptions {
+		qos, subscribed := currentQoS[topic]
+		if !slices.Contains(current, topic) || (subscribed && qos != want) {
+			added = append(added, topic)
+		}
+	}
+	slices.Sort(added)
+
+	if err := c.Unsubscribe(removed...); err != nil {
+		return nil, nil, fmt.Errorf("failed to unsubscribe from %v: %w", removed, err)
+	}
+	for _, topic := range added {
+		if err := c.subscribe(topic, subscriptions[topic], handler); err != nil {
+			return added, removed, fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+		}
+	}
+	return added, removed, nil
+}
+
 // Disconnect gracefully disconnects from the MQTT broker
 func (c *Client) Disconnect(quiesce uint) {
 	c.Client.Disconnect(quiesce)
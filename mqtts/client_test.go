@@ -8,8 +8,10 @@ import (
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // MockClient is a mock implementation of mqtt.Client
@@ -106,12 +108,42 @@ func TestNewClient(t *testing.T) {
 				TLSClientKey:  validClientKey,
 			},
 			mockSetup: func(mc *MockClient, mt *MockToken) {
-				mt.On("Wait").Return(true)
+				mt.On("WaitTimeout", defaultConnectTimeout).Return(true)
 				mt.On("Error").Return(nil)
 				mc.On("Connect").Return(mt)
 			},
 			expectError: false,
 		},
+		{
+			name: "connect timeout",
+			cfg: config.Config{
+				MQTTBroker:    "tls://localhost:8883",
+				TLSCACert:     validCACert,
+				TLSClientCert: validClientCert,
+				TLSClientKey:  validClientKey,
+			},
+			mockSetup: func(mc *MockClient, mt *MockToken) {
+				mt.On("WaitTimeout", defaultConnectTimeout).Return(false)
+				mc.On("Connect").Return(mt)
+				mc.On("Disconnect", uint(0)).Return()
+			},
+			expectError: true,
+		},
+		{
+			name: "broker refuses connection",
+			cfg: config.Config{
+				MQTTBroker:    "tls://localhost:8883",
+				TLSCACert:     validCACert,
+				TLSClientCert: validClientCert,
+				TLSClientKey:  validClientKey,
+			},
+			mockSetup: func(mc *MockClient, mt *MockToken) {
+				mt.On("WaitTimeout", defaultConnectTimeout).Return(true)
+				mt.On("Error").Return(errors.New("not authorized"))
+				mc.On("Connect").Return(mt)
+			},
+			expectError: true,
+		},
 		{
 			name: "connection error",
 			cfg: config.Config{
@@ -121,7 +153,7 @@ func TestNewClient(t *testing.T) {
 				TLSClientKey:  "test-client-key",
 			},
 			mockSetup: func(mc *MockClient, mt *MockToken) {
-				mt.On("Wait").Return(true)
+				mt.On("WaitTimeout", defaultConnectTimeout).Return(true)
 				mt.On("Error").Return(errors.New("connection failed"))
 				mc.On("Connect").Return(mt)
 			},
@@ -175,10 +207,13 @@ func TestNewClient(t *testing.T) {
 				}
 			}
 
+			client, err := New(tt.cfg)
 			if tt.expectError {
-				assert.Panics(t, func() { New(tt.cfg) })
+				assert.Error(t, err)
+				assert.Nil(t, client)
 			} else {
-				assert.NotPanics(t, func() { New(tt.cfg) })
+				assert.NoError(t, err)
+				assert.NotNil(t, client)
 			}
 		})
 	}
@@ -254,7 +289,7 @@ func TestSubscribeAndListen(t *testing.T) {
 			name:  "successful subscription",
 			topic: "test/topic",
 			mockSetup: func(mc *MockClient, mt *MockToken) {
-				mt.On("Wait").Return(true)
+				mt.On("WaitTimeout", defaultSubscribeTimeout).Return(true)
 				mt.On("Error").Return(nil)
 				mc.On("Subscribe", "test/topic", byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mt)
 			},
@@ -264,12 +299,21 @@ func TestSubscribeAndListen(t *testing.T) {
 			name:  "subscription error",
 			topic: "test/topic",
 			mockSetup: func(mc *MockClient, mt *MockToken) {
-				mt.On("Wait").Return(true)
+				mt.On("WaitTimeout", defaultSubscribeTimeout).Return(true)
 				mt.On("Error").Return(errors.New("subscription failed"))
 				mc.On("Subscribe", "test/topic", byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mt)
 			},
 			expectError: true,
 		},
+		{
+			name:  "subscription timeout",
+			topic: "test/topic",
+			mockSetup: func(mc *MockClient, mt *MockToken) {
+				mt.On("WaitTimeout", defaultSubscribeTimeout).Return(false)
+				mc.On("Subscribe", "test/topic", byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mt)
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -287,6 +331,7 @@ func TestSubscribeAndListen(t *testing.T) {
 
 			if tt.expectError {
 				assert.Error(t, err)
+				assert.Empty(t, c.Topics())
 			} else {
 				assert.NoError(t, err)
 			}
@@ -297,6 +342,302 @@ func TestSubscribeAndListen(t *testing.T) {
 	}
 }
 
+func TestSubscribeAndListenQoS(t *testing.T) {
+	mockClient := &MockClient{}
+	mockToken := &MockToken{}
+	mockToken.On("WaitTimeout", defaultSubscribeTimeout).Return(true)
+	mockToken.On("Error").Return(nil)
+	mockClient.On("Subscribe", "test/topic", byte(1), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken)
+
+	c := &Client{
+		Client: mockClient,
+		cfg:    config.Config{MQTTQoS: 1},
+	}
+
+	err := c.SubscribeAndListen("test/topic", func(client mqtt.Client, msg mqtt.Message) {})
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestSyncSubscriptionsQoS(t *testing.T) {
+	mockClient := &MockClient{}
+	mockToken := &MockToken{}
+	mockToken.On("WaitTimeout", defaultSubscribeTimeout).Return(true)
+	mockToken.On("Error").Return(nil)
+	mockClient.On("Subscribe", "plant/a", byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken).Once()
+	mockClient.On("Subscribe", "plant/b", byte(1), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken).Once()
+	mockClient.On("Subscribe", "plant/a", byte(2), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken).Once()
+
+	c := &Client{Client: mockClient}
+	handler := func(client mqtt.Client, msg mqtt.Message) {}
+
+	added, _, err := c.SyncSubscriptions(map[string]byte{"plant/a": 0, "plant/b": 1}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plant/a", "plant/b"}, added)
+
+	// Only the topic wanted at another QoS is subscribed again
+	added, removed, err := c.SyncSubscriptions(map[string]byte{"plant/a": 2, "plant/b": 1}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plant/a"}, added)
+	assert.Empty(t, removed)
+	assert.ElementsMatch(t, []string{"plant/a", "plant/b"}, c.Topics())
+
+	mockClient.AssertExpectations(t)
+}
+
+func TestNewOptionsHook(t *testing.T) {
+	oldNewClient := mqttNewClient
+	defer func() { mqttNewClient = oldNewClient }()
+
+	var built *mqtt.ClientOptions
+	mqttNewClient = func(opts *mqtt.ClientOptions) mqtt.Client {
+		built = opts
+		mockToken := &MockToken{}
+		mockToken.On("WaitTimeout", defaultConnectTimeout).Return(true)
+		mockToken.On("Error").Return(nil)
+		mockClient := &MockClient{}
+		mockClient.On("Connect").Return(mockToken)
+		return mockClient
+	}
+
+	cfg := config.Config{
+		MQTTBroker:    "tls://localhost:8883",
+		TLSCACert:     validCACert,
+		TLSClientCert: validClientCert,
+		TLSClientKey:  validClientKey,
+	}
+	cfg.MQTTOrderMatters = true
+
+	// Without hooks the defaults and config are kept
+	_, err := New(cfg)
+	assert.NoError(t, err)
+	assert.True(t, built.AutoReconnect)
+	assert.True(t, built.Order)
+
+	_, err = New(cfg,
+		func(opts *mqtt.ClientOptions) {
+			opts.SetKeepAlive(45 * time.Second)
+			opts.SetPingTimeout(5 * time.Second)
+		},
+		func(opts *mqtt.ClientOptions) {
+			opts.SetOrderMatters(false)
+			opts.SetMessageChannelDepth(500)
+			opts.SetAutoReconnect(false)
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(45), built.KeepAlive)
+	assert.Equal(t, 5*time.Second, built.PingTimeout)
+	assert.False(t, built.Order)
+	assert.Equal(t, uint(500), built.MessageChannelDepth)
+	assert.False(t, built.AutoReconnect, "Expected hooks to override the defaults")
+	assert.True(t, built.ConnectRetry, "Expected defaults the hooks didn't touch to stay")
+}
+
+func TestNewClientID(t *testing.T) {
+	oldNewClient, oldNewUUID := mqttNewClient, newUUID
+	defer func() { mqttNewClient, newUUID = oldNewClient, oldNewUUID }()
+
+	var built *mqtt.ClientOptions
+	mqttNewClient = func(opts *mqtt.ClientOptions) mqtt.Client {
+		built = opts
+		mockToken := &MockToken{}
+		mockToken.On("WaitTimeout", defaultConnectTimeout).Return(true)
+		mockToken.On("Error").Return(nil)
+		mockClient := &MockClient{}
+		mockClient.On("Connect").Return(mockToken)
+		return mockClient
+	}
+	newUUID = func() uuid.UUID {
+		return uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	}
+
+	cfg := config.Config{MQTTBroker: "ws://localhost:8083/mqtt", MQTTUsername: "engine"}
+	_, err := New(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "go_mqtt_subscriber_6ba7b810-9dad-11d1-80b4-00c04fd430c8", built.ClientID)
+
+	// Hooks may still set their own ID
+	_, err = New(cfg, func(opts *mqtt.ClientOptions) { opts.SetClientID("edge-1") })
+	require.NoError(t, err)
+	assert.Equal(t, "edge-1", built.ClientID)
+}
+
+func TestNewWebSocketBroker(t *testing.T) {
+	oldNewClient := mqttNewClient
+	defer func() { mqttNewClient = oldNewClient }()
+
+	var built *mqtt.ClientOptions
+	mqttNewClient = func(opts *mqtt.ClientOptions) mqtt.Client {
+		built = opts
+		mockToken := &MockToken{}
+		mockToken.On("WaitTimeout", defaultConnectTimeout).Return(true)
+		mockToken.On("Error").Return(nil)
+		mockClient := &MockClient{}
+		mockClient.On("Connect").Return(mockToken)
+		return mockClient
+	}
+
+	// A wss broker with username/password auth needs neither a CA nor client certificates
+	_, err := New(config.Config{
+		MQTTBroker:   "wss://broker.example.com:8084/mqtt",
+		MQTTUsername: "engine",
+		MQTTPassword: "secret",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, built.TLSConfig)
+	assert.Empty(t, built.TLSConfig.Certificates)
+	assert.Nil(t, built.TLSConfig.RootCAs, "Expected the system roots without a CA certificate")
+	assert.Equal(t, "wss://broker.example.com:8084/mqtt", built.Servers[0].String())
+	assert.Equal(t, "engine", built.Username)
+	assert.Equal(t, "secret", built.Password)
+	assert.NotNil(t, built.WebsocketOptions)
+
+	// Client certificates are still used when configured
+	_, err = New(config.Config{
+		MQTTBroker:    "wss://broker.example.com:8084/mqtt",
+		TLSCACert:     validCACert,
+		TLSClientCert: validClientCert,
+		TLSClientKey:  validClientKey,
+	})
+	require.NoError(t, err)
+	assert.Len(t, built.TLSConfig.Certificates, 1)
+	assert.NotNil(t, built.TLSConfig.RootCAs)
+
+	// A plain ws broker has no TLS at all
+	_, err = New(config.Config{MQTTBroker: "ws://localhost:8083/mqtt", MQTTUsername: "engine"})
+	require.NoError(t, err)
+	assert.Nil(t, built.TLSConfig)
+	assert.NotNil(t, built.WebsocketOptions)
+}
+
+func TestCreateWebSocketTLSConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantErr bool
+	}{
+		{
+			name: "Username without certificates",
+			cfg:  config.Config{MQTTUsername: "engine"},
+		},
+		{
+			name: "Client certificates without username",
+			cfg:  config.Config{TLSClientCert: validClientCert, TLSClientKey: validClientKey},
+		},
+		{
+			name:    "Neither certificates nor username",
+			cfg:     config.Config{},
+			wantErr: true,
+		},
+		{
+			name:    "Client certificate without key",
+			cfg:     config.Config{MQTTUsername: "engine", TLSClientCert: validClientCert},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid CA certificate",
+			cfg:     config.Config{MQTTUsername: "engine", TLSCACert: "invalid-ca-cert"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := createWebSocketTLSConfig(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// pendingToken is a token that never completes, like a connect to a hung broker
+type pendingToken struct {
+	done chan struct{}
+}
+
+func (t *pendingToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *pendingToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *pendingToken) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *pendingToken) Error() error {
+	return nil
+}
+
+func TestConnectTimeout(t *testing.T) {
+	oldNewClient := mqttNewClient
+	defer func() { mqttNewClient = oldNewClient }()
+
+	mockClient := &MockClient{}
+	mockClient.On("Connect").Return(&pendingToken{done: make(chan struct{})})
+	mockClient.On("Disconnect", uint(0)).Return()
+	mqttNewClient = func(opts *mqtt.ClientOptions) mqtt.Client {
+		return mockClient
+	}
+
+	cfg := config.Config{
+		MQTTBroker:         "tls://localhost:8883",
+		MQTTConnectTimeout: 50 * time.Millisecond,
+		TLSCACert:          validCACert,
+		TLSClientCert:      validClientCert,
+		TLSClientKey:       validClientKey,
+	}
+
+	// A hung broker fails startup once the connect timeout passed
+	start := time.Now()
+	client, err := New(cfg)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Nil(t, client)
+	assert.Less(t, time.Since(start), time.Second)
+
+	mockClient.AssertExpectations(t)
+}
+
+func TestSubscribeTimeout(t *testing.T) {
+	mockClient := &MockClient{}
+	subscribe := &MockToken{}
+	subscribe.On("WaitTimeout", 50*time.Millisecond).Return(false)
+	mockClient.On("Subscribe", "test/topic", byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(subscribe)
+	unsubscribe := &MockToken{}
+	unsubscribe.On("WaitTimeout", 50*time.Millisecond).Return(false)
+	mockClient.On("Unsubscribe", []string{"old/topic"}).Return(unsubscribe)
+
+	c := &Client{
+		cfg:    config.Config{MQTTSubscribeTimeout: 50 * time.Millisecond},
+		Client: mockClient,
+		topics: []string{"old/topic"},
+	}
+
+	// The configured timeout bounds the wait and surfaces as ErrTimeout
+	err := c.SubscribeAndListen("test/topic", func(client mqtt.Client, msg mqtt.Message) {})
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	_, _, err = c.SyncSubscriptions(map[string]byte{"test/topic": 0}, func(client mqtt.Client, msg mqtt.Message) {})
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Equal(t, []string{"old/topic"}, c.Topics())
+
+	mockClient.AssertExpectations(t)
+	subscribe.AssertExpectations(t)
+	unsubscribe.AssertExpectations(t)
+}
+
 // mqttNewClient is a variable that holds the mqtt.NewClient function
 // This allows us to mock it in tests
 
@@ -0,0 +1,191 @@
+// Package mqttstest provides an in-memory MQTT broker for tests that exercise
+// the path from a published message to the handlers subscribed to it.
+package mqttstest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Broker is an mqtt.Client delivering published messages to the handlers of
+// matching subscriptions, wildcards included. Delivery is synchronous, so the
+// handlers have run when Publish returns. Wrap it with
+// &mqtts.Client{Client: broker} to use it in place of a connected client.
+type Broker struct {
+	mu        sync.Mutex
+	connected bool
+	subs      map[string]mqtt.MessageHandler // Topic filter -> handler
+	nextID    atomic.Uint32
+}
+
+// NewBroker returns a connected broker without subscriptions
+func NewBroker() *Broker {
+	return &Broker{connected: true, subs: make(map[string]mqtt.MessageHandler)}
+}
+
+// Subscriptions returns the topic filters currently subscribed
+func (b *Broker) Subscriptions() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	filters := make([]string, 0, len(b.subs))
+	for filter := range b.subs {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+func (b *Broker) IsConnected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connected
+}
+
+func (b *Broker) IsConnectionOpen() bool {
+	return b.IsConnected()
+}
+
+func (b *Broker) Connect() mqtt.Token {
+	b.mu.Lock()
+	b.connected = true
+	b.mu.Unlock()
+	return &token{}
+}
+
+func (b *Broker) Disconnect(quiesce uint) {
+	b.mu.Lock()
+	b.connected = false
+	b.mu.Unlock()
+}
+
+// Publish delivers payload, a []byte or string, to every subscription whose
+// filter matches topic
+func (b *Broker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		return &token{err: fmt.Errorf("unsupported payload type %T", payload)}
+	}
+
+	b.mu.Lock()
+	if !b.connected {
+		b.mu.Unlock()
+		return &token{err: mqtt.ErrNotConnected}
+	}
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range b.subs {
+		if Match(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	b.mu.Unlock()
+
+	msg := &Message{
+		topic:    topic,
+		payload:  data,
+		qos:      qos,
+		retained: retained,
+		id:       uint16(b.nextID.Add(1)),
+	}
+	for _, handler := range handlers {
+		handler(b, msg)
+	}
+	return &token{}
+}
+
+func (b *Broker) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[topic] = callback
+	return &token{}
+}
+
+func (b *Broker) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for filter := range filters {
+		b.subs[filter] = callback
+	}
+	return &token{}
+}
+
+func (b *Broker) Unsubscribe(topics ...string) mqtt.Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, topic := range topics {
+		delete(b.subs, topic)
+	}
+	return &token{}
+}
+
+func (b *Broker) AddRoute(topic string, callback mqtt.MessageHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[topic] = callback
+}
+
+func (b *Broker) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// Match reports whether topic matches the subscription filter, with "+"
+// matching one level and a trailing "#" any remaining levels
+func Match(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// Message is a message delivered by Broker
+type Message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	id       uint16
+	acked    atomic.Bool
+}
+
+func (m *Message) Duplicate() bool   { return false }
+func (m *Message) Qos() byte         { return m.qos }
+func (m *Message) Retained() bool    { return m.retained }
+func (m *Message) Topic() string     { return m.topic }
+func (m *Message) MessageID() uint16 { return m.id }
+func (m *Message) Payload() []byte   { return m.payload }
+func (m *Message) Ack()              { m.acked.Store(true) }
+
+// Acked reports whether the handler acknowledged the message
+func (m *Message) Acked() bool {
+	return m.acked.Load()
+}
+
+// token is an already completed mqtt.Token
+type token struct {
+	err error
+}
+
+func (t *token) Wait() bool                     { return true }
+func (t *token) WaitTimeout(time.Duration) bool { return true }
+func (t *token) Error() error                   { return t.err }
+func (t *token) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
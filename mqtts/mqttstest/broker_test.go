@@ -0,0 +1,56 @@
+package mqttstest
+
+import (
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensors/D800", "sensors/D800", true},
+		{"sensors/D800", "sensors/D801", false},
+		{"sensors/+", "sensors/D800", true},
+		{"sensors/+", "sensors/line1/D800", false},
+		{"sensors/#", "sensors/line1/D800", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "plc/D800", false},
+		{"sensors/+/D800", "sensors/line1/D800", true},
+		{"sensors", "sensors/D800", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Match(tt.filter, tt.topic), "%s on %s", tt.filter, tt.topic)
+	}
+}
+
+func TestBrokerDelivers(t *testing.T) {
+	broker := NewBroker()
+
+	var received []string
+	broker.Subscribe("sensors/+", 0, func(client mqtt.Client, msg mqtt.Message) {
+		received = append(received, msg.Topic()+" "+string(msg.Payload()))
+	})
+	broker.Subscribe("plc/#", 0, func(client mqtt.Client, msg mqtt.Message) {
+		received = append(received, "plc "+msg.Topic())
+	})
+
+	assert.NoError(t, broker.Publish("sensors/D800", 0, false, `{"value": 1}`).Error())
+	assert.NoError(t, broker.Publish("plc/line1/D100", 0, false, []byte("1")).Error())
+	assert.NoError(t, broker.Publish("other/D800", 0, false, "ignored").Error())
+	assert.Equal(t, []string{`sensors/D800 {"value": 1}`, "plc plc/line1/D100"}, received)
+
+	// Unsubscribed and disconnected brokers deliver nothing
+	broker.Unsubscribe("sensors/+")
+	broker.Publish("sensors/D800", 0, false, "1")
+	assert.Len(t, received, 2)
+
+	broker.Disconnect(0)
+	assert.ErrorIs(t, broker.Publish("plc/D100", 0, false, "1").Error(), mqtt.ErrNotConnected)
+	assert.Error(t, broker.Publish("plc/D100", 0, false, 1).Error())
+}
@@ -0,0 +1,83 @@
+package realtime
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Postgres change types
+const (
+	ChangeInsert = "INSERT"
+	ChangeUpdate = "UPDATE"
+	ChangeDelete = "DELETE"
+)
+
+// Change is a decoded postgres_changes event
+type Change struct {
+	Type      string // INSERT, UPDATE or DELETE
+	Schema    string
+	Table     string
+	Record    map[string]any // New row, empty for DELETE
+	OldRecord map[string]any // Previous row, empty for INSERT
+	Changed   []string       // Sorted columns whose value changed, UPDATE only
+	Committed time.Time      // When the change was committed, zero when the payload has no commit_timestamp
+}
+
+// DecodeChange extracts the change from a postgres_changes message. The
+// change may be the message's payload or nested in its "data" field.
+func DecodeChange(msg map[string]any) (Change, error) {
+	data, ok := msg["payload"].(map[string]any)
+	if !ok {
+		return Change{}, errors.New("postgres change without payload")
+	}
+	if nested, ok := data["data"].(map[string]any); ok {
+		data = nested
+	}
+
+	change := Change{}
+	change.Type, _ = data["type"].(string)
+	change.Schema, _ = data["schema"].(string)
+	change.Table, _ = data["table"].(string)
+	change.Record, _ = data["record"].(map[string]any)
+	change.OldRecord, _ = data["old_record"].(map[string]any)
+	if committed, ok := data["commit_timestamp"].(string); ok {
+		change.Committed, _ = time.Parse(time.RFC3339Nano, committed)
+	}
+	if change.Type == "" {
+		return Change{}, errors.New("postgres change without type")
+	}
+
+	if change.Type == ChangeUpdate {
+		change.Changed = ChangedColumns(change.OldRecord, change.Record)
+	}
+	return change, nil
+}
+
+// ChangedColumns returns the sorted columns whose value differs between
+// oldRecord and record. Unless the table's replica identity is FULL,
+// old_record only holds the primary key, so columns missing from either
+// record count as changed.
+func ChangedColumns(oldRecord, record map[string]any) []string {
+	changed := []string{}
+	for column, value := range record {
+		oldValue, ok := oldRecord[column]
+		if !ok || !reflect.DeepEqual(oldValue, value) {
+			changed = append(changed, column)
+		}
+	}
+	for column := range oldRecord {
+		if _, ok := record[column]; !ok {
+			changed = append(changed, column)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Has reports whether column changed
+func (c Change) Has(column string) bool {
+	i := sort.SearchStrings(c.Changed, column)
+	return i < len(c.Changed) && c.Changed[i] == column
+}
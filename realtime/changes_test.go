@@ -0,0 +1,96 @@
+package realtime
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChangedColumns(t *testing.T) {
+	tests := []struct {
+		name      string
+		oldRecord map[string]any
+		record    map[string]any
+		want      []string
+	}{
+		{
+			"changed values",
+			map[string]any{"id": 1.0, "threshold": 10.0, "table": "alerts", "topics": []any{"a"}},
+			map[string]any{"id": 1.0, "threshold": 12.0, "table": "alerts", "topics": []any{"a", "b"}},
+			[]string{"threshold", "topics"},
+		},
+		{
+			"unchanged",
+			map[string]any{"id": 1.0, "conditions": map[string]any{"level": 2.0}},
+			map[string]any{"id": 1.0, "conditions": map[string]any{"level": 2.0}},
+			[]string{},
+		},
+		{
+			"null to value",
+			map[string]any{"id": 1.0, "machine": nil},
+			map[string]any{"id": 1.0, "machine": "m1"},
+			[]string{"machine"},
+		},
+		{
+			// Without a full replica identity old_record only holds the key
+			"primary key only",
+			map[string]any{"id": 1.0},
+			map[string]any{"id": 1.0, "table": "alerts"},
+			[]string{"table"},
+		},
+		{
+			"dropped column",
+			map[string]any{"id": 1.0, "legacy": true},
+			map[string]any{"id": 1.0},
+			[]string{"legacy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ChangedColumns(tt.oldRecord, tt.record); !slices.Equal(got, tt.want) {
+				t.Errorf("ChangedColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeChange(t *testing.T) {
+	msg := map[string]any{
+		"event": POSTGRES_CHANGE_EVENT,
+		"payload": map[string]any{
+			"data": map[string]any{
+				"type":             "UPDATE",
+				"schema":           "public",
+				"table":            "alert_rules",
+				"record":           map[string]any{"id": "r1", "category": "line", "machine": "m2"},
+				"old_record":       map[string]any{"id": "r1", "category": "line", "machine": "m1"},
+				"commit_timestamp": "2024-05-01T08:00:00.123Z",
+			},
+		},
+	}
+
+	change, err := DecodeChange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != ChangeUpdate || change.Table != "alert_rules" || !slices.Equal(change.Changed, []string{"machine"}) {
+		t.Errorf("Unexpected change %+v", change)
+	}
+	if want := time.Date(2024, 5, 1, 8, 0, 0, 123000000, time.UTC); !change.Committed.Equal(want) {
+		t.Errorf("Expected commit time %s, got %s", want, change.Committed)
+	}
+	if !change.Has("machine") || change.Has("category") {
+		t.Errorf("Expected only machine to have changed, got %v", change.Changed)
+	}
+
+	// Inserts carry no changed columns, the payload may hold the change directly
+	insert, err := DecodeChange(map[string]any{"payload": map[string]any{"type": "INSERT", "record": map[string]any{"id": "r2"}}})
+	if err != nil || insert.Type != ChangeInsert || insert.Changed != nil || !insert.Committed.IsZero() {
+		t.Errorf("Unexpected insert %+v, %v", insert, err)
+	}
+
+	if _, err := DecodeChange(map[string]any{"event": POSTGRES_CHANGE_EVENT}); err == nil {
+		t.Error("Expected an error for a message without payload")
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"goalert-engine/metrics"
+
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
@@ -20,30 +23,149 @@ type Client struct {
 	mu                sync.Mutex
 	conn              *websocket.Conn
 	closed            chan struct{}
+	connected         atomic.Bool // Whether the websocket is up, false while reconnecting
 	logger            *zap.Logger
 	dialTimeout       time.Duration
 	reconnectInterval time.Duration
 	heartbeatDuration time.Duration
 	heartbeatInterval time.Duration
+	clock             Clock
+	handlers          map[string]func(map[string]interface{}) // Postgres changes handlers by topic
+	listening         bool                                    // Whether a listener reads the connection
+
+	stateMu       sync.Mutex   // Serializes state transitions and their callbacks
+	state         atomic.Int32 // Current State
+	onStateChange func(State)
 }
 
-// Create a new Client with user's speicfications
-func CreateRealtimeClient(projectRef string, apiKey string, logger *zap.Logger) *Client {
-	realtimeUrl := fmt.Sprintf(
+const (
+	defaultDialTimeout       = 10 * time.Second
+	defaultHeartbeatDuration = 5 * time.Second
+	defaultHeartbeatInterval = 20 * time.Second
+	defaultReconnectInterval = 500 * time.Millisecond
+)
+
+// Option customizes a Client
+type Option func(*Client)
+
+// WithURL connects to the realtime websocket at url
+func WithURL(url string) Option {
+	return func(client *Client) {
+		client.Url = url
+	}
+}
+
+// WithAPIKey sets the project API key the client authenticates with
+func WithAPIKey(apiKey string) Option {
+	return func(client *Client) {
+		client.ApiKey = apiKey
+	}
+}
+
+// WithLogger logs through logger instead of discarding the client's logs
+func WithLogger(logger *zap.Logger) Option {
+	return func(client *Client) {
+		client.logger = logger
+	}
+}
+
+// WithHeartbeat sends a heartbeat every interval, each allowed timeout to be
+// written. interval must exceed timeout.
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(client *Client) {
+		client.heartbeatInterval = interval
+		client.heartbeatDuration = timeout
+	}
+}
+
+// WithDialTimeout bounds each attempt to connect to the server
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.dialTimeout = timeout
+	}
+}
+
+// WithReconnect waits interval between reconnection attempts
+func WithReconnect(interval time.Duration) Option {
+	return func(client *Client) {
+		client.reconnectInterval = interval
+	}
+}
+
+// ProjectURL returns the realtime websocket URL of a Supabase project
+func ProjectURL(projectRef, apiKey string) string {
+	return fmt.Sprintf(
 		"wss://%s.supabase.co/realtime/v1/websocket?apikey=%s&log_level=info&vsn=1.0.0",
 		projectRef,
 		apiKey,
 	)
+}
+
+// NewClient creates a Client configured by opts. Timings not set, or set to
+// values that can't work, keep their defaults.
+func NewClient(opts ...Option) *Client {
+	client := &Client{
+		logger:            zap.NewNop(),
+		dialTimeout:       defaultDialTimeout,
+		heartbeatDuration: defaultHeartbeatDuration,
+		heartbeatInterval: defaultHeartbeatInterval,
+		reconnectInterval: defaultReconnectInterval,
+		clock:             systemClock{},
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	if client.logger == nil {
+		client.logger = zap.NewNop()
+	}
+	if client.clock == nil {
+		client.clock = systemClock{}
+	}
+	client.applyTimingDefaults()
+
+	return client
+}
+
+// Create a new Client with user's speicfications
+//
+// Deprecated: use NewClient with WithURL(ProjectURL(projectRef, apiKey)).
+func CreateRealtimeClient(projectRef string, apiKey string, logger *zap.Logger, opts ...Option) *Client {
+	return NewClient(append([]Option{
+		WithURL(ProjectURL(projectRef, apiKey)),
+		WithAPIKey(apiKey),
+		WithLogger(logger),
+	}, opts...)...)
+}
+
+// applyTimingDefaults replaces timings that can't work with the defaults
+func (client *Client) applyTimingDefaults() {
+	if client.dialTimeout <= 0 {
+		client.logger.Warn("Invalid realtime dial timeout, using default",
+			zap.Duration("dial_timeout", client.dialTimeout))
+		client.dialTimeout = defaultDialTimeout
+	}
+	if client.reconnectInterval <= 0 {
+		client.logger.Warn("Invalid realtime reconnect interval, using default",
+			zap.Duration("reconnect_interval", client.reconnectInterval))
+		client.reconnectInterval = defaultReconnectInterval
+	}
+	if err := ValidateHeartbeat(client.heartbeatInterval, client.heartbeatDuration); err != nil {
+		client.logger.Warn("Invalid realtime heartbeat, using defaults", zap.Error(err))
+		client.heartbeatInterval = defaultHeartbeatInterval
+		client.heartbeatDuration = defaultHeartbeatDuration
+	}
+}
 
-	return &Client{
-		Url:               realtimeUrl,
-		ApiKey:            apiKey,
-		logger:            logger,
-		dialTimeout:       10 * time.Second,
-		heartbeatDuration: 5 * time.Second,
-		heartbeatInterval: 20 * time.Second,
-		reconnectInterval: 500 * time.Millisecond,
+// ValidateHeartbeat checks that heartbeats every interval, each written
+// within timeout, can keep a connection alive
+func ValidateHeartbeat(interval, timeout time.Duration) error {
+	if interval <= 0 || timeout <= 0 {
+		return fmt.Errorf("heartbeat interval %s and timeout %s must be positive", interval, timeout)
 	}
+	if interval <= timeout {
+		return fmt.Errorf("heartbeat interval %s must exceed its timeout %s", interval, timeout)
+	}
+	return nil
 }
 
 // Connect the client with the realtime server
@@ -53,8 +175,10 @@ func (client *Client) Connect() error {
 	}
 
 	// Attempt to dial the server
+	client.setState(StateConnecting)
 	err := client.dialServer()
 	if err != nil {
+		client.setState(StateDisconnected)
 		return fmt.Errorf("Cannot connect to the server: %w", err)
 	}
 
@@ -62,6 +186,7 @@ func (client *Client) Connect() error {
 	client.mu.Lock()
 	client.closed = make(chan struct{})
 	client.mu.Unlock()
+	client.setState(StateConnected)
 
 	go client.startHeartbeats()
 
@@ -77,6 +202,9 @@ func (client *Client) Disconnect() error {
 		return nil
 	}
 
+	client.setConnected(false)
+	client.setState(StateDisconnected)
+
 	err := client.conn.Close(websocket.StatusNormalClosure, "Closing the connection")
 	if err != nil {
 		if !client.isConnectionAlive(err) {
@@ -92,8 +220,13 @@ func (client *Client) Disconnect() error {
 	return nil
 }
 
-// Start sending heartbeats to the server to maintain connection
+// Start sending heartbeats to the server to maintain connection, until the
+// client disconnects
 func (client *Client) startHeartbeats() {
+	client.mu.Lock()
+	closed := client.closed
+	client.mu.Unlock()
+
 	for client.isClientAlive() {
 		err := client.sendHeartbeat()
 
@@ -101,24 +234,35 @@ func (client *Client) startHeartbeats() {
 			if client.isConnectionAlive(err) {
 				client.logger.Error("Failed to Connect", zap.Error(err))
 			} else {
-				client.logger.Warn("Error: lost connection with the server")
-				client.logger.Info("Attempting to to send hearbeat again")
-
-				ctx, cancel := context.WithCancel(context.Background())
-				defer cancel()
-
-				// there should never be an error returned, since it'll keep trying
-				_ = client.reconnect(ctx)
+				client.reconnectAfterLoss()
 			}
 		}
 
 		// in case where the client needs to reconnect with the server,
 		// the interval between heartbeats be however long it takes to
 		// reconnect plus the number of heartbeatInterval has gone by
-		time.Sleep(client.heartbeatInterval)
+		select {
+		case <-client.clock.After(client.heartbeatInterval):
+		case <-closed:
+			return
+		}
 	}
 }
 
+// reconnectAfterLoss marks the connection lost and reconnects
+func (client *Client) reconnectAfterLoss() {
+	client.logger.Warn("Error: lost connection with the server")
+	client.setConnected(false)
+	client.setState(StateReconnecting)
+	client.logger.Info("Attempting to to send hearbeat again")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// there should never be an error returned, since it'll keep trying
+	_ = client.reconnect(ctx)
+}
+
 // Send the heartbeat to the realtime server
 func (client *Client) sendHeartbeat() error {
 	msg := HearbeatMsg{
@@ -135,7 +279,11 @@ func (client *Client) sendHeartbeat() error {
 
 	client.logger.Info("Sending heartbeat")
 
-	err := wsjson.Write(ctx, client.conn, msg)
+	client.mu.Lock()
+	conn := client.conn
+	client.mu.Unlock()
+
+	err := wsjson.Write(ctx, conn, msg)
 	if err != nil {
 		client.logger.Error("Failed to send heartbeat",
 			zap.Float64("timeout_seconds", client.heartbeatDuration.Seconds()),
@@ -148,15 +296,12 @@ func (client *Client) sendHeartbeat() error {
 	return nil
 }
 
-// Dial the server with a certain timeout in seconds
+// Dial the server with a certain timeout in seconds, replacing the current
+// connection if there is one
 func (client *Client) dialServer() error {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
-	if client.isClientAlive() {
-		return nil
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), client.dialTimeout)
 	defer cancel()
 
@@ -171,7 +316,11 @@ func (client *Client) dialServer() error {
 		return fmt.Errorf("failed to dial the server: %w", err)
 	}
 
+	if client.conn != nil {
+		client.conn.CloseNow()
+	}
 	client.conn = conn
+	client.setConnected(true)
 	client.logger.Info("Connection established successfully",
 		zap.String("url", client.Url),
 	)
@@ -189,6 +338,8 @@ func (client *Client) reconnect(ctx context.Context) error {
 		default:
 			err := client.dialServer()
 			if err == nil {
+				metrics.RealtimeReconnects.Inc()
+				client.setState(StateConnected)
 				return nil
 			}
 
@@ -203,6 +354,22 @@ func (client *Client) reconnect(ctx context.Context) error {
 	return nil
 }
 
+// Connected reports whether the connection to the realtime server is up
+func (client *Client) Connected() bool {
+	return client.connected.Load()
+}
+
+// setConnected records whether the connection to the realtime server is up,
+// in Connected and the connection metrics
+func (client *Client) setConnected(up bool) {
+	client.connected.Store(up)
+	if up {
+		metrics.MarkRealtimeConnected(time.Now())
+	} else {
+		metrics.RealtimeConnected.Set(0)
+	}
+}
+
 // Check if the realtime client has been killed
 func (client *Client) isClientAlive() bool {
 	if client.closed == nil {
@@ -226,13 +393,17 @@ type PostgresChangesOptions struct {
 	Filter string // e.g., "event=INSERT"
 }
 
+// ListenToPostgresChanges subscribes handler to the changes of a table. Tables
+// subscribed over the same connection each get their own handler, incoming
+// changes are dispatched by topic. Subscribing a table again replaces its
+// handler.
 func (client *Client) ListenToPostgresChanges(opts PostgresChangesOptions, handler func(payload map[string]interface{})) error {
 	if !client.isClientAlive() {
 		return errors.New("client not connected")
 	}
 
 	// Construct the topic name
-	topic := fmt.Sprintf("realtime:%s:%s", opts.Schema, opts.Table)
+	topic := changesTopic(opts.Schema, opts.Table)
 
 	// Subscribe message
 	subscribeMsg := map[string]interface{}{
@@ -263,13 +434,48 @@ func (client *Client) ListenToPostgresChanges(opts PostgresChangesOptions, handl
 		return fmt.Errorf("failed to subscribe: %w", err)
 	}
 
+	if client.handlers == nil {
+		client.handlers = make(map[string]func(map[string]interface{}))
+	}
+	client.handlers[topic] = handler
+
 	// Start message listener if not already running
-	go client.listenForMessages(handler)
+	if !client.listening {
+		client.listening = true
+		go client.listenForMessages()
+	}
 
 	return nil
 }
 
-func (client *Client) listenForMessages(handler func(map[string]interface{})) {
+// changesTopic is the channel topic of a table's postgres changes
+func changesTopic(schema, table string) string {
+	return fmt.Sprintf("realtime:%s:%s", schema, table)
+}
+
+// ListenToChanges is ListenToPostgresChanges handing the handler decoded
+// changes, with the changed columns of UPDATE events. Messages that aren't
+// changes are logged and skipped.
+func (client *Client) ListenToChanges(opts PostgresChangesOptions, handler func(change Change)) error {
+	return client.ListenToPostgresChanges(opts, func(payload map[string]interface{}) {
+		change, err := DecodeChange(payload)
+		if err != nil {
+			client.logger.Warn("Skipping undecodable postgres change", zap.Error(err))
+			return
+		}
+		handler(change)
+	})
+}
+
+// listenForMessages reads the connection, handing postgres changes to the
+// handler of their topic
+func (client *Client) listenForMessages() {
+	defer func() {
+		client.mu.Lock()
+		client.listening = false
+		client.mu.Unlock()
+	}()
+
 	for client.isClientAlive() {
 		var msg map[string]interface{}
 		ctx := context.Background()
@@ -285,6 +491,15 @@ func (client *Client) listenForMessages(handler func(map[string]interface{})) {
 
 		// Filter for postgres_changes events
 		if event, ok := msg["event"].(string); ok && event == POSTGRES_CHANGE_EVENT {
+			topic, _ := msg["topic"].(string)
+			client.mu.Lock()
+			handler := client.handlers[topic]
+			client.mu.Unlock()
+
+			if handler == nil {
+				client.logger.Warn("Dropping postgres change without a subscription", zap.String("topic", topic))
+				continue
+			}
 			handler(msg)
 		}
 	}
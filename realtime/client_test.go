@@ -0,0 +1,332 @@
+package realtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goalert-engine/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// newTestServer accepts websocket connections and counts the messages they send
+func newTestServer(t *testing.T, received *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+			if received != nil {
+				received.Add(1)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newDroppingServer accepts websocket connections, counting them, and hands
+// each to the test through conns so it can drop them
+func newDroppingServer(t *testing.T, accepts *atomic.Int32, conns chan<- *websocket.Conn) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Counted before the handshake completes, so before the client's dial returns
+		accepts.Add(1)
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		conns <- conn
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReconnectMetrics(t *testing.T) {
+	var accepts atomic.Int32
+	conns := make(chan *websocket.Conn, 2)
+	server := newDroppingServer(t, &accepts, conns)
+
+	client := NewClient(WithURL(strings.Replace(server.URL, "http://", "ws://", 1)))
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.RealtimeConnected); got != 1 {
+		t.Errorf("Expected connected gauge 1 after Connect, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.RealtimeSinceLastConnect); got < 0 || got > 5 {
+		t.Errorf("Expected a recent last connect, got %vs ago", got)
+	}
+
+	// Drop the link on the server side, as the heartbeat would notice
+	before := testutil.ToFloat64(metrics.RealtimeReconnects)
+	(<-conns).CloseNow()
+	client.reconnectAfterLoss()
+
+	if got := accepts.Load(); got != 2 {
+		t.Fatalf("Expected the server to accept a second connection, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.RealtimeReconnects); got != before+1 {
+		t.Errorf("Expected reconnect counter %v, got %v", before+1, got)
+	}
+	if got := testutil.ToFloat64(metrics.RealtimeConnected); got != 1 {
+		t.Errorf("Expected connected gauge 1 after reconnect, got %v", got)
+	}
+	if !client.Connected() {
+		t.Errorf("Expected the client connected after reconnect")
+	}
+
+	if err := client.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.RealtimeConnected); got != 0 {
+		t.Errorf("Expected connected gauge 0 after Disconnect, got %v", got)
+	}
+}
+
+// manualClock fires the channels of After once it is advanced past them
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []manualTimer
+}
+
+type manualTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, manualTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the timers due
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// waiting returns the number of timers not fired yet
+func (c *manualClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// waitFor fails the test unless cond holds within a second
+func waitFor(t *testing.T, cond func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	var heartbeats atomic.Int32
+	server := newTestServer(t, &heartbeats)
+
+	clock := &manualClock{}
+	client := NewClient(
+		WithURL(strings.Replace(server.URL, "http://", "ws://", 1)),
+		WithHeartbeat(50*time.Millisecond, 20*time.Millisecond),
+		WithClock(clock),
+	)
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	// One heartbeat right away, then one every 50ms
+	for want := int32(1); want <= 4; want++ {
+		waitFor(t, func() bool { return heartbeats.Load() == want && clock.waiting() == 1 },
+			"Expected heartbeat %d waiting for the next, got %d heartbeats", want, heartbeats.Load())
+		clock.Advance(49 * time.Millisecond)
+		if clock.waiting() != 1 {
+			t.Fatalf("Expected no heartbeat before the interval passed")
+		}
+		clock.Advance(time.Millisecond)
+	}
+	waitFor(t, func() bool { return heartbeats.Load() == 5 }, "Expected 5 heartbeats, got %d", heartbeats.Load())
+}
+
+func TestInvalidTimingsFallBackToDefaults(t *testing.T) {
+	client := NewClient(
+		WithHeartbeat(time.Second, 2*time.Second),
+		WithDialTimeout(0),
+		WithReconnect(-time.Second),
+	)
+
+	if client.heartbeatInterval != defaultHeartbeatInterval || client.heartbeatDuration != defaultHeartbeatDuration {
+		t.Errorf("Expected default heartbeat for an interval below its timeout, got %s/%s", client.heartbeatInterval, client.heartbeatDuration)
+	}
+	if client.dialTimeout != defaultDialTimeout || client.reconnectInterval != defaultReconnectInterval {
+		t.Errorf("Expected default dial timeout and reconnect interval, got %s/%s", client.dialTimeout, client.reconnectInterval)
+	}
+
+	client = NewClient(WithDialTimeout(time.Second), WithReconnect(time.Second))
+	if client.dialTimeout != time.Second || client.reconnectInterval != time.Second {
+		t.Errorf("Expected custom dial timeout and reconnect interval, got %s/%s", client.dialTimeout, client.reconnectInterval)
+	}
+}
+
+func TestNewClientOptions(t *testing.T) {
+	logger := zap.NewExample()
+	client := NewClient(
+		WithURL("ws://localhost:4000/socket"),
+		WithAPIKey("key"),
+		WithLogger(logger),
+		WithHeartbeat(30*time.Second, 10*time.Second),
+		WithDialTimeout(3*time.Second),
+		WithReconnect(2*time.Second),
+	)
+
+	if client.Url != "ws://localhost:4000/socket" || client.ApiKey != "key" || client.logger != logger {
+		t.Errorf("Expected URL, API key and logger options applied, got %q, %q", client.Url, client.ApiKey)
+	}
+	if client.heartbeatInterval != 30*time.Second || client.heartbeatDuration != 10*time.Second {
+		t.Errorf("Expected heartbeat 30s/10s, got %s/%s", client.heartbeatInterval, client.heartbeatDuration)
+	}
+	if client.dialTimeout != 3*time.Second || client.reconnectInterval != 2*time.Second {
+		t.Errorf("Expected dial timeout 3s and reconnect 2s, got %s/%s", client.dialTimeout, client.reconnectInterval)
+	}
+
+	// Without options every timing keeps its default
+	client = NewClient()
+	if client.logger == nil || client.dialTimeout != defaultDialTimeout || client.heartbeatInterval != defaultHeartbeatInterval ||
+		client.heartbeatDuration != defaultHeartbeatDuration || client.reconnectInterval != defaultReconnectInterval {
+		t.Errorf("Expected defaults without options, got %+v", client)
+	}
+
+	// The positional constructor wraps NewClient
+	client = CreateRealtimeClient("abc", "key", logger, WithDialTimeout(time.Second))
+	if client.Url != ProjectURL("abc", "key") || client.ApiKey != "key" || client.dialTimeout != time.Second {
+		t.Errorf("Expected CreateRealtimeClient to apply the project URL and options, got %q, %s", client.Url, client.dialTimeout)
+	}
+}
+
+// newChangesServer waits for joins to topics, then sends a postgres change on
+// each of sends' topics
+func newChangesServer(t *testing.T, joins int, sends ...string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+		for joined := 0; joined < joins; {
+			var msg map[string]any
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				return
+			}
+			if msg["event"] == JOIN_EVENT {
+				joined++
+			}
+		}
+		for _, topic := range sends {
+			change := map[string]any{
+				"event":   POSTGRES_CHANGE_EVENT,
+				"topic":   topic,
+				"payload": map[string]any{"data": map[string]any{"type": "INSERT", "table": topic}},
+			}
+			if err := wsjson.Write(ctx, conn, change); err != nil {
+				return
+			}
+		}
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestListenToMultipleTables(t *testing.T) {
+	server := newChangesServer(t, 2, "realtime:public:rules", "realtime:public:suppressions", "realtime:public:other", "realtime:public:rules")
+
+	client := NewClient(WithURL(strings.Replace(server.URL, "http://", "ws://", 1)))
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	var mu sync.Mutex
+	received := map[string][]string{}
+	listen := func(table string) {
+		err := client.ListenToPostgresChanges(PostgresChangesOptions{Schema: "public", Table: table, Filter: "*"}, func(msg map[string]interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[table] = append(received[table], msg["topic"].(string))
+		})
+		if err != nil {
+			t.Fatalf("Failed to listen to %s: %v", table, err)
+		}
+	}
+	listen("rules")
+	listen("suppressions")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(received["rules"]) == 2 && len(received["suppressions"]) == 1
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := received["rules"]; !slices.Equal(got, []string{"realtime:public:rules", "realtime:public:rules"}) {
+		t.Errorf("Expected both rules changes routed to the rules handler, got %v", got)
+	}
+	if got := received["suppressions"]; !slices.Equal(got, []string{"realtime:public:suppressions"}) {
+		t.Errorf("Expected the suppressions change routed to its handler, got %v", got)
+	}
+}
@@ -0,0 +1,20 @@
+package realtime
+
+import "time"
+
+// Clock schedules the client's heartbeats. Tests inject a manual clock to
+// drive them without waiting.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock schedules the heartbeats on clock instead of the system clock
+func WithClock(clock Clock) Option {
+	return func(client *Client) {
+		client.clock = clock
+	}
+}
@@ -0,0 +1,53 @@
+package realtime
+
+// State is the state of the client's connection to the realtime server
+type State int32
+
+const (
+	StateDisconnected State = iota // Not connected, before Connect or after Disconnect
+	StateConnecting                // Connect is dialing the server
+	StateConnected                 // The connection is up
+	StateReconnecting              // The connection was lost and is being re-established
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "disconnected"
+	}
+}
+
+// OnStateChange registers fn to be called on every state transition, e.g. to
+// pause work while the connection flaps. Calls are synchronous and in order,
+// fn must not block nor call Connect or Disconnect.
+func (client *Client) OnStateChange(fn func(State)) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	client.onStateChange = fn
+}
+
+// State returns the current state of the connection
+func (client *Client) State() State {
+	return State(client.state.Load())
+}
+
+// setState moves the client to state, notifying the OnStateChange callback
+// when it differs from the current one
+func (client *Client) setState(state State) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+
+	if client.State() == state {
+		return
+	}
+	client.state.Store(int32(state))
+	if client.onStateChange != nil {
+		client.onStateChange(state)
+	}
+}
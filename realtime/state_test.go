@@ -0,0 +1,76 @@
+package realtime
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stateRecorder collects the states a client moves through
+type stateRecorder struct {
+	mu     sync.Mutex
+	states []State
+}
+
+func (r *stateRecorder) record(state State) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+}
+
+func (r *stateRecorder) States() []State {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.states)
+}
+
+func TestStateChangesDuringReconnect(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	client := NewClient(
+		WithURL(strings.Replace(server.URL, "http://", "ws://", 1)),
+		WithReconnect(10*time.Millisecond),
+	)
+	var recorder stateRecorder
+	client.OnStateChange(recorder.record)
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if client.State() != StateConnected {
+		t.Errorf("Expected connected after Connect, got %s", client.State())
+	}
+
+	// Simulate the heartbeat noticing a dropped link
+	client.reconnectAfterLoss()
+
+	if err := client.Disconnect(); err != nil {
+		t.Fatalf("Disconnect failed: %v", err)
+	}
+
+	want := []State{StateConnecting, StateConnected, StateReconnecting, StateConnected, StateDisconnected}
+	if got := recorder.States(); !slices.Equal(got, want) {
+		t.Errorf("Expected states %v, got %v", want, got)
+	}
+}
+
+func TestStateChangesOnFailedConnect(t *testing.T) {
+	server := newTestServer(t, nil)
+	url := strings.Replace(server.URL, "http://", "ws://", 1)
+	server.Close()
+
+	client := NewClient(WithURL(url), WithDialTimeout(time.Second))
+	var recorder stateRecorder
+	client.OnStateChange(recorder.record)
+
+	if err := client.Connect(); err == nil {
+		t.Fatal("Expected Connect to fail against a closed server")
+	}
+
+	want := []State{StateConnecting, StateDisconnected}
+	if got := recorder.States(); !slices.Equal(got, want) {
+		t.Errorf("Expected states %v, got %v", want, got)
+	}
+}
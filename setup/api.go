@@ -0,0 +1,210 @@
+package setup
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"goalert-engine/alert"
+	"goalert-engine/metrics"
+
+	"go.uber.org/zap"
+)
+
+// maxTestBody bounds the device values posted to the rule test endpoint
+const maxTestBody = 1 << 20
+
+// NewAPIHandler serves the metrics endpoint and, when secret is set, the
+// operator API acting on the rule manager currently running in services.
+// API requests must carry "Authorization: Bearer <secret>".
+func NewAPIHandler(services *ServiceManager, secret string, logger *zap.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	if secret == "" {
+		logger.Info("API_SECRET is empty, operator API disabled")
+		return mux
+	}
+
+	// POST /ack?key=<ruleID_conditionID_level> holds off an alert until its condition clears
+	mux.Handle("POST /ack", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing alert key", http.StatusBadRequest)
+			return
+		}
+
+		ruleManager, _ := services.GetServices()
+		if ruleManager == nil {
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		}
+
+		ruleManager.Ack(key)
+		logger.Info("Alert acknowledged", zap.String("alertKey", key))
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	// POST /snooze?key=<ruleID_conditionID_level>&duration=<e.g. 30m> mutes an alert for
+	// the duration, a zero duration lifts the snooze
+	mux.Handle("POST /snooze", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing alert key", http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || duration < 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+
+		ruleManager, _ := services.GetServices()
+		if ruleManager == nil {
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		}
+
+		ruleManager.Snooze(key, duration)
+		logger.Info("Alert snoozed", zap.String("alertKey", key), zap.Duration("duration", duration))
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	// POST /rules/{id}/snooze?until=<RFC 3339 time> mutes every alert of a
+	// rule until then, a past time lifts the snooze
+	mux.Handle("POST /rules/{id}/snooze", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ruleID := r.PathValue("id")
+		until, err := time.Parse(time.RFC3339, r.URL.Query().Get("until"))
+		if err != nil {
+			http.Error(w, "invalid until, expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+
+		ruleManager, _ := services.GetServices()
+		if ruleManager == nil {
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		}
+
+		ruleManager.SnoozeRule(ruleID, until)
+		logger.Info("Rule snoozed", zap.String("rule_id", ruleID), zap.Time("until", until))
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	// GET /rules lists the loaded rules with the alerts they delivered within
+	// the last hour and the time of their latest one
+	mux.Handle("GET /rules", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ruleManager, _ := services.GetServices()
+		if ruleManager == nil {
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{"rules": ruleManager.RuleStats()}); err != nil {
+			logger.Warn("Failed to write rules response", zap.Error(err))
+		}
+	})))
+
+	// POST /reload reloads the rules from Supabase without waiting for a
+	// change event, e.g. after a manual migration
+	mux.Handle("POST /reload", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count, err := services.ReloadRules(r.Context())
+		switch {
+		case errors.Is(err, ErrServicesNotRunning):
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, alert.ErrReloadInProgress):
+			http.Error(w, "reload already in progress", http.StatusConflict)
+			return
+		case err != nil:
+			logger.Error("Forced rules reload failed", zap.Error(err))
+			http.Error(w, "failed to reload rules", http.StatusBadGateway)
+			return
+		}
+
+		logger.Info("Rules reloaded on request", zap.Int("count", count))
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]int{"rules": count}); err != nil {
+			logger.Warn("Failed to write reload response", zap.Error(err))
+		}
+	})))
+
+	// POST /dead-letters/replay inserts the dead-lettered alerts again, e.g.
+	// once the database is back, and reports the outcome counts. Alerts
+	// inserted by an earlier replay are skipped, a replay requested while one
+	// runs gets 409.
+	mux.Handle("POST /dead-letters/replay", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replay, err := services.ReplayDeadLetters(r.Context())
+		switch {
+		case errors.Is(err, ErrServicesNotRunning):
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, alert.ErrNoDeadLetterReplayer):
+			http.Error(w, "no dead-letter sink configured", http.StatusNotFound)
+			return
+		case errors.Is(err, alert.ErrReplayInProgress):
+			http.Error(w, "replay already in progress", http.StatusConflict)
+			return
+		case err != nil:
+			logger.Error("Dead-letter replay failed", zap.Error(err))
+			http.Error(w, "failed to replay dead letters", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(replay); err != nil {
+			logger.Warn("Failed to write replay response", zap.Error(err))
+		}
+	})))
+
+	// POST /rules/{id}/test with a JSON object of device address -> value
+	// returns the conditions of the rule that would trigger on those values,
+	// without inserting anything or touching cooldowns
+	mux.Handle("POST /rules/{id}/test", requireSecret(secret, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ruleID := r.PathValue("id")
+		var values map[string]any
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTestBody)).Decode(&values); err != nil {
+			http.Error(w, "invalid body, expected a JSON object of device values", http.StatusBadRequest)
+			return
+		}
+
+		ruleManager, _ := services.GetServices()
+		if ruleManager == nil {
+			http.Error(w, "services not running", http.StatusServiceUnavailable)
+			return
+		}
+
+		matches, ok := ruleManager.TestRule(ruleID, values)
+		if !ok {
+			http.Error(w, "rule not found", http.StatusNotFound)
+			return
+		}
+		if matches == nil {
+			matches = []alert.RuleMatch{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{"rule_id": ruleID, "matches": matches}); err != nil {
+			logger.Warn("Failed to write rule test response", zap.String("rule_id", ruleID), zap.Error(err))
+		}
+	})))
+
+	return mux
+}
+
+// requireSecret rejects requests that don't carry the shared secret as a
+// bearer token
+func requireSecret(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
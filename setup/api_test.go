@@ -0,0 +1,340 @@
+package setup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"goalert-engine/alert"
+	"goalert-engine/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAPIAck(t *testing.T) {
+	rm := alert.NewRuleManager(context.Background(), nil, config.Config{}, alert.NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	ack := func(target, token string) int {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, ack("/ack?key=rule1_1_1", ""))
+	assert.Equal(t, http.StatusUnauthorized, ack("/ack?key=rule1_1_1", "wrong"))
+	assert.Equal(t, http.StatusBadRequest, ack("/ack", "s3cret"))
+	assert.Equal(t, http.StatusNoContent, ack("/ack?key=rule1_1_1", "s3cret"))
+
+	sm.currentRuleManager = nil
+	assert.Equal(t, http.StatusServiceUnavailable, ack("/ack?key=rule1_1_1", "s3cret"))
+}
+
+func TestAPISnooze(t *testing.T) {
+	rules := []alert.AlertRule{
+		*alert.NewAlertRule("rule1", []string{"sensor/D800"}, "alerts", "", "", "", []alert.AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: alert.LevelWarning},
+		}, zap.NewNop()),
+	}
+	inserter := &alert.RecordingInserter{}
+	rm := alert.NewRuleManager(context.Background(), rules, config.Config{}, inserter, zap.NewNop())
+	defer rm.Shutdown()
+	require.NoError(t, rm.Start(context.Background()))
+
+	var results []alert.AlertResult
+	var mu sync.Mutex
+	rm.OnAlertResult = func(result alert.AlertResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+	}
+
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	snooze := func(target, token string) int {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, snooze("/snooze?key=rule1_1_1&duration=30m", ""))
+	assert.Equal(t, http.StatusBadRequest, snooze("/snooze?duration=30m", "s3cret"))
+	assert.Equal(t, http.StatusBadRequest, snooze("/snooze?key=rule1_1_1", "s3cret"))
+	assert.Equal(t, http.StatusBadRequest, snooze("/snooze?key=rule1_1_1&duration=-5m", "s3cret"))
+	assert.Equal(t, http.StatusNoContent, snooze("/snooze?key=rule1_1_1&duration=30m", "s3cret"))
+
+	// The snoozed alert is evaluated but not delivered
+	rm.HandleMQTTMessage("sensor/D800", []byte(`{"address": "D800", "value": 950}`), config.Config{})
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results) == 1 && results[0].Status == alert.AlertSuppressed && results[0].Reason == "snoozed"
+	}, time.Second, 5*time.Millisecond)
+	assert.Empty(t, inserter.Alerts())
+
+	assert.Equal(t, http.StatusNoContent, snooze("/snooze?key=rule1_1_1&duration=0s", "s3cret"))
+}
+
+func TestAPISnoozeRule(t *testing.T) {
+	rm := alert.NewRuleManager(context.Background(), nil, config.Config{}, alert.NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	snooze := func(target, token string) int {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	until := time.Now().Add(2 * time.Hour).Format(time.RFC3339)
+	assert.Equal(t, http.StatusUnauthorized, snooze("/rules/rule1/snooze?until="+until, ""))
+	assert.Equal(t, http.StatusBadRequest, snooze("/rules/rule1/snooze", "s3cret"))
+	assert.Equal(t, http.StatusBadRequest, snooze("/rules/rule1/snooze?until=2h", "s3cret"))
+	assert.Equal(t, http.StatusNoContent, snooze("/rules/rule1/snooze?until="+until, "s3cret"))
+
+	sm.currentRuleManager = nil
+	assert.Equal(t, http.StatusServiceUnavailable, snooze("/rules/rule1/snooze?until="+until, "s3cret"))
+}
+
+func TestAPITestRule(t *testing.T) {
+	rules := []alert.AlertRule{
+		*alert.NewAlertRule("oven", []string{"sensor/D800"}, "alerts", "", "", "", []alert.AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: alert.LevelWarning},
+			{ID: 2, Device: "D800", Operator: "D800 > 1000", Threshold: 1000, Level: alert.LevelCritical},
+		}, zap.NewNop()),
+	}
+	inserter := &alert.RecordingInserter{}
+	rm := alert.NewRuleManager(context.Background(), rules, config.Config{}, inserter, zap.NewNop())
+	defer rm.Shutdown()
+
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	test := func(target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, test("/rules/oven/test", "", `{"D800": 950}`).Code)
+	assert.Equal(t, http.StatusBadRequest, test("/rules/oven/test", "s3cret", `[950]`).Code)
+	assert.Equal(t, http.StatusNotFound, test("/rules/kiln/test", "s3cret", `{"D800": 950}`).Code)
+
+	// Only the warning holds at 950, repeatedly since cooldowns don't apply
+	for range 2 {
+		rec := test("/rules/oven/test", "s3cret", `{"D800": 950}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp struct {
+			RuleID  string            `json:"rule_id"`
+			Matches []alert.RuleMatch `json:"matches"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "oven", resp.RuleID)
+		require.Len(t, resp.Matches, 1)
+		assert.Equal(t, 1, resp.Matches[0].ConditionID)
+		assert.Equal(t, "WARNING", resp.Matches[0].Alert.Severity)
+		assert.Equal(t, 950.0, resp.Matches[0].Alert.Current)
+		assert.Contains(t, resp.Matches[0].Message, `"device":"D800"`)
+	}
+
+	rec := test("/rules/oven/test", "s3cret", `{"D800": 500}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"rule_id": "oven", "matches": []}`, rec.Body.String())
+	assert.Empty(t, inserter.Alerts(), "Expected testing a rule not to insert alerts")
+}
+
+// fakeReloader returns rules, or err, on every reload
+type fakeReloader struct {
+	rules []alert.AlertRule
+	err   error
+}
+
+func (r *fakeReloader) Reload(ctx context.Context) ([]alert.AlertRule, error) {
+	return r.rules, r.err
+}
+
+func TestAPIReload(t *testing.T) {
+	rm := alert.NewRuleManager(context.Background(), nil, config.Config{}, alert.NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+
+	reloader := &fakeReloader{rules: []alert.AlertRule{
+		*alert.NewAlertRule("oven", []string{"sensor/D800"}, "alerts", "", "", "", []alert.AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: alert.LevelWarning},
+		}, zap.NewNop()),
+	}}
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm, currentReloader: reloader}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	reload := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, reload("").Code)
+
+	// The reloaded rules replace the running ones
+	rec := reload("s3cret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"rules": 1}`, rec.Body.String())
+	assert.Equal(t, 1, rm.Stats().Rules)
+	_, found := rm.TestRule("oven", map[string]any{})
+	assert.True(t, found, "Expected the reloaded rule to be loaded")
+
+	reloader.err = alert.ErrReloadInProgress
+	assert.Equal(t, http.StatusConflict, reload("s3cret").Code)
+	reloader.err = errors.New("supabase unreachable")
+	assert.Equal(t, http.StatusBadGateway, reload("s3cret").Code)
+
+	sm.currentRuleManager = nil
+	assert.Equal(t, http.StatusServiceUnavailable, reload("s3cret").Code)
+}
+
+func TestAPIReplayDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := alert.NewFileDeadLetterSink(path)
+	require.NoError(t, sink.StoreDeadLetter(context.Background(), alert.DeadLetter{RuleID: "oven", Table: "alerts", Device: "D800"}))
+
+	rm := alert.NewManager(context.Background(), nil, config.Config{},
+		alert.WithInserter(alert.NoopInserter{}),
+		alert.WithDeadLetterSink(sink),
+	)
+	defer rm.Shutdown()
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	replay := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/dead-letters/replay", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := replay()
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"inserted": 1, "failed": 0, "skipped": 0}`, rec.Body.String())
+
+	rec = replay()
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"inserted": 0, "failed": 0, "skipped": 1}`, rec.Body.String())
+
+	// Without a dead-letter sink there is nothing to replay
+	plain := alert.NewRuleManager(context.Background(), nil, config.Config{}, alert.NoopInserter{}, zap.NewNop())
+	defer plain.Shutdown()
+	sm.currentRuleManager = plain
+	assert.Equal(t, http.StatusNotFound, replay().Code)
+
+	sm.currentRuleManager = nil
+	assert.Equal(t, http.StatusServiceUnavailable, replay().Code)
+}
+
+// insertHook calls insert for every alert
+type insertHook func()
+
+func (h insertHook) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	h()
+	return nil
+}
+
+func TestAPIReplayDeadLettersConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink := alert.NewFileDeadLetterSink(path)
+	require.NoError(t, sink.StoreDeadLetter(context.Background(), alert.DeadLetter{RuleID: "oven", Table: "alerts", Device: "D800"}))
+
+	var handler http.Handler
+	replay := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/dead-letters/replay", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A replay requested while one inserts is turned away
+	var nested *httptest.ResponseRecorder
+	rm := alert.NewManager(context.Background(), nil, config.Config{},
+		alert.WithInserter(insertHook(func() { nested = replay() })),
+		alert.WithDeadLetterSink(sink),
+	)
+	defer rm.Shutdown()
+	handler = NewAPIHandler(&ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}, "s3cret", zap.NewNop())
+
+	require.Equal(t, http.StatusOK, replay().Code)
+	require.NotNil(t, nested)
+	assert.Equal(t, http.StatusConflict, nested.Code)
+}
+
+func TestAPIRules(t *testing.T) {
+	rules := []alert.AlertRule{
+		*alert.NewAlertRule("oven", []string{"sensor/D800"}, "alerts", "", "", "", []alert.AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: alert.LevelWarning},
+		}, zap.NewNop()),
+	}
+	rm := alert.NewRuleManager(context.Background(), rules, config.Config{}, alert.NoopInserter{}, zap.NewNop())
+	defer rm.Shutdown()
+	sm := &ServiceManager{logger: zap.NewNop(), currentRuleManager: rm}
+	handler := NewAPIHandler(sm, "s3cret", zap.NewNop())
+
+	list := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/rules", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := list()
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"rules": [{"id": "oven", "topics": ["sensor/D800"], "conditions": 1, "trigger_rate_1h": 0, "last_fired": null}]}`, rec.Body.String())
+
+	sm.currentRuleManager = nil
+	assert.Equal(t, http.StatusServiceUnavailable, list().Code)
+}
+
+func TestAPIDisabledWithoutSecret(t *testing.T) {
+	handler := NewAPIHandler(&ServiceManager{}, "", zap.NewNop())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ack?key=rule1_1_1", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,79 @@
+package setup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"goalert-engine/alert"
+	"goalert-engine/config"
+	"goalert-engine/mqtts"
+	"goalert-engine/mqtts/mqttstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordingNotifier keeps the notifications it receives
+type recordingNotifier struct {
+	mu            sync.Mutex
+	notifications []alert.Notification
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) Notify(ctx context.Context, notification alert.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func (n *recordingNotifier) Notifications() []alert.Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]alert.Notification(nil), n.notifications...)
+}
+
+func TestPublishedValueRaisesAlert(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{MQTTTopic: "sensors/#"}
+
+	rules := []alert.AlertRule{
+		*alert.NewAlertRule("oven", []string{"sensors/D800"}, "alerts", "", "", "", []alert.AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 900", Threshold: 900, Level: alert.LevelError},
+		}, logger),
+	}
+	inserter := &alert.RecordingInserter{}
+	notifier := &recordingNotifier{}
+	ruleManager := alert.NewManager(ctx, rules, cfg, alert.WithInserter(inserter), alert.WithNotifiers(notifier))
+	defer ruleManager.Shutdown()
+	require.NoError(t, ruleManager.Start(ctx))
+
+	broker := mqttstest.NewBroker()
+	var wg sync.WaitGroup
+	MQTTSubscriber(ctx, &wg, &mqtts.Client{Client: broker}, ruleManager, cfg, logger)
+	assert.Equal(t, []string{"sensors/#"}, broker.Subscriptions())
+
+	// A value below the threshold raises nothing, one above it an alert
+	require.NoError(t, broker.Publish("sensors/D800", 0, false, `{"address": "D800", "value": 850}`).Error())
+	require.NoError(t, broker.Publish("sensors/D800", 0, false, `{"address": "D800", "value": 950}`).Error())
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		return len(notifier.Notifications()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	notification := notifier.Notifications()[0]
+	assert.Equal(t, "oven", notification.RuleID)
+	assert.Equal(t, "D800", notification.Alert.Device)
+	assert.Equal(t, alert.LevelError, notification.Level)
+
+	inserted := inserter.Alerts()
+	require.Len(t, inserted, 1)
+	assert.Equal(t, "alerts", inserted[0].Table)
+	assert.Equal(t, "D800", inserted[0].Device)
+}
@@ -0,0 +1,125 @@
+package setup
+
+import (
+	"context"
+	"sync"
+
+	"goalert-engine/metrics"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Queue policies for a saturated message pool
+const (
+	QueuePolicyBlock = "block" // Block the MQTT client until there is room
+	QueuePolicyShed  = "shed"  // Drop the message
+)
+
+// Defaults for a pool configured with zero sizes
+const (
+	defaultMessageWorkers   = 8
+	defaultMessageQueueSize = 1000
+)
+
+// messagePool processes MQTT messages on a fixed number of workers fed by a
+// bounded queue, so a flood of messages can't spawn unbounded goroutines.
+// Messages are acked once processed. Shed messages and those left over at
+// shutdown aren't, so the broker redelivers them when QoS > 0.
+type messagePool struct {
+	ctx     context.Context
+	queue   chan mqtt.Message
+	shed    bool
+	process func(mqtt.Message)
+	pending *sync.WaitGroup // Queued and running messages
+
+	mu     sync.RWMutex // Guards closed, held by submitters while enqueueing
+	closed bool
+}
+
+// newMessagePool starts workers calling process for every submitted message.
+// The pool closes when ctx is cancelled; messages still queued are handed to
+// process, which should skip them.
+func newMessagePool(ctx context.Context, workers, queueSize int, policy string, pending *sync.WaitGroup, process func(mqtt.Message)) *messagePool {
+	if workers <= 0 {
+		workers = defaultMessageWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultMessageQueueSize
+	}
+
+	p := &messagePool{
+		ctx:     ctx,
+		queue:   make(chan mqtt.Message, queueSize),
+		shed:    policy == QueuePolicyShed,
+		process: process,
+		pending: pending,
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	go func() {
+		<-ctx.Done()
+		p.close()
+	}()
+
+	return p
+}
+
+// submit queues msg and reports whether it was accepted. A full queue blocks
+// or sheds the message depending on the pool's policy.
+func (p *messagePool) submit(msg mqtt.Message) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return false
+	}
+
+	// Counted before the message is queued, a worker may take it off the
+	// queue before the send returns
+	p.pending.Add(1)
+	metrics.MessageQueueDepth.Inc()
+	if p.shed {
+		select {
+		case p.queue <- msg:
+		default:
+			p.pending.Done()
+			metrics.MessageQueueDepth.Dec()
+			metrics.MessagesShed.Inc()
+			return false
+		}
+	} else {
+		p.queue <- msg
+	}
+	return true
+}
+
+func (p *messagePool) worker() {
+	for msg := range p.queue {
+		metrics.MessageQueueDepth.Dec()
+		p.run(msg)
+	}
+}
+
+func (p *messagePool) run(msg mqtt.Message) {
+	defer p.pending.Done()
+	p.process(msg)
+
+	// process skips messages once the pool is closing
+	if p.ctx.Err() == nil {
+		msg.Ack()
+	}
+}
+
+// close stops accepting messages and lets the workers exit once the queue
+// is drained
+func (p *messagePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+}
@@ -0,0 +1,170 @@
+package setup
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goalert-engine/metrics"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessagePoolBoundsConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		pending sync.WaitGroup
+		active  atomic.Int32
+		peak    atomic.Int32
+	)
+	pool := newMessagePool(ctx, 2, 100, QueuePolicyBlock, &pending, func(msg mqtt.Message) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		active.Add(-1)
+	})
+
+	for i := 0; i < 20; i++ {
+		assert.True(t, pool.submit(&fakeMessage{topic: "sensors/D800"}))
+	}
+	pending.Wait()
+
+	assert.Equal(t, int32(2), peak.Load(), "expected exactly the configured number of workers to run")
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.MessageQueueDepth))
+}
+
+func TestMessagePoolBurstNeverExceedsWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		pending sync.WaitGroup
+		active  atomic.Int32
+		peak    atomic.Int32
+	)
+	pool := newMessagePool(ctx, 3, 5, QueuePolicyShed, &pending, func(msg mqtt.Message) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		active.Add(-1)
+	})
+
+	// A burst from many publishers at once, beyond the queue sheds
+	var submitters sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		submitters.Add(1)
+		go func() {
+			defer submitters.Done()
+			for j := 0; j < 20; j++ {
+				pool.submit(&fakeMessage{topic: "sensors/D800"})
+			}
+		}()
+	}
+	submitters.Wait()
+	pending.Wait()
+
+	assert.LessOrEqual(t, peak.Load(), int32(3), "expected at most the configured number of handlers in flight")
+}
+
+func TestMessagePoolShedsWhenFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var pending sync.WaitGroup
+	entered := make(chan struct{}, 3)
+	release := make(chan struct{})
+	pool := newMessagePool(ctx, 1, 1, QueuePolicyShed, &pending, func(msg mqtt.Message) {
+		entered <- struct{}{}
+		<-release
+	})
+
+	before := testutil.ToFloat64(metrics.MessagesShed)
+
+	// One message runs, one waits in the queue, the third is shed
+	running, queued, shed := &fakeMessage{topic: "sensors/D1"}, &fakeMessage{topic: "sensors/D2"}, &fakeMessage{topic: "sensors/D3"}
+	assert.True(t, pool.submit(running))
+	<-entered
+	assert.True(t, pool.submit(queued))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.MessageQueueDepth))
+	assert.False(t, pool.submit(shed))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.MessagesShed)-before)
+
+	close(release)
+	pending.Wait()
+	assert.Len(t, entered, 1, "expected only the queued message to run after the first")
+
+	// The shed QoS 1 message stays unacked for the broker to redeliver
+	assert.True(t, running.acked.Load())
+	assert.True(t, queued.acked.Load())
+	assert.False(t, shed.acked.Load())
+}
+
+func TestMessagePoolRejectsAfterClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var pending sync.WaitGroup
+	pool := newMessagePool(ctx, 1, 1, QueuePolicyBlock, &pending, func(msg mqtt.Message) {})
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		return !pool.submit(&fakeMessage{topic: "sensors/D1"})
+	}, time.Second, 5*time.Millisecond)
+	pending.Wait()
+}
+
+// BenchmarkMessagePool floods the pool from many goroutines with messages
+// that take no time to process, measuring the pool's own overhead. The
+// messages in flight stay bounded by the workers regardless of the rate.
+func BenchmarkMessagePool(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const workers = 8
+	var (
+		pending sync.WaitGroup
+		active  atomic.Int32
+		peak    atomic.Int32
+	)
+	pool := newMessagePool(ctx, workers, 1000, QueuePolicyBlock, &pending, func(msg mqtt.Message) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		active.Add(-1)
+	})
+	msg := &fakeMessage{topic: "sensors/D800"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pool.submit(msg)
+		}
+	})
+	pending.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(peak.Load()), "peak-in-flight")
+	if peak.Load() > workers {
+		b.Fatalf("Expected at most %d messages in flight, got %d", workers, peak.Load())
+	}
+}
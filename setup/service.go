@@ -2,22 +2,32 @@ package setup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"goalert-engine/alert"
 	"goalert-engine/config"
 	"goalert-engine/mqtts"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// RuleReloader reloads the rules from their source, bypassing any cache
+type RuleReloader interface {
+	Reload(ctx context.Context) ([]alert.AlertRule, error)
+}
+
 type ServiceManager struct {
 	ctx                context.Context
 	cfg                config.Config
 	logger             *zap.Logger
 	currentRuleManager *alert.RuleManager
 	currentMQTTClient  *mqtts.Client
+	currentReloader    RuleReloader
 	restartChan        chan struct{}
+	handlers           sync.WaitGroup     // Outstanding MQTT message handlers
+	stopSubscriber     context.CancelFunc // Stops the current subscriber's worker pool
 	mu                 sync.Mutex
 }
 
@@ -39,31 +49,113 @@ func (sm *ServiceManager) restartServices() error {
 	defer sm.mu.Unlock()
 
 	// Clean up old services if they exist
-	if sm.currentRuleManager != nil {
-		sm.currentRuleManager.Shutdown()
-	}
-	if sm.currentMQTTClient != nil {
-		sm.currentMQTTClient.Disconnect(250)
-	}
+	sm.stopServices()
 
 	// Initialize new services
-	ruleManager, mqttClient, err := InitializeServices(sm.ctx, sm.cfg, sm.logger)
+	ruleManager, mqttClient, loader, err := InitializeServices(sm.ctx, sm.cfg, sm.logger)
 	if err != nil {
 		return fmt.Errorf("failed to restart services: %w", err)
 	}
 
 	sm.currentRuleManager = ruleManager
 	sm.currentMQTTClient = mqttClient
+	sm.currentReloader = loader
 
-	// Start MQTT subscriber
-	var wg sync.WaitGroup
-	MQTTSubscriber(sm.ctx, &wg, mqttClient, ruleManager, sm.cfg, sm.logger)
+	// Start MQTT subscriber, its workers live until the services are stopped
+	subscriberCtx, stopSubscriber := context.WithCancel(sm.ctx)
+	sm.stopSubscriber = stopSubscriber
+	MQTTSubscriber(subscriberCtx, &sm.handlers, mqttClient, ruleManager, sm.cfg, sm.logger)
 
 	return nil
 }
 
+// Stop tears down the running services
+func (sm *ServiceManager) Stop() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.stopServices()
+}
+
+// stopServices unsubscribes from all active topics, waits for queued and
+// in-flight messages to drain, stops the subscriber's workers and then shuts
+// down the rule manager and the broker connection. Callers must hold sm.mu.
+func (sm *ServiceManager) stopServices() {
+	if sm.currentMQTTClient != nil {
+		if err := sm.currentMQTTClient.Unsubscribe(sm.currentMQTTClient.Topics()...); err != nil {
+			sm.logger.Warn("Failed to unsubscribe before disconnect", zap.Error(err))
+		}
+	}
+
+	if !waitTimeout(&sm.handlers, sm.cfg.ShutdownTimeout) {
+		sm.logger.Warn("Timed out waiting for message handlers to finish",
+			zap.Duration("timeout", sm.cfg.ShutdownTimeout))
+	}
+	if sm.stopSubscriber != nil {
+		sm.stopSubscriber()
+		sm.stopSubscriber = nil
+	}
+
+	if sm.currentRuleManager != nil {
+		sm.currentRuleManager.Shutdown()
+		sm.currentRuleManager = nil
+	}
+	if sm.currentMQTTClient != nil {
+		sm.currentMQTTClient.Disconnect(uint(sm.cfg.MQTTDisconnectQuiesce))
+		sm.currentMQTTClient = nil
+	}
+	sm.currentReloader = nil
+}
+
+// waitTimeout waits for wg and reports whether it finished within timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (sm *ServiceManager) GetServices() (*alert.RuleManager, *mqtts.Client) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 	return sm.currentRuleManager, sm.currentMQTTClient
 }
+
+// ErrServicesNotRunning is returned when acting on services that aren't running
+var ErrServicesNotRunning = errors.New("services not running")
+
+// ReloadRules reloads the rules from their source into the running rule
+// manager, without waiting for a change event. Concurrent reloads fail with
+// alert.ErrReloadInProgress.
+func (sm *ServiceManager) ReloadRules(ctx context.Context) (int, error) {
+	sm.mu.Lock()
+	ruleManager, reloader := sm.currentRuleManager, sm.currentReloader
+	sm.mu.Unlock()
+	if ruleManager == nil || reloader == nil {
+		return 0, ErrServicesNotRunning
+	}
+
+	rules, err := reloader.Reload(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ruleManager.UpdateRules(rules, sm.cfg)
+	return len(rules), nil
+}
+
+// ReplayDeadLetters inserts the dead-lettered alerts through the running rule
+// manager's inserter
+func (sm *ServiceManager) ReplayDeadLetters(ctx context.Context) (alert.DeadLetterReplay, error) {
+	ruleManager, _ := sm.GetServices()
+	if ruleManager == nil {
+		return alert.DeadLetterReplay{}, ErrServicesNotRunning
+	}
+	return ruleManager.ReplayDeadLetters(ctx)
+}
@@ -0,0 +1,270 @@
+package setup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"goalert-engine/alert"
+	"goalert-engine/config"
+	"goalert-engine/mqtts"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeToken is an already-completed mqtt.Token
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (t *fakeToken) Error() error { return t.err }
+
+// fakeMQTTClient records the order of subscription lifecycle calls
+type fakeMQTTClient struct {
+	mu       sync.Mutex
+	calls    []string
+	handlers map[string]mqtt.MessageHandler
+	quiesce  uint // Quiesce of the last Disconnect
+}
+
+func (c *fakeMQTTClient) record(call string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+func (c *fakeMQTTClient) Calls() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+func (c *fakeMQTTClient) IsConnected() bool      { return true }
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return true }
+func (c *fakeMQTTClient) Connect() mqtt.Token    { return &fakeToken{} }
+func (c *fakeMQTTClient) Disconnect(quiesce uint) {
+	c.record("disconnect")
+	c.mu.Lock()
+	c.quiesce = quiesce
+	c.mu.Unlock()
+}
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.record("subscribe " + topic)
+	c.mu.Lock()
+	if c.handlers == nil {
+		c.handlers = make(map[string]mqtt.MessageHandler)
+	}
+	c.handlers[topic] = callback
+	c.mu.Unlock()
+	return &fakeToken{}
+}
+func (c *fakeMQTTClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{}
+}
+func (c *fakeMQTTClient) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		c.record("unsubscribe " + topic)
+	}
+	return &fakeToken{}
+}
+func (c *fakeMQTTClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+func (c *fakeMQTTClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// blockingMessage is an mqtt.Message whose Payload blocks until released,
+// keeping the message handler in flight
+type blockingMessage struct {
+	topic   string
+	payload []byte
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingMessage) Duplicate() bool   { return false }
+func (m *blockingMessage) Qos() byte         { return 1 }
+func (m *blockingMessage) Retained() bool    { return false }
+func (m *blockingMessage) MessageID() uint16 { return 1 }
+func (m *blockingMessage) Ack()              {}
+func (m *blockingMessage) Topic() string {
+	close(m.entered)
+	return m.topic
+}
+func (m *blockingMessage) Payload() []byte {
+	<-m.release
+	return m.payload
+}
+
+func TestStopUnsubscribesBeforeDisconnect(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{MQTTTopic: "sensors/#"}
+
+	fake := &fakeMQTTClient{}
+	client := &mqtts.Client{Client: fake}
+	ruleManager := alert.NewRuleManager(ctx, nil, cfg, nil, logger)
+
+	sm := NewServiceManager(ctx, cfg, logger)
+	sm.currentMQTTClient = client
+	sm.currentRuleManager = ruleManager
+
+	var wg sync.WaitGroup
+	MQTTSubscriber(ctx, &wg, client, ruleManager, cfg, logger)
+	assert.Equal(t, []string{"sensors/#"}, client.Topics())
+
+	sm.Stop()
+
+	assert.Equal(t, []string{
+		"subscribe sensors/#",
+		"unsubscribe sensors/#",
+		"disconnect",
+	}, fake.Calls())
+	assert.Empty(t, client.Topics())
+
+	rm, mc := sm.GetServices()
+	assert.Nil(t, rm)
+	assert.Nil(t, mc)
+}
+
+func TestStopUsesConfiguredDisconnectQuiesce(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{MQTTDisconnectQuiesce: 1500}
+
+	fake := &fakeMQTTClient{}
+	sm := NewServiceManager(ctx, cfg, logger)
+	sm.currentMQTTClient = &mqtts.Client{Client: fake}
+
+	sm.Stop()
+
+	assert.Equal(t, []string{"disconnect"}, fake.Calls())
+	assert.Equal(t, uint(1500), fake.quiesce)
+}
+
+func TestStopDrainsMessageHandlers(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{MQTTTopic: "sensors/#", ShutdownTimeout: 5 * time.Second}
+
+	fake := &fakeMQTTClient{}
+	client := &mqtts.Client{Client: fake}
+	ruleManager := alert.NewRuleManager(ctx, nil, cfg, nil, logger)
+
+	sm := NewServiceManager(ctx, cfg, logger)
+	sm.currentMQTTClient = client
+	sm.currentRuleManager = ruleManager
+	MQTTSubscriber(ctx, &sm.handlers, client, ruleManager, cfg, logger)
+
+	handler := fake.handlers["sensors/#"]
+	msgs := make([]*blockingMessage, 3)
+	for i := range msgs {
+		msgs[i] = &blockingMessage{
+			topic:   "sensors/D800",
+			payload: []byte(`{"address": "D800", "value": 1}`),
+			entered: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+		go handler(fake, msgs[i])
+		<-msgs[i].entered
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		sm.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while message handlers were still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, msg := range msgs {
+		close(msg.release)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return after handlers drained")
+	}
+	assert.Equal(t, "disconnect", fake.Calls()[len(fake.Calls())-1])
+}
+
+func TestStopDrainTimeout(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{MQTTTopic: "sensors/#", ShutdownTimeout: 50 * time.Millisecond}
+
+	fake := &fakeMQTTClient{}
+	client := &mqtts.Client{Client: fake}
+	ruleManager := alert.NewRuleManager(ctx, nil, cfg, nil, logger)
+
+	sm := NewServiceManager(ctx, cfg, logger)
+	sm.currentMQTTClient = client
+	sm.currentRuleManager = ruleManager
+	MQTTSubscriber(ctx, &sm.handlers, client, ruleManager, cfg, logger)
+
+	msg := &blockingMessage{
+		topic:   "sensors/D800",
+		payload: []byte(`{"address": "D800", "value": 1}`),
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	go fake.handlers["sensors/#"](fake, msg)
+	<-msg.entered
+	defer close(msg.release)
+
+	start := time.Now()
+	sm.Stop()
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRuleUpdatesSyncSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{}
+
+	fake := &fakeMQTTClient{}
+	client := &mqtts.Client{Client: fake}
+	rules := []alert.AlertRule{{ID: "a", Topics: []string{"plant/a/D1"}}}
+	ruleManager := alert.NewRuleManager(ctx, rules, cfg, &alert.NoopInserter{}, logger)
+	defer ruleManager.Shutdown()
+
+	var wg sync.WaitGroup
+	MQTTSubscriber(ctx, &wg, client, ruleManager, cfg, logger)
+	assert.Equal(t, []string{"plant/a/D1"}, client.Topics())
+
+	// Adding a rule with a new topic subscribes to it
+	ruleManager.UpdateRules([]alert.AlertRule{
+		{ID: "a", Topics: []string{"plant/a/D1"}},
+		{ID: "b", Topics: []string{"plant/b/D2"}},
+	}, cfg)
+	assert.ElementsMatch(t, []string{"plant/a/D1", "plant/b/D2"}, client.Topics())
+
+	// Removing a rule unsubscribes from the topics no other rule needs
+	ruleManager.UpdateRules([]alert.AlertRule{
+		{ID: "b", Topics: []string{"plant/b/D2"}},
+	}, cfg)
+	assert.Equal(t, []string{"plant/b/D2"}, client.Topics())
+
+	assert.Equal(t, []string{
+		"subscribe plant/a/D1",
+		"subscribe plant/b/D2",
+		"unsubscribe plant/a/D1",
+	}, fake.Calls())
+}
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"goalert-engine/alert"
 	"goalert-engine/config"
+	"goalert-engine/metrics"
 	"goalert-engine/mqtts"
+	"goalert-engine/realtime"
 	"goalert-engine/supabase"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.uber.org/zap"
@@ -38,54 +42,227 @@ func HandleVersionFlag(logger *zap.Logger, version string) bool {
 }
 
 func ValidateConfig(cfg config.Config) error {
-	if cfg.MQTTTopic == "" {
-		return errors.New("MQTT topic cannot be empty")
+	if cfg.MessageWorkers < 0 || cfg.MessageQueueSize < 0 {
+		return errors.New("message workers and queue size cannot be negative")
+	}
+	if cfg.MQTTDisconnectQuiesce < 0 {
+		return errors.New("MQTT disconnect quiesce cannot be negative")
+	}
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+		return fmt.Errorf("invalid MQTT QoS %d, expected 0, 1 or 2", cfg.MQTTQoS)
+	}
+	if cfg.MQTTConnectTimeout < 0 || cfg.MQTTSubscribeTimeout < 0 {
+		return errors.New("MQTT connect and subscribe timeouts cannot be negative")
+	}
+	switch cfg.MessageQueuePolicy {
+	case "", QueuePolicyBlock, QueuePolicyShed:
+	default:
+		return fmt.Errorf("invalid message queue policy %q, expected %q or %q", cfg.MessageQueuePolicy, QueuePolicyBlock, QueuePolicyShed)
+	}
+	if cfg.AlertCountResetFactor < 0 {
+		return errors.New("alert count reset factor cannot be negative")
+	}
+	switch cfg.AlertCooldownPolicy {
+	case "", alert.CooldownImmediateFirst, alert.CooldownThrottleAll:
+	default:
+		return fmt.Errorf("invalid alert cooldown policy %q, expected %q or %q", cfg.AlertCooldownPolicy, alert.CooldownImmediateFirst, alert.CooldownThrottleAll)
+	}
+	if cfg.StartupGracePeriod < 0 {
+		return errors.New("startup grace period cannot be negative")
+	}
+	if cfg.DeviceCacheMaxEntries < 0 {
+		return errors.New("device cache max entries cannot be negative")
+	}
+	if cfg.SupabaseHTTPTimeout < 0 {
+		return errors.New("Supabase HTTP timeout cannot be negative")
+	}
+	if cfg.SupabaseMaxIdleConns < 0 || cfg.SupabaseMaxIdleConnsPerHost < 0 || cfg.SupabaseIdleConnTimeout < 0 {
+		return errors.New("Supabase connection pool settings cannot be negative")
+	}
+	if cfg.EvaluationCoalesceWindow < 0 {
+		return errors.New("evaluation coalesce window cannot be negative")
+	}
+	if cfg.WatchdogInterval < 0 || cfg.WatchdogMQTTDisconnected < 0 || cfg.WatchdogRealtimeDisconnected < 0 || cfg.WatchdogNoMessages < 0 {
+		return errors.New("watchdog interval and thresholds cannot be negative")
+	}
+	if cfg.DeviceCacheSweepInterval < 0 {
+		return errors.New("device cache sweep interval cannot be negative")
+	}
+	if cfg.Supabase.ReloadJitter < 0 || cfg.Supabase.ReloadJitter > alert.MaxReloadJitter {
+		return fmt.Errorf("Supabase reload jitter must be between 0 and %s", alert.MaxReloadJitter)
+	}
+	if _, err := alert.NewDecoder(cfg); err != nil {
+		return err
+	}
+	if cfg.PayloadSchema != "" && cfg.PayloadFormat != "" && cfg.PayloadFormat != alert.FormatJSON {
+		return fmt.Errorf("payload schema only applies to the %q payload format", alert.FormatJSON)
+	}
+	if err := realtime.ValidateHeartbeat(cfg.RealtimeHeartbeatInterval, cfg.RealtimeHeartbeatTimeout); err != nil {
+		return fmt.Errorf("invalid realtime heartbeat: %w", err)
+	}
+	if cfg.RealtimeDialTimeout <= 0 || cfg.RealtimeReconnectInterval <= 0 {
+		return errors.New("realtime dial timeout and reconnect interval must be positive")
+	}
+	if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", cfg.Timezone, err)
 	}
 	return nil
 }
 
+// StartHTTPServer serves handler on addr until ctx is cancelled
+func StartHTTPServer(ctx context.Context, addr string, handler http.Handler, logger *zap.Logger) {
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		logger.Info("Starting HTTP server", zap.String("addr", addr))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed", zap.Error(err))
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+}
+
 func InitializeServices(
 	ctx context.Context,
 	cfg config.Config,
 	logger *zap.Logger,
-) (*alert.RuleManager, *mqtts.Client, error) {
+) (*alert.RuleManager, *mqtts.Client, *alert.SupabaseRuleLoader, error) {
 	// Initialize MQTT client
-	mqttClient := mqtts.New(cfg)
+	mqttClient, err := mqtts.New(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	// Initialize Supabase inserter
+	supabase.ConfigureHTTPClient(cfg)
 	inserter := &supabase.SupabaseInserter{}
 
 	// Initialize rule loader
 	loader, err := alert.NewSupabaseRuleLoader(cfg, logger)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	// Load initial rules
-	rules, err := loader.GetRules()
+	opts, err := managerOptions(cfg, inserter, logger)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	if len(rules) == 0 {
-		logger.Warn("no rules found, continuing with empty rule set")
+	var manager *alert.RuleManager
+	if cached := loader.LastKnownRules(); cached != nil {
+		// Warm restart: run the last-known-good rules right away and replace
+		// them once the first DB fetch completes
+		logger.Info("Starting with cached rules", zap.Int("count", len(cached)))
+		manager = alert.NewManager(ctx, cached, cfg, opts...)
+
+		go func() {
+			if err := loader.WaitJitter(ctx); err != nil {
+				return
+			}
+			rules, err := loader.GetRules()
+			if err != nil {
+				logger.Error("Failed to load rules, keeping cached rules", zap.Error(err))
+				return
+			}
+			if ctx.Err() == nil {
+				manager.UpdateRules(rules, cfg)
+			}
+		}()
+	} else {
+		// Load initial rules
+		if err := loader.WaitJitter(ctx); err != nil {
+			return nil, nil, nil, err
+		}
+		rules, err := loader.GetRules()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if len(rules) == 0 {
+			logger.Warn("no rules found, continuing with empty rule set")
+		}
+
+		manager = alert.NewManager(ctx, rules, cfg, opts...)
 	}
 
-	manager := alert.NewRuleManager(ctx, rules, cfg, inserter, logger)
+	if err := manager.Start(ctx); err != nil {
+		return nil, nil, nil, err
+	}
 
 	// Start watching for changes and update manager on change
 	err = loader.WatchChanges(ctx, func(updatedRules []alert.AlertRule) {
 		manager.UpdateRules(updatedRules, cfg)
 	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to start rule realtime listener: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to start rule realtime listener: %w", err)
 	}
 
+	manager.StartWatchdog(alert.WatchdogProbes{
+		MQTT:     mqttClient.Client.IsConnectionOpen,
+		Realtime: loader.RealtimeConnected,
+	})
+
 	// Load rules from a file (which contains multiple conditions per rule)
 	// loadedRules := alert.LoadRulesFromFile("mocks/rules.json", logger)
-	// return alert.NewRuleManager(ctx, loadedRules, cfg, inserter, logger), mqttClient, nil
+	// manager := alert.NewRuleManager(ctx, loadedRules, cfg, inserter, logger)
+	// return manager, mqttClient, manager.Start(ctx)
 
-	return manager, mqttClient, nil
+	return manager, mqttClient, loader, nil
+}
+
+// managerOptions returns the options of the rule manager: rule and engine
+// alerts go to inserter, failed inserts to the dead-letter sink
+func managerOptions(cfg config.Config, inserter alert.AlertInserter, logger *zap.Logger) ([]alert.Option, error) {
+	opts := []alert.Option{alert.WithInserter(inserter), alert.WithLogger(logger)}
+	metadata, err := deviceMetadata(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		opts = append(opts, alert.WithDeviceMetadata(metadata))
+	}
+	if sink := deadLetterSink(cfg); sink != nil {
+		opts = append(opts, alert.WithDeadLetterSink(sink))
+	}
+	return opts, nil
+}
+
+// deviceMetadata returns the configured device metadata, from a file or else
+// a Supabase table, nil when neither is set
+func deviceMetadata(cfg config.Config, logger *zap.Logger) (*alert.DeviceMetadata, error) {
+	switch {
+	case cfg.DeviceMetadataFile != "":
+		return alert.NewDeviceMetadata(alert.FileMetadataSource(cfg.DeviceMetadataFile), cfg.DeviceMetadataTTL, logger), nil
+	case cfg.DeviceMetadataTable != "":
+		source, err := alert.SupabaseMetadataSource(cfg, cfg.DeviceMetadataTable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize device metadata: %w", err)
+		}
+		return alert.NewDeviceMetadata(source, cfg.DeviceMetadataTTL, logger), nil
+	}
+	return nil, nil
+}
+
+// deadLetterSink returns the configured dead-letter sink, a file or else a
+// Supabase table, nil when neither is set
+func deadLetterSink(cfg config.Config) alert.DeadLetterSink {
+	switch {
+	case cfg.DeadLetterFile != "":
+		return alert.NewFileDeadLetterSink(cfg.DeadLetterFile)
+	case cfg.DeadLetterTable != "":
+		return alert.NewTableDeadLetterSink(cfg, cfg.DeadLetterTable)
+	}
+	return nil
+}
+
+// stampedMessage is an MQTT message with its arrival order
+type stampedMessage struct {
+	mqtt.Message
+	arrival uint64
 }
 
 func MQTTSubscriber(
@@ -96,23 +273,72 @@ func MQTTSubscriber(
 	cfg config.Config,
 	logger *zap.Logger,
 ) {
-	messageHandler := func(client mqtt.Client, msg mqtt.Message) {
-		wg.Add(1)
-		defer wg.Done()
+	// Messages are handled on a bounded worker pool, wg tracks the queued
+	// and running ones
+	pool := newMessagePool(ctx, cfg.MessageWorkers, cfg.MessageQueueSize, cfg.MessageQueuePolicy, wg, func(msg mqtt.Message) {
+		defer recoverHandlerPanic(msg, logger)
 
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			ruleManager.HandleMQTTMessage(msg.Topic(), msg.Payload(), cfg)
+			meta := alert.MessageMeta{ID: msg.MessageID(), Retained: msg.Retained()}
+			if stamped, ok := msg.(stampedMessage); ok {
+				meta.Arrival = stamped.arrival
+			}
+			ruleManager.HandleMQTTMessageWithMeta(msg.Topic(), msg.Payload(), meta, cfg)
+		}
+	})
+
+	// Messages are stamped on receipt, the pool's workers may handle them out
+	// of order
+	messageHandler := func(client mqtt.Client, msg mqtt.Message) {
+		if !pool.submit(stampedMessage{Message: msg, arrival: ruleManager.NextArrival()}) {
+			logger.Debug("Dropped MQTT message, queue full or closed", zap.String("topic", msg.Topic()))
+		}
+	}
+
+	// Subscribe to the topics the rules need, following rule updates. Syncs
+	// are serialized and read the current rules, so an update racing the
+	// initial sync can't leave stale subscriptions behind.
+	var syncMu sync.Mutex
+	syncSubscriptions := func() map[string]byte {
+		syncMu.Lock()
+		defer syncMu.Unlock()
+
+		subscriptions := ruleManager.Subscriptions(cfg.MQTTTopic)
+		added, removed, err := mqttClient.SyncSubscriptions(subscriptions, messageHandler)
+		if err != nil {
+			logger.Error("Failed to update MQTT subscriptions", zap.Error(err))
 		}
+		if len(added) > 0 || len(removed) > 0 {
+			logger.Info("Updated MQTT subscriptions",
+				zap.Strings("subscribed", added),
+				zap.Strings("unsubscribed", removed),
+			)
+		}
+		return subscriptions
+	}
+
+	ruleManager.OnRulesUpdated(func(rules []alert.AlertRule) {
+		syncSubscriptions()
+	})
+
+	if subscriptions := syncSubscriptions(); len(subscriptions) == 0 {
+		logger.Warn("No MQTT topics to subscribe to, rules declare none and MQTT_TOPIC is empty")
 	}
+}
 
-	if err := mqttClient.SubscribeAndListen(cfg.MQTTTopic, messageHandler); err != nil {
-		logger.Error(
-			"Failed to subscribe to MQTT topic",
-			zap.String("topic", cfg.MQTTTopic),
-			zap.Error(err),
+// recoverHandlerPanic logs and counts a panic raised while handling msg, so
+// one bad message can't take down the engine
+func recoverHandlerPanic(msg mqtt.Message, logger *zap.Logger) {
+	if r := recover(); r != nil {
+		metrics.MessageHandlerPanics.Inc()
+		logger.Error("Recovered from panic in message handler",
+			zap.String("topic", msg.Topic()),
+			zap.ByteString("payload", msg.Payload()),
+			zap.Any("panic", r),
+			zap.Stack("stack"),
 		)
 	}
 }
@@ -0,0 +1,134 @@
+package setup
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goalert-engine/alert"
+	"goalert-engine/config"
+	"goalert-engine/metrics"
+	"goalert-engine/mqtts"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeMessage is a plain mqtt.Message
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	id       uint16
+	retained bool
+	acked    atomic.Bool
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return m.id }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              { m.acked.Store(true) }
+
+func TestMQTTSubscriberRecoversHandlerPanic(t *testing.T) {
+	core, logs := observer.New(zapcore.ErrorLevel)
+	logger := zap.New(core)
+	cfg := config.Config{MQTTTopic: "sensors/#"}
+
+	fake := &fakeMQTTClient{}
+	client := &mqtts.Client{Client: fake}
+
+	// An uninitialized rule manager makes the handler panic on the first message
+	var wg sync.WaitGroup
+	MQTTSubscriber(context.Background(), &wg, client, &alert.RuleManager{}, cfg, logger)
+
+	before := testutil.ToFloat64(metrics.MessageHandlerPanics)
+	msg := &fakeMessage{topic: "sensors/D800", payload: []byte(`{"address": "D800", "value": 1}`)}
+
+	assert.NotPanics(t, func() {
+		fake.handlers["sensors/#"](fake, msg)
+	})
+	wg.Wait()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.MessageHandlerPanics)-before)
+
+	entries := logs.FilterMessage("Recovered from panic in message handler").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "sensors/D800", fields["topic"])
+	assert.Equal(t, `{"address": "D800", "value": 1}`, fields["payload"])
+}
+
+func TestMQTTSubscriberThreadsRetainedFlag(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	cfg := config.Config{MQTTTopic: "sensors/#"}
+
+	rules := []alert.AlertRule{
+		*alert.NewAlertRule("live", []string{"sensors/D800"}, "alerts", "", "", "", []alert.AlertCondition{
+			{ID: 1, Device: "D800", Operator: "D800 > 10", Level: alert.LevelWarning},
+		}, logger),
+	}
+	rules[0].IgnoreRetained = true
+	ruleManager := alert.NewRuleManager(ctx, rules, cfg, alert.NoopInserter{}, logger)
+	defer ruleManager.Shutdown()
+	require.NoError(t, ruleManager.Start(ctx))
+
+	var results []alert.AlertResult
+	var mu sync.Mutex
+	ruleManager.OnAlertResult = func(result alert.AlertResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, result)
+	}
+
+	fake := &fakeMQTTClient{}
+	var wg sync.WaitGroup
+	MQTTSubscriber(ctx, &wg, &mqtts.Client{Client: fake}, ruleManager, cfg, logger)
+
+	// The retained value is cached but never evaluated by the rule
+	fake.handlers["sensors/#"](fake, &fakeMessage{topic: "sensors/D800", payload: []byte(`{"address": "D800", "value": 15}`), retained: true})
+	wg.Wait()
+	// Give the rule's worker a moment to evaluate anything unexpected
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	assert.Empty(t, results)
+	mu.Unlock()
+
+	fake.handlers["sensors/#"](fake, &fakeMessage{topic: "sensors/D800", payload: []byte(`{"address": "D800", "value": 15}`)})
+	wg.Wait()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(results) == 1 && results[0].Status == alert.AlertDelivered
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestEngineAlertsReachInserter(t *testing.T) {
+	cfg := config.Load()
+	cfg.WatchdogInterval = 5 * time.Millisecond
+	cfg.WatchdogMQTTDisconnected = time.Millisecond
+	cfg.WatchdogTable = "engine_alerts"
+
+	recorder := &alert.RecordingInserter{}
+	opts, err := managerOptions(cfg, recorder, zap.NewNop())
+	require.NoError(t, err)
+
+	manager := alert.NewManager(context.Background(), nil, cfg, opts...)
+	defer manager.Shutdown()
+	manager.StartWatchdog(alert.WatchdogProbes{MQTT: func() bool { return false }})
+
+	require.Eventually(t, func() bool { return len(recorder.Alerts()) > 0 }, time.Second, 5*time.Millisecond)
+	recorded := recorder.Alerts()[0]
+	assert.Equal(t, "engine_alerts", recorded.Table)
+	assert.Equal(t, alert.EngineCategory, recorded.Category)
+	assert.Equal(t, alert.CheckMQTTDisconnected, recorded.Device)
+	assert.Equal(t, "CRITICAL", recorded.Level)
+}
@@ -2,58 +2,230 @@ package supabase
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"goalert-engine/config"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // SupabaseInserter wraps the package-level InsertAlert function
 // to implement the alert.AlertInserter interface
 type SupabaseInserter struct{}
 
-func (s *SupabaseInserter) InsertAlert(cfg config.Config, table, device, message, category, machine string) error {
-	return InsertAlert(cfg, table, device, message, category, machine)
+func (s *SupabaseInserter) InsertAlert(cfg config.Config, table, device, message, category, machine, level string) error {
+	return InsertAlert(cfg, table, device, message, category, machine, level)
 }
 
+func (s *SupabaseInserter) InsertAlertContext(ctx context.Context, cfg config.Config, table, device, message, category, machine, level string) error {
+	return InsertAlertContext(ctx, cfg, table, device, message, category, machine, level)
+}
+
+// InsertRPCRuleTable as SUPABASE_INSERT_RPC calls /rest/v1/rpc/<table>, the
+// rule's table naming the Postgres function
+const InsertRPCRuleTable = "*"
+
+// defaultHTTPTimeout bounds requests unless SUPABASE_HTTP_TIMEOUT is set
+const defaultHTTPTimeout = 10 * time.Second
+
+// Connection pool defaults, used unless configured
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
 // Shared client with connection pooling
-var httpClient = &http.Client{
-	Timeout: 10 * time.Second,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		IdleConnTimeout:     90 * time.Second,
-		DisableCompression:  false,
-		MaxIdleConnsPerHost: 100,
-	},
+var httpClient = newHTTPClient(config.Config{})
+
+// ConfigureHTTPClient rebuilds the shared client with the configured timeout
+// and connection pool. Call it before inserting alerts.
+func ConfigureHTTPClient(cfg config.Config) {
+	httpClient = newHTTPClient(cfg)
 }
 
-func InsertAlert(cfg config.Config, table, deviceID, message, category, machine string) error {
+// newHTTPClient builds a client with the configured timeout and connection
+// pool, zero values keep the defaults
+func newHTTPClient(cfg config.Config) *http.Client {
+	return &http.Client{
+		Timeout: orDefault(cfg.SupabaseHTTPTimeout, defaultHTTPTimeout),
+		Transport: &http.Transport{
+			MaxIdleConns:        orDefault(cfg.SupabaseMaxIdleConns, defaultMaxIdleConns),
+			IdleConnTimeout:     orDefault(cfg.SupabaseIdleConnTimeout, defaultIdleConnTimeout),
+			DisableCompression:  false,
+			MaxIdleConnsPerHost: orDefault(cfg.SupabaseMaxIdleConnsPerHost, defaultMaxIdleConnsPerHost),
+		},
+	}
+}
+
+func orDefault[T int | time.Duration](value, fallback T) T {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func InsertAlert(cfg config.Config, table, deviceID, message, category, machine, level string) error {
+	return InsertAlertContext(context.Background(), cfg, table, deviceID, message, category, machine, level)
+}
+
+// InsertAlertContext is InsertAlert bound to ctx, which cancels the request
+// and carries the caller's trace. With SUPABASE_INSERT_RPC set the alert goes
+// through that Postgres function instead of table, or through the function
+// named by table when it is InsertRPCRuleTable.
+func InsertAlertContext(ctx context.Context, cfg config.Config, table, deviceID, message, category, machine, level string) error {
+	switch cfg.SupabaseInsertRPC {
+	case "":
+	case InsertRPCRuleTable:
+		return InsertAlertViaRPC(ctx, cfg, table, deviceID, message, category, machine, level)
+	default:
+		return InsertAlertViaRPC(ctx, cfg, cfg.SupabaseInsertRPC, deviceID, message, category, machine, level)
+	}
+
 	// Construct REST API endpoint URL
 	url := fmt.Sprintf("%s/rest/v1/%s", cfg.SupabaseURL, table)
+	return post(ctx, cfg, url, alertFields(cfg, deviceID, message, category, machine, level))
+}
+
+// InsertAlertViaRPC inserts the alert by calling the Postgres function fn,
+// which receives the alert fields as named parameters (device_id, message,
+// category, machine and the level column)
+func InsertAlertViaRPC(ctx context.Context, cfg config.Config, fn, deviceID, message, category, machine, level string) error {
+	url := fmt.Sprintf("%s/rest/v1/rpc/%s", cfg.SupabaseURL, fn)
+	return post(ctx, cfg, url, alertFields(cfg, deviceID, message, category, machine, level))
+}
+
+// InsertRow inserts fields as a row of table, e.g. for records other than
+// alerts
+func InsertRow(ctx context.Context, cfg config.Config, table string, fields map[string]any) error {
+	url := fmt.Sprintf("%s/rest/v1/%s", cfg.SupabaseURL, table)
+	return post(ctx, cfg, url, fields)
+}
+
+// SelectRows reads the rows of table matching the PostgREST query, e.g.
+// "replayed_at=is.null&order=id", into out
+func SelectRows(ctx context.Context, cfg config.Config, table, query string, out any) error {
+	url := fmt.Sprintf("%s/rest/v1/%s?%s", cfg.SupabaseURL, table, query)
+	body, err := send(ctx, cfg, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to unmarshal rows of %s: %w", table, err)
+	}
+	return nil
+}
+
+// UpdateRows sets fields on the rows of table matching the PostgREST query,
+// e.g. "id=eq.7"
+func UpdateRows(ctx context.Context, cfg config.Config, table, query string, fields map[string]any) error {
+	url := fmt.Sprintf("%s/rest/v1/%s?%s", cfg.SupabaseURL, table, query)
+	_, err := send(ctx, cfg, http.MethodPatch, url, fields)
+	return err
+}
+
+// TokenSource returns the bearer token inserts are authorized with
+type TokenSource func(ctx context.Context) (string, error)
+
+var (
+	tokenMu     sync.RWMutex
+	tokenSource TokenSource
+)
 
-	// Prepare request body
-	requestBody := map[string]any{
+// SetTokenSource makes inserts authorize with the token returned by fn, e.g. a
+// user JWT honoring row-level security, while the apikey header keeps the
+// configured key. fn is called before every request, so it can refresh the
+// token as it nears expiry. A nil fn restores the configured token.
+func SetTokenSource(fn TokenSource) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	tokenSource = fn
+}
+
+// bearerToken returns the token for the Authorization header: the token
+// source's, else SUPABASE_USER_JWT, else the API key itself
+func bearerToken(ctx context.Context, cfg config.Config) (string, error) {
+	tokenMu.RLock()
+	fn := tokenSource
+	tokenMu.RUnlock()
+
+	if fn != nil {
+		token, err := fn(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get user token: %w", err)
+		}
+		return token, nil
+	}
+	if cfg.SupabaseUserJWT != "" {
+		return cfg.SupabaseUserJWT, nil
+	}
+	return cfg.SupabaseKey, nil
+}
+
+// alertFields is the insert body of an alert. The level goes into the
+// column configured by SUPABASE_LEVEL_COLUMN, which may be empty for tables
+// and functions without one.
+func alertFields(cfg config.Config, deviceID, message, category, machine, level string) map[string]any {
+	fields := map[string]any{
 		"device_id": deviceID,
 		"message":   message,
 		"category":  category,
 		"machine":   machine,
 	}
+	if cfg.SupabaseLevelColumn != "" {
+		fields[cfg.SupabaseLevelColumn] = level
+	}
+	return fields
+}
 
-	body, err := json.Marshal(requestBody)
+// clientFor returns the shared client with the configured timeout. Clients
+// with other timeouts share its transport and so its connection pool.
+func clientFor(cfg config.Config) *http.Client {
+	if cfg.SupabaseHTTPTimeout <= 0 || cfg.SupabaseHTTPTimeout == httpClient.Timeout {
+		return httpClient
+	}
+	client := *httpClient
+	client.Timeout = cfg.SupabaseHTTPTimeout
+	return &client
+}
+
+// post sends requestBody as JSON to the Supabase REST endpoint url
+func post(ctx context.Context, cfg config.Config, url string, requestBody map[string]any) error {
+	_, err := send(ctx, cfg, http.MethodPost, url, requestBody)
+	return err
+}
+
+// send makes a request to the Supabase REST endpoint url, with requestBody as
+// JSON unless it is nil, and returns the response body
+func send(ctx context.Context, cfg config.Config, method, url string, requestBody map[string]any) ([]byte, error) {
+	var body io.Reader
+	if requestBody != nil {
+		data, err := json.Marshal(requestBody)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	token, err := bearerToken(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, err
 	}
 
 	// Set required headers
 	req.Header.Set("apikey", cfg.SupabaseKey)
-	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseKey)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Prefer", "return=minimal")
 
@@ -61,9 +233,9 @@ func InsertAlert(cfg config.Config, table, deviceID, message, category, machine
 	req.Header.Set("Content-Profile", cfg.Schema)
 	req.Header.Set("Accept-Profile", cfg.Schema)
 
-	resp, err := httpClient.Do(req)
+	resp, err := clientFor(cfg).Do(req)
 	if err != nil {
-		return fmt.Errorf("API request failed: %w", err)
+		return nil, fmt.Errorf("API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -71,8 +243,63 @@ func InsertAlert(cfg config.Config, table, deviceID, message, category, machine
 	bodyBytes, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode >= 300 {
-		return fmt.Errorf("API error (%d): %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp.StatusCode, bodyBytes)
 	}
 
-	return nil
+	return bodyBytes, nil
+}
+
+// maxErrorSnippet is how much of a non-JSON error body an APIError keeps
+const maxErrorSnippet = 120
+
+// APIError is an error response of the Supabase REST API
+type APIError struct {
+	StatusCode int
+	Body       string // JSON error body, or a short snippet of any other body, e.g. a proxy's HTML page
+	JSON       bool   // Whether Body is the JSON error of the API
+}
+
+// newAPIError keeps JSON error bodies and truncates any other body, with
+// whitespace collapsed, to a snippet
+func newAPIError(statusCode int, body []byte) *APIError {
+	body = bytes.TrimSpace(body)
+	if json.Valid(body) {
+		return &APIError{StatusCode: statusCode, Body: string(body), JSON: true}
+	}
+
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if len(snippet) > maxErrorSnippet {
+		cut := maxErrorSnippet
+		for cut > 0 && !utf8.RuneStart(snippet[cut]) {
+			cut--
+		}
+		snippet = snippet[:cut] + "..."
+	}
+	return &APIError{StatusCode: statusCode, Body: snippet}
+}
+
+func (e *APIError) Error() string {
+	if e.JSON {
+		return fmt.Sprintf("API error (%d): %s", e.StatusCode, e.Body)
+	}
+
+	kind := "permanent"
+	if e.Transient() {
+		kind = "transient"
+	}
+	return fmt.Sprintf("API error (%d %s, %s): %s", e.StatusCode, http.StatusText(e.StatusCode), kind, e.Body)
+}
+
+// Transient reports whether the request may succeed when retried: timeouts,
+// rate limiting and server or gateway errors
+func (e *APIError) Transient() bool {
+	return e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= 500
+}
+
+// IsTransient reports whether err is an APIError that may succeed when retried
+func IsTransient(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Transient()
 }
@@ -2,14 +2,17 @@ package supabase
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"goalert-engine/config"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestInsertAlert(t *testing.T) {
@@ -75,7 +78,7 @@ func TestInsertAlert(t *testing.T) {
 			}
 
 			// Call the function
-			err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk")
+			err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR")
 
 			// Check errors
 			if tt.expectedError != "" {
@@ -174,7 +177,7 @@ func TestInsertAlertWithMockServer(t *testing.T) {
 			}
 
 			// Call the function
-			err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk")
+			err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR")
 
 			// Check errors
 			if tt.expectedError != "" {
@@ -191,6 +194,152 @@ func TestInsertAlertWithMockServer(t *testing.T) {
 	}
 }
 
+func TestInsertAlertHTMLErrorBody(t *testing.T) {
+	page := "<html>\n<head><title>502 Bad Gateway</title></head>\n<body>\n<center><h1>502 Bad Gateway</h1></center>\n" +
+		strings.Repeat("<!-- proxy error page padding -->\n", 20) + "</body>\n</html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	cfg := config.Config{SupabaseURL: server.URL, SupabaseKey: "test-key", Schema: "public"}
+	err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected an APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway || apiErr.JSON {
+		t.Errorf("Unexpected API error %+v", apiErr)
+	}
+	if !IsTransient(err) {
+		t.Error("Expected a 502 to be transient")
+	}
+	if len(err.Error()) > 200 || strings.Contains(err.Error(), "\n") {
+		t.Errorf("Expected a concise single-line error, got %q", err.Error())
+	}
+	if !strings.HasPrefix(err.Error(), "API error (502 Bad Gateway, transient): <html> <head><title>502 Bad Gateway") {
+		t.Errorf("Expected status and snippet in the error, got %q", err.Error())
+	}
+}
+
+func TestAPIErrorClassification(t *testing.T) {
+	tests := []struct {
+		status    int
+		body      string
+		transient bool
+		message   string
+	}{
+		{http.StatusBadRequest, `{"message":"invalid input"}`, false, `API error (400): {"message":"invalid input"}`},
+		{http.StatusNotFound, "Not Found", false, "API error (404 Not Found, permanent): Not Found"},
+		{http.StatusTooManyRequests, "slow down", true, "API error (429 Too Many Requests, transient): slow down"},
+		{http.StatusServiceUnavailable, `{"message":"overloaded"}`, true, `API error (503): {"message":"overloaded"}`},
+	}
+
+	for _, tt := range tests {
+		err := newAPIError(tt.status, []byte(tt.body))
+		if err.Transient() != tt.transient || err.Error() != tt.message {
+			t.Errorf("Status %d: expected %q transient=%v, got %q transient=%v", tt.status, tt.message, tt.transient, err.Error(), err.Transient())
+		}
+	}
+
+	if IsTransient(errors.New("API request failed")) {
+		t.Error("Expected only API errors to be classified")
+	}
+}
+
+func TestInsertAlertContextCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected cancelled request not to reach the server")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	previous := httpClient
+	httpClient = server.Client()
+	defer func() { httpClient = previous }()
+
+	cfg := config.Config{
+		SupabaseURL: server.URL,
+		SupabaseKey: "test-key",
+		Schema:      "public",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := InsertAlertContext(ctx, cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+}
+
+func TestInsertAlertHTTPTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	previous := httpClient
+	httpClient = server.Client()
+	defer func() { httpClient = previous }()
+
+	cfg := config.Config{
+		SupabaseURL:         server.URL,
+		SupabaseKey:         "test-key",
+		Schema:              "public",
+		SupabaseHTTPTimeout: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the insert to give up after the configured timeout, took %v", elapsed)
+	}
+
+	// The configured client keeps the shared transport and its pool
+	if client := clientFor(cfg); client.Transport != httpClient.Transport || client.Timeout != cfg.SupabaseHTTPTimeout {
+		t.Errorf("expected a client sharing the transport with a %v timeout, got %+v", cfg.SupabaseHTTPTimeout, client)
+	}
+}
+
+func TestConfigureHTTPClient(t *testing.T) {
+	previous := httpClient
+	defer func() { httpClient = previous }()
+
+	ConfigureHTTPClient(config.Config{
+		SupabaseHTTPTimeout:         3 * time.Second,
+		SupabaseMaxIdleConns:        4,
+		SupabaseMaxIdleConnsPerHost: 2,
+		SupabaseIdleConnTimeout:     15 * time.Second,
+	})
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected an *http.Transport, got %T", httpClient.Transport)
+	}
+	if httpClient.Timeout != 3*time.Second || transport.MaxIdleConns != 4 || transport.MaxIdleConnsPerHost != 2 || transport.IdleConnTimeout != 15*time.Second {
+		t.Errorf("expected the configured pool, got timeout %v, %d idle, %d per host, idle timeout %v",
+			httpClient.Timeout, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+
+	// Unset values keep the defaults
+	ConfigureHTTPClient(config.Config{})
+	transport = httpClient.Transport.(*http.Transport)
+	if httpClient.Timeout != defaultHTTPTimeout || transport.MaxIdleConns != defaultMaxIdleConns || transport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Errorf("expected the default pool, got timeout %v, %d idle, %d per host", httpClient.Timeout, transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+}
+
 // mockTransport implements http.RoundTripper for testing
 type mockTransport struct {
 	response *http.Response
@@ -200,3 +349,223 @@ type mockTransport struct {
 func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return m.response, m.err
 }
+
+func TestInsertAlertViaRPC(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if r.Header.Get("Content-Profile") != "ops" {
+			t.Errorf("expected Content-Profile ops, got %q", r.Header.Get("Content-Profile"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := config.Config{
+		SupabaseURL:       server.URL,
+		SupabaseKey:       "test-key",
+		Schema:            "ops",
+		SupabaseInsertRPC: "insert_alert",
+	}
+
+	// The configured function replaces the table insert
+	if err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if gotPath != "/rest/v1/rpc/insert_alert" {
+		t.Errorf("expected RPC path, got %s", gotPath)
+	}
+	want := map[string]any{
+		"device_id": "device123",
+		"message":   "test message",
+		"category":  "coating",
+		"machine":   "nk",
+	}
+	if len(gotBody) != len(want) {
+		t.Errorf("expected parameters %v, got %v", want, gotBody)
+	}
+	for k, v := range want {
+		if gotBody[k] != v {
+			t.Errorf("expected parameter %s to be %v, got %v", k, v, gotBody[k])
+		}
+	}
+}
+
+func TestInsertAlertLevelColumn(t *testing.T) {
+	var gotBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody = nil
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cfg := config.Config{
+		SupabaseURL:         server.URL,
+		SupabaseKey:         "test-key",
+		SupabaseLevelColumn: "severity",
+	}
+
+	for _, level := range []string{"WARNING", "ERROR", "CRITICAL"} {
+		if err := InsertAlert(cfg, "alerts", "D800", "too hot", "coating", "nk", level); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if gotBody["severity"] != level {
+			t.Errorf("expected severity %s, got %v", level, gotBody["severity"])
+		}
+	}
+
+	// Without a column the level is left out
+	cfg.SupabaseLevelColumn = ""
+	if err := InsertAlert(cfg, "alerts", "D800", "too hot", "coating", "nk", "ERROR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gotBody) != 4 {
+		t.Errorf("expected only the alert fields without a level column, got %v", gotBody)
+	}
+}
+
+func TestInsertAlertDefaultConfigOmitsLevel(t *testing.T) {
+	var gotBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// Tables and insert functions predating the level column keep working
+	t.Setenv("SUPABASE_LEVEL_COLUMN", "")
+	cfg := config.Load()
+	cfg.SupabaseURL = server.URL
+
+	if err := InsertAlert(cfg, "alerts", "D800", "too hot", "coating", "nk", "ERROR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := gotBody["level"]; ok || len(gotBody) != 4 {
+		t.Errorf("expected no level field by default, got %v", gotBody)
+	}
+}
+
+func TestInsertAlertRPCRuleTable(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := config.Config{
+		SupabaseURL:       server.URL,
+		SupabaseKey:       "test-key",
+		SupabaseInsertRPC: InsertRPCRuleTable,
+	}
+
+	// The rule's table names the function
+	if err := InsertAlert(cfg, "create_alert", "D800", "too hot", "coating", "nk", "ERROR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if gotPath != "/rest/v1/rpc/create_alert" {
+		t.Errorf("expected RPC path /rest/v1/rpc/create_alert, got %s", gotPath)
+	}
+	want := map[string]any{
+		"device_id": "D800",
+		"message":   "too hot",
+		"category":  "coating",
+		"machine":   "nk",
+	}
+	if len(gotBody) != len(want) {
+		t.Errorf("expected arguments %v, got %v", want, gotBody)
+	}
+	for k, v := range want {
+		if gotBody[k] != v {
+			t.Errorf("expected argument %s to be %v, got %v", k, v, gotBody[k])
+		}
+	}
+
+	// Without an insert RPC the alert is posted to the table
+	cfg.SupabaseInsertRPC = ""
+	if err := InsertAlert(cfg, "alerts", "D800", "too hot", "coating", "nk", "ERROR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotPath != "/rest/v1/alerts" {
+		t.Errorf("expected table path /rest/v1/alerts, got %s", gotPath)
+	}
+}
+
+func TestInsertAlertWithUserJWT(t *testing.T) {
+	var apikeys, authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apikeys = append(apikeys, r.Header.Get("apikey"))
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	cfg := config.Config{
+		SupabaseURL:     server.URL,
+		SupabaseKey:     "anon-key",
+		SupabaseUserJWT: "user-jwt",
+		Schema:          "public",
+	}
+
+	if err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A token source takes over from the configured JWT on every request
+	tokens := []string{"refreshed-1", "refreshed-2"}
+	SetTokenSource(func(ctx context.Context) (string, error) {
+		token := tokens[0]
+		tokens = tokens[1:]
+		return token, nil
+	})
+	defer SetTokenSource(nil)
+
+	for i := 0; i < 2; i++ {
+		if err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	wantAuth := []string{"Bearer user-jwt", "Bearer refreshed-1", "Bearer refreshed-2"}
+	for i, want := range wantAuth {
+		if apikeys[i] != "anon-key" {
+			t.Errorf("request %d: expected apikey anon-key, got %q", i, apikeys[i])
+		}
+		if authorizations[i] != want {
+			t.Errorf("request %d: expected Authorization %q, got %q", i, want, authorizations[i])
+		}
+	}
+}
+
+func TestInsertAlertTokenSourceError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected request without a token not to reach the server")
+	}))
+	defer server.Close()
+
+	SetTokenSource(func(ctx context.Context) (string, error) {
+		return "", errors.New("refresh failed")
+	})
+	defer SetTokenSource(nil)
+
+	cfg := config.Config{SupabaseURL: server.URL, SupabaseKey: "anon-key"}
+	err := InsertAlert(cfg, "alerts", "device123", "test message", "coating", "nk", "ERROR")
+	if err == nil || !strings.Contains(err.Error(), "refresh failed") {
+		t.Errorf("expected token source error, got %v", err)
+	}
+}